@@ -2,10 +2,12 @@ package main
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"streamcast-backend/internal/handlers"
 	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/playback"
 	"streamcast-backend/internal/rtmp"
 
 	"github.com/gin-contrib/cors"
@@ -18,8 +20,12 @@ func main() {
 
 	// 2. Start RTMP Server
 	rtmpServer := rtmp.NewRtmpServer("1935")
+	rtmpServer.CPUUsage = handlers.CurrentCPUUsage
+	rtmpServer.Access = playback.Check
+	rtmpServer.KeyAccess = playback.CheckSession
 	rtmpServer.Start()
 	defer rtmpServer.Stop()
+	handlers.RtmpServer = rtmpServer
 
 	// 3. Setup Router
 	r := gin.Default()
@@ -27,9 +33,9 @@ func main() {
 	// CORS Setup
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"}, // Allow all for dev
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		ExposeHeaders:    []string{"Content-Length", "Location"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -50,9 +56,19 @@ func main() {
 	r.Static("/uploads", "./uploads")
 	r.Static("/api/uploads", "./uploads")
 
-	// Live Stream (HTTP-FLV)
-	r.GET("/live.flv", func(c *gin.Context) {
-		rtmpServer.HandleFLV(c.Writer, c.Request)
+	// Live Stream (HTTP-FLV / WebSocket-FLV): /live/<playback_id>.flv
+	r.GET("/live/:file", func(c *gin.Context) {
+		playbackID, ok := strings.CutSuffix(c.Param("file"), ".flv")
+		if !ok {
+			c.JSON(404, gin.H{"error": "Not found"})
+			return
+		}
+		rtmpServer.ServeFLV(c.Writer, c.Request, playbackID)
+	})
+
+	// HLS & DASH: /hls/<playback_id>/... (nginx only caches these responses)
+	r.GET("/hls/:playback_id/*file", func(c *gin.Context) {
+		rtmpServer.ServeHLS(c.Writer, c.Request, c.Param("playback_id"), c.Param("file"))
 	})
 
 	api := r.Group("/api")
@@ -64,6 +80,7 @@ func main() {
 		// Archives
 		api.GET("/archives", handlers.GetArchives)
 		api.DELETE("/archives/:id", handlers.DeleteArchive)
+		api.DELETE("/clips/:id", handlers.DeleteClip)
 
 		// Streams
 		api.GET("/streams", handlers.GetStreams)
@@ -72,6 +89,33 @@ func main() {
 		api.PUT("/streams/:id", handlers.UpdateStream)
 		api.DELETE("/streams/:id", handlers.DeleteStream)
 		api.POST("/streams/:id/stop", handlers.StopStream)
+		api.POST("/streams/:id/pull", handlers.StartPull)
+		api.POST("/streams/:id/starting-soon", handlers.ShowStartingSoon)
+		api.GET("/streams/:id/transcoder", handlers.GetTranscoderStatus)
+		api.GET("/streams/:id/ingest", handlers.GetIngestStatus)
+		api.POST("/streams/:id/playback-token", handlers.IssuePlaybackToken)
+		api.GET("/streams/:id/restreams", handlers.GetRestreamTargets)
+		api.POST("/streams/:id/restreams", handlers.CreateRestreamTarget)
+		api.PUT("/streams/:id/restreams/:target_id", handlers.UpdateRestreamTarget)
+		api.DELETE("/streams/:id/restreams/:target_id", handlers.DeleteRestreamTarget)
+		api.GET("/streams/:id/clips", handlers.GetClips)
+		api.POST("/streams/:id/clips", handlers.CreateClip)
+
+		// WebRTC ingest (WHIP)
+		api.POST("/whip/:stream_key", handlers.PublishWHIP)
+		api.PATCH("/whip/:stream_key/:session_id", handlers.RejectTrickleICE)
+		api.DELETE("/whip/:stream_key/:session_id", handlers.StopWHIP)
+
+		// WebRTC playback (WHEP)
+		api.POST("/whep/:playback_id", handlers.PlayWHEP)
+		api.PATCH("/whep/:playback_id/:session_id", handlers.RejectTrickleICE)
+		api.DELETE("/whep/:playback_id/:session_id", handlers.StopWHEP)
+
+		// Transcoding Profiles
+		api.GET("/transcode-profiles", handlers.GetTranscodeProfiles)
+		api.POST("/transcode-profiles", handlers.CreateTranscodeProfile)
+		api.PUT("/transcode-profiles/:id", handlers.UpdateTranscodeProfile)
+		api.DELETE("/transcode-profiles/:id", handlers.DeleteTranscodeProfile)
 
 		// Search
 		api.GET("/search", handlers.SearchContent)
@@ -7,10 +7,15 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// GetArchives returns a list of archived streams
+// GetArchives returns a list of archived streams, optionally only those
+// recorded from ?stream_id=
 func GetArchives(c *gin.Context) {
 	var archives []models.Archive
-	if result := models.DB.Order("created_at desc").Find(&archives); result.Error != nil {
+	query := models.DB.Order("created_at desc")
+	if streamID := c.Query("stream_id"); streamID != "" {
+		query = query.Where("stream_id = ?", streamID)
+	}
+	if result := query.Find(&archives); result.Error != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
 		return
 	}
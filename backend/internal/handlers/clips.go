@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/rtmp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateClip handles POST /api/streams/:id/clips. The clip is cut in the
+// background: it comes back as "processing" and turns "ready" (with its
+// file and thumbnail) or "failed".
+func CreateClip(c *gin.Context) {
+	var stream models.Stream
+	if err := models.DB.First(&stream, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	var input rtmp.ClipRequest
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+
+	clip, err := RtmpServer.CreateClip(&stream, input)
+	switch {
+	case errors.Is(err, rtmp.ErrArchiveNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Archive not found"})
+		return
+	case errors.Is(err, rtmp.ErrStreamOffline):
+		c.JSON(http.StatusConflict, gin.H{"error": "Stream is not live; clip one of its archives instead"})
+		return
+	case errors.Is(err, rtmp.ErrClipRange), errors.Is(err, rtmp.ErrClipEncrypted):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"data": clip})
+}
+
+// GetClips handles GET /api/streams/:id/clips, newest first.
+func GetClips(c *gin.Context) {
+	var clips []models.Clip
+	if err := models.DB.Where("stream_id = ?", c.Param("id")).Order("created_at desc").Find(&clips).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": clips})
+}
+
+// DeleteClip handles DELETE /api/clips/:id
+// Like archives, only the entry is removed; the files stay on disk.
+func DeleteClip(c *gin.Context) {
+	if err := models.DB.Delete(&models.Clip{}, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/rtmp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// GetTranscodeProfiles handles GET /api/transcode-profiles
+func GetTranscodeProfiles(c *gin.Context) {
+	var profiles []models.TranscodeProfile
+	if err := models.DB.Order("name").Find(&profiles).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": profiles})
+}
+
+// CreateTranscodeProfile handles POST /api/transcode-profiles
+func CreateTranscodeProfile(c *gin.Context) {
+	var input models.TranscodeProfile
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateProfile(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.ID = 0
+	if err := models.DB.Create(&input).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A profile with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create profile"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": input})
+}
+
+// UpdateTranscodeProfile handles PUT /api/transcode-profiles/:id
+// Changes apply to the next ffmpeg run of streams using the profile.
+func UpdateTranscodeProfile(c *gin.Context) {
+	var profile models.TranscodeProfile
+	if err := models.DB.First(&profile, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+
+	var input models.TranscodeProfile
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateProfile(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Streams refer to their profile by name: renaming one in use would
+	// leave them pointing at nothing.
+	if input.Name != profile.Name && transcodeProfileInUse(profile.Name) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Profile is assigned to streams and cannot be renamed"})
+		return
+	}
+
+	input.ID = profile.ID
+	input.CreatedAt = profile.CreatedAt
+	if err := models.DB.Save(&input).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A profile with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": input})
+}
+
+// DeleteTranscodeProfile handles DELETE /api/transcode-profiles/:id
+func DeleteTranscodeProfile(c *gin.Context) {
+	var profile models.TranscodeProfile
+	if err := models.DB.First(&profile, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+		return
+	}
+
+	if transcodeProfileInUse(profile.Name) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Profile is assigned to streams"})
+		return
+	}
+
+	models.DB.Delete(&profile)
+	c.JSON(http.StatusOK, gin.H{"message": "Profile deleted"})
+}
+
+// transcodeProfileInUse reports whether streams are assigned the profile
+// called name.
+func transcodeProfileInUse(name string) bool {
+	var inUse int64
+	models.DB.Model(&models.Stream{}).Where("transcode_profile = ?", name).Count(&inUse)
+	return inUse > 0
+}
+
+// transcodeProfileExists reports whether name can be assigned to a stream.
+func transcodeProfileExists(name string) bool {
+	if name == "" {
+		return true
+	}
+	_, ok := models.FindTranscodeProfile(name)
+	return ok
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/rtmp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetRestreamTargets handles GET /api/streams/:id/restreams
+// Live relays are reported under "status" while the stream is being ingested.
+func GetRestreamTargets(c *gin.Context) {
+	var stream models.Stream
+	if err := models.DB.First(&stream, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	var targets []models.RestreamTarget
+	if err := models.DB.Where("stream_id = ?", stream.ID).Order("id").Find(&targets).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	status := []rtmp.RestreamStatus{}
+	if RtmpServer != nil {
+		if live, ok := RtmpServer.RestreamStatus(stream.ID); ok {
+			status = live
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"data": targets, "status": status})
+}
+
+// CreateRestreamTarget handles POST /api/streams/:id/restreams
+// An enabled target starts relaying right away if the stream is live.
+func CreateRestreamTarget(c *gin.Context) {
+	var stream models.Stream
+	if err := models.DB.First(&stream, c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	var input models.RestreamTarget
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateRestreamTarget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.ID = 0
+	input.StreamID = stream.ID
+	if err := models.DB.Create(&input).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create restream target"})
+		return
+	}
+	if RtmpServer != nil {
+		RtmpServer.ApplyRestreamTarget(input)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": input})
+}
+
+// UpdateRestreamTarget handles PUT /api/streams/:id/restreams/:target_id
+// A live relay is restarted with the new settings, or stopped if disabled.
+func UpdateRestreamTarget(c *gin.Context) {
+	var target models.RestreamTarget
+	if err := models.DB.Where("stream_id = ?", c.Param("id")).First(&target, c.Param("target_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Restream target not found"})
+		return
+	}
+
+	var input models.RestreamTarget
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateRestreamTarget(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	input.ID = target.ID
+	input.StreamID = target.StreamID
+	input.CreatedAt = target.CreatedAt
+	if err := models.DB.Save(&input).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update restream target"})
+		return
+	}
+	if RtmpServer != nil {
+		RtmpServer.ApplyRestreamTarget(input)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": input})
+}
+
+// DeleteRestreamTarget handles DELETE /api/streams/:id/restreams/:target_id
+func DeleteRestreamTarget(c *gin.Context) {
+	var target models.RestreamTarget
+	if err := models.DB.Where("stream_id = ?", c.Param("id")).First(&target, c.Param("target_id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Restream target not found"})
+		return
+	}
+
+	if RtmpServer != nil {
+		RtmpServer.RemoveRestreamTarget(target)
+	}
+	models.DB.Delete(&target)
+	c.JSON(http.StatusOK, gin.H{"data": true})
+}
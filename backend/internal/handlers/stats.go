@@ -64,13 +64,19 @@ func GetRealViewerCount() int {
 	return count * 10
 }
 
-func GetStats(c *gin.Context) {
-	// 1. CPU Usage
+// CurrentCPUUsage returns host CPU usage in percent since the previous call.
+// The ingest server uses it to fall back to passthrough on a busy host.
+func CurrentCPUUsage() float64 {
 	cpuPercent, _ := cpu.Percent(0, false)
-	currentCPU := 0.0
 	if len(cpuPercent) > 0 {
-		currentCPU = cpuPercent[0]
+		return cpuPercent[0]
 	}
+	return 0.0
+}
+
+func GetStats(c *gin.Context) {
+	// 1. CPU Usage
+	currentCPU := CurrentCPUUsage()
 
 	// 2. RAM Usage
 	v, _ := mem.VirtualMemory()
@@ -1,13 +1,39 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
 	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/playback"
 	"streamcast-backend/internal/rtmp"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// RtmpServer is the running ingest server, set by main. Handlers use it to
+// act on live channels (e.g. stopping a publisher).
+var RtmpServer *rtmp.Server
+
+type StopStreamInput struct {
+	// CooldownSeconds overrides how long the stream key is refused after the
+	// stop. Omit to use rtmp.DefaultStopCooldown.
+	CooldownSeconds *int `json:"cooldown_seconds"`
+}
+
+type PlaybackTokenInput struct {
+	// TTLSeconds is how long the token is valid, capped at
+	// playback.MaxTTL. Omit to use playback.DefaultTTL.
+	TTLSeconds *int `json:"ttl_seconds"`
+	// BindIP restricts the token to the caller's address. Tokens issued to
+	// a viewer page are always bound.
+	BindIP bool `json:"bind_ip"`
+	// IP is rejected: a token may only be bound to the address that asked
+	// for it.
+	IP string `json:"ip"`
+}
+
 func GetStreams(c *gin.Context) {
 	var streams []models.Stream
 	models.DB.Find(&streams)
@@ -21,15 +47,40 @@ func CreateStream(c *gin.Context) {
 		return
 	}
 
+	if !transcodeProfileExists(input.TranscodeProfile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown transcode profile"})
+		return
+	}
+	if !playback.ValidPolicy(input.PlaybackPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown playback policy"})
+		return
+	}
+	if err := validateEncryption(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateSource(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := rtmp.ValidateDVR(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	key, _ := rtmp.GenerateStreamKey()
+	playbackID, err := models.NewPlaybackID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	input.StreamKey = key
-	input.IngestStatus = "offline"
+	input.PlaybackID = playbackID
+	input.IngestStatus = rtmp.StatusOffline
 	input.IsLive = false
 	if input.Title == "" {
 		input.Title = "Untitled Stream"
 	}
-	// For HLS, we might generate a PlaybackID based on the ID or random
-	input.PlaybackID = "hls-" + key[:8]
 
 	models.DB.Create(&input)
 	c.JSON(http.StatusOK, gin.H{"data": input})
@@ -59,16 +110,84 @@ func UpdateStream(c *gin.Context) {
 	stream.PreMatchDetails = input.PreMatchDetails
 	stream.PostMatchDetails = input.PostMatchDetails
 
-	// Explicitly set IsLive as it's boolean
-	stream.IsLive = input.IsLive
+	// Takes effect on the next publish (or transcoder restart)
+	if !transcodeProfileExists(input.TranscodeProfile) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown transcode profile"})
+		return
+	}
+	stream.TranscodeProfile = input.TranscodeProfile
+	stream.LowLatency = input.LowLatency
+	stream.DASH = input.DASH
+
+	if !playback.ValidPolicy(input.PlaybackPolicy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown playback policy"})
+		return
+	}
+	stream.PlaybackPolicy = input.PlaybackPolicy
+
+	// Takes effect on the next publish
+	if err := validateEncryption(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream.Encrypted = input.Encrypted
+	stream.KeyRotation = input.KeyRotation
+
+	// Takes effect on the next publish
+	if err := rtmp.ValidateDVR(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream.DVRWindow = input.DVRWindow
+	stream.DVRMode = input.DVRMode
+
+	// Takes effect on the next pull; a running pull keeps its source
+	if err := rtmp.ValidateSource(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stream.SourceType = input.SourceType
+	stream.SourceURL = input.SourceURL
+	stream.PullStartAt = input.PullStartAt
+	stream.PullStopAt = input.PullStopAt
 
-	models.DB.Save(&stream)
+	// Only the editable columns are written: is_live, ingest_status and
+	// viewer_count belong to the ingest state tracker, which may have
+	// changed them since the stream was loaded.
+	if err := models.DB.Model(&stream).Select(streamEditableFields).Updates(&stream).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	models.DB.First(&stream, stream.ID)
 	c.JSON(http.StatusOK, gin.H{"data": stream})
 }
 
+// streamEditableFields are the models.Stream fields UpdateStream saves.
+var streamEditableFields = []string{
+	"Title", "Description", "SportCategory", "BannerURL", "ThumbnailURL",
+	"OfflineBannerURL", "PreMatchDetails", "PostMatchDetails",
+	"TranscodeProfile", "LowLatency", "DASH", "PlaybackPolicy",
+	"Encrypted", "KeyRotation", "DVRWindow", "DVRMode",
+	"SourceType", "SourceURL", "PullStartAt", "PullStopAt",
+}
+
+// validateEncryption rejects encryption settings the packagers cannot honour:
+// LL-HLS parts and CMAF segments are never encrypted, so they would expose
+// the stream in the clear.
+func validateEncryption(stream *models.Stream) error {
+	if stream.KeyRotation < 0 {
+		return errors.New("key_rotation must not be negative")
+	}
+	if stream.Encrypted && (stream.LowLatency || stream.DASH) {
+		return errors.New("encrypted streams cannot use low latency or DASH output")
+	}
+	return nil
+}
+
 func DeleteStream(c *gin.Context) {
 	id := c.Param("id")
 	models.DB.Delete(&models.Stream{}, id)
+	models.DB.Where("stream_id = ?", id).Delete(&models.HLSKey{})
 	c.JSON(http.StatusOK, gin.H{"data": true})
 }
 
@@ -79,7 +198,11 @@ func GetStream(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"data": stream})
+	dvr := rtmp.DVRStatus{}
+	if RtmpServer != nil {
+		dvr = RtmpServer.DVRStatus(&stream)
+	}
+	c.JSON(http.StatusOK, gin.H{"data": stream, "dvr": dvr})
 }
 
 func StopStream(c *gin.Context) {
@@ -90,13 +213,179 @@ func StopStream(c *gin.Context) {
 		return
 	}
 
-	stream.IsLive = false
-	stream.IngestStatus = "stopped"
-	stream.UpdatedAt = models.DB.NowFunc()
+	// Body is optional; an empty POST uses the default cooldown.
+	var input StopStreamInput
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	cooldown := rtmp.DefaultStopCooldown
+	if input.CooldownSeconds != nil {
+		cooldown = time.Duration(*input.CooldownSeconds) * time.Second
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	// Disconnect the publisher and let ffmpeg finalize the archive. The
+	// server's state tracker ends the stream and saves its status.
+	disconnected := RtmpServer.StopStream(&stream, cooldown)
+
+	models.DB.First(&stream, stream.ID)
+	c.JSON(http.StatusOK, gin.H{
+		"data":         stream,
+		"disconnected": disconnected,
+		"cooldown":     cooldown.String(),
+		"message":      "Stream stopped successfully",
+	})
+}
+
+// StartPull starts pulling a "pull" stream from its source URL now,
+// regardless of its schedule. Stop it with StopStream.
+func StartPull(c *gin.Context) {
+	id := c.Param("id")
+	var stream models.Stream
+	if err := models.DB.First(&stream, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+	if stream.SourceType != rtmp.SourcePull {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stream is not a pull source"})
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	if err := RtmpServer.StartPull(&stream); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": stream, "message": "Pull started"})
+}
+
+// ShowStartingSoon opens a stream on its "starting soon" slate until the
+// publisher arrives. Stop it with StopStream.
+func ShowStartingSoon(c *gin.Context) {
+	id := c.Param("id")
+	var stream models.Stream
+	if err := models.DB.First(&stream, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	if err := RtmpServer.ShowStartingSoon(&stream); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": stream, "message": "Starting soon slate shown"})
+}
+
+// GetTranscoderStatus reports the ffmpeg supervisor of a live stream:
+// restarts, last exit and the recent stderr lines.
+func GetTranscoderStatus(c *gin.Context) {
+	id := c.Param("id")
+	var stream models.Stream
+	if err := models.DB.First(&stream, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	status, ok := RtmpServer.TranscoderStatus(stream.ID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream is not being transcoded"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": status, "ingest_status": RtmpServer.IngestStatus(stream.ID)})
+}
+
+// GetIngestStatus reports the inputs of a live stream: which of the
+// primary and backup publishers is on air, and the recent failovers.
+func GetIngestStatus(c *gin.Context) {
+	id := c.Param("id")
+	var stream models.Stream
+	if err := models.DB.First(&stream, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	report, ok := RtmpServer.IngestReport(stream.ID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream is not live"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": report, "ingest_status": RtmpServer.IngestStatus(stream.ID)})
+}
+
+// IssuePlaybackToken signs a playback token for a stream. Streams with the
+// "signed" playback policy only serve HLS, FLV and RTMP playback to requests
+// carrying one in their token query parameter. Tokens are issued to services
+// holding playback.IssuerKey, and to the player of a viewer page, bound to
+// the viewer's address.
+func IssuePlaybackToken(c *gin.Context) {
+	issuer := playback.IsIssuer(c.Request)
+	if !issuer && !playback.FromViewerPage(c.Request) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Playback tokens are only issued to the player or with the issuer key"})
+		return
+	}
+
+	id := c.Param("id")
+	var stream models.Stream
+	if err := models.DB.First(&stream, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream not found"})
+		return
+	}
+
+	// Body is optional; an empty POST issues an unbound token.
+	var input PlaybackTokenInput
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	ttl := playback.DefaultTTL
+	if input.TTLSeconds != nil {
+		ttl = time.Duration(*input.TTLSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > playback.MaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds must be between 1 and " + strconv.Itoa(int(playback.MaxTTL.Seconds()))})
+		return
+	}
 
-	// In a real app with joy4/avutil, we would also find the active connection in a map and close it.
-	// For now, updating the DB will trigger the frontend to stop playback.
+	if input.IP != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ip cannot be chosen, use bind_ip to bind the token to your address"})
+		return
+	}
+
+	claims := playback.Claims{StreamID: stream.ID, Expires: time.Now().Add(ttl).Truncate(time.Second)}
+	if input.BindIP || !issuer {
+		claims.IP = playback.ClientIP(c.Request)
+	}
+	token := playback.Sign(playback.Secret, claims)
 
-	models.DB.Save(&stream)
-	c.JSON(http.StatusOK, gin.H{"data": stream, "message": "Stream stopped successfully"})
+	hlsURL, flvURL := rtmp.PlaybackURLs(&stream, token)
+	c.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"token":      token,
+		"expires_at": claims.Expires,
+		"ip":         claims.IP,
+		"hls_url":    hlsURL,
+		"flv_url":    flvURL,
+	}})
 }
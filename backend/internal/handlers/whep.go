@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"streamcast-backend/internal/playback"
+	"streamcast-backend/internal/rtmp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PlayWHEP handles POST /api/whep/:playback_id (WHEP). The body is the
+// viewer's SDP offer. Signed and encrypted streams take their playback
+// token as a bearer token, or in ?token= like HLS.
+func PlayWHEP(c *gin.Context) {
+	offer, ok := readSDPOffer(c)
+	if !ok {
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	token := c.Query("token")
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	playbackID := c.Param("playback_id")
+	id, answer, err := RtmpServer.PlayWHEP(playbackID, token, playback.ClientIP(c.Request), offer)
+	switch {
+	case errors.Is(err, rtmp.ErrStreamOffline):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stream is not live"})
+		return
+	case errors.Is(err, rtmp.ErrPlaybackDenied):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, rtmp.ErrNoH264):
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Location", "/api/whep/"+playbackID+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// StopWHEP handles DELETE /api/whep/:playback_id/:session_id, the viewer
+// leaving.
+func StopWHEP(c *gin.Context) {
+	if RtmpServer == nil || !RtmpServer.StopWHEP(c.Param("playback_id"), c.Param("session_id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"streamcast-backend/internal/rtmp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSDPSize bounds WHIP offers; real ones are a few kilobytes.
+const maxSDPSize = 64 << 10
+
+// PublishWHIP handles POST /api/whip/:stream_key (WHIP, RFC 9725). The body
+// is an SDP offer; the answer comes back with the session URL in Location.
+func PublishWHIP(c *gin.Context) {
+	offer, ok := readSDPOffer(c)
+	if !ok {
+		return
+	}
+
+	if RtmpServer == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Ingest server not running"})
+		return
+	}
+	streamKey := c.Param("stream_key")
+	id, answer, err := RtmpServer.PublishWHIP(streamKey, offer)
+	switch {
+	case errors.Is(err, rtmp.ErrUnknownStreamKey):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown stream key"})
+		return
+	case errors.Is(err, rtmp.ErrPublishRefused):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, rtmp.ErrStreamBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Location", "/api/whip/"+streamKey+"/"+id)
+	c.Data(http.StatusCreated, "application/sdp", []byte(answer))
+}
+
+// StopWHIP handles DELETE /api/whip/:stream_key/:session_id, the publisher
+// hanging up.
+func StopWHIP(c *gin.Context) {
+	if RtmpServer == nil || !RtmpServer.StopWHIP(c.Param("stream_key"), c.Param("session_id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// readSDPOffer reads the SDP offer of a WHIP or WHEP request, answering
+// the request itself if there is none.
+func readSDPOffer(c *gin.Context) (string, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(c.ContentType()); mediaType != "application/sdp" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/sdp"})
+		return "", false
+	}
+	offer, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSDPSize))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Offer too large"})
+		return "", false
+	}
+	return string(offer), true
+}
+
+// RejectTrickleICE handles PATCH on WHIP and WHEP sessions. Answers carry
+// every ICE candidate, so trickle ICE and ICE restarts are not supported.
+func RejectTrickleICE(c *gin.Context) {
+	c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "Trickle ICE is not supported"})
+}
@@ -0,0 +1,365 @@
+package hls
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// CMAFSegmenter is an av.Muxer that packages every track into CMAF
+// (fragmented MP4) segments cut on video keyframes. The same segment files
+// are described twice: as fMP4 HLS (master.m3u8 with one media playlist per
+// track) and as a live DASH manifest (manifest.mpd).
+type CMAFSegmenter struct {
+	// Dir receives init segments, media segments, playlists and the MPD.
+	Dir string
+	// TargetDuration is the minimum segment length; segments are only cut
+	// on keyframes, so they may run longer.
+	TargetDuration time.Duration
+	// PlaylistSize is the number of segments listed in the playlists and
+	// the MPD's timeline.
+	PlaylistSize int
+	// RetainSegments is how many segments that fell out of the playlists
+	// stay on disk for players still downloading them.
+	RetainSegments int
+
+	lock     sync.Mutex
+	tracks   []*cmafTrack
+	videoIdx int
+
+	open     bool
+	seq      int
+	segStart time.Duration
+	lastTime time.Duration
+	origin   time.Time     // wall clock of the first segment's start
+	first    time.Duration // stream time of the first segment's start
+
+	segments []cmafSegment // listed, oldest first
+	expired  []cmafSegment // dropped from the playlists, still on disk
+	ended    bool
+}
+
+type cmafTrack struct {
+	*fmp4Track
+	name     string // "video" or "audio": file prefix and DASH representation ID
+	pending  *av.Packet
+	samples  []fmp4Sample
+	base     uint64 // decode time of the open segment's first sample
+	next     uint64 // decode time following the last finished sample
+	started  bool
+	duration uint64 // of the finished samples in the open segment
+}
+
+type cmafSegment struct {
+	Sequence  int
+	Duration  time.Duration
+	fragments []cmafFragment // one per track, same order as tracks
+}
+
+type cmafFragment struct {
+	base     uint64
+	duration uint64
+	size     int
+}
+
+// NewCMAFSegmenter creates a CMAF segmenter writing into dir.
+func NewCMAFSegmenter(dir string, targetDuration time.Duration, playlistSize int) *CMAFSegmenter {
+	return &CMAFSegmenter{
+		Dir:            dir,
+		TargetDuration: targetDuration,
+		PlaylistSize:   playlistSize,
+		RetainSegments: 2,
+	}
+}
+
+func (s *CMAFSegmenter) WriteHeader(streams []av.CodecData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	s.tracks = nil
+	s.videoIdx = -1
+	for i, codec := range streams {
+		track, err := newFMP4Track(codec, uint32(i+1))
+		if err != nil {
+			return err
+		}
+		name := "audio"
+		if codec.Type().IsVideo() {
+			name = "video"
+			s.videoIdx = i
+		}
+		s.tracks = append(s.tracks, &cmafTrack{fmp4Track: track, name: name})
+	}
+
+	for _, track := range s.tracks {
+		if err := writeFileAtomic(filepath.Join(s.Dir, track.initName()), track.initSegment()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CMAFSegmenter) WritePacket(pkt av.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if int(pkt.Idx) >= len(s.tracks) {
+		return nil
+	}
+	track := s.tracks[pkt.Idx]
+	isKey := s.videoIdx == -1 || (int(pkt.Idx) == s.videoIdx && pkt.IsKeyFrame)
+
+	if !s.open {
+		// Every segment must start with a keyframe to be decodable.
+		if !isKey {
+			return nil
+		}
+		s.openSegment(pkt.Time)
+	} else if isKey && pkt.Time-s.segStart >= s.TargetDuration {
+		// The keyframe ends the previous video sample before the cut.
+		track.finishPending(pkt.Time)
+		if err := s.closeSegment(); err != nil {
+			return err
+		}
+		s.openSegment(pkt.Time)
+	}
+
+	track.add(pkt)
+	if pkt.Time > s.lastTime {
+		s.lastTime = pkt.Time
+	}
+	return nil
+}
+
+// WriteTrailer finishes the last segment and ends the playlists.
+func (s *CMAFSegmenter) WriteTrailer() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.open {
+		// The last frame's own duration is unknown; approximate it with
+		// one video frame at 30fps.
+		for _, track := range s.tracks {
+			track.finishPending(s.lastTime + time.Second/30)
+		}
+		if err := s.closeSegment(); err != nil {
+			return err
+		}
+	}
+	s.ended = true
+	return s.writeManifests()
+}
+
+func (t *cmafTrack) initName() string {
+	return "init_" + t.name + ".mp4"
+}
+
+func (t *cmafTrack) segmentName(seq int) string {
+	return fmt.Sprintf("%s_%d.m4s", t.name, seq)
+}
+
+// add queues a packet as a sample of the open segment. Video samples last
+// until the next video packet, so they are only finished then.
+func (t *cmafTrack) add(pkt av.Packet) {
+	if !t.started {
+		t.started = true
+		t.base = t.ticks(pkt.Time)
+		t.next = t.base
+	}
+
+	if _, isAAC := t.codec.(aacparser.CodecData); isAAC {
+		t.appendSample(pkt, 1024)
+		return
+	}
+	t.finishPending(pkt.Time)
+	t.pending = &pkt
+}
+
+func (t *cmafTrack) finishPending(end time.Duration) {
+	if t.pending == nil {
+		return
+	}
+	pkt := *t.pending
+	t.pending = nil
+
+	duration := uint64(0)
+	if endTicks := t.ticks(end); endTicks > t.next {
+		duration = endTicks - t.next
+	}
+	t.appendSample(pkt, uint32(duration))
+}
+
+func (t *cmafTrack) appendSample(pkt av.Packet, duration uint32) {
+	_, isVideo := t.codec.(h264parser.CodecData)
+	t.samples = append(t.samples, fmp4Sample{
+		data:     pkt.Data,
+		duration: duration,
+		cts:      uint32(t.ticks(pkt.CompositionTime)),
+		sync:     !isVideo || pkt.IsKeyFrame,
+	})
+	t.next += uint64(duration)
+	t.duration += uint64(duration)
+}
+
+func (s *CMAFSegmenter) openSegment(start time.Duration) {
+	if s.origin.IsZero() {
+		s.origin = time.Now()
+		s.first = start
+	}
+	s.segStart = start
+	s.open = true
+	for _, track := range s.tracks {
+		track.base = track.next
+		if !track.started {
+			// A track that has not started yet begins with this segment.
+			track.base = track.ticks(start)
+			track.next = track.base
+		}
+		track.samples = nil
+		track.duration = 0
+	}
+}
+
+func (s *CMAFSegmenter) closeSegment() error {
+	s.open = false
+	seg := cmafSegment{Sequence: s.seq, Duration: s.lastTime - s.segStart}
+
+	var end time.Duration
+	for _, track := range s.tracks {
+		data := track.fragment(uint32(s.seq+1), track.base, track.samples)
+		if err := writeFileAtomic(filepath.Join(s.Dir, track.segmentName(s.seq)), data); err != nil {
+			return err
+		}
+		seg.fragments = append(seg.fragments, cmafFragment{base: track.base, duration: track.duration, size: len(data)})
+		if d := time.Duration(track.duration) * time.Second / time.Duration(track.timescale); d > end {
+			end = d
+		}
+	}
+	if end > 0 {
+		seg.Duration = end
+	}
+	s.segments = append(s.segments, seg)
+	s.seq++
+
+	for len(s.segments) > s.PlaylistSize {
+		s.expired = append(s.expired, s.segments[0])
+		s.segments = s.segments[1:]
+	}
+	for len(s.expired) > s.RetainSegments {
+		for _, track := range s.tracks {
+			os.Remove(filepath.Join(s.Dir, track.segmentName(s.expired[0].Sequence)))
+		}
+		s.expired = s.expired[1:]
+	}
+	return s.writeManifests()
+}
+
+func (s *CMAFSegmenter) writeManifests() error {
+	for i, track := range s.tracks {
+		if err := writeFileAtomic(filepath.Join(s.Dir, track.name+".m3u8"), s.mediaPlaylist(i)); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(filepath.Join(s.Dir, "master.m3u8"), s.masterPlaylist()); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.Dir, "manifest.mpd"), s.manifest(time.Now()))
+}
+
+func (s *CMAFSegmenter) mediaPlaylist(trackIdx int) []byte {
+	track := s.tracks[trackIdx]
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", s.targetDuration())
+	mediaSeq := s.seq
+	if len(s.segments) > 0 {
+		mediaSeq = s.segments[0].Sequence
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq)
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", track.initName())
+	for _, seg := range s.segments {
+		frag := seg.fragments[trackIdx]
+		duration := float64(frag.duration) / float64(track.timescale)
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", duration, track.segmentName(seg.Sequence))
+	}
+	if s.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return []byte(b.String())
+}
+
+// masterPlaylist lists the video playlist with the audio playlist as its
+// audio group, or the single playlist of an audio- or video-only stream.
+func (s *CMAFSegmenter) masterPlaylist() []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	var codecs []string
+	var variant, audio *cmafTrack
+	bandwidth := 0
+	for i, track := range s.tracks {
+		if name := CodecString(track.codec); name != "" {
+			codecs = append(codecs, name)
+		}
+		bandwidth += s.bandwidth(i)
+		if track.name == "video" {
+			variant = track
+		} else {
+			audio = track
+		}
+	}
+
+	attrs := fmt.Sprintf("BANDWIDTH=%d,CODECS=\"%s\"", bandwidth, strings.Join(codecs, ","))
+	if variant != nil {
+		if c, ok := variant.codec.(h264parser.CodecData); ok {
+			attrs += fmt.Sprintf(",RESOLUTION=%dx%d", c.Width(), c.Height())
+		}
+		if audio != nil {
+			fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"audio\",DEFAULT=YES,AUTOSELECT=YES,URI=\"%s.m3u8\"\n", audio.name)
+			attrs += ",AUDIO=\"audio\""
+		}
+	} else {
+		variant = audio
+	}
+	if variant != nil {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:%s\n%s.m3u8\n", attrs, variant.name)
+	}
+	return []byte(b.String())
+}
+
+// bandwidth is the peak bitrate of a track over the listed segments.
+func (s *CMAFSegmenter) bandwidth(trackIdx int) int {
+	track := s.tracks[trackIdx]
+	peak := 0
+	for _, seg := range s.segments {
+		frag := seg.fragments[trackIdx]
+		if frag.duration == 0 {
+			continue
+		}
+		bps := int(uint64(frag.size) * 8 * uint64(track.timescale) / frag.duration)
+		if bps > peak {
+			peak = bps
+		}
+	}
+	return peak
+}
+
+func (s *CMAFSegmenter) targetDuration() int {
+	listed := make([]Segment, len(s.segments))
+	for i, seg := range s.segments {
+		listed[i] = Segment{Duration: seg.Duration}
+	}
+	return targetDuration(s.TargetDuration, listed)
+}
@@ -0,0 +1,197 @@
+package hls
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/format/mp4/mp4io"
+)
+
+func readAtoms(t *testing.T, path string) []mp4io.Atom {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	atoms, err := mp4io.ReadFileAtoms(f)
+	if err != nil {
+		t.Fatalf("%s: %v", filepath.Base(path), err)
+	}
+	return atoms
+}
+
+func newCMAFSegmenter(t *testing.T) *CMAFSegmenter {
+	t.Helper()
+	s := NewCMAFSegmenter(t.TempDir(), 2*time.Second, 6)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCMAFInitSegments(t *testing.T) {
+	s := newCMAFSegmenter(t)
+
+	var video *mp4io.Movie
+	for _, atom := range readAtoms(t, filepath.Join(s.Dir, "init_video.mp4")) {
+		if moov, ok := atom.(*mp4io.Movie); ok {
+			video = moov
+		}
+	}
+	if video == nil || video.MovieExtend == nil || len(video.Tracks) != 1 {
+		t.Fatalf("init_video.mp4 needs a moov with mvex and one track: %+v", video)
+	}
+	desc := video.Tracks[0].Media.Info.Sample.SampleDesc.AVC1Desc
+	if desc == nil || desc.Width != 640 || desc.Height != 360 {
+		t.Errorf("unexpected video sample description %+v", desc)
+	}
+
+	var audio *mp4io.Movie
+	for _, atom := range readAtoms(t, filepath.Join(s.Dir, "init_audio.mp4")) {
+		if moov, ok := atom.(*mp4io.Movie); ok {
+			audio = moov
+		}
+	}
+	if audio == nil || audio.Tracks[0].Media.Header.TimeScale != 44100 {
+		t.Fatalf("audio track should use its sample rate as timescale: %+v", audio)
+	}
+	if desc := audio.Tracks[0].Media.Info.Sample.SampleDesc.MP4ADesc; desc == nil || desc.SampleRate != 44100 {
+		t.Errorf("unexpected audio sample description %+v", desc)
+	}
+}
+
+// findBox returns the payload of the box at path, e.g. "moof", "traf", "trun".
+func findBox(t *testing.T, b []byte, path ...string) []byte {
+	t.Helper()
+	for len(path) > 0 {
+		found := false
+		for len(b) >= 8 {
+			size := int(binary.BigEndian.Uint32(b))
+			if size < 8 || size > len(b) {
+				t.Fatalf("invalid box size %d", size)
+			}
+			if string(b[4:8]) == path[0] {
+				b, found = b[8:size], true
+				break
+			}
+			b = b[size:]
+		}
+		if !found {
+			t.Fatalf("box %s not found", path[0])
+		}
+		path = path[1:]
+	}
+	return b
+}
+
+func TestCMAFFragments(t *testing.T) {
+	s := newCMAFSegmenter(t)
+	feed(t, s, 5*time.Second)
+
+	data, err := os.ReadFile(filepath.Join(s.Dir, "video_1.m4s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moofSize := int(binary.BigEndian.Uint32(data))
+	if string(data[4:8]) != "moof" || string(data[moofSize+4:moofSize+8]) != "mdat" {
+		t.Fatal("a segment is one moof followed by its mdat")
+	}
+
+	tfdt := findBox(t, data, "moof", "traf", "tfdt")
+	if base := binary.BigEndian.Uint64(tfdt[4:]); base != 180000 {
+		t.Errorf("segment 1 decode time = %d, want 180000", base)
+	}
+
+	trun := findBox(t, data, "moof", "traf", "trun")
+	count := binary.BigEndian.Uint32(trun[4:])
+	if count != 60 {
+		t.Errorf("2s of 30fps video should be 60 samples, got %d", count)
+	}
+	if offset := int(binary.BigEndian.Uint32(trun[8:])); offset != moofSize+8 {
+		t.Errorf("data offset %d does not point into mdat (moof is %d bytes)", offset, moofSize)
+	}
+	var total uint32
+	for i := uint32(0); i < count; i++ {
+		entry := trun[12+16*i:]
+		total += binary.BigEndian.Uint32(entry)
+		flags := binary.BigEndian.Uint32(entry[8:])
+		if (i%30 == 0) != (flags == sampleFlagsSync) {
+			t.Errorf("sample %d flags %#x: only keyframes are sync samples", i, flags)
+		}
+	}
+	if total != 180000 {
+		t.Errorf("segment lasts %d ticks, want 180000", total)
+	}
+
+	segments := s.segments
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	// Decode times continue exactly from one segment to the next.
+	for i, frag := range segments[0].fragments {
+		if next := segments[1].fragments[i]; next.base != frag.base+frag.duration {
+			t.Errorf("track %d: segment 1 starts at %d, segment 0 ends at %d", i, next.base, frag.base+frag.duration)
+		}
+	}
+}
+
+func TestCMAFPlaylistsAndManifest(t *testing.T) {
+	s := newCMAFSegmenter(t)
+	feed(t, s, 5*time.Second)
+
+	video, _ := os.ReadFile(filepath.Join(s.Dir, "video.m3u8"))
+	for _, want := range []string{"#EXT-X-VERSION:7", `#EXT-X-MAP:URI="init_video.mp4"`, "#EXTINF:2.000,\nvideo_1.m4s"} {
+		if !strings.Contains(string(video), want) {
+			t.Errorf("video.m3u8 missing %q:\n%s", want, video)
+		}
+	}
+
+	master, _ := os.ReadFile(filepath.Join(s.Dir, "master.m3u8"))
+	for _, want := range []string{`TYPE=AUDIO,GROUP-ID="audio"`, `URI="audio.m3u8"`, `CODECS="avc1.64001e,mp4a.40.2"`, "RESOLUTION=640x360", `AUDIO="audio"` + "\nvideo.m3u8"} {
+		if !strings.Contains(string(master), want) {
+			t.Errorf("master.m3u8 missing %q:\n%s", want, master)
+		}
+	}
+
+	mpd, _ := os.ReadFile(filepath.Join(s.Dir, "manifest.mpd"))
+	if err := xml.Unmarshal(mpd, new(struct{})); err != nil {
+		t.Fatalf("manifest.mpd is not well-formed XML: %v", err)
+	}
+	for _, want := range []string{
+		`type="dynamic"`,
+		`minimumUpdatePeriod="PT2.000S"`,
+		`media="$RepresentationID$_$Number$.m4s"`,
+		`startNumber="0"`,
+		`<S t="0" d="180000"/>`,
+		`<S t="180000" d="180000"/>`,
+		`<Representation id="video" codecs="avc1.64001e"`,
+		`<Representation id="audio" codecs="mp4a.40.2"`,
+	} {
+		if !strings.Contains(string(mpd), want) {
+			t.Errorf("manifest.mpd missing %q:\n%s", want, mpd)
+		}
+	}
+}
+
+func TestCMAFTrailerEndsPresentation(t *testing.T) {
+	s := newCMAFSegmenter(t)
+	feed(t, s, 3*time.Second)
+	if err := s.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+
+	audio, _ := os.ReadFile(filepath.Join(s.Dir, "audio.m3u8"))
+	if !strings.HasSuffix(string(audio), "#EXT-X-ENDLIST\n") {
+		t.Errorf("audio.m3u8 must end with EXT-X-ENDLIST:\n%s", audio)
+	}
+	mpd, _ := os.ReadFile(filepath.Join(s.Dir, "manifest.mpd"))
+	if strings.Contains(string(mpd), "minimumUpdatePeriod") || !strings.Contains(string(mpd), "mediaPresentationDuration") {
+		t.Errorf("ended manifest must not ask for updates:\n%s", mpd)
+	}
+}
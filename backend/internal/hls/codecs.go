@@ -0,0 +1,24 @@
+package hls
+
+import (
+	"fmt"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// CodecString returns the RFC 6381 codec name used in HLS CODECS and DASH
+// codecs attributes, e.g. "avc1.64001f" or "mp4a.40.2". It is empty for
+// codecs that cannot be described.
+func CodecString(codec av.CodecData) string {
+	switch c := codec.(type) {
+	case h264parser.CodecData:
+		if sps := c.SPS(); len(sps) >= 4 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+		}
+	case aacparser.CodecData:
+		return fmt.Sprintf("mp4a.40.%d", c.Config.ObjectType)
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// DASHContentType is the MIME type of DASH manifests.
+const DASHContentType = "application/dash+xml"
+
+// manifest renders the live DASH manifest. Every track is its own
+// adaptation set whose SegmentTimeline lists the same segments as the HLS
+// media playlists.
+func (s *CMAFSegmenter) manifest(now time.Time) []byte {
+	target := s.TargetDuration.Seconds()
+
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" profiles="urn:mpeg:dash:profile:isoff-live:2011,urn:mpeg:dash:profile:cmaf:2019" type="dynamic"`)
+	fmt.Fprintf(&b, ` availabilityStartTime="%s" publishTime="%s"`, mpdTime(s.origin), mpdTime(now))
+	fmt.Fprintf(&b, ` minBufferTime="%s" timeShiftBufferDepth="%s"`, mpdDuration(target), mpdDuration(target*float64(s.PlaylistSize)))
+	if s.ended {
+		// No further updates: the presentation ends with the last segment.
+		fmt.Fprintf(&b, ` mediaPresentationDuration="%s"`, mpdDuration((s.lastTime - s.first).Seconds()))
+	} else {
+		fmt.Fprintf(&b, ` minimumUpdatePeriod="%s" suggestedPresentationDelay="%s"`, mpdDuration(target), mpdDuration(3*target))
+	}
+	b.WriteString(">\n  <Period id=\"0\" start=\"PT0S\">\n")
+
+	startNumber := s.seq
+	if len(s.segments) > 0 {
+		startNumber = s.segments[0].Sequence
+	}
+	for i, track := range s.tracks {
+		contentType := "audio"
+		if track.name == "video" {
+			contentType = "video"
+		}
+		fmt.Fprintf(&b, "    <AdaptationSet id=\"%d\" contentType=\"%s\" mimeType=\"%s/mp4\" segmentAlignment=\"true\" startWithSAP=\"1\">\n",
+			i, contentType, contentType)
+		fmt.Fprintf(&b, "      <SegmentTemplate timescale=\"%d\" presentationTimeOffset=\"%d\" initialization=\"init_$RepresentationID$.mp4\" media=\"$RepresentationID$_$Number$.m4s\" startNumber=\"%d\">\n",
+			track.timescale, track.ticks(s.first), startNumber)
+		b.WriteString("        <SegmentTimeline>\n")
+		for _, seg := range s.segments {
+			frag := seg.fragments[i]
+			fmt.Fprintf(&b, "          <S t=\"%d\" d=\"%d\"/>\n", frag.base, frag.duration)
+		}
+		b.WriteString("        </SegmentTimeline>\n      </SegmentTemplate>\n")
+
+		fmt.Fprintf(&b, "      <Representation id=\"%s\" codecs=\"%s\" bandwidth=\"%d\"", track.name, CodecString(track.codec), s.bandwidth(i))
+		switch c := track.codec.(type) {
+		case h264parser.CodecData:
+			fmt.Fprintf(&b, " width=\"%d\" height=\"%d\"/>\n", c.Width(), c.Height())
+		case aacparser.CodecData:
+			fmt.Fprintf(&b, " audioSamplingRate=\"%d\">\n", c.SampleRate())
+			fmt.Fprintf(&b, "        <AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>\n",
+				c.ChannelLayout().Count())
+			b.WriteString("      </Representation>\n")
+		}
+		b.WriteString("    </AdaptationSet>\n")
+	}
+	b.WriteString("  </Period>\n</MPD>\n")
+	return []byte(b.String())
+}
+
+func mpdTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func mpdDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
@@ -0,0 +1,70 @@
+package hls
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Key is an AES-128 content key shared by a run of segments.
+type Key struct {
+	// URI is where players fetch the key; it is written into the playlist
+	// as is.
+	URI   string
+	Bytes []byte
+}
+
+// KeySource returns the key media segment seq is encrypted with, or nil to
+// leave it in the clear.
+type KeySource func(seq int) (*Key, error)
+
+// segmentIV is the IV players assume when EXT-X-KEY has none: the media
+// sequence number as a 128-bit big-endian integer.
+func segmentIV(seq int) []byte {
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(seq))
+	return iv
+}
+
+// cbcWriter encrypts everything written to it with AES-128-CBC. Close pads
+// the final block (PKCS#7) as METHOD=AES-128 requires.
+type cbcWriter struct {
+	w    io.Writer
+	mode cipher.BlockMode
+	buf  []byte
+}
+
+func newCBCWriter(w io.Writer, key *Key, seq int) (*cbcWriter, error) {
+	block, err := aes.NewCipher(key.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("hls: invalid key %s: %w", key.URI, err)
+	}
+	return &cbcWriter{w: w, mode: cipher.NewCBCEncrypter(block, segmentIV(seq))}, nil
+}
+
+func (c *cbcWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	full := len(c.buf) - len(c.buf)%aes.BlockSize
+	if full == 0 {
+		return len(p), nil
+	}
+	c.mode.CryptBlocks(c.buf[:full], c.buf[:full])
+	if _, err := c.w.Write(c.buf[:full]); err != nil {
+		return 0, err
+	}
+	c.buf = append(c.buf[:0], c.buf[full:]...)
+	return len(p), nil
+}
+
+func (c *cbcWriter) Close() error {
+	pad := aes.BlockSize - len(c.buf)
+	for i := 0; i < pad; i++ {
+		c.buf = append(c.buf, byte(pad))
+	}
+	c.mode.CryptBlocks(c.buf, c.buf)
+	_, err := c.w.Write(c.buf)
+	c.buf = nil
+	return err
+}
@@ -0,0 +1,71 @@
+package hls
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rotatingKeys hands out a new key every n segments.
+func rotatingKeys(n int) KeySource {
+	keys := make(map[int]*Key)
+	return func(seq int) (*Key, error) {
+		idx := seq / n
+		if keys[idx] == nil {
+			keys[idx] = &Key{URI: fmt.Sprintf("/keys/%d.key", idx), Bytes: bytes.Repeat([]byte{byte(idx + 1)}, 16)}
+		}
+		return keys[idx], nil
+	}
+}
+
+func TestSegmenterEncryptsSegments(t *testing.T) {
+	s := NewSegmenter(t.TempDir(), 2*time.Second, 6)
+	s.Keys = rotatingKeys(2)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, 9*time.Second)
+
+	playlist := string(s.Playlist())
+	want := "#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/0.key\"\n#EXTINF:2.000,\nseg_0.ts\n#EXTINF:2.000,\nseg_1.ts\n" +
+		"#EXT-X-KEY:METHOD=AES-128,URI=\"/keys/1.key\"\n#EXTINF:2.000,\nseg_2.ts\n#EXTINF:2.000,\nseg_3.ts\n"
+	if !strings.Contains(playlist, want) {
+		t.Errorf("playlist should switch keys every 2 segments:\n%s", playlist)
+	}
+
+	for seq, keyByte := range []byte{1, 1, 2, 2} {
+		data, err := os.ReadFile(filepath.Join(s.Dir, s.segmentName(seq)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+			t.Fatalf("segment %d is %d bytes, not whole AES blocks", seq, len(data))
+		}
+		block, _ := aes.NewCipher(bytes.Repeat([]byte{keyByte}, 16))
+		cipher.NewCBCDecrypter(block, segmentIV(seq)).CryptBlocks(data, data)
+
+		pad := int(data[len(data)-1])
+		if pad < 1 || pad > aes.BlockSize {
+			t.Fatalf("segment %d has invalid padding %d", seq, pad)
+		}
+		data = data[:len(data)-pad]
+		if len(data)%188 != 0 || data[0] != 0x47 {
+			t.Errorf("segment %d does not decrypt to MPEG-TS packets", seq)
+		}
+	}
+}
+
+func TestSegmenterRejectsEncryptedParts(t *testing.T) {
+	s := NewSegmenter(t.TempDir(), 2*time.Second, 6)
+	s.PartTarget = 500 * time.Millisecond
+	s.Keys = rotatingKeys(1)
+	if err := s.WriteHeader(syntheticStreams(t)); err == nil {
+		t.Error("encryption with LL-HLS parts should be rejected")
+	}
+}
@@ -0,0 +1,214 @@
+package hls
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/mp4/mp4io"
+)
+
+// mp4Epoch is time zero of MP4 header timestamps.
+var mp4Epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Sample flags of a trun entry: sync samples depend on nothing, other video
+// samples depend on earlier ones and are not sync samples.
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// fmp4Track is one track of a CMAF presentation: every track gets its own
+// init segment and its own media segments.
+type fmp4Track struct {
+	codec     av.CodecData
+	id        uint32
+	timescale uint32
+}
+
+func newFMP4Track(codec av.CodecData, id uint32) (*fmp4Track, error) {
+	switch c := codec.(type) {
+	case h264parser.CodecData:
+		return &fmp4Track{codec: codec, id: id, timescale: 90000}, nil
+	case aacparser.CodecData:
+		// Audio uses its sample rate so every AAC frame lasts exactly 1024.
+		return &fmp4Track{codec: codec, id: id, timescale: uint32(c.SampleRate())}, nil
+	}
+	return nil, fmt.Errorf("hls: codec %s cannot be packaged as CMAF", codec.Type())
+}
+
+func (t *fmp4Track) ticks(d time.Duration) uint64 {
+	return uint64(d) * uint64(t.timescale) / uint64(time.Second)
+}
+
+// initSegment returns the CMAF header (ftyp + moov) of the track.
+func (t *fmp4Track) initSegment() []byte {
+	trak := &mp4io.Track{
+		Header: &mp4io.TrackHeader{
+			CreateTime: mp4Epoch,
+			ModifyTime: mp4Epoch,
+			TrackId:    int32(t.id),
+			Flags:      0x0003, // enabled, in movie
+			Matrix:     [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+		},
+		Media: &mp4io.Media{
+			Header: &mp4io.MediaHeader{
+				CreateTime: mp4Epoch,
+				ModifyTime: mp4Epoch,
+				TimeScale:  int32(t.timescale),
+				Language:   21956, // "und"
+			},
+			Info: &mp4io.MediaInfo{
+				Data: &mp4io.DataInfo{
+					Refer: &mp4io.DataRefer{Url: &mp4io.DataReferUrl{Flags: 0x000001}},
+				},
+				// Fragmented files keep their samples in moof boxes, so the
+				// sample table only describes the codec.
+				Sample: &mp4io.SampleTable{
+					SampleDesc:    &mp4io.SampleDesc{},
+					TimeToSample:  &mp4io.TimeToSample{},
+					SampleToChunk: &mp4io.SampleToChunk{},
+					SampleSize:    &mp4io.SampleSize{},
+					ChunkOffset:   &mp4io.ChunkOffset{},
+				},
+			},
+		},
+	}
+
+	switch c := t.codec.(type) {
+	case h264parser.CodecData:
+		trak.Header.TrackWidth = float64(c.Width())
+		trak.Header.TrackHeight = float64(c.Height())
+		trak.Media.Handler = &mp4io.HandlerRefer{SubType: [4]byte{'v', 'i', 'd', 'e'}, Name: []byte("Video Media Handler")}
+		trak.Media.Info.Video = &mp4io.VideoMediaInfo{Flags: 0x000001}
+		trak.Media.Info.Sample.SampleDesc.AVC1Desc = &mp4io.AVC1Desc{
+			DataRefIdx:           1,
+			HorizontalResolution: 72,
+			VorizontalResolution: 72,
+			Width:                int16(c.Width()),
+			Height:               int16(c.Height()),
+			FrameCount:           1,
+			Depth:                24,
+			ColorTableId:         -1,
+			Conf:                 &mp4io.AVC1Conf{Data: c.AVCDecoderConfRecordBytes()},
+		}
+	case aacparser.CodecData:
+		trak.Header.Volume = 1
+		trak.Header.AlternateGroup = 1
+		trak.Media.Handler = &mp4io.HandlerRefer{SubType: [4]byte{'s', 'o', 'u', 'n'}, Name: []byte("Sound Handler")}
+		trak.Media.Info.Sound = &mp4io.SoundMediaInfo{}
+		trak.Media.Info.Sample.SampleDesc.MP4ADesc = &mp4io.MP4ADesc{
+			DataRefIdx:       1,
+			NumberOfChannels: int16(c.ChannelLayout().Count()),
+			SampleSize:       16,
+			SampleRate:       float64(c.SampleRate()),
+			Conf:             &mp4io.ElemStreamDesc{DecConfig: c.MPEG4AudioConfigBytes()},
+		}
+	}
+
+	moov := &mp4io.Movie{
+		Header: &mp4io.MovieHeader{
+			CreateTime:        mp4Epoch,
+			ModifyTime:        mp4Epoch,
+			PreviewTime:       mp4Epoch,
+			PreviewDuration:   mp4Epoch,
+			PosterTime:        mp4Epoch,
+			SelectionTime:     mp4Epoch,
+			SelectionDuration: mp4Epoch,
+			CurrentTime:       mp4Epoch,
+			TimeScale:         1000,
+			PreferredRate:     1,
+			PreferredVolume:   1,
+			Matrix:            [9]int32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000},
+			NextTrackId:       int32(t.id + 1),
+		},
+		MovieExtend: &mp4io.MovieExtend{
+			Tracks: []*mp4io.TrackExtend{{TrackId: t.id, DefaultSampleDescIdx: 1}},
+		},
+		Tracks: []*mp4io.Track{trak},
+	}
+
+	ftyp := box("ftyp", []byte("cmfc"), u32(0), []byte("cmfciso6isomdash"))
+	b := make([]byte, len(ftyp)+moov.Len())
+	copy(b, ftyp)
+	moov.Marshal(b[len(ftyp):])
+	return b
+}
+
+// fmp4Sample is one access unit of a fragment.
+type fmp4Sample struct {
+	data     []byte
+	duration uint32
+	cts      uint32
+	sync     bool
+}
+
+// fragment returns a CMAF chunk (moof + mdat) holding samples, starting at
+// baseTime in the track's timescale.
+func (t *fmp4Track) fragment(seq uint32, baseTime uint64, samples []fmp4Sample) []byte {
+	const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800 // offset, duration, size, flags, cts
+
+	trun := make([]byte, 0, 12+16*len(samples))
+	trun = append(trun, u32(trunFlags)...) // version 0
+	trun = append(trun, u32(uint32(len(samples)))...)
+	trun = append(trun, u32(0)...) // data offset, patched below
+	mdatSize := 8
+	for _, s := range samples {
+		flags := uint32(sampleFlagsNonSync)
+		if s.sync {
+			flags = sampleFlagsSync
+		}
+		trun = append(trun, u32(s.duration)...)
+		trun = append(trun, u32(uint32(len(s.data)))...)
+		trun = append(trun, u32(flags)...)
+		trun = append(trun, u32(s.cts)...)
+		mdatSize += len(s.data)
+	}
+
+	tfdt := append(u32(0x01000000), u64(baseTime)...) // version 1: 64-bit time
+	traf := box("traf",
+		box("tfhd", u32(0x020000), u32(t.id)), // default-base-is-moof
+		box("tfdt", tfdt),
+		box("trun", trun),
+	)
+	moof := box("moof", box("mfhd", u32(0), u32(seq)), traf)
+
+	// Samples start right after the moof and the mdat header.
+	offset := len(moof) + 8
+	trunPos := len(moof) - len(trun) + 8
+	binary.BigEndian.PutUint32(moof[trunPos:], uint32(offset))
+
+	out := make([]byte, 0, len(moof)+mdatSize)
+	out = append(out, moof...)
+	out = append(out, u32(uint32(mdatSize))...)
+	out = append(out, "mdat"...)
+	for _, s := range samples {
+		out = append(out, s.data...)
+	}
+	return out
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = append(b, u32(uint32(size))...)
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
@@ -0,0 +1,135 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// PlaylistContentType is the MIME type of HLS playlists.
+const PlaylistContentType = "application/vnd.apple.mpegurl"
+
+// WaitForPart blocks until part of media segment msn has been published, or
+// the whole segment if part is negative. It returns false if ctx ends first
+// or the part will never exist (the segment was cut before reaching it, or
+// the stream ended).
+func (s *Segmenter) WaitForPart(ctx context.Context, msn, part int) bool {
+	for {
+		s.lock.Lock()
+		available, never := s.partState(msn, part)
+		updated := s.updated
+		s.lock.Unlock()
+
+		if available {
+			return true
+		}
+		if never {
+			return false
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (s *Segmenter) partState(msn, part int) (available, never bool) {
+	switch {
+	case msn < s.seq:
+		if part < 0 {
+			return true, false
+		}
+		for _, seg := range s.segments {
+			if seg.Sequence == msn {
+				return part < len(seg.Parts), part >= len(seg.Parts)
+			}
+		}
+		// Expired segments are not worth blocking for.
+		return true, false
+	case msn == s.seq && s.open && part >= 0 && part < len(s.parts):
+		return true, false
+	}
+	return false, s.ended
+}
+
+// blockTimeout is how long a blocking request may wait: the LL-HLS spec
+// asks servers to give up after three target durations.
+func (s *Segmenter) blockTimeout() time.Duration {
+	return 3 * s.TargetDuration
+}
+
+// ServePlaylist serves the media playlist, implementing LL-HLS blocking
+// playlist reload: with _HLS_msn (and optionally _HLS_part) the response is
+// held until the playlist contains that segment or part. A non-empty
+// uriQuery is appended to every URI in the playlist (see PlaylistWithQuery).
+func (s *Segmenter) ServePlaylist(w http.ResponseWriter, r *http.Request, uriQuery string) {
+	query := r.URL.Query()
+	msnParam, partParam := query.Get("_HLS_msn"), query.Get("_HLS_part")
+
+	if msnParam != "" {
+		msn, err := strconv.Atoi(msnParam)
+		if err != nil || msn < 0 {
+			http.Error(w, "invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if partParam != "" {
+			if part, err = strconv.Atoi(partParam); err != nil || part < 0 {
+				http.Error(w, "invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+
+		s.lock.Lock()
+		tooFar := msn > s.seq+2
+		s.lock.Unlock()
+		if tooFar {
+			http.Error(w, "_HLS_msn is too far in the future", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.blockTimeout())
+		defer cancel()
+		if !s.WaitForPart(ctx, msn, part) && ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "playlist not updated in time", http.StatusServiceUnavailable)
+			return
+		}
+	} else if partParam != "" {
+		http.Error(w, "_HLS_part requires _HLS_msn", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", PlaylistContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(PlaylistWithQuery(s.Playlist(), uriQuery))
+}
+
+// ServePart serves a part file, waiting for it when a player follows the
+// playlist's preload hint before the part is finished.
+func (s *Segmenter) ServePart(w http.ResponseWriter, r *http.Request, name string) {
+	var msn, part int
+	if _, err := fmt.Sscanf(name, "seg_%d.%d.ts", &msn, &part); err != nil || s.partName(msn, part) != name {
+		http.NotFound(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.blockTimeout())
+	defer cancel()
+	if !s.WaitForPart(ctx, msn, part) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	http.ServeFile(w, r, filepath.Join(s.Dir, name))
+}
+
+// IsPartName reports whether name looks like a part file of a segmenter.
+func IsPartName(name string) bool {
+	var msn, part int
+	_, err := fmt.Sscanf(name, "seg_%d.%d.ts", &msn, &part)
+	return err == nil
+}
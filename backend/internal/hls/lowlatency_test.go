@@ -0,0 +1,161 @@
+package hls
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLowLatencySegmenter(t *testing.T) *Segmenter {
+	t.Helper()
+	s := NewSegmenter(t.TempDir(), 2*time.Second, 6)
+	s.PartTarget = 500 * time.Millisecond
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLowLatencyParts(t *testing.T) {
+	s := newLowLatencySegmenter(t)
+	feed(t, s, 5*time.Second)
+
+	segments := s.Segments()
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	parts := segments[0].Parts
+	if len(parts) != 4 {
+		t.Fatalf("first segment has %d parts, want 4", len(parts))
+	}
+	if !parts[0].Independent || !parts[2].Independent || parts[1].Independent {
+		t.Errorf("only parts starting on a keyframe are independent: %+v", parts)
+	}
+
+	// A segment is exactly the concatenation of its parts.
+	var joined []byte
+	for _, part := range parts {
+		if part.Duration != 500*time.Millisecond {
+			t.Errorf("%s lasts %s, want 500ms", part.Name, part.Duration)
+		}
+		data, err := os.ReadFile(filepath.Join(s.Dir, part.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined = append(joined, data...)
+	}
+	whole, _ := os.ReadFile(filepath.Join(s.Dir, segments[0].Name))
+	if string(joined) != string(whole) {
+		t.Errorf("parts (%d bytes) do not add up to %s (%d bytes)", len(joined), segments[0].Name, len(whole))
+	}
+
+	playlist := string(s.Playlist())
+	for _, want := range []string{
+		"#EXT-X-VERSION:6",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=1.500",
+		"#EXT-X-PART-INF:PART-TARGET=0.500",
+		`#EXT-X-PART:DURATION=0.500,URI="seg_0.0.ts",INDEPENDENT=YES`,
+		`#EXT-X-PART:DURATION=0.500,URI="seg_2.0.ts",INDEPENDENT=YES`,
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="seg_2.1.ts"`,
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist missing %q:\n%s", want, playlist)
+		}
+	}
+}
+
+func TestWaitForPartBlocksUntilPublished(t *testing.T) {
+	s := newLowLatencySegmenter(t)
+	feed(t, s, time.Second)
+
+	done := make(chan bool)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.WaitForPart(ctx, 0, 3)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("part 3 was reported before it was written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Continue the same timeline up to 2s so part 3 closes.
+	for i := 30; i <= 60; i++ {
+		s.WritePacket(videoPacket(time.Duration(i)*time.Second/30, i%30 == 0))
+	}
+	if !<-done {
+		t.Error("WaitForPart returned false for a published part")
+	}
+
+	// The segment was cut after four parts, so a fifth never comes.
+	if s.WaitForPart(context.Background(), 0, 4) {
+		t.Error("expected false for a part past the end of its segment")
+	}
+}
+
+func TestServePlaylistBlockingReload(t *testing.T) {
+	s := newLowLatencySegmenter(t)
+	feed(t, s, time.Second)
+
+	rec := httptest.NewRecorder()
+	s.ServePlaylist(rec, httptest.NewRequest(http.MethodGet, "/index.m3u8?_HLS_msn=9", nil), "")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("far future _HLS_msn: status %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServePlaylist(rec, httptest.NewRequest(http.MethodGet, "/index.m3u8?_HLS_part=1", nil), "")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("_HLS_part without _HLS_msn: status %d, want 400", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServePlaylist(rec, httptest.NewRequest(http.MethodGet, "/index.m3u8?_HLS_msn=0&_HLS_part=0", nil), "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != PlaylistContentType {
+		t.Fatalf("available part: status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), `URI="seg_0.0.ts"`) {
+		t.Errorf("playlist does not list the requested part:\n%s", rec.Body.String())
+	}
+
+	// A request for a future part is held until the part is published.
+	served := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.ServePlaylist(rec, httptest.NewRequest(http.MethodGet, "/index.m3u8?_HLS_msn=0&_HLS_part=3", nil), "")
+		served <- rec
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 30; i <= 60; i++ {
+		s.WritePacket(videoPacket(time.Duration(i)*time.Second/30, i%30 == 0))
+	}
+	select {
+	case rec := <-served:
+		if !strings.Contains(rec.Body.String(), `URI="seg_0.3.ts"`) {
+			t.Errorf("blocked reload returned a playlist without the part:\n%s", rec.Body.String())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("blocking reload did not return once the part was published")
+	}
+}
+
+func TestSegmentsWithoutPartTargetHaveNoParts(t *testing.T) {
+	s := NewSegmenter(t.TempDir(), 2*time.Second, 6)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, 5*time.Second)
+	if strings.Contains(string(s.Playlist()), "EXT-X-PART") {
+		t.Error("regular HLS playlist lists parts")
+	}
+	if parts, _ := filepath.Glob(filepath.Join(s.Dir, "seg_*.*.ts")); len(parts) != 0 {
+		t.Errorf("regular HLS wrote part files: %v", parts)
+	}
+}
@@ -0,0 +1,289 @@
+package hls
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PullLiveEdge is how many segments from the end of a live playlist a
+// PlaylistReader starts at, as players do to have something buffered.
+const PullLiveEdge = 3
+
+// maxPlaylistSize bounds the playlists a PlaylistReader accepts.
+const maxPlaylistSize = 1 << 20
+
+var (
+	ErrNotPlaylist        = errors.New("hls: not an HLS playlist")
+	ErrUnsupportedSource  = errors.New("hls: only unencrypted MPEG-TS playlists can be pulled")
+	ErrPlaylistStalled    = errors.New("hls: playlist stopped advancing")
+	errMasterWithoutMedia = errors.New("hls: master playlist has no variants")
+)
+
+// PlaylistReader follows a remote HLS stream and reads its MPEG-TS segments
+// back to back, as one continuous transport stream for ts.NewDemuxer. A
+// master playlist is resolved to its highest-bandwidth variant. Live
+// playlists are polled until Close, starting PullLiveEdge segments from the
+// end; a playlist with EXT-X-ENDLIST is read from its first segment to
+// io.EOF.
+type PlaylistReader struct {
+	client *http.Client
+	pr     *io.PipeReader
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+// NewPlaylistReader starts following playlistURL. A nil client means
+// http.DefaultClient.
+func NewPlaylistReader(client *http.Client, playlistURL string) *PlaylistReader {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pr, pw := io.Pipe()
+	r := &PlaylistReader{client: client, pr: pr, cancel: cancel}
+	go func() {
+		pw.CloseWithError(r.follow(ctx, playlistURL, pw))
+	}()
+	return r
+}
+
+func (r *PlaylistReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+// Close stops following the playlist. Pending reads return io.ErrClosedPipe.
+func (r *PlaylistReader) Close() error {
+	r.once.Do(func() {
+		r.cancel()
+		r.pr.Close()
+	})
+	return nil
+}
+
+// mediaPlaylist is the part of a media playlist a PlaylistReader needs.
+type mediaPlaylist struct {
+	targetDuration time.Duration
+	mediaSequence  int
+	segments       []*url.URL
+	ended          bool
+}
+
+// follow writes the segments of the playlist at playlistURL to w. It
+// returns nil at the end of a finished playlist.
+func (r *PlaylistReader) follow(ctx context.Context, playlistURL string, w io.Writer) error {
+	playlistURL, err := r.resolveVariant(ctx, playlistURL)
+	if err != nil {
+		return err
+	}
+
+	nextSeq := -1
+	lastProgress := time.Now()
+	for {
+		data, base, err := r.get(ctx, playlistURL)
+		if err != nil {
+			return err
+		}
+		playlist, _, err := parsePlaylist(base, data)
+		if err != nil {
+			return err
+		}
+		if playlist == nil {
+			return fmt.Errorf("hls: %s is a master playlist, expected media", playlistURL)
+		}
+
+		if nextSeq < 0 {
+			nextSeq = playlist.mediaSequence
+			if !playlist.ended && len(playlist.segments) > PullLiveEdge {
+				nextSeq += len(playlist.segments) - PullLiveEdge
+			}
+		}
+		if nextSeq < playlist.mediaSequence {
+			// We fell behind the sliding window; resume at its start.
+			nextSeq = playlist.mediaSequence
+		}
+
+		wrote := false
+		for i, segment := range playlist.segments {
+			if playlist.mediaSequence+i < nextSeq {
+				continue
+			}
+			if err := r.copySegment(ctx, segment, w); err != nil {
+				return err
+			}
+			nextSeq = playlist.mediaSequence + i + 1
+			wrote = true
+		}
+		if playlist.ended {
+			return nil
+		}
+
+		// Reload after a target duration when the playlist moved, half of
+		// it when it did not (RFC 8216, 6.3.4).
+		wait := playlist.targetDuration
+		if wrote {
+			lastProgress = time.Now()
+		} else {
+			wait /= 2
+			if time.Since(lastProgress) > 3*playlist.targetDuration {
+				return ErrPlaylistStalled
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// resolveVariant returns the media playlist to follow for playlistURL,
+// which may be a master playlist.
+func (r *PlaylistReader) resolveVariant(ctx context.Context, playlistURL string) (string, error) {
+	data, base, err := r.get(ctx, playlistURL)
+	if err != nil {
+		return "", err
+	}
+	playlist, variant, err := parsePlaylist(base, data)
+	if err != nil {
+		return "", err
+	}
+	if playlist != nil {
+		return playlistURL, nil
+	}
+	return variant.String(), nil
+}
+
+func (r *PlaylistReader) get(ctx context.Context, rawURL string) ([]byte, *url.URL, error) {
+	body, base, err := r.open(ctx, rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, maxPlaylistSize))
+	return data, base, err
+}
+
+func (r *PlaylistReader) copySegment(ctx context.Context, segment *url.URL, w io.Writer) error {
+	body, _, err := r.open(ctx, segment.String())
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// open requests rawURL and returns the body with the URL it was served
+// from, after redirects, to resolve relative URIs against.
+func (r *PlaylistReader) open(ctx context.Context, rawURL string) (io.ReadCloser, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("hls: GET %s: %s", rawURL, resp.Status)
+	}
+	return resp.Body, resp.Request.URL, nil
+}
+
+// parsePlaylist parses a media playlist, or returns the highest-bandwidth
+// variant of a master playlist.
+func parsePlaylist(base *url.URL, data []byte) (*mediaPlaylist, *url.URL, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "#EXTM3U" {
+		return nil, nil, ErrNotPlaylist
+	}
+
+	media := &mediaPlaylist{targetDuration: 2 * time.Second}
+	var variant *url.URL
+	bestBandwidth := -1
+	isMaster := false
+	pendingBandwidth := -1 // set by EXT-X-STREAM-INF for the URI line that follows
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		tag, value, _ := strings.Cut(line, ":")
+		switch {
+		case line == "":
+		case tag == "#EXT-X-TARGETDURATION":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				media.targetDuration = time.Duration(n) * time.Second
+			}
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			if n, err := strconv.Atoi(value); err == nil {
+				media.mediaSequence = n
+			}
+		case tag == "#EXT-X-ENDLIST":
+			media.ended = true
+		case tag == "#EXT-X-MAP":
+			return nil, nil, ErrUnsupportedSource
+		case tag == "#EXT-X-KEY":
+			if attribute(value, "METHOD") != "NONE" {
+				return nil, nil, ErrUnsupportedSource
+			}
+		case tag == "#EXT-X-STREAM-INF":
+			isMaster = true
+			pendingBandwidth, _ = strconv.Atoi(attribute(value, "BANDWIDTH"))
+		case strings.HasPrefix(line, "#"):
+		default:
+			uri, err := base.Parse(line)
+			if err != nil {
+				return nil, nil, fmt.Errorf("hls: bad URI %q: %w", line, err)
+			}
+			if isMaster {
+				if pendingBandwidth > bestBandwidth {
+					variant, bestBandwidth = uri, pendingBandwidth
+				}
+				pendingBandwidth = -1
+				continue
+			}
+			media.segments = append(media.segments, uri)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if isMaster {
+		if variant == nil {
+			return nil, nil, errMasterWithoutMedia
+		}
+		return nil, variant, nil
+	}
+	return media, nil, nil
+}
+
+// attribute returns the value of name in an attribute list such as
+// `BANDWIDTH=800000,CODECS="avc1.64001f,mp4a.40.2"`.
+func attribute(list, name string) string {
+	for list != "" {
+		var key, value string
+		key, list, _ = strings.Cut(list, "=")
+		if strings.HasPrefix(list, `"`) {
+			end := strings.Index(list[1:], `"`)
+			if end < 0 {
+				return ""
+			}
+			value, list = list[1:end+1], list[end+2:]
+		} else {
+			value, list, _ = strings.Cut(list, ",")
+		}
+		list = strings.TrimPrefix(list, ",")
+		if strings.TrimSpace(key) == name {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/format/ts"
+)
+
+// writeVOD segments dur of synthetic media into dir/hi and adds a master
+// playlist with a lower, missing variant next to it.
+func writeVOD(t *testing.T, dir string, dur time.Duration) {
+	t.Helper()
+	s := NewSegmenter(filepath.Join(dir, "hi"), 2*time.Second, 100)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, dur)
+	if err := s.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=500000,CODECS=\"avc1.64001e,mp4a.40.2\"\nlo/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS=\"avc1.64001e,mp4a.40.2\"\nhi/index.m3u8\n"
+	if err := os.WriteFile(filepath.Join(dir, "master.m3u8"), []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlaylistReaderReadsVOD(t *testing.T) {
+	dir := t.TempDir()
+	writeVOD(t, dir, 6*time.Second)
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	r := NewPlaylistReader(srv.Client(), srv.URL+"/master.m3u8")
+	defer r.Close()
+	demuxer := ts.NewDemuxer(r)
+	streams, err := demuxer.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want video and audio", len(streams))
+	}
+
+	keyframes := 0
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkt.IsKeyFrame && streams[pkt.Idx].Type().IsVideo() {
+			keyframes++
+		}
+	}
+	// One keyframe per second, across all three segments.
+	if keyframes != 6 {
+		t.Errorf("read %d keyframes, want 6", keyframes)
+	}
+}
+
+func TestPlaylistReaderFollowsLiveEdge(t *testing.T) {
+	dir := t.TempDir()
+	writeVOD(t, dir, 10*time.Second)
+	segments, err := filepath.Glob(filepath.Join(dir, "hi", "*.ts"))
+	if err != nil || len(segments) != 5 {
+		t.Fatalf("expected 5 segments, got %v (%v)", segments, err)
+	}
+
+	var lock sync.Mutex
+	var requested []string
+	files := http.FileServer(http.Dir(filepath.Join(dir, "hi")))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live.m3u8" {
+			// A live window of the five segments that never advances.
+			playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:40\n"
+			for _, segment := range segments {
+				playlist += "#EXTINF:2.000,\n" + filepath.Base(segment) + "\n"
+			}
+			fmt.Fprint(w, playlist)
+			return
+		}
+		lock.Lock()
+		requested = append(requested, r.URL.Path)
+		lock.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	r := NewPlaylistReader(srv.Client(), srv.URL+"/live.m3u8")
+	_, err = io.Copy(io.Discard, r)
+	if err != ErrPlaylistStalled {
+		t.Errorf("a playlist that stops advancing should fail with ErrPlaylistStalled, got %v", err)
+	}
+	r.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(requested) != PullLiveEdge {
+		t.Fatalf("requested %v, want the last %d segments", requested, PullLiveEdge)
+	}
+	for i, path := range requested {
+		if want := "/" + filepath.Base(segments[len(segments)-PullLiveEdge+i]); path != want {
+			t.Errorf("request %d = %s, want %s", i, path, want)
+		}
+	}
+}
+
+func TestPlaylistReaderClose(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-TARGETDURATION:10\n")
+	}))
+	defer srv.Close()
+
+	r := NewPlaylistReader(srv.Client(), srv.URL+"/live.m3u8")
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 188))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("read after Close should fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock a pending read")
+	}
+}
+
+func TestParsePlaylistRejectsUnsupported(t *testing.T) {
+	base, _ := url.Parse("http://origin/live/index.m3u8")
+	for name, playlist := range map[string]string{
+		"fmp4":      "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2,\n0.m4s\n",
+		"encrypted": "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXTINF:2,\n0.ts\n",
+		"not hls":   "<html></html>",
+	} {
+		if _, _, err := parsePlaylist(base, []byte(playlist)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	media, _, err := parsePlaylist(base, []byte("#EXTM3U\n#EXT-X-KEY:METHOD=NONE\n#EXTINF:2,\n../seg/0.ts\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(media.segments) != 1 || media.segments[0].String() != "http://origin/seg/0.ts" {
+		t.Errorf("segments = %v", media.segments)
+	}
+	if got := attribute(`CODECS="avc1.64001e,mp4a.40.2",BANDWIDTH=800000`, "BANDWIDTH"); got != "800000" {
+		t.Errorf("BANDWIDTH = %q", got)
+	}
+	if got := attribute(`BANDWIDTH=1,CODECS="a,b"`, "CODECS"); !strings.Contains(got, "a,b") {
+		t.Errorf("CODECS = %q", got)
+	}
+}
@@ -0,0 +1,62 @@
+package hls
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	playlistURIAttr = regexp.MustCompile(`URI="([^"]*)"`)
+	manifestURLAttr = regexp.MustCompile(`(initialization|media)="([^"]*)"`)
+)
+
+// PlaylistWithQuery appends query (e.g. "token=...") to every URI of an
+// HLS playlist: segment and part lines as well as URI="..." attributes of
+// tags such as EXT-X-MAP, EXT-X-PART and EXT-X-PRELOAD-HINT. Players
+// resolve those URIs against the playlist URL but drop its query, so a
+// query the origin needs has to be repeated on each of them.
+func PlaylistWithQuery(playlist []byte, query string) []byte {
+	if query == "" {
+		return playlist
+	}
+	lines := strings.SplitAfter(string(playlist), "\n")
+	for i, line := range lines {
+		content := strings.TrimRight(line, "\r\n")
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "#") {
+			content = playlistURIAttr.ReplaceAllStringFunc(content, func(attr string) string {
+				uri := playlistURIAttr.FindStringSubmatch(attr)[1]
+				return `URI="` + withQuery(uri, query) + `"`
+			})
+		} else {
+			content = withQuery(content, query)
+		}
+		lines[i] = content + line[len(strings.TrimRight(line, "\r\n")):]
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// ManifestWithQuery appends query to the segment templates of a DASH
+// manifest.
+func ManifestWithQuery(manifest []byte, query string) []byte {
+	if query == "" {
+		return manifest
+	}
+	return manifestURLAttr.ReplaceAllFunc(manifest, func(attr []byte) []byte {
+		m := manifestURLAttr.FindSubmatch(attr)
+		sep := "?"
+		if strings.Contains(string(m[2]), "?") {
+			sep = "&amp;"
+		}
+		return []byte(string(m[1]) + `="` + string(m[2]) + sep + query + `"`)
+	})
+}
+
+func withQuery(uri, query string) string {
+	if strings.Contains(uri, "?") {
+		return uri + "&" + query
+	}
+	return uri + "?" + query
+}
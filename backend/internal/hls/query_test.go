@@ -0,0 +1,45 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlaylistWithQuery(t *testing.T) {
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-MAP:URI=\"init_video.mp4\"\n" +
+		"#EXTINF:2.000,\n" +
+		"seg_0.ts\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"seg_1.0.ts\",INDEPENDENT=YES\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg_1.1.ts?x=1\"\n" +
+		"\n"
+	got := string(PlaylistWithQuery([]byte(playlist), "token=abc"))
+	want := "#EXTM3U\n" +
+		"#EXT-X-MAP:URI=\"init_video.mp4?token=abc\"\n" +
+		"#EXTINF:2.000,\n" +
+		"seg_0.ts?token=abc\n" +
+		"#EXT-X-PART:DURATION=0.500,URI=\"seg_1.0.ts?token=abc\",INDEPENDENT=YES\n" +
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"seg_1.1.ts?x=1&token=abc\"\n" +
+		"\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if got := PlaylistWithQuery([]byte(playlist), ""); string(got) != playlist {
+		t.Error("an empty query must leave the playlist untouched")
+	}
+}
+
+func TestManifestWithQuery(t *testing.T) {
+	mpd := `<SegmentTemplate timescale="90000" initialization="init_$RepresentationID$.mp4" media="$RepresentationID$_$Number$.m4s" startNumber="0">`
+	got := string(ManifestWithQuery([]byte(mpd), "token=abc"))
+	for _, want := range []string{
+		`initialization="init_$RepresentationID$.mp4?token=abc"`,
+		`media="$RepresentationID$_$Number$.m4s?token=abc"`,
+		`timescale="90000"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("manifest missing %q: %s", want, got)
+		}
+	}
+}
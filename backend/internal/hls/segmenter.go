@@ -0,0 +1,427 @@
+// Package hls packages live packets into HLS in-process, without ffmpeg.
+package hls
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// Segment is a finished media segment listed in the playlist.
+type Segment struct {
+	Sequence int
+	Name     string
+	Duration time.Duration
+	Parts    []Part // LL-HLS partial segments, if enabled
+	Key      *Key   // AES-128 key the segment is encrypted with, if any
+}
+
+// Part is an LL-HLS partial segment: a standalone file holding a slice of
+// its parent segment.
+type Part struct {
+	Name        string
+	Duration    time.Duration
+	Independent bool // starts with a keyframe
+}
+
+// Segmenter is an av.Muxer that cuts a packet stream into MPEG-TS segments
+// on video keyframes and maintains a rolling media playlist (index.m3u8)
+// next to them. Feed it from a pubsub.QueueCursor with avutil.CopyFile.
+type Segmenter struct {
+	// Dir receives the segments and index.m3u8.
+	Dir string
+	// TargetDuration is the minimum segment length; segments are only cut
+	// on keyframes, so they may run longer.
+	TargetDuration time.Duration
+	// PlaylistSize is the number of segments listed in the playlist, or 0
+	// to list every segment.
+	PlaylistSize int
+	// PlaylistType is written as EXT-X-PLAYLIST-TYPE when set, e.g.
+	// "EVENT" for a playlist that only ever grows.
+	PlaylistType string
+	// RetainSegments is how many segments that fell out of the playlist
+	// stay on disk for players still downloading them.
+	RetainSegments int
+	// PartTarget enables Low-Latency HLS: segments are also published as
+	// partial segments of about this length. Zero disables it.
+	PartTarget time.Duration
+	// Keys, when set, enables AES-128 segment encryption. It cannot be
+	// combined with PartTarget.
+	Keys KeySource
+
+	lock     sync.Mutex
+	streams  []av.CodecData
+	videoIdx int
+	muxer    *ts.Muxer
+
+	file     *os.File
+	bufw     *bufio.Writer
+	enc      *cbcWriter // encrypts into bufw, if the segment has a key
+	key      *Key
+	open     bool
+	seq      int
+	segStart time.Duration
+	lastTime time.Duration
+
+	parts       []Part // finished parts of the open segment
+	partBuf     bytes.Buffer
+	partStart   time.Duration
+	independent bool
+
+	segments []Segment // listed in the playlist, oldest first
+	expired  []Segment // dropped from the playlist, still on disk
+	playlist []byte
+	ended    bool
+	updated  chan struct{} // closed and replaced whenever the playlist changes
+}
+
+// NewSegmenter creates a segmenter writing into dir.
+func NewSegmenter(dir string, targetDuration time.Duration, playlistSize int) *Segmenter {
+	return &Segmenter{
+		Dir:            dir,
+		TargetDuration: targetDuration,
+		PlaylistSize:   playlistSize,
+		RetainSegments: 2,
+		updated:        make(chan struct{}),
+	}
+}
+
+func (s *Segmenter) WriteHeader(streams []av.CodecData) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, codec := range streams {
+		if codec.Type() != av.H264 && codec.Type() != av.AAC {
+			return fmt.Errorf("hls: codec %s cannot be packaged without transcoding", codec.Type())
+		}
+	}
+	if s.Keys != nil && s.PartTarget > 0 {
+		return fmt.Errorf("hls: encryption cannot be combined with partial segments")
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+
+	s.streams = streams
+	s.videoIdx = -1
+	for i, codec := range streams {
+		if codec.Type().IsVideo() {
+			s.videoIdx = i
+		}
+	}
+	// The header's PAT/PMT is discarded; openSegment repeats them at the
+	// start of every segment.
+	s.muxer = ts.NewMuxer(io.Discard)
+	return s.muxer.WriteHeader(streams)
+}
+
+func (s *Segmenter) WritePacket(pkt av.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	isKey := s.videoIdx == -1 || (int(pkt.Idx) == s.videoIdx && pkt.IsKeyFrame)
+
+	if !s.open {
+		// Every segment must start with a keyframe to be decodable.
+		if !isKey {
+			return nil
+		}
+		if err := s.openSegment(pkt.Time); err != nil {
+			return err
+		}
+	} else if isKey && pkt.Time-s.segStart >= s.TargetDuration {
+		if err := s.closeSegment(pkt.Time); err != nil {
+			return err
+		}
+		if err := s.openSegment(pkt.Time); err != nil {
+			return err
+		}
+	} else if s.partDue(pkt) {
+		if err := s.closePart(pkt.Time); err != nil {
+			return err
+		}
+		s.openPart(pkt.Time, isKey)
+		if err := s.writePlaylist(); err != nil {
+			return err
+		}
+	}
+
+	if pkt.Time > s.lastTime {
+		s.lastTime = pkt.Time
+	}
+	return s.muxer.WritePacket(pkt)
+}
+
+// WriteTrailer finishes the last segment and ends the playlist.
+func (s *Segmenter) WriteTrailer() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.open {
+		// The last packet's own duration is unknown; approximate it with
+		// one video frame at 30fps.
+		if err := s.closeSegment(s.lastTime + time.Second/30); err != nil {
+			return err
+		}
+	}
+	s.ended = true
+	return s.writePlaylist()
+}
+
+// Segments returns the segments currently listed in the playlist.
+func (s *Segmenter) Segments() []Segment {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Segment(nil), s.segments...)
+}
+
+// Playlist returns the current media playlist.
+func (s *Segmenter) Playlist() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.playlist
+}
+
+func (s *Segmenter) segmentName(seq int) string {
+	return fmt.Sprintf("seg_%d.ts", seq)
+}
+
+func (s *Segmenter) partName(seq, part int) string {
+	return fmt.Sprintf("seg_%d.%d.ts", seq, part)
+}
+
+func (s *Segmenter) openSegment(start time.Duration) error {
+	s.key, s.enc = nil, nil
+	if s.Keys != nil {
+		key, err := s.Keys(s.seq)
+		if err != nil {
+			return err
+		}
+		s.key = key
+	}
+
+	f, err := os.Create(filepath.Join(s.Dir, s.segmentName(s.seq)))
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.bufw = bufio.NewWriterSize(f, 64*1024)
+	s.segStart = start
+	s.open = true
+
+	var w io.Writer = s.bufw
+	if s.key != nil {
+		if s.enc, err = newCBCWriter(s.bufw, s.key, s.seq); err != nil {
+			f.Close()
+			return err
+		}
+		w = s.enc
+	}
+
+	if s.PartTarget > 0 {
+		// Packets go to the segment and the current part at once.
+		s.muxer.SetWriter(io.MultiWriter(w, &s.partBuf))
+		s.parts = nil
+		s.openPart(start, true)
+	} else {
+		s.muxer.SetWriter(w)
+	}
+
+	// Each segment carries its own PAT/PMT so it can be decoded on its own.
+	return s.muxer.WritePATPMT()
+}
+
+func (s *Segmenter) closeSegment(end time.Duration) error {
+	if s.PartTarget > 0 {
+		if err := s.closePart(end); err != nil {
+			return err
+		}
+	}
+
+	s.open = false
+	if s.enc != nil {
+		if err := s.enc.Close(); err != nil {
+			s.file.Close()
+			return err
+		}
+	}
+	if err := s.bufw.Flush(); err != nil {
+		s.file.Close()
+		return err
+	}
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	s.segments = append(s.segments, Segment{
+		Sequence: s.seq,
+		Name:     s.segmentName(s.seq),
+		Duration: end - s.segStart,
+		Parts:    s.parts,
+		Key:      s.key,
+	})
+	s.seq++
+	s.parts = nil
+
+	for s.PlaylistSize > 0 && len(s.segments) > s.PlaylistSize {
+		s.expired = append(s.expired, s.segments[0])
+		s.segments = s.segments[1:]
+	}
+	for len(s.expired) > s.RetainSegments {
+		old := s.expired[0]
+		os.Remove(filepath.Join(s.Dir, old.Name))
+		for _, part := range old.Parts {
+			os.Remove(filepath.Join(s.Dir, part.Name))
+		}
+		s.expired = s.expired[1:]
+	}
+	return s.writePlaylist()
+}
+
+// partDue reports whether pkt starts a new part of the open segment. Parts
+// are only cut before video frames so audio stays with its video.
+func (s *Segmenter) partDue(pkt av.Packet) bool {
+	if s.PartTarget <= 0 {
+		return false
+	}
+	if s.videoIdx != -1 && int(pkt.Idx) != s.videoIdx {
+		return false
+	}
+	return pkt.Time-s.partStart >= s.PartTarget
+}
+
+func (s *Segmenter) openPart(start time.Duration, independent bool) {
+	s.partBuf.Reset()
+	s.partStart = start
+	s.independent = independent
+}
+
+// closePart publishes the buffered part as its own file.
+func (s *Segmenter) closePart(end time.Duration) error {
+	name := s.partName(s.seq, len(s.parts))
+	if err := writeFileAtomic(filepath.Join(s.Dir, name), s.partBuf.Bytes()); err != nil {
+		return err
+	}
+	s.parts = append(s.parts, Part{
+		Name:        name,
+		Duration:    end - s.partStart,
+		Independent: s.independent,
+	})
+	s.partBuf.Reset()
+	return nil
+}
+
+func (s *Segmenter) writePlaylist() error {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if s.PartTarget > 0 {
+		b.WriteString("#EXT-X-VERSION:6\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", targetDuration(s.TargetDuration, s.segments))
+	if s.PlaylistType != "" {
+		fmt.Fprintf(&b, "#EXT-X-PLAYLIST-TYPE:%s\n", s.PlaylistType)
+	}
+	if s.PartTarget > 0 {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*s.PartTarget.Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.PartTarget.Seconds())
+	}
+	mediaSeq := s.seq
+	if len(s.segments) > 0 {
+		mediaSeq = s.segments[0].Sequence
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSeq)
+
+	// Parts are only listed close to the live edge (three target durations,
+	// as the LL-HLS spec requires); older segments are listed whole.
+	partsFrom := len(s.segments)
+	if s.PartTarget > 0 {
+		var edge time.Duration
+		for _, part := range s.parts {
+			edge += part.Duration
+		}
+		for partsFrom > 0 && edge < 3*s.TargetDuration {
+			partsFrom--
+			edge += s.segments[partsFrom].Duration
+		}
+	}
+
+	var key *Key
+	for i, seg := range s.segments {
+		if seg.Key != key {
+			writeKey(&b, seg.Key)
+			key = seg.Key
+		}
+		if i >= partsFrom {
+			writeParts(&b, seg.Parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration.Seconds(), seg.Name)
+	}
+	if s.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	} else if s.PartTarget > 0 && s.open {
+		writeParts(&b, s.parts)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", s.partName(s.seq, len(s.parts)))
+	}
+
+	s.playlist = []byte(b.String())
+	close(s.updated)
+	s.updated = make(chan struct{})
+	return writeFileAtomic(filepath.Join(s.Dir, "index.m3u8"), s.playlist)
+}
+
+func writeParts(b *strings.Builder, parts []Part) {
+	for _, part := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration.Seconds(), part.Name)
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// writeKey starts a run of segments encrypted with key (nil: unencrypted).
+// Without an IV attribute players use the media sequence number, which is
+// what the segmenter encrypts with.
+func writeKey(b *strings.Builder, key *Key) {
+	if key == nil {
+		b.WriteString("#EXT-X-KEY:METHOD=NONE\n")
+		return
+	}
+	fmt.Fprintf(b, "#EXT-X-KEY:METHOD=AES-128,URI=\"%s\"\n", key.URI)
+}
+
+// targetDuration is EXT-X-TARGETDURATION: no listed segment may exceed it
+// once rounded to the nearest second.
+func targetDuration(target time.Duration, segments []Segment) int {
+	max := int(math.Ceil(target.Seconds()))
+	for _, seg := range segments {
+		if d := int(math.Round(seg.Duration.Seconds())); d > max {
+			max = d
+		}
+	}
+	if max < 1 {
+		max = 1
+	}
+	return max
+}
+
+// writeFileAtomic replaces path so players never read a partial playlist.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,180 @@
+package hls
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// syntheticStreams returns 640x360 H.264 and 44.1kHz stereo AAC codec data.
+func syntheticStreams(t *testing.T) []av.CodecData {
+	t.Helper()
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c0f162d96")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRate:      44100,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+		ChannelLayout:   av.CH_STEREO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// feed writes dur worth of 30fps video (keyframe every second) interleaved
+// with AAC frames.
+func feed(t *testing.T, s av.Muxer, dur time.Duration) {
+	t.Helper()
+	aacFrame := time.Duration(1024) * time.Second / 44100
+	nextAudio := time.Duration(0)
+
+	for i := 0; time.Duration(i)*time.Second/30 < dur; i++ {
+		now := time.Duration(i) * time.Second / 30
+		for nextAudio <= now {
+			if err := s.WritePacket(av.Packet{Idx: 1, Time: nextAudio, Data: make([]byte, 200)}); err != nil {
+				t.Fatal(err)
+			}
+			nextAudio += aacFrame
+		}
+		if err := s.WritePacket(videoPacket(now, i%30 == 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func videoPacket(t time.Duration, keyframe bool) av.Packet {
+	return av.Packet{Idx: 0, Time: t, IsKeyFrame: keyframe, Data: []byte{0, 0, 0, 4, 0x65, 1, 2, 3}}
+}
+
+func TestSegmenterRollingPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmenter(dir, 2*time.Second, 3)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, 10*time.Second)
+
+	segments := s.Segments()
+	if len(segments) != 3 {
+		t.Fatalf("playlist lists %d segments, want 3", len(segments))
+	}
+	for _, seg := range segments {
+		if seg.Duration != 2*time.Second {
+			t.Errorf("%s lasts %s, want 2s (cut on keyframes)", seg.Name, seg.Duration)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, seg.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) == 0 || len(data)%188 != 0 || data[0] != 0x47 {
+			t.Errorf("%s is not a valid MPEG-TS file (%d bytes)", seg.Name, len(data))
+		}
+	}
+
+	playlist, err := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(playlist)
+	for _, want := range []string{"#EXT-X-TARGETDURATION:2", "#EXT-X-MEDIA-SEQUENCE:1", "#EXTINF:2.000,\nseg_3.ts"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("playlist missing %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "#EXT-X-ENDLIST") {
+		t.Error("live playlist must not be ended")
+	}
+
+	// seg_0 fell out of the playlist but is still retained for slow players.
+	if _, err := os.Stat(filepath.Join(dir, "seg_0.ts")); err != nil {
+		t.Errorf("seg_0.ts should still be retained: %v", err)
+	}
+}
+
+func TestSegmenterDeletesExpiredSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmenter(dir, time.Second, 2)
+	s.RetainSegments = 0
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, 6*time.Second)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ts"))
+	// Two listed segments plus the one still being written.
+	if len(files) != 3 {
+		t.Errorf("found %d segment files, want 3: %v", len(files), files)
+	}
+}
+
+func TestSegmenterEventPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmenter(dir, time.Second, 0)
+	s.PlaylistType = "EVENT"
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+	feed(t, s, 6*time.Second)
+
+	if n := len(s.Segments()); n != 5 {
+		t.Errorf("playlist lists %d segments, want all 5", n)
+	}
+	text := string(s.Playlist())
+	for _, want := range []string{"#EXT-X-PLAYLIST-TYPE:EVENT", "#EXT-X-MEDIA-SEQUENCE:0", "seg_0.ts"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("playlist missing %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestSegmenterWaitsForKeyframeAndEndsPlaylist(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSegmenter(dir, 2*time.Second, 6)
+	if err := s.WriteHeader(syntheticStreams(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A delta frame before any keyframe cannot start a segment.
+	if err := s.WritePacket(av.Packet{Idx: 0, Data: []byte{0, 0, 0, 1, 0x41}}); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.ts")); len(files) != 0 {
+		t.Fatalf("segment opened without a keyframe: %v", files)
+	}
+
+	feed(t, s, 3*time.Second)
+	if err := s.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	playlist, _ := os.ReadFile(filepath.Join(dir, "index.m3u8"))
+	if !strings.HasSuffix(string(playlist), "#EXT-X-ENDLIST\n") {
+		t.Errorf("finished playlist must end with EXT-X-ENDLIST:\n%s", playlist)
+	}
+	if n := len(s.Segments()); n != 2 {
+		t.Errorf("got %d segments, want 2", n)
+	}
+}
+
+func TestSegmenterRejectsUnsupportedCodecs(t *testing.T) {
+	s := NewSegmenter(t.TempDir(), 2*time.Second, 6)
+	if err := s.WriteHeader([]av.CodecData{fakeCodec{}}); err == nil {
+		t.Error("expected an error for a non H.264/AAC stream")
+	}
+}
+
+type fakeCodec struct{}
+
+func (fakeCodec) Type() av.CodecType { return av.SPEEX }
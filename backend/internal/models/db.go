@@ -1,6 +1,8 @@
 package models
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -17,16 +19,63 @@ func ConnectDatabase() {
 		dsn = "host=localhost user=postgres password=postgres dbname=streamcast port=5432 sslmode=disable"
 	}
 
-	database, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	database, err := gorm.Open(postgres.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
-	err = database.AutoMigrate(&User{}, &Stream{}, &Event{}, &HeroBanner{}, &Post{}, &Archive{}, &Ad{})
+	// Playback IDs are unique from now on; older ones were derived from the
+	// stream key and may collide.
+	if err := dedupePlaybackIDs(database); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
+	err = database.AutoMigrate(&User{}, &Stream{}, &Event{}, &HeroBanner{}, &Post{}, &Archive{}, &Ad{}, &TranscodeProfile{}, &HLSKey{}, &RestreamTarget{}, &Clip{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	seedTranscodeProfiles(database)
+
 	DB = database
 	fmt.Println("Database connected successfully")
 }
+
+// NewPlaybackID returns a random public playback ID, unrelated to the
+// stream key.
+func NewPlaybackID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate playback ID: %w", err)
+	}
+	return "hls-" + hex.EncodeToString(b), nil
+}
+
+// dedupePlaybackIDs gives every stream but the oldest of those sharing a
+// playback ID a new one, so the unique index on playback_id can be built.
+func dedupePlaybackIDs(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&Stream{}) || db.Migrator().HasIndex(&Stream{}, "PlaybackID") {
+		return nil
+	}
+	var streams []Stream
+	err := db.Unscoped().Select("id", "playback_id").Order("id").Find(&streams).Error
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(streams))
+	for _, stream := range streams {
+		if !seen[stream.PlaybackID] {
+			seen[stream.PlaybackID] = true
+			continue
+		}
+		id, err := NewPlaybackID()
+		if err != nil {
+			return err
+		}
+		if err := db.Unscoped().Model(&Stream{}).Where("id = ?", stream.ID).Update("playback_id", id).Error; err != nil {
+			return err
+		}
+		log.Printf("Stream %d shared playback ID %q, now %q", stream.ID, stream.PlaybackID, id)
+	}
+	return nil
+}
@@ -22,7 +22,7 @@ type Stream struct {
 	Title            string         `json:"title"`
 	Description      string         `json:"description"`
 	StreamKey        string         `gorm:"unique;not null" json:"stream_key"`
-	PlaybackID       string         `json:"playback_id"`
+	PlaybackID       string         `gorm:"uniqueIndex" json:"playback_id"`
 	SportCategory    string         `json:"sport_category"`
 	ThumbnailURL     string         `json:"thumbnail_url"`
 	BannerURL        string         `json:"banner_url"`         // New: Stream specific banner
@@ -33,11 +33,73 @@ type Stream struct {
 	IsLive           bool           `json:"is_live"`
 	IngestStatus     string         `json:"ingest_status"`
 	ViewerCount      int            `json:"viewer_count"`
+	TranscodeProfile string         `json:"transcode_profile"` // TranscodeProfile.Name, empty = default
+	LowLatency       bool           `json:"low_latency"`       // Also publish LL-HLS under /hls/<playback_id>/ll/
+	DASH             bool           `json:"dash"`              // Also publish DASH + fMP4 HLS under /hls/<playback_id>/cmaf/
+	PlaybackPolicy   string         `json:"playback_policy"`   // "public" (default) or "signed": playback requires a token
+	Encrypted        bool           `json:"encrypted"`         // AES-128 encrypt HLS segments, keys only released to playback sessions
+	KeyRotation      int            `json:"key_rotation"`      // segments per content key, 0 = default
+	DVRWindow        int            `json:"dvr_window"`        // seconds of the broadcast viewers can rewind, 0 = live edge only
+	DVRMode          string         `json:"dvr_mode"`          // "sliding" (default): the last DVRWindow; "event": everything since the publish started, DVRWindow unused
+	SourceType       string         `json:"source_type"`       // "push" (default): encoder publishes over RTMP; "pull": we fetch SourceURL
+	SourceURL        string         `json:"source_url"`        // rtmp://, HTTP-FLV or HLS (.m3u8) URL of a pull source
+	PullStartAt      *time.Time     `json:"pull_start_at"`     // scheduled start of a pull, nil = on demand only
+	PullStopAt       *time.Time     `json:"pull_stop_at"`      // scheduled end of a pull, nil = until the source ends
 	CreatedAt        time.Time      `json:"created_at"`
 	UpdatedAt        time.Time      `json:"updated_at"`
 	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// RestreamTarget is an external RTMP ingest a stream is relayed to while
+// it is live, e.g. a partner's platform.
+type RestreamTarget struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	StreamID  uint      `gorm:"index;not null" json:"stream_id"`
+	Name      string    `json:"name"`       // e.g. "Partner YouTube"
+	URL       string    `json:"url"`        // e.g. "rtmp://a.rtmp.youtube.com/live2"
+	StreamKey string    `json:"stream_key"` // appended to URL as the stream name
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HLSKey is an AES-128 content key of an encrypted stream. Players fetch
+// it from /hls/<playback_id>/keys/<id>.key.
+type HLSKey struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	StreamID  uint      `gorm:"index;not null" json:"stream_id"`
+	Key       []byte    `gorm:"not null" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TranscodeProfile describes how a stream is transcoded into HLS.
+type TranscodeProfile struct {
+	ID              uint        `gorm:"primaryKey" json:"id"`
+	Name            string      `gorm:"unique;not null" json:"name"` // e.g. "football-hd"
+	Description     string      `json:"description"`
+	VideoCodec      string      `json:"video_codec"` // "libx264", "copy" or "none" (audio only)
+	AudioCodec      string      `json:"audio_codec"` // "aac" or "copy"
+	Preset          string      `json:"preset"`      // x264 preset, e.g. "ultrafast"
+	Tune            string      `json:"tune"`        // x264 tune, e.g. "zerolatency"
+	FrameRate       int         `json:"frame_rate"`
+	GOPSize         int         `json:"gop_size"`         // frames between keyframes
+	SegmentDuration int         `json:"segment_duration"` // HLS segment length in seconds
+	PlaylistSize    int         `json:"playlist_size"`    // segments kept in the live playlist
+	Packager        string      `json:"packager"`         // "ffmpeg" (default) or "native" (copy profiles only)
+	Renditions      []Rendition `gorm:"serializer:json" json:"renditions"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// Rendition is one quality level of a TranscodeProfile's ABR ladder.
+type Rendition struct {
+	Name         string `json:"name"` // e.g. "720p", used as the HLS variant directory
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	VideoBitrate int    `json:"video_bitrate"` // kbps
+	AudioBitrate int    `json:"audio_bitrate"` // kbps
+}
+
 type Event struct {
 	ID          uint           `gorm:"primaryKey" json:"id"`
 	TitleAr     string         `json:"title_ar"`
@@ -77,13 +139,45 @@ type HeroBanner struct {
 }
 
 type Archive struct {
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	StreamID        uint           `gorm:"index" json:"stream_id"` // originating stream, 0 if unknown
+	Title           string         `json:"title"`
+	Status          string         `json:"status"` // post-processing: "processing", "ready" or "failed"
+	Error           string         `json:"error,omitempty"`
+	FilePath        string         `json:"file_path"`
+	Duration        string         `json:"duration"`
+	DurationSeconds float64        `json:"duration_seconds"` // probed from the recording
+	Width           int            `json:"width"`
+	Height          int            `json:"height"`
+	VideoCodec      string         `json:"video_codec"`
+	AudioCodec      string         `json:"audio_codec"`
+	Thumbnail       string         `json:"thumbnail"`
+	SpriteURL       string         `json:"sprite_url"` // WebVTT of thumbnail sprite cues for seek previews
+	HLSURL          string         `json:"hls_url"`    // VOD HLS packaging of the recording
+	FileSize        int64          `json:"file_size"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// Clip is a highlight cut from a live stream's retained HLS segments or
+// from one of its archive recordings, saved as its own MP4.
+type Clip struct {
 	ID        uint           `gorm:"primaryKey" json:"id"`
+	StreamID  uint           `gorm:"index;not null" json:"stream_id"`
+	ArchiveID *uint          `json:"archive_id"` // source recording, nil for clips of the live stream
 	Title     string         `json:"title"`
+	Status    string         `json:"status"` // "processing", "ready" or "failed"
+	Error     string         `json:"error,omitempty"`
+	Start     float64        `json:"start"`    // seconds into the source
+	End       float64        `json:"end"`      // seconds into the source
+	Accurate  bool           `json:"accurate"` // edges re-encoded at the exact offsets, else cut on keyframes
 	FilePath  string         `json:"file_path"`
 	Duration  string         `json:"duration"`
 	Thumbnail string         `json:"thumbnail"`
 	FileSize  int64          `json:"file_size"`
 	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// DefaultTranscodeProfile is used for streams without a TranscodeProfile.
+const DefaultTranscodeProfile = "football-hd"
+
+// BuiltinTranscodeProfiles returns the profiles every installation starts
+// with. Admins can edit them or add their own through the API.
+func BuiltinTranscodeProfiles() []TranscodeProfile {
+	return []TranscodeProfile{
+		{
+			Name:            "football-hd",
+			Description:     "Four-rung 1080p/720p/480p/240p ladder for live sports",
+			VideoCodec:      "libx264",
+			AudioCodec:      "aac",
+			Preset:          "ultrafast",
+			Tune:            "zerolatency",
+			FrameRate:       30,
+			GOPSize:         60,
+			SegmentDuration: 2,
+			PlaylistSize:    6,
+			Renditions: []Rendition{
+				{Name: "1080p", Width: 1920, Height: 1080, VideoBitrate: 3500, AudioBitrate: 192},
+				{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 2000, AudioBitrate: 128},
+				{Name: "480p", Width: 854, Height: 480, VideoBitrate: 1000, AudioBitrate: 96},
+				{Name: "240p", Width: 426, Height: 240, VideoBitrate: 400, AudioBitrate: 64},
+			},
+		},
+		{
+			Name:            "low-cpu",
+			Description:     "Two renditions at 25fps for small hosts",
+			VideoCodec:      "libx264",
+			AudioCodec:      "aac",
+			Preset:          "ultrafast",
+			Tune:            "zerolatency",
+			FrameRate:       25,
+			GOPSize:         100,
+			SegmentDuration: 4,
+			PlaylistSize:    5,
+			Renditions: []Rendition{
+				{Name: "720p", Width: 1280, Height: 720, VideoBitrate: 1500, AudioBitrate: 128},
+				{Name: "360p", Width: 640, Height: 360, VideoBitrate: 600, AudioBitrate: 64},
+			},
+		},
+		{
+			Name:            "audio-only",
+			Description:     "AAC audio only, for radio-style commentary",
+			VideoCodec:      "none",
+			AudioCodec:      "aac",
+			SegmentDuration: 4,
+			PlaylistSize:    6,
+			Renditions: []Rendition{
+				{Name: "audio", AudioBitrate: 128},
+			},
+		},
+		{
+			Name:            "passthrough",
+			Description:     "Repackage the incoming H.264/AAC into HLS without re-encoding",
+			VideoCodec:      "copy",
+			AudioCodec:      "copy",
+			Packager:        "native",
+			SegmentDuration: 2,
+			PlaylistSize:    6,
+			Renditions: []Rendition{
+				{Name: "source"},
+			},
+		},
+	}
+}
+
+// FindTranscodeProfile loads a profile by name, falling back to the
+// built-in definition when the database has none (or is not connected).
+// An empty name selects DefaultTranscodeProfile.
+func FindTranscodeProfile(name string) (*TranscodeProfile, bool) {
+	if name == "" {
+		name = DefaultTranscodeProfile
+	}
+	if DB != nil {
+		var profile TranscodeProfile
+		if err := DB.Where("name = ?", name).First(&profile).Error; err == nil {
+			return &profile, true
+		}
+	}
+	for _, profile := range BuiltinTranscodeProfiles() {
+		if profile.Name == name {
+			return &profile, true
+		}
+	}
+	return nil, false
+}
+
+// seedTranscodeProfiles creates missing built-in profiles without touching
+// ones an admin has already edited.
+func seedTranscodeProfiles(db *gorm.DB) {
+	for _, profile := range BuiltinTranscodeProfiles() {
+		profile := profile
+		if err := db.Where(TranscodeProfile{Name: profile.Name}).FirstOrCreate(&profile).Error; err != nil {
+			log.Printf("Failed to seed transcode profile %s: %v", profile.Name, err)
+		}
+	}
+}
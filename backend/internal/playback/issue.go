@@ -0,0 +1,68 @@
+package playback
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// IssuerKey lets services request playback tokens for their viewers by
+// sending it as "Authorization: Bearer <key>". Set PLAYBACK_ISSUER_KEY to
+// enable it.
+var IssuerKey = os.Getenv("PLAYBACK_ISSUER_KEY")
+
+// ViewerOrigins are the origins (scheme://host[:port]) of the pages whose
+// player may request tokens for the viewer watching it. Set
+// PLAYBACK_VIEWER_ORIGINS to a comma separated list; by default only pages
+// served from the API's own host may.
+var ViewerOrigins = originsFromEnv("PLAYBACK_VIEWER_ORIGINS")
+
+// IsIssuer reports whether r carries IssuerKey.
+func IsIssuer(r *http.Request) bool {
+	if IssuerKey == "" {
+		return false
+	}
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(key), []byte(IssuerKey)) == 1
+}
+
+// FromViewerPage reports whether r was sent by the player on one of
+// ViewerOrigins, going by its Origin header or, without one, its Referer.
+// Browsers set both themselves, so other sites cannot embed the player and
+// mint tokens for their visitors.
+func FromViewerPage(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		referer, err := url.Parse(r.Header.Get("Referer"))
+		if err != nil || referer.Host == "" {
+			return false
+		}
+		origin = referer.Scheme + "://" + referer.Host
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if len(ViewerOrigins) == 0 {
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	origin = strings.ToLower(u.Scheme + "://" + u.Host)
+	for _, allowed := range ViewerOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func originsFromEnv(name string) []string {
+	var origins []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(v), "/")); v != "" {
+			origins = append(origins, v)
+		}
+	}
+	return origins
+}
@@ -0,0 +1,86 @@
+package playback
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsIssuer(t *testing.T) {
+	saved := IssuerKey
+	defer func() { IssuerKey = saved }()
+
+	r := httptest.NewRequest("POST", "/api/streams/1/playback-token", nil)
+	IssuerKey = ""
+	r.Header.Set("Authorization", "Bearer ")
+	if IsIssuer(r) {
+		t.Error("empty key accepted with issuing by key disabled")
+	}
+
+	IssuerKey = "issuer key"
+	for header, want := range map[string]bool{
+		"":                  false,
+		"issuer key":        false,
+		"Bearer issuer":     false,
+		"Bearer issuer key": true,
+	} {
+		r.Header.Set("Authorization", header)
+		if got := IsIssuer(r); got != want {
+			t.Errorf("Authorization %q: IsIssuer = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestFromViewerPage(t *testing.T) {
+	saved := ViewerOrigins
+	defer func() { ViewerOrigins = saved }()
+
+	request := func(origin, referer string) bool {
+		r := httptest.NewRequest("POST", "http://sportevent.online/api/streams/1/playback-token", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if referer != "" {
+			r.Header.Set("Referer", referer)
+		}
+		return FromViewerPage(r)
+	}
+
+	ViewerOrigins = nil
+	for _, tc := range []struct {
+		origin, referer string
+		want            bool
+	}{
+		{"https://sportevent.online", "", true},
+		{"", "https://sportevent.online/live?id=1", true},
+		{"https://evil.example", "https://sportevent.online/live", false},
+		{"", "https://evil.example/sportevent.online", false},
+		{"null", "", false},
+		{"", "", false},
+	} {
+		if got := request(tc.origin, tc.referer); got != tc.want {
+			t.Errorf("same host: Origin %q, Referer %q: got %v, want %v", tc.origin, tc.referer, got, tc.want)
+		}
+	}
+
+	ViewerOrigins = originsFromEnv("TEST_UNSET_VIEWER_ORIGINS")
+	if len(ViewerOrigins) != 0 {
+		t.Fatalf("unset origins parsed as %v", ViewerOrigins)
+	}
+	t.Setenv("TEST_VIEWER_ORIGINS", "http://localhost:3000/, https://Player.Example")
+	ViewerOrigins = originsFromEnv("TEST_VIEWER_ORIGINS")
+	for _, tc := range []struct {
+		origin, referer string
+		want            bool
+	}{
+		{"http://localhost:3000", "", true},
+		{"https://player.example", "", true},
+		{"", "https://player.example/embed/1", true},
+		{"https://sportevent.online", "", false},
+		{"http://player.example", "", false},
+		{"https://localhost:3000", "", false},
+	} {
+		if got := request(tc.origin, tc.referer); got != tc.want {
+			t.Errorf("listed origins: Origin %q, Referer %q: got %v, want %v", tc.origin, tc.referer, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package playback
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"streamcast-backend/internal/models"
+	"strings"
+	"time"
+)
+
+// Playback policies of models.Stream.PlaybackPolicy.
+const (
+	PolicyPublic = "public" // anyone with the playback ID (the default)
+	PolicySigned = "signed" // requires a valid playback token
+)
+
+// ValidPolicy reports whether policy is a known playback policy. Empty
+// means public.
+func ValidPolicy(policy string) bool {
+	return policy == "" || policy == PolicyPublic || policy == PolicySigned
+}
+
+// Check decides whether a viewer presenting token from ip may play stream.
+func Check(stream *models.Stream, token, ip string) error {
+	if stream.PlaybackPolicy != PolicySigned {
+		return nil
+	}
+	return CheckSession(stream, token, ip)
+}
+
+// CheckSession requires a valid token for stream whatever its policy. It
+// guards content keys, which even public streams only release to viewers
+// with a playback session.
+func CheckSession(stream *models.Stream, token, ip string) error {
+	claims, err := Verify(Secret, token, time.Now())
+	if err != nil {
+		return err
+	}
+	if claims.StreamID != stream.ID {
+		return fmt.Errorf("%w: issued for another stream", ErrInvalidToken)
+	}
+	if claims.IP != "" && claims.IP != ip {
+		return fmt.Errorf("%w: issued for another address", ErrInvalidToken)
+	}
+	return nil
+}
+
+// TrustedProxies are the addresses allowed to tell the viewer's address in
+// X-Real-IP or X-Forwarded-For. Set PLAYBACK_TRUSTED_PROXIES to a comma
+// separated list of IPs and CIDRs; by default only loopback is trusted, as
+// nginx runs on the same host.
+var TrustedProxies = proxiesFromEnv("PLAYBACK_TRUSTED_PROXIES")
+
+// ClientIP returns the viewer's address. Requests relayed by a trusted
+// proxy carry it in X-Real-IP (nginx) or X-Forwarded-For; anyone else could
+// forge those headers, so their own address is used.
+func ClientIP(r *http.Request) string {
+	remote := HostIP(r.RemoteAddr)
+	if !trustedProxy(remote) {
+		return remote
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	// Each proxy appends the address it got the request from, so the
+	// viewer is the last hop that is not one of ours.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trustedProxy(hop) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, network := range TrustedProxies {
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func proxiesFromEnv(name string) []*net.IPNet {
+	value := os.Getenv(name)
+	if value == "" {
+		value = "127.0.0.0/8,::1/128"
+	}
+	var proxies []*net.IPNet
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Printf("Ignoring invalid %s entry %q", name, v)
+			continue
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// HostIP strips the port from a "host:port" address.
+func HostIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
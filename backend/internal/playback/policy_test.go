@@ -0,0 +1,70 @@
+package playback
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	saved := TrustedProxies
+	defer func() { TrustedProxies = saved }()
+	os.Setenv("TEST_TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1,bogus")
+	defer os.Unsetenv("TEST_TRUSTED_PROXIES")
+	TrustedProxies = proxiesFromEnv("TEST_TRUSTED_PROXIES")
+	if len(TrustedProxies) != 2 {
+		t.Fatalf("parsed %d trusted proxies, want 2", len(TrustedProxies))
+	}
+
+	for _, tc := range []struct {
+		name      string
+		remote    string
+		realIP    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "198.51.100.1:4000", "", nil, "198.51.100.1"},
+		{"direct with forged X-Real-IP", "198.51.100.1:4000", "203.0.113.9", nil, "198.51.100.1"},
+		{"direct with forged X-Forwarded-For", "198.51.100.1:4000", "", []string{"203.0.113.9"}, "198.51.100.1"},
+		{"proxy sets X-Real-IP", "10.1.2.3:4000", "198.51.100.1", nil, "198.51.100.1"},
+		{"proxy sets X-Forwarded-For", "10.1.2.3:4000", "", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"viewer prepends a forged hop", "10.1.2.3:4000", "", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.1.2.3:4000", "", []string{"203.0.113.9, 198.51.100.1, 192.0.2.1", "10.9.9.9"}, "198.51.100.1"},
+		{"only trusted hops", "10.1.2.3:4000", "", []string{"192.0.2.1"}, "192.0.2.1"},
+		{"proxy without headers", "10.1.2.3:4000", "", nil, "10.1.2.3"},
+		{"loopback is not trusted when not listed", "127.0.0.1:4000", "203.0.113.9", nil, "127.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		for _, v := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := ClientIP(r); got != tc.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestTrustedProxiesDefault(t *testing.T) {
+	os.Unsetenv("TEST_TRUSTED_PROXIES")
+	saved := TrustedProxies
+	defer func() { TrustedProxies = saved }()
+	TrustedProxies = proxiesFromEnv("TEST_TRUSTED_PROXIES")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Real-IP", "198.51.100.1")
+	for remote, want := range map[string]string{
+		"127.0.0.1:4000":    "198.51.100.1",
+		"[::1]:4000":        "198.51.100.1",
+		"203.0.113.9:4000":  "203.0.113.9",
+		"[2001:db8::1]:443": "2001:db8::1",
+	} {
+		r.RemoteAddr = remote
+		if got := ClientIP(r); got != want {
+			t.Errorf("from %s: ClientIP = %q, want %q", remote, got, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package playback issues and checks signed playback tokens.
+//
+// A token binds a viewer to one stream until an expiry time, optionally
+// from a single IP address. It is an HMAC-SHA256 signed payload:
+//
+//	base64url("<stream id>|<expiry unix>|<ip>") + "." + base64url(signature)
+package playback
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Secret signs playback tokens. Set PLAYBACK_TOKEN_SECRET so tokens survive
+// restarts and work across API instances.
+var Secret = secretFromEnv()
+
+// DefaultTTL is how long an issued token stays valid when the caller does
+// not ask for a specific lifetime; MaxTTL caps requested lifetimes.
+var (
+	DefaultTTL = 4 * time.Hour
+	MaxTTL     = 24 * time.Hour
+)
+
+var (
+	ErrMissingToken = errors.New("missing playback token")
+	ErrInvalidToken = errors.New("invalid playback token")
+	ErrExpiredToken = errors.New("playback token expired")
+)
+
+// Claims are the facts a token vouches for.
+type Claims struct {
+	StreamID uint
+	Expires  time.Time
+	IP       string // empty: any address
+}
+
+// Sign returns the token for claims.
+func Sign(secret []byte, claims Claims) string {
+	payload := fmt.Sprintf("%d|%d|%s", claims.StreamID, claims.Expires.Unix(), claims.IP)
+	return encode([]byte(payload)) + "." + encode(signature(secret, payload))
+}
+
+// Verify checks a token's signature and expiry and returns its claims.
+func Verify(secret []byte, token string, now time.Time) (Claims, error) {
+	if token == "" {
+		return Claims{}, ErrMissingToken
+	}
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Claims{}, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil || !hmac.Equal(sig, signature(secret, string(payload))) {
+		return Claims{}, ErrInvalidToken
+	}
+
+	fields := strings.SplitN(string(payload), "|", 3)
+	if len(fields) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	streamID, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	claims := Claims{StreamID: uint(streamID), Expires: time.Unix(expires, 0), IP: fields[2]}
+	if !now.Before(claims.Expires) {
+		return claims, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func signature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func secretFromEnv() []byte {
+	if secret := os.Getenv("PLAYBACK_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	// Tokens signed with a random secret stop working on restart.
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate playback token secret: %v", err)
+	}
+	log.Println("Warning: PLAYBACK_TOKEN_SECRET is not set, playback tokens will not survive a restart")
+	return secret
+}
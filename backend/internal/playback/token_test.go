@@ -0,0 +1,88 @@
+package playback
+
+import (
+	"errors"
+	"streamcast-backend/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSecret = []byte("test secret")
+
+func TestSignVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := Claims{StreamID: 42, Expires: now.Add(time.Hour), IP: "203.0.113.7"}
+	token := Sign(testSecret, claims)
+
+	got, err := Verify(testSecret, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.StreamID != 42 || !got.Expires.Equal(claims.Expires) || got.IP != claims.IP {
+		t.Errorf("claims = %+v, want %+v", got, claims)
+	}
+
+	if _, err := Verify(testSecret, token, now.Add(2*time.Hour)); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("expired token: err = %v", err)
+	}
+	if _, err := Verify([]byte("other secret"), token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("wrong secret: err = %v", err)
+	}
+	if _, err := Verify(testSecret, "", now); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("empty token: err = %v", err)
+	}
+
+	// Swapping in another payload must break the signature.
+	forged := Sign(testSecret, Claims{StreamID: 43, Expires: claims.Expires})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(token, ".")
+	if _, err := Verify(testSecret, payload+"."+sig, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("forged token: err = %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	saved := Secret
+	Secret = testSecret
+	defer func() { Secret = saved }()
+
+	stream := &models.Stream{ID: 7, PlaybackPolicy: PolicySigned}
+	expires := time.Now().Add(time.Hour)
+
+	if err := Check(&models.Stream{}, "", ""); err != nil {
+		t.Errorf("public streams need no token: %v", err)
+	}
+	if err := Check(stream, "", "198.51.100.1"); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("signed stream without token: err = %v", err)
+	}
+	if err := Check(stream, Sign(Secret, Claims{StreamID: 7, Expires: expires}), "198.51.100.1"); err != nil {
+		t.Errorf("valid token rejected: %v", err)
+	}
+	if err := Check(stream, Sign(Secret, Claims{StreamID: 8, Expires: expires}), "198.51.100.1"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token of another stream: err = %v", err)
+	}
+
+	bound := Sign(Secret, Claims{StreamID: 7, Expires: expires, IP: "198.51.100.1"})
+	if err := Check(stream, bound, "198.51.100.1"); err != nil {
+		t.Errorf("bound token from its address rejected: %v", err)
+	}
+	if err := Check(stream, bound, "198.51.100.2"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("bound token from another address: err = %v", err)
+	}
+}
+
+func TestCheckSession(t *testing.T) {
+	saved := Secret
+	Secret = testSecret
+	defer func() { Secret = saved }()
+
+	public := &models.Stream{ID: 7, Encrypted: true}
+	if err := CheckSession(public, "", "198.51.100.1"); !errors.Is(err, ErrMissingToken) {
+		t.Errorf("keys of public streams still need a session: err = %v", err)
+	}
+	token := Sign(Secret, Claims{StreamID: 7, Expires: time.Now().Add(time.Hour)})
+	if err := CheckSession(public, token, "198.51.100.1"); err != nil {
+		t.Errorf("valid session rejected: %v", err)
+	}
+}
@@ -0,0 +1,389 @@
+package rtmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"streamcast-backend/internal/models"
+	"strings"
+	"time"
+)
+
+// Archive post-processing. A finished recording is saved as processing and
+// handed to the job below, which probes its real duration, resolution and
+// codecs, moves its index to the front (faststart) so it plays while
+// downloading, and writes a thumbnail, a thumbnail sprite with its WebVTT
+// cues for seek previews, and a VOD HLS packaging of the recording. All of
+// them go to ArchiveDir/<recording name>/.
+const (
+	JobProcessing = "processing"
+	JobReady      = "ready"
+	JobFailed     = "failed"
+)
+
+// jobWorkers is how many post-processing jobs (archives and clips) run
+// ffmpeg at once.
+const jobWorkers = 2
+
+var jobSlots = make(chan struct{}, jobWorkers)
+
+// SpriteInterval is the time between thumbnail sprite tiles; longer
+// recordings space them further to stay within maxSpriteTiles.
+var SpriteInterval = 10 * time.Second
+
+// VODSegmentDuration is the segment length, in seconds, of archive VOD HLS.
+var VODSegmentDuration = 6
+
+const (
+	spriteColumns   = 10
+	maxSpriteTiles  = 100
+	spriteTileWidth = 160
+)
+
+// registerArchive saves a recording of stream that started at startedAt
+// and starts its post-processing. Empty recordings, from an ffmpeg that
+// never got going, are deleted instead.
+func registerArchive(stream *models.Stream, path string, startedAt time.Time) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	fileSize := fileInfo.Size()
+	if fileSize == 0 {
+		os.Remove(path)
+		return
+	}
+	log.Printf("Archive created: %s (%d bytes)", path, fileSize)
+
+	// Until the archive job probes it, the recording lasted until it was
+	// last written to.
+	approxDuration := fileInfo.ModTime().Sub(startedAt).Round(time.Second)
+	archiveEntry := &models.Archive{
+		StreamID:  stream.ID,
+		Title:     fmt.Sprintf("%s %s", stream.Title, startedAt.Format("2006-01-02 15:04")),
+		Status:    JobProcessing,
+		FilePath:  "/archive/" + filepath.Base(path), // Web path
+		Duration:  approxDuration.String(),
+		FileSize:  fileSize,
+		CreatedAt: time.Now(),
+	}
+
+	if models.DB != nil {
+		if result := models.DB.Create(archiveEntry); result.Error != nil {
+			log.Printf("Failed to save archive to DB: %v", result.Error)
+			return
+		}
+		log.Printf("Archive saved to DB with ID: %d", archiveEntry.ID)
+	}
+	go processArchive(archiveEntry, path)
+}
+
+// recoverArchives registers the recordings in ArchiveDir that have no
+// archive yet, left behind by a crash of the server itself, and resumes the
+// post-processing it interrupted. Deleted archives stay deleted. It must run
+// before anything records.
+func recoverArchives() {
+	// Half-written faststart copies are useless; their originals are intact.
+	if temps, err := filepath.Glob(filepath.Join(ArchiveDir, ".*.faststart")); err == nil {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(ArchiveDir, "archive_*.mp4"))
+	if err != nil || len(files) == 0 || models.DB == nil {
+		return
+	}
+
+	var archives []models.Archive
+	if err := models.DB.Unscoped().Find(&archives).Error; err != nil {
+		log.Printf("Archive recovery: %v", err)
+		return
+	}
+	known := make(map[string]*models.Archive, len(archives))
+	for i := range archives {
+		known[filepath.Base(archives[i].FilePath)] = &archives[i]
+	}
+
+	for _, file := range files {
+		if archive, ok := known[filepath.Base(file)]; ok {
+			if !archive.DeletedAt.Valid && archive.Status == JobProcessing {
+				log.Printf("Archive recovery: resuming post-processing of archive %d", archive.ID)
+				go processArchive(archive, file)
+			}
+			continue
+		}
+
+		playbackID, startedAt, ok := parseArchiveName(filepath.Base(file))
+		if !ok {
+			continue
+		}
+		var stream models.Stream
+		if models.DB.Where("playback_id = ?", playbackID).First(&stream).Error != nil {
+			stream = models.Stream{Title: "Recovered recording"}
+		}
+		log.Printf("Archive recovery: registering orphaned recording %s", file)
+		registerArchive(&stream, file, startedAt)
+	}
+}
+
+// parseArchiveName reads the playback ID and start time from the name of a
+// recording, archive_<playback id>_<unix time>.mp4.
+func parseArchiveName(name string) (playbackID string, startedAt time.Time, ok bool) {
+	rest, found := strings.CutPrefix(name, "archive_")
+	rest, hasExt := strings.CutSuffix(rest, ".mp4")
+	i := strings.LastIndex(rest, "_")
+	if !found || !hasExt || i <= 0 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return rest[:i], time.Unix(unix, 0), true
+}
+
+// processArchive post-processes the recording at path and records the
+// outcome on its archive.
+func processArchive(archive *models.Archive, path string) {
+	jobSlots <- struct{}{}
+	defer func() { <-jobSlots }()
+
+	err := postProcessArchive(archive, path)
+	if errors.Is(err, errEmptyRecording) {
+		log.Printf("Archive %d (%s): no media recorded, deleting it", archive.ID, path)
+		os.Remove(path)
+		if models.DB != nil && archive.ID != 0 {
+			models.DB.Delete(archive)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Archive %d (%s): post-processing failed: %v", archive.ID, path, err)
+		archive.Status, archive.Error = JobFailed, err.Error()
+	} else {
+		log.Printf("Archive %d (%s): ready, %s %dx%d", archive.ID, path, archive.Duration, archive.Width, archive.Height)
+		archive.Status, archive.Error = JobReady, ""
+	}
+	if models.DB != nil {
+		if err := models.DB.Save(archive).Error; err != nil {
+			log.Printf("Failed to save archive %d: %v", archive.ID, err)
+		}
+	}
+}
+
+// postProcessArchive runs the post-processing steps in order, filling in
+// archive as they succeed. It stops at the first failure; the recording
+// itself is only ever replaced by a complete faststart copy. The faststart
+// remux also repairs recordings cut short: it rewrites the fragments that
+// made it to disk as a regular MP4.
+func postProcessArchive(archive *models.Archive, path string) error {
+	info, err := probeMedia(path)
+	if err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	archive.DurationSeconds = info.Duration.Seconds()
+	archive.Duration = info.Duration.Round(time.Second).String()
+	archive.Width, archive.Height = info.Width, info.Height
+	archive.VideoCodec, archive.AudioCodec = info.VideoCodec, info.AudioCodec
+
+	if err := faststart(path); err != nil {
+		return fmt.Errorf("faststart: %w", err)
+	}
+	if fileInfo, err := os.Stat(path); err == nil {
+		archive.FileSize = fileInfo.Size()
+	}
+	if info.VideoCodec == "" {
+		return nil // audio only: nothing to preview
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	dir := filepath.Join(filepath.Dir(path), name)
+	webDir := "/archive/" + name
+	if err := os.MkdirAll(filepath.Join(dir, "hls"), 0755); err != nil {
+		return err
+	}
+
+	if err := runFFmpeg(thumbnailArgs(path, info.Duration/10, filepath.Join(dir, "thumb.jpg"))); err != nil {
+		return fmt.Errorf("thumbnail: %w", err)
+	}
+	archive.Thumbnail = webDir + "/thumb.jpg"
+
+	sprite := newSprite(info)
+	if err := runFFmpeg(sprite.args(path, filepath.Join(dir, "sprite.jpg"))); err != nil {
+		return fmt.Errorf("sprite: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sprite.vtt"), []byte(sprite.vtt("sprite.jpg")), 0644); err != nil {
+		return fmt.Errorf("sprite: %w", err)
+	}
+	archive.SpriteURL = webDir + "/sprite.vtt"
+
+	if err := runFFmpeg(vodHLSArgs(path, filepath.Join(dir, "hls"))); err != nil {
+		return fmt.Errorf("hls: %w", err)
+	}
+	archive.HLSURL = webDir + "/hls/index.m3u8"
+	return nil
+}
+
+// mediaInfo is what ffprobe reports about a recording.
+type mediaInfo struct {
+	Duration   time.Duration
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+}
+
+// errEmptyRecording is returned for recordings without any media in them.
+var errEmptyRecording = errors.New("recording has no media")
+
+// probeMedia inspects a media file with ffprobe.
+func probeMedia(path string) (mediaInfo, error) {
+	out, err := exec.Command(FFprobeBinary, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			lines := strings.Split(strings.TrimSpace(string(exitErr.Stderr)), "\n")
+			return mediaInfo{}, fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return mediaInfo{}, err
+	}
+	return parseProbe(out)
+}
+
+// parseProbe reads ffprobe's JSON output. The container duration is used
+// when present, else the longest stream's.
+func parseProbe(data []byte) (mediaInfo, error) {
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+			Duration  string `json:"duration"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return mediaInfo{}, err
+	}
+
+	var info mediaInfo
+	seconds, _ := strconv.ParseFloat(probe.Format.Duration, 64)
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec, info.Width, info.Height = stream.CodecName, stream.Width, stream.Height
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+		default:
+			continue
+		}
+		if probe.Format.Duration == "" {
+			if d, err := strconv.ParseFloat(stream.Duration, 64); err == nil && d > seconds {
+				seconds = d
+			}
+		}
+	}
+	if seconds <= 0 {
+		return mediaInfo{}, errEmptyRecording
+	}
+	info.Duration = time.Duration(seconds * float64(time.Second))
+	return info, nil
+}
+
+// faststart rewrites an MP4 with its index in front. The copy replaces the
+// original only once it is complete.
+func faststart(path string) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".faststart")
+	args := []string{
+		"-hide_banner", "-loglevel", "error", "-y", "-i", path,
+		"-map", "0", "-c", "copy", "-movflags", "+faststart", "-f", "mp4", tmp,
+	}
+	if err := runFFmpeg(args); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// vodHLSArgs builds the ffmpeg command line packaging a recording as a VOD
+// HLS playlist in dir, without re-encoding.
+func vodHLSArgs(video, dir string) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-y", "-i", video,
+		"-map", "0:v?", "-map", "0:a?", "-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(VODSegmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "seg_%03d.ts"),
+		filepath.Join(dir, "index.m3u8"),
+	}
+}
+
+// sprite is the layout of a recording's thumbnail sprite: one tile every
+// interval, spriteColumns to a row.
+type sprite struct {
+	duration      time.Duration
+	interval      time.Duration
+	tiles         int
+	width, height int // of a tile
+}
+
+func newSprite(info mediaInfo) sprite {
+	interval := SpriteInterval
+	if info.Duration > interval*maxSpriteTiles {
+		interval = (info.Duration + maxSpriteTiles - 1) / maxSpriteTiles
+	}
+	height := spriteTileWidth * 9 / 16
+	if info.Width > 0 && info.Height > 0 {
+		height = int(math.Round(float64(spriteTileWidth*info.Height)/float64(info.Width)/2)) * 2
+	}
+	tiles := int((info.Duration + interval - 1) / interval)
+	return sprite{
+		duration: info.Duration,
+		interval: interval,
+		tiles:    max(tiles, 1),
+		width:    spriteTileWidth,
+		height:   height,
+	}
+}
+
+func (s sprite) rows() int {
+	return (s.tiles + spriteColumns - 1) / spriteColumns
+}
+
+// args builds the ffmpeg command line writing the sprite image of video.
+func (s sprite) args(video, out string) []string {
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d", ffmpegSeconds(s.interval), s.width, s.height, spriteColumns, s.rows())
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-y", "-i", video,
+		"-vf", filter, "-frames:v", "1", "-q:v", "5", out,
+	}
+}
+
+// vtt returns the WebVTT cues mapping each interval of the recording to
+// its tile in the sprite image at image.
+func (s sprite) vtt(image string) string {
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < s.tiles; i++ {
+		start := time.Duration(i) * s.interval
+		end := min(start+s.interval, s.duration)
+		x, y := i%spriteColumns*s.width, i/spriteColumns*s.height
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTimestamp(start), vttTimestamp(end), image, x, y, s.width, s.height)
+	}
+	return b.String()
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,111 @@
+package rtmp
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+)
+
+func TestParseProbe(t *testing.T) {
+	info, err := parseProbe([]byte(`{
+		"streams": [
+			{"codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "duration": "95.400000"},
+			{"codec_type": "audio", "codec_name": "aac", "duration": "95.488000"},
+			{"codec_type": "data", "codec_name": "bin_data"}
+		],
+		"format": {"duration": "95.488000"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mediaInfo{Duration: 95488 * time.Millisecond, Width: 1920, Height: 1080, VideoCodec: "h264", AudioCodec: "aac"}
+	if info != want {
+		t.Errorf("got %+v, want %+v", info, want)
+	}
+
+	// Without a container duration the longest stream's is used.
+	info, err = parseProbe([]byte(`{"streams": [{"codec_type": "audio", "codec_name": "aac", "duration": "12.5"}], "format": {}}`))
+	if err != nil || info.Duration != 12500*time.Millisecond || info.VideoCodec != "" {
+		t.Errorf("audio only: got %+v, %v", info, err)
+	}
+
+	// A fragmented MP4 whose ffmpeg died before the first fragment.
+	if _, err := parseProbe([]byte(`{"streams": [{"codec_type": "video", "codec_name": "h264"}], "format": {"duration": "0.000000"}}`)); !errors.Is(err, errEmptyRecording) {
+		t.Errorf("recording without media: got %v", err)
+	}
+}
+
+func TestSprite(t *testing.T) {
+	s := newSprite(mediaInfo{Duration: 25 * time.Second, Width: 1280, Height: 720})
+	if s.tiles != 3 || s.interval != 10*time.Second || s.width != 160 || s.height != 90 {
+		t.Fatalf("got %+v", s)
+	}
+	want := "WEBVTT\n" +
+		"\n00:00:00.000 --> 00:00:10.000\nsprite.jpg#xywh=0,0,160,90\n" +
+		"\n00:00:10.000 --> 00:00:20.000\nsprite.jpg#xywh=160,0,160,90\n" +
+		"\n00:00:20.000 --> 00:00:25.000\nsprite.jpg#xywh=320,0,160,90\n"
+	if vtt := s.vtt("sprite.jpg"); vtt != want {
+		t.Errorf("vtt:\n%s\nwant:\n%s", vtt, want)
+	}
+	if args := strings.Join(s.args("in.mp4", "sprite.jpg"), " "); !strings.Contains(args, "-vf fps=1/10.000,scale=160:90,tile=10x1 -frames:v 1") {
+		t.Errorf("args %q", args)
+	}
+
+	// Long recordings space the tiles out instead of growing the sprite.
+	s = newSprite(mediaInfo{Duration: 2 * time.Hour, Width: 1080, Height: 1920})
+	if s.tiles != maxSpriteTiles || s.interval != 72*time.Second || s.rows() != 10 || s.height != 284 {
+		t.Errorf("2h portrait recording: got %+v", s)
+	}
+	if vtt := s.vtt("s.jpg"); !strings.Contains(vtt, "01:58:48.000 --> 02:00:00.000\ns.jpg#xywh=1440,2556,160,284\n") {
+		t.Errorf("last cue missing from %q", vtt[len(vtt)-80:])
+	}
+}
+
+func TestVODHLSArgs(t *testing.T) {
+	args := strings.Join(vodHLSArgs("/archive/a.mp4", "/archive/a/hls"), " ")
+	for _, want := range []string{"-i /archive/a.mp4", "-c copy", "-hls_playlist_type vod", "-hls_time 6", "/archive/a/hls/index.m3u8"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q lack %q", args, want)
+		}
+	}
+}
+
+func TestParseArchiveName(t *testing.T) {
+	playbackID, startedAt, ok := parseArchiveName("archive_ab_cd12_1760000000.mp4")
+	if !ok || playbackID != "ab_cd12" || !startedAt.Equal(time.Unix(1760000000, 0)) {
+		t.Errorf("got %q, %s, %v", playbackID, startedAt, ok)
+	}
+	for _, name := range []string{"clip_3_4.mp4", "archive_pb.mp4", "archive_pb_now.mp4", "archive_pb_1760000000.ts"} {
+		if _, _, ok := parseArchiveName(name); ok {
+			t.Errorf("%s parsed as a recording", name)
+		}
+	}
+}
+
+func TestRecoverArchivesCleansUp(t *testing.T) {
+	defer func(dir string) { ArchiveDir = dir }(ArchiveDir)
+	ArchiveDir = t.TempDir()
+	temp := filepath.Join(ArchiveDir, ".archive_pb_1760000000.mp4.faststart")
+	empty := filepath.Join(ArchiveDir, "archive_pb_1760000000.mp4")
+	for _, path := range []string{temp, empty} {
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recoverArchives()
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Errorf("leftover faststart copy kept: %v", err)
+	}
+
+	// An ffmpeg that never wrote anything leaves nothing to archive.
+	registerArchive(&models.Stream{ID: 1}, empty, time.Now())
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("empty recording kept: %v", err)
+	}
+}
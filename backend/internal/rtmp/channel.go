@@ -0,0 +1,381 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"streamcast-backend/internal/hls"
+	"streamcast-backend/internal/models"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/pubsub"
+)
+
+// Channel is a single live stream being ingested. Each channel owns its own
+// packet queue, so publishers never overwrite each other and viewers only
+// receive the stream they asked for.
+type Channel struct {
+	StreamID   uint
+	StreamKey  string
+	PlaybackID string
+	Title      string
+	Queue      *pubsub.Queue
+	StartedAt  time.Time
+
+	lock          sync.Mutex
+	closing       bool // last input gone, guarded by Registry.lock
+	transcoder    *Transcoder
+	segmenters    map[string]*hls.Segmenter
+	restreamers   map[uint]*Restreamer // by models.RestreamTarget ID
+	stopRequested bool
+	viewers       int
+	codecs        []av.CodecData
+	bytesIn       int64
+	keyframe      chan struct{}
+	done          chan struct{}
+
+	ingestLock sync.Mutex               // input switching, see failover.go
+	inputs     map[string]*channelInput // by role
+	header     []av.CodecData
+	active     *channelInput
+	lostRole   string          // role of the active input that disconnected
+	lastOut    []time.Duration // last output time per track
+	outLast    time.Duration   // latest output time on any track
+	outLastAt  time.Time       // when outLast was written
+	events     []FailoverEvent
+}
+
+func newChannel(stream *models.Stream) *Channel {
+	return &Channel{
+		StreamID:   stream.ID,
+		StreamKey:  stream.StreamKey,
+		PlaybackID: stream.PlaybackID,
+		Title:      stream.Title,
+		Queue:      pubsub.NewQueue(),
+		StartedAt:  time.Now(),
+		inputs:     make(map[string]*channelInput),
+		keyframe:   make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Keyframe is closed once the first video keyframe (or, for audio-only
+// ingest, the first packet) has been queued.
+func (ch *Channel) Keyframe() <-chan struct{} {
+	return ch.keyframe
+}
+
+func (ch *Channel) markKeyframe() {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	select {
+	case <-ch.keyframe:
+	default:
+		close(ch.keyframe)
+	}
+}
+
+// Done is closed once the channel has been removed from the registry.
+func (ch *Channel) Done() <-chan struct{} {
+	return ch.done
+}
+
+// Codecs returns the codecs announced by the publisher.
+func (ch *Channel) Codecs() []av.CodecData {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.codecs
+}
+
+// IngestBitrate returns the average ingest bitrate since the channel
+// opened, in bits per second.
+func (ch *Channel) IngestBitrate() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	elapsed := time.Since(ch.StartedAt).Seconds()
+	if elapsed < 1 {
+		return 0
+	}
+	return int(float64(ch.bytesIn*8) / elapsed)
+}
+
+func (ch *Channel) setCodecs(codecs []av.CodecData) {
+	ch.lock.Lock()
+	ch.codecs = codecs
+	ch.lock.Unlock()
+}
+
+func (ch *Channel) countBytes(n int) {
+	ch.lock.Lock()
+	ch.bytesIn += int64(n)
+	ch.lock.Unlock()
+}
+
+// SetTranscoder records the ffmpeg supervisor working on this channel.
+func (ch *Channel) SetTranscoder(t *Transcoder) {
+	ch.lock.Lock()
+	ch.transcoder = t
+	ch.lock.Unlock()
+}
+
+// Transcoder returns the ffmpeg supervisor working on this channel, if any.
+func (ch *Channel) Transcoder() *Transcoder {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.transcoder
+}
+
+// AddSegmenter records a native HLS segmenter writing the named rendition
+// directory, so its playlist can be served with LL-HLS blocking reload.
+func (ch *Channel) AddSegmenter(rendition string, s *hls.Segmenter) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.segmenters == nil {
+		ch.segmenters = make(map[string]*hls.Segmenter)
+	}
+	ch.segmenters[rendition] = s
+}
+
+// Segmenter returns the native segmenter of a rendition, if any.
+func (ch *Channel) Segmenter(rendition string) *hls.Segmenter {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.segmenters[rendition]
+}
+
+// AddRestreamer records the relay to a restream target.
+func (ch *Channel) AddRestreamer(targetID uint, r *Restreamer) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.restreamers == nil {
+		ch.restreamers = make(map[uint]*Restreamer)
+	}
+	ch.restreamers[targetID] = r
+}
+
+// RemoveRestreamer forgets the relay to a restream target and returns it,
+// so the caller can stop it.
+func (ch *Channel) RemoveRestreamer(targetID uint) *Restreamer {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	r := ch.restreamers[targetID]
+	delete(ch.restreamers, targetID)
+	return r
+}
+
+// Restreamers returns the relays of this channel, ordered by target ID.
+func (ch *Channel) Restreamers() []*Restreamer {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	restreamers := make([]*Restreamer, 0, len(ch.restreamers))
+	for _, r := range ch.restreamers {
+		restreamers = append(restreamers, r)
+	}
+	sort.Slice(restreamers, func(i, j int) bool {
+		return restreamers[i].target.ID < restreamers[j].target.ID
+	})
+	return restreamers
+}
+
+// StopTranscoder stops ffmpeg supervision, giving ffmpeg up to timeout to
+// finalize its outputs.
+func (ch *Channel) StopTranscoder(timeout time.Duration) {
+	if t := ch.Transcoder(); t != nil {
+		t.Stop(timeout)
+	}
+}
+
+// RequestStop marks the channel as stopped by an operator, so the publisher
+// disconnect that follows ends the stream instead of waiting for a reconnect.
+func (ch *Channel) RequestStop() {
+	ch.lock.Lock()
+	ch.stopRequested = true
+	ch.lock.Unlock()
+}
+
+// StopRequested reports whether an operator stopped this channel.
+func (ch *Channel) StopRequested() bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.stopRequested
+}
+
+// Publishers returns the sources attached to this channel: RTMP
+// connections, pull sources and the like, primary and backup, and the
+// offline slate. Closing them ends the ingest.
+func (ch *Channel) Publishers() []io.Closer {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	var publishers []io.Closer
+	for _, role := range []string{InputPrimary, InputBackup, InputSlate} {
+		if in := ch.inputs[role]; in != nil && in.publisher != nil {
+			publishers = append(publishers, in.publisher)
+		}
+	}
+	return publishers
+}
+
+// AddViewer registers a new viewer and returns the updated count.
+func (ch *Channel) AddViewer() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.viewers++
+	return ch.viewers
+}
+
+// RemoveViewer unregisters a viewer and returns the updated count.
+func (ch *Channel) RemoveViewer() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	if ch.viewers > 0 {
+		ch.viewers--
+	}
+	return ch.viewers
+}
+
+// Viewers returns the number of RTMP/FLV viewers currently attached.
+func (ch *Channel) Viewers() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.viewers
+}
+
+// Registry tracks every live channel, indexed by stream key (for ingest) and
+// by playback ID (for viewers). It is safe for concurrent use.
+type Registry struct {
+	lock       sync.RWMutex
+	byKey      map[string]*Channel
+	byPlayback map[string]*Channel
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byKey:      make(map[string]*Channel),
+		byPlayback: make(map[string]*Channel),
+	}
+}
+
+// Attach adds a publisher to a stream's channel as its role input, creating
+// the channel if the stream is not live yet (created is then true). Each
+// role takes one publisher; a second one is rejected, as is any publisher
+// while the channel is shutting down.
+func (r *Registry) Attach(stream *models.Stream, role string, publisher io.Closer) (ch *Channel, created bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ch = r.byKey[stream.StreamKey]
+	if ch == nil {
+		ch = newChannel(stream)
+		r.byKey[ch.StreamKey] = ch
+		r.byPlayback[ch.PlaybackID] = ch
+		created = true
+	} else if ch.closing {
+		return nil, false, fmt.Errorf("stream %d is shutting down", stream.ID)
+	} else if ch.hasInput(role) {
+		return nil, false, fmt.Errorf("stream %d already has a %s publisher", stream.ID, role)
+	}
+	ch.addInput(role, publisher)
+	return ch, created, nil
+}
+
+// Detach removes the role input from a channel. It reports whether that
+// was the last input, in which case the channel is shutting down and the
+// caller must Close it.
+func (r *Registry) Detach(ch *Channel, role string) (last bool) {
+	_, last = r.DetachToSlate(ch, role, nil)
+	return last
+}
+
+// DetachToSlate removes the role input from a channel like Detach, but if
+// that leaves a channel that has started streaming without a publisher,
+// slate is attached as its InputSlate instead of shutting it down. It
+// reports whether the slate was attached, or else whether the input was
+// the last one. A nil slate behaves like Detach.
+func (r *Registry) DetachToSlate(ch *Channel, role string, slate *slateSource) (slated, last bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if ch.removeInput(role) > 0 {
+		return false, false
+	}
+	if slate != nil && ch.hasHeader() && !ch.StopRequested() {
+		ch.addInput(InputSlate, slate)
+		return true, false
+	}
+	ch.closing = true
+	return false, true
+}
+
+// InputBusy reports whether a stream already has a publisher for role, or
+// cannot take one because it is shutting down.
+func (r *Registry) InputBusy(streamKey, role string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ch := r.byKey[streamKey]
+	return ch != nil && (ch.closing || ch.hasInput(role))
+}
+
+// Close removes the channel from the registry and ends its queue, which
+// disconnects every viewer reading from it.
+func (r *Registry) Close(ch *Channel) {
+	r.lock.Lock()
+	if r.byKey[ch.StreamKey] == ch {
+		delete(r.byKey, ch.StreamKey)
+	}
+	if r.byPlayback[ch.PlaybackID] == ch {
+		delete(r.byPlayback, ch.PlaybackID)
+	}
+	r.lock.Unlock()
+
+	ch.lock.Lock()
+	select {
+	case <-ch.done:
+	default:
+		close(ch.done)
+	}
+	ch.lock.Unlock()
+
+	ch.Queue.Close()
+}
+
+// ByKey returns the live channel for a stream key, or nil.
+func (r *Registry) ByKey(key string) *Channel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.byKey[key]
+}
+
+// ByPlaybackID returns the live channel for a playback ID, or nil.
+func (r *Registry) ByPlaybackID(id string) *Channel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.byPlayback[id]
+}
+
+// ByStreamID returns the live channel for a models.Stream ID, or nil.
+func (r *Registry) ByStreamID(id uint) *Channel {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, ch := range r.byKey {
+		if ch.StreamID == id {
+			return ch
+		}
+	}
+	return nil
+}
+
+// List returns all live channels, oldest first.
+func (r *Registry) List() []*Channel {
+	r.lock.RLock()
+	channels := make([]*Channel, 0, len(r.byKey))
+	for _, ch := range r.byKey {
+		channels = append(channels, ch)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].StartedAt.Before(channels[j].StartedAt)
+	})
+	return channels
+}
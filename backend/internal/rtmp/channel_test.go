@@ -0,0 +1,128 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+)
+
+func TestRegistryLookups(t *testing.T) {
+	registry := NewRegistry()
+	stream := &models.Stream{ID: 7, StreamKey: "key", PlaybackID: "pb"}
+	ch, _, err := registry.Attach(stream, InputPrimary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registry.ByKey("key") != ch || registry.ByPlaybackID("pb") != ch || registry.ByStreamID(7) != ch {
+		t.Fatal("channel not found by key, playback ID and stream ID")
+	}
+	if registry.ByKey("pb") != nil || registry.ByPlaybackID("key") != nil || registry.ByStreamID(8) != nil {
+		t.Error("lookup matched the wrong index")
+	}
+
+	registry.Close(ch)
+	registry.Close(ch) // closing twice is harmless
+	select {
+	case <-ch.Done():
+	default:
+		t.Error("Done not closed")
+	}
+	if registry.ByKey("key") != nil || registry.ByPlaybackID("pb") != nil || registry.ByStreamID(7) != nil || len(registry.List()) != 0 {
+		t.Error("closed channel still registered")
+	}
+	if _, err := ch.Queue.Latest().ReadPacket(); err == nil {
+		t.Error("queue still open after Close")
+	}
+
+	// A closed channel does not block a new publish of the same stream, and
+	// closing the old one again leaves the new one alone.
+	again, created, err := registry.Attach(stream, InputPrimary, nil)
+	if err != nil || !created || again == ch {
+		t.Fatalf("republish: created %v, err %v", created, err)
+	}
+	registry.Close(ch)
+	if registry.ByKey("key") != again || registry.ByPlaybackID("pb") != again {
+		t.Error("closing a stale channel removed its successor")
+	}
+	registry.Close(again)
+}
+
+func TestRegistryDetachBeforeStreaming(t *testing.T) {
+	registry := NewRegistry()
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}
+	ch, _, _ := registry.Attach(stream, InputPrimary, nil)
+	defer registry.Close(ch)
+
+	// Without a header there is nothing to hold viewers on: the channel
+	// shuts down rather than going to the slate.
+	if slated, last := registry.DetachToSlate(ch, InputPrimary, newSlateSource(stream, nil)); slated || !last {
+		t.Errorf("slated %v, last %v, want the channel shut down", slated, last)
+	}
+	if !registry.InputBusy("key", InputBackup) {
+		t.Error("channel shutting down still takes publishers")
+	}
+}
+
+func TestRegistryConcurrentUse(t *testing.T) {
+	registry := NewRegistry()
+	const streams = 8
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	// Readers look channels up while publishers come and go.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for n := 0; n < streams; n++ {
+					if ch := registry.ByKey(fmt.Sprintf("key%d", n)); ch != nil && ch.StreamID != uint(n+1) {
+						t.Errorf("key%d maps to stream %d", n, ch.StreamID)
+					}
+					registry.ByPlaybackID(fmt.Sprintf("pb%d", n))
+					registry.ByStreamID(uint(n + 1))
+				}
+				registry.List()
+			}
+		}()
+	}
+
+	var publishers sync.WaitGroup
+	for n := 0; n < streams; n++ {
+		stream := &models.Stream{ID: uint(n + 1), StreamKey: fmt.Sprintf("key%d", n), PlaybackID: fmt.Sprintf("pb%d", n)}
+		for _, role := range []string{InputPrimary, InputBackup} {
+			publishers.Add(1)
+			go func(role string) {
+				defer publishers.Done()
+				for i := 0; i < 50; i++ {
+					ch, _, err := registry.Attach(stream, role, nil)
+					if err != nil {
+						continue // the other role's channel is shutting down
+					}
+					if registry.Detach(ch, role) {
+						registry.Close(ch)
+					}
+				}
+			}(role)
+		}
+	}
+	publishers.Wait()
+	close(stop)
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for len(registry.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(registry.List()); n != 0 {
+		t.Errorf("%d channels left after every publisher detached", n)
+	}
+}
@@ -0,0 +1,317 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"streamcast-backend/internal/models"
+	"strings"
+	"time"
+)
+
+// Clips. Highlights are cut from a live stream's retained HLS segments (its
+// DVR window, or just the live playlist without one) or from one of its
+// archive recordings. Offsets are seconds into the source; negative ones
+// count back from its end, which for a live stream is the live edge. Plain
+// clips are stream copies starting on the keyframe at or before the start
+// offset; Accurate clips are re-encoded to start and end exactly on the
+// offsets. Clips are written to ArchiveDir/clips by the post-processing
+// workers, and their models.Clip rows track the progress.
+
+// MaxClipDuration bounds the length of a clip.
+var MaxClipDuration = 10 * time.Minute
+
+// FFprobeBinary is the ffprobe executable used to inspect recordings.
+var FFprobeBinary = "ffprobe"
+
+var (
+	ErrClipRange       = errors.New("invalid clip range")
+	ErrArchiveNotFound = errors.New("archive not found")
+	ErrClipEncrypted   = errors.New("encrypted streams can only be clipped from their archives")
+)
+
+// ClipRequest describes a clip to cut.
+type ClipRequest struct {
+	Title     string   `json:"title"`
+	Start     float64  `json:"start"`      // seconds into the source, negative counts back from its end
+	End       *float64 `json:"end"`        // like Start, omit to clip up to the end
+	ArchiveID *uint    `json:"archive_id"` // cut from this recording instead of the live stream
+	Accurate  bool     `json:"accurate"`   // re-encode so the clip starts exactly at Start
+}
+
+// clipJob is a clip waiting for ffmpeg.
+type clipJob struct {
+	input   []string      // ffmpeg input arguments
+	seek    time.Duration // where the clip starts in the input
+	length  time.Duration
+	workDir string // removed once the clip is done, if set
+}
+
+func (j *clipJob) cleanup() {
+	if j.workDir != "" {
+		os.RemoveAll(j.workDir)
+	}
+}
+
+// CreateClip validates a clip request, saves the clip as processing and
+// cuts it in the background. Segments of a live stream are taken before
+// CreateClip returns, so pruning cannot remove them from under the job.
+func (s *Server) CreateClip(stream *models.Stream, req ClipRequest) (*models.Clip, error) {
+	var (
+		job      *clipJob
+		from, to time.Duration
+		err      error
+	)
+	if req.ArchiveID != nil {
+		job, from, to, err = archiveClip(stream, *req.ArchiveID, req)
+	} else {
+		job, from, to, err = s.liveClip(stream, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	clip := &models.Clip{
+		StreamID:  stream.ID,
+		ArchiveID: req.ArchiveID,
+		Title:     req.Title,
+		Status:    JobProcessing,
+		Start:     from.Seconds(),
+		End:       to.Seconds(),
+		Accurate:  req.Accurate,
+	}
+	if clip.Title == "" {
+		clip.Title = fmt.Sprintf("%s %s", stream.Title, time.Now().Format("2006-01-02 15:04:05"))
+	}
+	if models.DB != nil {
+		if err := models.DB.Create(clip).Error; err != nil {
+			job.cleanup()
+			return nil, err
+		}
+	}
+	go runClip(clip, job)
+	return clip, nil
+}
+
+// liveClip prepares a clip of the segments a live stream still lists.
+func (s *Server) liveClip(stream *models.Stream, req ClipRequest) (*clipJob, time.Duration, time.Duration, error) {
+	if s.channels.ByStreamID(stream.ID) == nil {
+		return nil, 0, 0, ErrStreamOffline
+	}
+	if stream.Encrypted {
+		return nil, 0, 0, ErrClipEncrypted
+	}
+	dir := clipRendition(filepath.Join(HLSDir, stream.PlaybackID))
+	segments, err := readMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if dir == "" || err != nil || len(segments) == 0 {
+		return nil, 0, 0, fmt.Errorf("%w: no segments written yet", ErrClipRange)
+	}
+	from, to, err := clipRange(req, playlistDuration(segments))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	picked := segmentsBetween(segments, from, to)
+	workDir, err := os.MkdirTemp("", "clip-")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var list strings.Builder
+	for _, seg := range picked {
+		name := filepath.Base(seg.URI)
+		if err := linkFile(filepath.Join(dir, name), filepath.Join(workDir, name)); err != nil {
+			os.RemoveAll(workDir)
+			return nil, 0, 0, fmt.Errorf("segment %s: %w", name, err)
+		}
+		fmt.Fprintf(&list, "file '%s'\n", name)
+	}
+	listPath := filepath.Join(workDir, "segments.txt")
+	if err := os.WriteFile(listPath, []byte(list.String()), 0644); err != nil {
+		os.RemoveAll(workDir)
+		return nil, 0, 0, err
+	}
+	return &clipJob{
+		input:   []string{"-f", "concat", "-safe", "0", "-i", listPath},
+		seek:    from - picked[0].Start,
+		length:  to - from,
+		workDir: workDir,
+	}, from, to, nil
+}
+
+// archiveClip prepares a clip of one of a stream's archive recordings.
+func archiveClip(stream *models.Stream, archiveID uint, req ClipRequest) (*clipJob, time.Duration, time.Duration, error) {
+	var archive models.Archive
+	if models.DB == nil || models.DB.First(&archive, archiveID).Error != nil {
+		return nil, 0, 0, ErrArchiveNotFound
+	}
+	if archive.StreamID != 0 && archive.StreamID != stream.ID {
+		return nil, 0, 0, ErrArchiveNotFound
+	}
+	path := filepath.Join(ArchiveDir, filepath.Base(archive.FilePath))
+	info, err := probeMedia(path)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("read archive %d: %w", archiveID, err)
+	}
+	from, to, err := clipRange(req, info.Duration)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return &clipJob{input: []string{"-i", path}, seek: from, length: to - from}, from, to, nil
+}
+
+// clipRange resolves a request's offsets against a source lasting total.
+// Offsets past either end are clamped to it, since the live window moves
+// while the request is on its way.
+func clipRange(req ClipRequest, total time.Duration) (from, to time.Duration, err error) {
+	at := func(offset float64) time.Duration {
+		d := time.Duration(offset * float64(time.Second))
+		if offset < 0 {
+			d += total
+		}
+		return min(max(d, 0), total)
+	}
+	from, to = at(req.Start), total
+	if req.End != nil {
+		to = at(*req.End)
+	}
+	switch {
+	case to <= from:
+		return 0, 0, fmt.Errorf("%w: the source covers %.1fs and the clip must end after it starts", ErrClipRange, total.Seconds())
+	case to-from > MaxClipDuration:
+		return 0, 0, fmt.Errorf("%w: clips are limited to %s", ErrClipRange, MaxClipDuration)
+	}
+	return from, to, nil
+}
+
+// segmentsBetween returns the segments overlapping [from, to).
+func segmentsBetween(segments []playlistSegment, from, to time.Duration) []playlistSegment {
+	var picked []playlistSegment
+	for _, seg := range segments {
+		if seg.Start+seg.Duration > from && seg.Start < to {
+			picked = append(picked, seg)
+		}
+	}
+	return picked
+}
+
+// clipRendition returns the rendition directory live clips are cut from:
+// the first variant of the master playlist, the top of the ladder.
+func clipRendition(hlsDir string) string {
+	if data, err := os.ReadFile(filepath.Join(hlsDir, "master.m3u8")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				return filepath.Join(hlsDir, filepath.Dir(line))
+			}
+		}
+	}
+	if dirs := dvrRenditions(hlsDir); len(dirs) > 0 {
+		return dirs[0]
+	}
+	return ""
+}
+
+// runClip cuts a clip and records the outcome.
+func runClip(clip *models.Clip, job *clipJob) {
+	jobSlots <- struct{}{}
+	defer func() { <-jobSlots }()
+	defer job.cleanup()
+
+	dir := filepath.Join(ArchiveDir, "clips")
+	name := fmt.Sprintf("clip_%d_%d", clip.StreamID, clip.ID)
+	out := filepath.Join(dir, name+".mp4")
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = runFFmpeg(clipArgs(job, clip.Accurate, out))
+	}
+	if err != nil {
+		log.Printf("Clip %d of stream %d failed: %v", clip.ID, clip.StreamID, err)
+		clip.Status, clip.Error = JobFailed, err.Error()
+	} else {
+		clip.Status = JobReady
+		clip.FilePath = "/archive/clips/" + name + ".mp4"
+		clip.Duration = job.length.Round(time.Millisecond).String()
+		if info, err := os.Stat(out); err == nil {
+			clip.FileSize = info.Size()
+		}
+		thumb := filepath.Join(dir, name+".jpg")
+		if err := runFFmpeg(thumbnailArgs(out, min(time.Second, job.length/2), thumb)); err == nil {
+			clip.Thumbnail = "/archive/clips/" + name + ".jpg"
+		}
+		log.Printf("Clip %d of stream %d ready: %s (%d bytes)", clip.ID, clip.StreamID, out, clip.FileSize)
+	}
+	if models.DB != nil {
+		if err := models.DB.Save(clip).Error; err != nil {
+			log.Printf("Failed to save clip %d: %v", clip.ID, err)
+		}
+	}
+}
+
+// clipArgs builds the ffmpeg command line cutting job into out. Seeking
+// before the input is fast and, for stream copies, lands on the keyframe
+// at or before the offset.
+func clipArgs(job *clipJob, accurate bool, out string) []string {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-ss", ffmpegSeconds(job.seek)}
+	args = append(args, job.input...)
+	args = append(args, "-t", ffmpegSeconds(job.length), "-map", "0:v?", "-map", "0:a?")
+	if accurate {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-c:a", "aac", "-b:a", "128k")
+	} else {
+		args = append(args, "-c", "copy", "-bsf:a", "aac_adtstoasc", "-avoid_negative_ts", "make_zero")
+	}
+	return append(args, "-movflags", "+faststart", out)
+}
+
+// thumbnailArgs builds the ffmpeg command line grabbing the frame at `at`
+// of a video as a JPEG.
+func thumbnailArgs(video string, at time.Duration, out string) []string {
+	return []string{
+		"-hide_banner", "-loglevel", "error", "-y",
+		"-ss", ffmpegSeconds(at), "-i", video,
+		"-frames:v", "1", "-vf", "scale=640:-2", out,
+	}
+}
+
+func ffmpegSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// runFFmpeg runs ffmpeg to completion, returning its last error line if it
+// fails.
+func runFFmpeg(args []string) error {
+	out, err := exec.Command(FFmpegBinary, args...).CombinedOutput()
+	if err != nil {
+		if lines := strings.Split(strings.TrimSpace(string(out)), "\n"); lines[len(lines)-1] != "" {
+			return fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+		}
+		return err
+	}
+	return nil
+}
+
+// linkFile makes dst a hard link to src, or a copy where links are not
+// possible.
+func linkFile(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,126 @@
+package rtmp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+)
+
+func TestClipRange(t *testing.T) {
+	total := 5 * time.Minute
+	end := func(s float64) *float64 { return &s }
+	for _, tc := range []struct {
+		req      ClipRequest
+		from, to time.Duration
+		err      bool
+	}{
+		{ClipRequest{Start: 60, End: end(90)}, time.Minute, 90 * time.Second, false},
+		{ClipRequest{Start: -30}, total - 30*time.Second, total, false},
+		{ClipRequest{Start: -130, End: end(-110)}, total - 130*time.Second, total - 110*time.Second, false},
+		{ClipRequest{Start: -3600, End: end(10)}, 0, 10 * time.Second, false}, // clamped to the source
+		{ClipRequest{Start: 90, End: end(60)}, 0, 0, true},
+		{ClipRequest{Start: 400}, 0, 0, true},
+	} {
+		from, to, err := clipRange(tc.req, total)
+		if (err != nil) != tc.err {
+			t.Errorf("%+v: err %v, want error %v", tc.req, err, tc.err)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, ErrClipRange) {
+				t.Errorf("%+v: %v is not ErrClipRange", tc.req, err)
+			}
+			continue
+		}
+		if from != tc.from || to != tc.to {
+			t.Errorf("%+v: got %s-%s, want %s-%s", tc.req, from, to, tc.from, tc.to)
+		}
+	}
+
+	defer func(max time.Duration) { MaxClipDuration = max }(MaxClipDuration)
+	MaxClipDuration = time.Minute
+	if _, _, err := clipRange(ClipRequest{Start: 0}, total); !errors.Is(err, ErrClipRange) {
+		t.Errorf("clip over MaxClipDuration: got %v", err)
+	}
+}
+
+func TestClipArgs(t *testing.T) {
+	job := &clipJob{input: []string{"-i", "/archive/a.mp4"}, seek: 61500 * time.Millisecond, length: 20 * time.Second}
+
+	args := strings.Join(clipArgs(job, false, "/archive/clips/c.mp4"), " ")
+	for _, want := range []string{"-ss 61.500 -i /archive/a.mp4 -t 20.000", "-c copy", "-movflags +faststart /archive/clips/c.mp4"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q lack %q", args, want)
+		}
+	}
+	args = strings.Join(clipArgs(job, true, "/archive/clips/c.mp4"), " ")
+	if !strings.Contains(args, "-c:v libx264") || strings.Contains(args, "-c copy") {
+		t.Errorf("accurate clip is not re-encoded: %q", args)
+	}
+}
+
+func TestLiveClipTakesSegments(t *testing.T) {
+	defer func(dir string) { HLSDir = dir }(HLSDir)
+	HLSDir = t.TempDir()
+	hlsDir := filepath.Join(HLSDir, "pb")
+	for _, dir := range []string{"720p", "360p"} {
+		if err := os.MkdirAll(filepath.Join(hlsDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.WriteFile(filepath.Join(hlsDir, "master.m3u8"), []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\n720p/index.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1\n360p/index.m3u8\n"), 0644)
+	playlist := "#EXTM3U\n#EXT-X-MEDIA-SEQUENCE:7\n"
+	for _, name := range []string{"seg_007.ts", "seg_008.ts", "seg_009.ts", "seg_010.ts"} {
+		playlist += "#EXTINF:4.000,\n" + name + "\n"
+		os.WriteFile(filepath.Join(hlsDir, "720p", name), []byte(name), 0644)
+	}
+	os.WriteFile(filepath.Join(hlsDir, "720p", "index.m3u8"), []byte(playlist), 0644)
+
+	s := NewRtmpServer("0")
+	stream := &models.Stream{ID: 3, StreamKey: "key", PlaybackID: "pb"}
+	if _, _, _, err := s.liveClip(stream, ClipRequest{Start: 1}); !errors.Is(err, ErrStreamOffline) {
+		t.Fatalf("offline stream: got %v", err)
+	}
+	channel, _, err := s.channels.Attach(stream, InputPrimary, io.NopCloser(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.channels.Close(channel)
+
+	// The 6 seconds before the last 3: 7s to 13s, in seg_008 to seg_010.
+	end := -3.0
+	job, from, to, err := s.liveClip(stream, ClipRequest{Start: -9, End: &end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer job.cleanup()
+	if from != 7*time.Second || to != 13*time.Second {
+		t.Errorf("clip covers %s-%s, want 7s-13s", from, to)
+	}
+	if job.seek != 3*time.Second || job.length != 6*time.Second {
+		t.Errorf("seek %s for %s, want 3s for 6s", job.seek, job.length)
+	}
+	list, err := os.ReadFile(filepath.Join(job.workDir, "segments.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(list) != "file 'seg_008.ts'\nfile 'seg_009.ts'\nfile 'seg_010.ts'\n" {
+		t.Errorf("concat list %q", list)
+	}
+	// The job keeps its segments even once the live output drops them.
+	os.Remove(filepath.Join(hlsDir, "720p", "seg_008.ts"))
+	if data, err := os.ReadFile(filepath.Join(job.workDir, "seg_008.ts")); err != nil || string(data) != "seg_008.ts" {
+		t.Errorf("segment not kept for the job: %q, %v", data, err)
+	}
+
+	stream.Encrypted = true
+	if _, _, _, err := s.liveClip(stream, ClipRequest{Start: -5}); !errors.Is(err, ErrClipEncrypted) {
+		t.Errorf("encrypted stream: got %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package rtmp
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"streamcast-backend/internal/models"
+	"strings"
+	"time"
+)
+
+// DVR (timeshift) playlists, set per stream with models.Stream.DVRMode.
+// A sliding DVR lists the last DVRWindow of the broadcast so viewers can
+// rewind that far; an event DVR is an EXT-X-PLAYLIST-TYPE:EVENT playlist
+// listing everything since the publish started. Segments of a sliding DVR
+// stay on disk while they are listed and are pruned in the background once
+// they fall out of the window. Event playlists are unbounded: they keep
+// every segment for as long as the publish lasts, whatever DVRWindow says.
+// LL-HLS and CMAF outputs keep their short live playlists.
+const (
+	DVRSliding = "sliding"
+	DVREvent   = "event"
+)
+
+// MaxDVRWindow bounds DVRWindow, and with it the disk a sliding DVR may
+// hold. It does not apply to event playlists.
+var MaxDVRWindow = 6 * time.Hour
+
+// DVRPruneInterval is how often segments past the window are deleted, and
+// DVRPruneGrace how long they stay on disk after leaving the playlist, for
+// players still downloading them.
+var (
+	DVRPruneInterval = 30 * time.Second
+	DVRPruneGrace    = time.Minute
+)
+
+// DVR is the timeshift configuration of a stream's HLS output. The zero
+// value is a plain live playlist.
+type DVR struct {
+	Mode   string
+	Window time.Duration // sliding only
+}
+
+// StreamDVR returns the DVR configuration of a stream.
+func StreamDVR(stream *models.Stream) DVR {
+	switch {
+	case stream.DVRMode == DVREvent:
+		return DVR{Mode: DVREvent}
+	case stream.DVRWindow > 0:
+		return DVR{Mode: DVRSliding, Window: time.Duration(stream.DVRWindow) * time.Second}
+	}
+	return DVR{}
+}
+
+// ValidateDVR checks a stream's DVR settings. The window of an event DVR is
+// cleared: event playlists are unbounded, so it would not limit anything.
+func ValidateDVR(stream *models.Stream) error {
+	switch stream.DVRMode {
+	case "", DVRSliding:
+	case DVREvent:
+		stream.DVRWindow = 0
+		return nil
+	default:
+		return fmt.Errorf("unknown dvr_mode %q", stream.DVRMode)
+	}
+	if stream.DVRWindow < 0 || time.Duration(stream.DVRWindow)*time.Second > MaxDVRWindow {
+		return fmt.Errorf("dvr_window must be between 0 and %d seconds", int(MaxDVRWindow.Seconds()))
+	}
+	return nil
+}
+
+// playlistSize returns how many segments of segmentDuration seconds a
+// playlist lists: enough to cover the window for a sliding DVR, all of
+// them (0) for an event DVR, and liveSize without DVR.
+func (d DVR) playlistSize(segmentDuration, liveSize int) int {
+	switch d.Mode {
+	case DVRSliding:
+		size := int(math.Ceil(d.Window.Seconds() / float64(segmentDuration)))
+		return max(size, liveSize)
+	case DVREvent:
+		return 0
+	}
+	return liveSize
+}
+
+// DVRStatus reports the timeshift window of a stream.
+type DVRStatus struct {
+	Enabled bool   `json:"enabled"`
+	Mode    string `json:"mode,omitempty"`
+	// WindowSeconds is the configured depth, 0 for event playlists, which
+	// keep the whole broadcast.
+	WindowSeconds int `json:"window_seconds"`
+	// AvailableSeconds is how far back viewers can rewind right now.
+	AvailableSeconds float64 `json:"available_seconds"`
+}
+
+// DVRStatus reports a stream's DVR settings and, while it is live, how
+// much of the broadcast its playlists currently cover.
+func (s *Server) DVRStatus(stream *models.Stream) DVRStatus {
+	dvr := StreamDVR(stream)
+	status := DVRStatus{
+		Enabled:       dvr.Mode != "",
+		Mode:          dvr.Mode,
+		WindowSeconds: int(dvr.Window.Seconds()),
+	}
+	if status.Enabled && s.channels.ByStreamID(stream.ID) != nil {
+		status.AvailableSeconds = dvrAvailable(filepath.Join(HLSDir, stream.PlaybackID)).Seconds()
+	}
+	return status
+}
+
+// dvrRenditions returns the rendition directories of a stream's HLS output
+// that carry the DVR playlists.
+func dvrRenditions(hlsDir string) []string {
+	entries, err := os.ReadDir(hlsDir)
+	if err != nil {
+		return nil
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == LowLatencyRendition || entry.Name() == CMAFRendition {
+			continue
+		}
+		dirs = append(dirs, filepath.Join(hlsDir, entry.Name()))
+	}
+	return dirs
+}
+
+// dvrAvailable returns the longest duration listed by a rendition playlist.
+func dvrAvailable(hlsDir string) time.Duration {
+	var longest time.Duration
+	for _, dir := range dvrRenditions(hlsDir) {
+		segments, err := readMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+		if duration := playlistDuration(segments); err == nil && duration > longest {
+			longest = duration
+		}
+	}
+	return longest
+}
+
+// runDVRPruner deletes segments that fell out of a sliding DVR window
+// until the channel closes. Event playlists never drop segments, so they
+// have nothing to prune. FFmpeg writes those playlists without
+// deleting anything, so the window's segments are never removed under a
+// viewer.
+func runDVRPruner(stream *models.Stream, channel *Channel, hlsDir string) {
+	ticker := time.NewTicker(DVRPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-channel.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, dir := range dvrRenditions(hlsDir) {
+			if n, err := pruneSegments(dir, DVRPruneGrace); err != nil {
+				log.Printf("Stream %d: DVR pruning of %s failed: %v", stream.ID, dir, err)
+			} else if n > 0 {
+				log.Printf("Stream %d: pruned %d segments past the DVR window from %s", stream.ID, n, filepath.Base(dir))
+			}
+		}
+	}
+}
+
+// pruneSegments deletes the MPEG-TS segments in dir that its index.m3u8 no
+// longer lists and that were last written more than grace ago; younger
+// ones may still be in flight. It returns the number deleted.
+func pruneSegments(dir string, grace time.Duration) (int, error) {
+	segments, err := readMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	listed := make(map[string]bool, len(segments))
+	for _, seg := range segments {
+		listed[seg.URI] = true
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.ts"))
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-grace)
+	pruned := 0
+	for _, file := range files {
+		if listed[filepath.Base(file)] {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if err := os.Remove(file); err == nil {
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// playlistSegment is a segment listed in a media playlist, with its
+// position in the playlist's timeline.
+type playlistSegment struct {
+	URI      string
+	Start    time.Duration
+	Duration time.Duration
+}
+
+// readMediaPlaylist returns the segments a media playlist lists, oldest
+// first.
+func readMediaPlaylist(path string) ([]playlistSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		segments []playlistSegment
+		next     time.Duration // duration of the next segment, from its EXTINF
+		end      time.Duration
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+				next = time.Duration(seconds * float64(time.Second))
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segments = append(segments, playlistSegment{URI: line, Start: end, Duration: next})
+			end += next
+			next = 0
+		}
+	}
+	return segments, scanner.Err()
+}
+
+// playlistDuration returns how much time segments cover.
+func playlistDuration(segments []playlistSegment) time.Duration {
+	if len(segments) == 0 {
+		return 0
+	}
+	last := segments[len(segments)-1]
+	return last.Start + last.Duration
+}
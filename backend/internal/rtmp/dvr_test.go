@@ -0,0 +1,109 @@
+package rtmp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+)
+
+func TestStreamDVR(t *testing.T) {
+	for _, tc := range []struct {
+		stream models.Stream
+		want   DVR
+		size   int
+	}{
+		{models.Stream{}, DVR{}, 6},
+		{models.Stream{DVRWindow: 7200}, DVR{Mode: DVRSliding, Window: 2 * time.Hour}, 3600},
+		{models.Stream{DVRWindow: 5, DVRMode: DVRSliding}, DVR{Mode: DVRSliding, Window: 5 * time.Second}, 6},
+		{models.Stream{DVRMode: DVREvent}, DVR{Mode: DVREvent}, 0},
+	} {
+		dvr := StreamDVR(&tc.stream)
+		if dvr != tc.want {
+			t.Errorf("StreamDVR(%d, %q) = %+v, want %+v", tc.stream.DVRWindow, tc.stream.DVRMode, dvr, tc.want)
+		}
+		if size := dvr.playlistSize(2, 6); size != tc.size {
+			t.Errorf("%+v lists %d segments, want %d", dvr, size, tc.size)
+		}
+	}
+
+	if err := ValidateDVR(&models.Stream{DVRMode: "forever"}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if err := ValidateDVR(&models.Stream{DVRWindow: int(MaxDVRWindow.Seconds()) + 1}); err == nil {
+		t.Error("window over MaxDVRWindow accepted")
+	}
+	event := models.Stream{DVRMode: DVREvent, DVRWindow: int(MaxDVRWindow.Seconds()) + 1}
+	if err := ValidateDVR(&event); err != nil || event.DVRWindow != 0 {
+		t.Errorf("event DVR with a window: err %v, window %d, want it cleared", err, event.DVRWindow)
+	}
+}
+
+func TestBuildFFmpegArgsDVR(t *testing.T) {
+	args, err := BuildFFmpegArgs(builtinProfile(t, "football-hd"), DVR{Mode: DVRSliding, Window: time.Hour}, FFmpegInput{URL: "in"}, "/hls/pb", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := argValue(args, "-hls_list_size"); v != "1800" {
+		t.Errorf("hls_list_size = %q, want 1800", v)
+	}
+	if v, _ := argValue(args, "-hls_flags"); v != "append_list" {
+		t.Errorf("hls_flags = %q, want segments kept for the DVR", v)
+	}
+
+	args, err = BuildFFmpegArgs(builtinProfile(t, "football-hd"), DVR{Mode: DVREvent}, FFmpegInput{URL: "in"}, "/hls/pb", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := argValue(args, "-hls_playlist_type"); v != "event" {
+		t.Errorf("hls_playlist_type = %q, want event", v)
+	}
+	if v, _ := argValue(args, "-hls_list_size"); v != "0" {
+		t.Errorf("hls_list_size = %q, want 0", v)
+	}
+}
+
+func TestPruneSegments(t *testing.T) {
+	dir := t.TempDir()
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:2\n" +
+		"#EXTINF:2.000,\nseg_002.ts\n#EXTINF:1.500,\nseg_003.ts\n"
+	if err := os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"seg_000.ts", "seg_001.ts", "seg_002.ts", "seg_003.ts", "seg_004.ts"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("ts"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "seg_004.ts" { // still being written
+			os.Chtimes(path, old, old)
+		}
+	}
+
+	n, err := pruneSegments(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("pruned %d segments, want 2", n)
+	}
+	for name, kept := range map[string]bool{"seg_000.ts": false, "seg_001.ts": false, "seg_002.ts": true, "seg_003.ts": true, "seg_004.ts": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("%s kept: %v, want %v", name, err == nil, kept)
+		}
+	}
+
+	segments, err := readMediaPlaylist(filepath.Join(dir, "index.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 2 || segments[1].URI != "seg_003.ts" || segments[1].Start != 2*time.Second {
+		t.Errorf("got segments %+v", segments)
+	}
+	if total := playlistDuration(segments); total != 3500*time.Millisecond {
+		t.Errorf("playlist covers %s, want 3.5s", total)
+	}
+}
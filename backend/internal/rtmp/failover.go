@@ -0,0 +1,332 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"streamcast-backend/internal/models"
+	"strings"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// Ingest inputs. Each stream takes a primary publish on its stream key and
+// a backup publish on the key with BackupKeySuffix appended, over any
+// ingest protocol. One input feeds the channel at a time, the other stands
+// by: the channel fails over to the backup once the primary has sent
+// nothing for FailoverStallTimeout (or disconnects), and back once the
+// primary has been steady for FailbackStableFor. Switches happen on a
+// keyframe of the incoming input and keep the output timeline continuous,
+// so viewers, the transcoder and the archive never see the stream end.
+// When both are gone the channel falls back to an InputSlate (slate.go).
+const (
+	InputPrimary = "primary"
+	InputBackup  = "backup"
+	InputSlate   = "slate"
+)
+
+var (
+	BackupKeySuffix      = "_backup"
+	FailoverStallTimeout = 2 * time.Second
+	FailbackStableFor    = 5 * time.Second
+)
+
+// maxFailoverEvents is how many switches a channel remembers.
+const maxFailoverEvents = 20
+
+// FailoverEvent records a change of the input feeding a channel.
+type FailoverEvent struct {
+	At     time.Time `json:"at"`
+	From   string    `json:"from,omitempty"` // empty for the first input
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+}
+
+// InputStatus describes one input of a live channel.
+type InputStatus struct {
+	Role         string    `json:"role"`
+	Active       bool      `json:"active"`
+	LastPacketAt time.Time `json:"last_packet_at"`
+}
+
+// channelInput is a publisher feeding, or standing by for, a channel.
+type channelInput struct {
+	role      string
+	publisher io.Closer
+
+	trackMap   []int  // input track index -> channel track index, -1 to drop
+	inject     []byte // parameter sets prepended to keyframes when the video differs from the channel's
+	audioDiff  bool   // audio configuration differs from the channel's
+	lastPacket time.Time
+	since      time.Time     // receiving steadily since
+	offset     time.Duration // added to its timestamps while active
+}
+
+// lookupPublisher finds the stream a publisher pushes to and the input it
+// takes: the backup for keys ending in BackupKeySuffix, the primary
+// otherwise.
+func lookupPublisher(key string) (*models.Stream, string, error) {
+	role := InputPrimary
+	if base, ok := strings.CutSuffix(key, BackupKeySuffix); ok {
+		key, role = base, InputBackup
+	}
+	stream, err := lookupStreamByKey(key)
+	return stream, role, err
+}
+
+func (ch *Channel) addInput(role string, publisher io.Closer) {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	ch.inputs[role] = &channelInput{role: role, publisher: publisher}
+}
+
+// removeInput drops an input, handing the channel to the other one if it
+// was active. It returns the number of inputs left.
+func (ch *Channel) removeInput(role string) int {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	if in := ch.inputs[role]; in != nil && in == ch.active {
+		ch.active, ch.lostRole = nil, role
+		if len(ch.inputs) > 1 {
+			log.Printf("[FAILOVER %d] %s input disconnected, waiting for a keyframe from the other input", ch.StreamID, role)
+		}
+	}
+	delete(ch.inputs, role)
+	return len(ch.inputs)
+}
+
+func (ch *Channel) hasInput(role string) bool {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	return ch.inputs[role] != nil
+}
+
+// hasHeader reports whether an input has set the channel's tracks.
+func (ch *Channel) hasHeader() bool {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	return ch.header != nil
+}
+
+// openInput records the tracks of an input. The first input to get here
+// sets the channel's tracks; later ones are mapped onto them by type.
+func (ch *Channel) openInput(role string, streams []av.CodecData) (*channelInput, error) {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	in := ch.inputs[role]
+	if in == nil {
+		return nil, fmt.Errorf("%s input is not attached", role)
+	}
+	if ch.header == nil {
+		if err := ch.Queue.WriteHeader(streams); err != nil {
+			return nil, err
+		}
+		ch.setCodecs(streams)
+		ch.header = streams
+		ch.lastOut = make([]time.Duration, len(streams))
+	}
+
+	in.trackMap = make([]int, len(streams))
+	for i, codec := range streams {
+		in.trackMap[i] = ch.matchTrack(in, codec)
+	}
+	return in, nil
+}
+
+// matchTrack returns the channel track an input's track feeds, or -1, and
+// notes how the input's codec differs from the channel's.
+func (ch *Channel) matchTrack(in *channelInput, codec av.CodecData) int {
+	for j, want := range ch.header {
+		if codec.Type() != want.Type() {
+			continue
+		}
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			if !bytes.Equal(codec.AVCDecoderConfRecordBytes(), want.(h264parser.CodecData).AVCDecoderConfRecordBytes()) {
+				in.inject = avcc(codec.SPS(), codec.PPS())
+			}
+		case aacparser.CodecData:
+			in.audioDiff = !bytes.Equal(codec.MPEG4AudioConfigBytes(), want.(aacparser.CodecData).MPEG4AudioConfigBytes())
+		}
+		return j
+	}
+	return -1
+}
+
+// writeInput queues a packet from an input if it is the active one,
+// switching inputs first when the active one stalled or left, or the
+// primary recovered.
+func (ch *Channel) writeInput(in *channelInput, pkt av.Packet) error {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+
+	now := time.Now()
+	if in.lastPacket.IsZero() || now.Sub(in.lastPacket) > FailoverStallTimeout {
+		in.since = now
+	}
+	in.lastPacket = now
+
+	idx := in.trackMap[pkt.Idx]
+	if idx < 0 {
+		return nil
+	}
+	isVideo := ch.header[idx].Type().IsVideo()
+	if in != ch.active {
+		reason := ch.switchReason(in, now)
+		if reason == "" {
+			return nil
+		}
+		if ch.hasVideo() && !(isVideo && pkt.IsKeyFrame) {
+			return nil // switch on the next keyframe
+		}
+		ch.switchTo(in, pkt.Time, now, reason)
+	}
+
+	pkt.Idx = int8(idx)
+	pkt.Time += in.offset
+	if pkt.Time < ch.lastOut[idx] {
+		return nil // the other input already wrote past it
+	}
+	ch.lastOut[idx] = pkt.Time
+	if pkt.Time >= ch.outLast {
+		ch.outLast, ch.outLastAt = pkt.Time, now
+	}
+	if isVideo && pkt.IsKeyFrame && in.inject != nil {
+		// The transcoder has the channel's parameter sets; send this
+		// input's in-band so its video still decodes.
+		pkt.Data = append(append([]byte(nil), in.inject...), pkt.Data...)
+	}
+
+	if !ch.hasVideo() || (isVideo && pkt.IsKeyFrame) {
+		ch.markKeyframe()
+	}
+	ch.countBytes(len(pkt.Data))
+	return ch.Queue.WritePacket(pkt)
+}
+
+// switchReason says why in should take over from the active input, or
+// returns "" if it should not.
+func (ch *Channel) switchReason(in *channelInput, now time.Time) string {
+	active := ch.active
+	switch {
+	case active == nil && ch.lostRole != "":
+		return ch.lostRole + " disconnected"
+	case active == nil:
+		return "publish started"
+	case in.role == InputSlate:
+		return "" // only stands in while there is no publisher
+	case active.role == InputSlate:
+		return "publish resumed"
+	case now.Sub(active.lastPacket) > FailoverStallTimeout:
+		return active.role + " stalled"
+	case in.role == InputPrimary && now.Sub(in.since) >= FailbackStableFor:
+		return "primary recovered"
+	}
+	return ""
+}
+
+// switchTo makes in the active input from its packet at srcTime. The
+// output timeline carries on from the last packet written, plus the wall
+// time since, so a stall shows as a gap rather than being cut out.
+func (ch *Channel) switchTo(in *channelInput, srcTime time.Duration, now time.Time, reason string) {
+	from := ch.lostRole
+	if ch.active != nil {
+		from = ch.active.role
+	}
+	gap := time.Duration(0)
+	if !ch.outLastAt.IsZero() {
+		gap = now.Sub(ch.outLastAt)
+	}
+	in.offset = ch.outLast + gap - srcTime
+	if ch.active != nil && ch.active.role == InputSlate && ch.active.publisher != nil {
+		go ch.active.publisher.Close() // the publisher is back, drop the slate
+	}
+	ch.active, ch.lostRole = in, ""
+
+	event := FailoverEvent{At: now, From: from, To: in.role, Reason: reason}
+	ch.events = append(ch.events, event)
+	if len(ch.events) > maxFailoverEvents {
+		ch.events = ch.events[len(ch.events)-maxFailoverEvents:]
+	}
+	if from == "" && reason == "publish started" {
+		return
+	}
+	log.Printf("[FAILOVER %d] %s -> %s: %s", ch.StreamID, from, in.role, reason)
+	if in.audioDiff {
+		log.Printf("[FAILOVER %d] Warning: %s input's audio format differs from the stream's; audio may not decode", ch.StreamID, in.role)
+	}
+}
+
+func (ch *Channel) hasVideo() bool {
+	for _, codec := range ch.header {
+		if codec.Type().IsVideo() {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveInput returns the role of the input feeding the channel, or "".
+func (ch *Channel) ActiveInput() string {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	if ch.active == nil {
+		return ""
+	}
+	return ch.active.role
+}
+
+// Inputs describes the channel's inputs, primary first.
+func (ch *Channel) Inputs() []InputStatus {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	var inputs []InputStatus
+	for _, role := range []string{InputPrimary, InputBackup, InputSlate} {
+		if in := ch.inputs[role]; in != nil {
+			inputs = append(inputs, InputStatus{Role: role, Active: in == ch.active, LastPacketAt: in.lastPacket})
+		}
+	}
+	return inputs
+}
+
+// FailoverEvents returns the channel's recent input switches, oldest first.
+func (ch *Channel) FailoverEvents() []FailoverEvent {
+	ch.ingestLock.Lock()
+	defer ch.ingestLock.Unlock()
+	return append([]FailoverEvent(nil), ch.events...)
+}
+
+// avcc returns NAL units in joy4's length-prefixed form.
+func avcc(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = binary.BigEndian.AppendUint32(out, uint32(len(nalu)))
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// IngestReport describes the inputs of a live stream.
+type IngestReport struct {
+	ActiveInput    string          `json:"active_input"`
+	Inputs         []InputStatus   `json:"inputs"`
+	FailoverEvents []FailoverEvent `json:"failover_events"`
+}
+
+// IngestReport reports on the inputs of a live stream.
+func (s *Server) IngestReport(streamID uint) (IngestReport, bool) {
+	channel := s.channels.ByStreamID(streamID)
+	if channel == nil {
+		return IngestReport{}, false
+	}
+	return IngestReport{
+		ActiveInput:    channel.ActiveInput(),
+		Inputs:         channel.Inputs(),
+		FailoverEvents: channel.FailoverEvents(),
+	}, true
+}
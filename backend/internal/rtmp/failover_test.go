@@ -0,0 +1,153 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+func TestRegistryAttachRoles(t *testing.T) {
+	registry := NewRegistry()
+	stream := &models.Stream{StreamKey: "key", PlaybackID: "pb"}
+
+	ch, created, err := registry.Attach(stream, InputPrimary, nil)
+	if err != nil || !created {
+		t.Fatalf("primary: created %v, err %v", created, err)
+	}
+	if again, created, err := registry.Attach(stream, InputBackup, nil); err != nil || created || again != ch {
+		t.Fatalf("backup: created %v, err %v, want the primary's channel", created, err)
+	}
+	if _, _, err := registry.Attach(stream, InputPrimary, nil); err == nil {
+		t.Error("second primary was accepted")
+	}
+	if registry.Detach(ch, InputPrimary) {
+		t.Error("channel shut down while the backup is still attached")
+	}
+	if registry.InputBusy("key", InputPrimary) {
+		t.Error("primary slot still busy after detaching")
+	}
+	if !registry.Detach(ch, InputBackup) {
+		t.Error("channel not shut down after its last input left")
+	}
+	if _, _, err := registry.Attach(stream, InputPrimary, nil); err == nil {
+		t.Error("publisher attached to a channel shutting down")
+	}
+}
+
+// failoverPacket is a one-NALU video packet tagged with its input.
+func failoverPacket(at time.Duration, keyframe bool, tag byte) av.Packet {
+	return av.Packet{Time: at, IsKeyFrame: keyframe, Data: []byte{0, 0, 0, 2, 0x65, tag}}
+}
+
+func TestFailoverSwitchesInputs(t *testing.T) {
+	defer func(stall, stable time.Duration) {
+		FailoverStallTimeout, FailbackStableFor = stall, stable
+	}(FailoverStallTimeout, FailbackStableFor)
+	FailoverStallTimeout, FailbackStableFor = 100*time.Millisecond, 300*time.Millisecond
+
+	registry := NewRegistry()
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}
+	ch, _, _ := registry.Attach(stream, InputPrimary, nil)
+	registry.Attach(stream, InputBackup, nil)
+	defer registry.Close(ch)
+
+	video := testCodecs(t)[:1]
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c0f162d96")
+	backupVideo, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xee, 0x3c, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := ch.openInput(InputPrimary, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backup, err := ch.openInput(InputBackup, []av.CodecData{backupVideo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	type output struct {
+		tag      byte
+		keyframe bool
+		at       time.Duration
+		data     []byte
+	}
+	var outputs []output
+	read := make(chan struct{})
+	cursor := ch.Queue.Oldest()
+	go func() {
+		defer close(read)
+		for {
+			pkt, err := cursor.ReadPacket()
+			if err != nil {
+				return
+			}
+			outputs = append(outputs, output{pkt.Data[len(pkt.Data)-1], pkt.IsKeyFrame, pkt.Time, pkt.Data})
+		}
+	}()
+
+	// Both inputs send frames 20ms apart, with a keyframe every fifth;
+	// the backup's clock is an hour ahead of the primary's.
+	frame := 20 * time.Millisecond
+	interleave := func(from, n int, primaryUp bool) {
+		for i := from; i < from+n; i++ {
+			if primaryUp {
+				ch.writeInput(primary, failoverPacket(time.Duration(i)*frame, i%5 == 0, 'P'))
+			}
+			ch.writeInput(backup, failoverPacket(time.Hour+time.Duration(i)*frame, i%5 == 0, 'B'))
+			time.Sleep(frame)
+		}
+	}
+	interleave(0, 10, true)   // primary active, backup on standby
+	interleave(11, 15, false) // primary stalls: backup takes over
+	interleave(26, 30, true)  // primary back and steady: it takes over again
+
+	want := []string{"publish started", "primary stalled", "primary recovered"}
+	events := ch.FailoverEvents()
+	if len(events) != len(want) {
+		t.Fatalf("got events %+v, want %v", events, want)
+	}
+	for i, e := range events {
+		if e.Reason != want[i] {
+			t.Errorf("event %d: %q, want %q", i, e.Reason, want[i])
+		}
+	}
+	if got := ch.ActiveInput(); got != InputPrimary {
+		t.Errorf("active input %q, want primary", got)
+	}
+
+	// The output switches P -> B -> P, each run starting on a keyframe,
+	// with time moving forward throughout.
+	registry.Close(ch)
+	<-read
+	var (
+		runs []byte
+		last time.Duration = -1
+	)
+	for _, out := range outputs {
+		if len(runs) == 0 || runs[len(runs)-1] != out.tag {
+			runs = append(runs, out.tag)
+			if !out.keyframe {
+				t.Errorf("switch to %c on a non-keyframe", out.tag)
+			}
+			if out.tag == 'B' && !bytes.Contains(out.data, backupVideo.PPS()) {
+				t.Error("backup keyframe lacks its own parameter sets")
+			}
+		}
+		if out.at <= last {
+			t.Errorf("time went from %s to %s", last, out.at)
+		}
+		last = out.at
+	}
+	if string(runs) != "PBP" {
+		t.Errorf("output came from %q, want PBP", runs)
+	}
+	if last > time.Minute {
+		t.Errorf("output time %s follows the backup's clock", last)
+	}
+}
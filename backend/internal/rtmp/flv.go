@@ -0,0 +1,163 @@
+package rtmp
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"streamcast-backend/internal/playback"
+
+	"github.com/gorilla/websocket"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/utils/bits/pio"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Players are embedded on other origins; access control is done per stream.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// flushingMuxer flushes after every FLV tag so viewers get packets as soon as
+// they arrive instead of whenever the write buffer happens to fill up.
+type flushingMuxer struct {
+	*flv.Muxer
+	bufw  *bufio.Writer
+	flush func()
+}
+
+func newFlushingMuxer(w io.Writer, flush func()) *flushingMuxer {
+	bufw := bufio.NewWriterSize(w, pio.RecommendBufioSize)
+	return &flushingMuxer{
+		Muxer: flv.NewMuxerWriteFlusher(bufw),
+		bufw:  bufw,
+		flush: flush,
+	}
+}
+
+func (m *flushingMuxer) WriteHeader(streams []av.CodecData) error {
+	if err := m.Muxer.WriteHeader(streams); err != nil {
+		return err
+	}
+	return m.Flush()
+}
+
+func (m *flushingMuxer) WritePacket(pkt av.Packet) error {
+	if err := m.Muxer.WritePacket(pkt); err != nil {
+		return err
+	}
+	return m.Flush()
+}
+
+func (m *flushingMuxer) Flush() error {
+	if err := m.bufw.Flush(); err != nil {
+		return err
+	}
+	if m.flush != nil {
+		m.flush()
+	}
+	return nil
+}
+
+// wsWriter sends every write as one binary WebSocket message.
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (w wsWriter) Write(p []byte) (int, error) {
+	if err := w.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// ServeFLV serves a stream as HTTP-FLV, or as WebSocket-FLV when the request
+// is a WebSocket upgrade (for players behind proxies that buffer chunked
+// responses). Server.Access (if set) is consulted before anything is sent.
+func (s *Server) ServeFLV(w http.ResponseWriter, r *http.Request, playbackID string) {
+	stream, err := lookupStreamByPlaybackID(playbackID)
+	if err != nil {
+		http.Error(w, "Stream is offline", http.StatusNotFound)
+		return
+	}
+	channel := s.channels.ByStreamID(stream.ID)
+	if channel == nil {
+		http.Error(w, "Stream is offline", http.StatusNotFound)
+		return
+	}
+	if err := s.checkAccess(stream, r.URL.Query().Get("token"), playback.ClientIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		s.HandleWSFLV(w, r, channel)
+		return
+	}
+	s.HandleFLV(w, r, channel)
+}
+
+// HandleFLV serves a live channel as chunked HTTP-FLV.
+func (s *Server) HandleFLV(w http.ResponseWriter, r *http.Request, channel *Channel) {
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(200)
+
+	s.viewerJoined(channel)
+	defer s.viewerLeft(channel)
+
+	var flush func()
+	if f, ok := w.(http.Flusher); ok {
+		flush = f.Flush
+	}
+	flvWriter := newFlushingMuxer(w, flush)
+	cursor := channel.Queue.Latest()
+
+	avutil.CopyFile(flvWriter, cursor)
+}
+
+// HandleWSFLV serves a live channel as FLV over a WebSocket, one or more FLV
+// tags per binary message.
+func (s *Server) HandleWSFLV(w http.ResponseWriter, r *http.Request, channel *Channel) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WebSocket-FLV upgrade failed for %s: %v", channel.PlaybackID, err)
+		return
+	}
+	defer conn.Close()
+
+	s.viewerJoined(channel)
+	defer s.viewerLeft(channel)
+
+	// Drain client frames so ping/close control messages are handled. Once
+	// the socket is closed the next write fails and ends the copy below.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	flvWriter := newFlushingMuxer(wsWriter{conn: conn}, nil)
+	cursor := channel.Queue.Latest()
+
+	avutil.CopyFile(flvWriter, cursor)
+}
+
+func (s *Server) viewerJoined(channel *Channel) {
+	saveViewerCount(channel.StreamID, channel.AddViewer())
+}
+
+func (s *Server) viewerLeft(channel *Channel) {
+	count := channel.RemoveViewer()
+	// Leave the reset to HandlePublish once the channel is gone.
+	select {
+	case <-channel.Done():
+	default:
+		saveViewerCount(channel.StreamID, count)
+	}
+}
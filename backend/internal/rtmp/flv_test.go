@@ -0,0 +1,108 @@
+package rtmp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+)
+
+func TestServeFLVOffline(t *testing.T) {
+	offline := &models.Stream{ID: 1, PlaybackID: "pb-offline"}
+	s := hlsServer(t, offline)
+
+	for _, playbackID := range []string{"pb-offline", "pb-unknown"} {
+		r := httptest.NewRequest(http.MethodGet, "/live/"+playbackID+".flv", nil)
+		w := httptest.NewRecorder()
+		s.ServeFLV(w, r, playbackID)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status %d, want %d", playbackID, w.Code, http.StatusNotFound)
+		}
+		if strings.Contains(w.Header().Get("Content-Type"), "video/x-flv") {
+			t.Errorf("%s: served as FLV", playbackID)
+		}
+	}
+}
+
+// TestServeFLVCountsViewers plays two streams and checks each counts only
+// its own viewers, from connect to disconnect.
+func TestServeFLVCountsViewers(t *testing.T) {
+	first := &models.Stream{ID: 1, StreamKey: "key-1", PlaybackID: "pb-1"}
+	second := &models.Stream{ID: 2, StreamKey: "key-2", PlaybackID: "pb-2"}
+	s := hlsServer(t, first, second)
+
+	done := make(chan struct{})
+	defer close(done)
+	var channels []*Channel
+	for _, stream := range []*models.Stream{first, second} {
+		channel, _, err := s.channels.Attach(stream, InputPrimary, io.NopCloser(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.channels.Close(channel)
+		if err := channel.Queue.WriteHeader(testCodecs(t)); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			ticker := time.NewTicker(time.Second / 30)
+			defer ticker.Stop()
+			for i := 0; ; i++ {
+				pts := time.Duration(i) * time.Second / 30
+				channel.Queue.WritePacket(av.Packet{Idx: 0, Time: pts, IsKeyFrame: i%10 == 0, Data: []byte{0, 0, 0, 4, 0x65, 1, 2, 3}})
+				channel.Queue.WritePacket(av.Packet{Idx: 1, Time: pts, Data: make([]byte, 64)})
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		channels = append(channels, channel)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.ServeFLV(w, r, strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/live/"), ".flv"))
+	}))
+	defer server.Close()
+
+	play := func(playbackID string) io.Closer {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/live/" + playbackID + ".flv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			t.Fatalf("%s: status %d", playbackID, resp.StatusCode)
+		}
+		header := make([]byte, 3)
+		if _, err := io.ReadFull(resp.Body, header); err != nil || string(header) != "FLV" {
+			resp.Body.Close()
+			t.Fatalf("%s: read %q, %v; want an FLV header", playbackID, header, err)
+		}
+		return resp.Body
+	}
+	viewers := func(want0, want1 int) func() bool {
+		return func() bool { return channels[0].Viewers() == want0 && channels[1].Viewers() == want1 }
+	}
+
+	a := play("pb-1")
+	waitFor(t, "first viewer of pb-1", viewers(1, 0))
+	b := play("pb-1")
+	waitFor(t, "second viewer of pb-1", viewers(2, 0))
+	c := play("pb-2")
+	waitFor(t, "viewer of pb-2", viewers(2, 1))
+
+	a.Close()
+	waitFor(t, "first viewer of pb-1 to leave", viewers(1, 1))
+	c.Close()
+	waitFor(t, "viewer of pb-2 to leave", viewers(1, 0))
+	b.Close()
+	waitFor(t, "all viewers to leave", viewers(0, 0))
+}
@@ -0,0 +1,194 @@
+package rtmp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"streamcast-backend/internal/hls"
+	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/playback"
+	"strings"
+)
+
+// Cache-Control values for HLS/DASH responses. Playlists change every
+// segment, so nginx may only coalesce requests for a moment; segments never
+// change once written but their names restart on every publish.
+const (
+	playlistCacheControl = "public, max-age=1"
+	segmentCacheControl  = "public, max-age=60"
+)
+
+// hlsContentTypes maps the files of a stream's output to their MIME types.
+// Anything else (e.g. ffmpeg's temporary files) is never served.
+var hlsContentTypes = map[string]string{
+	".m3u8": hls.PlaylistContentType,
+	".mpd":  hls.DASHContentType,
+	".ts":   "video/mp2t",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+}
+
+// PlaybackURLs returns the URLs players open a stream at, carrying token
+// when it is not empty: the HLS master playlist, or the LL-HLS playlist of
+// low latency streams, and the HTTP-FLV stream.
+func PlaybackURLs(stream *models.Stream, token string) (hlsURL, flvURL string) {
+	var query string
+	if token != "" {
+		query = "?" + url.Values{"token": {token}}.Encode()
+	}
+	hlsURL = "/hls/" + stream.PlaybackID + "/master.m3u8"
+	if stream.LowLatency {
+		hlsURL = "/hls/" + stream.PlaybackID + "/" + LowLatencyRendition + "/index.m3u8"
+	}
+	return hlsURL + query, "/live/" + stream.PlaybackID + ".flv" + query
+}
+
+// PlaybackAccess decides whether a viewer presenting token (possibly empty)
+// from address ip may play a stream. A non-nil error rejects the viewer.
+type PlaybackAccess func(stream *models.Stream, token, ip string) error
+
+// ServeHLS serves a file of a stream's HLS/DASH output. Unknown and offline
+// streams are rejected, then Server.Access (if set) is consulted. Playlists
+// and parts of native segmenters with LL-HLS enabled are served from memory
+// with blocking reload; content keys of encrypted streams (keys/<id>.key)
+// come from the database; everything else comes from HLSDir.
+func (s *Server) ServeHLS(w http.ResponseWriter, r *http.Request, playbackID, file string) {
+	// Clean against a rooted path so ".." can never leave the stream directory.
+	rel := strings.TrimPrefix(path.Clean("/"+file), "/")
+	dir, name := path.Split(rel)
+	contentType, ok := hlsContentTypes[path.Ext(name)]
+	if !ok && dir != "keys/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	stream, err := lookupStreamByPlaybackID(playbackID)
+	if err != nil {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	if !s.isPlayable(stream) {
+		http.Error(w, "stream is offline", http.StatusNotFound)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if err := s.checkAccess(stream, token, playback.ClientIP(r)); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if dir == "keys/" {
+		s.serveKey(w, stream, name, token, playback.ClientIP(r))
+		return
+	}
+	// Players drop the playlist's query when resolving the URIs in it, so
+	// the token has to be written into the playlists of signed streams, and
+	// of encrypted ones for their key requests.
+	var uriQuery string
+	if token != "" && (stream.PlaybackPolicy == playback.PolicySigned || stream.Encrypted) {
+		uriQuery = url.Values{"token": {token}}.Encode()
+	}
+
+	if channel := s.channels.ByPlaybackID(stream.PlaybackID); channel != nil {
+		if segmenter := channel.Segmenter(strings.TrimSuffix(dir, "/")); segmenter != nil && segmenter.PartTarget > 0 {
+			switch {
+			case name == "index.m3u8":
+				segmenter.ServePlaylist(w, r, uriQuery)
+				return
+			case hls.IsPartName(name):
+				segmenter.ServePart(w, r, name)
+				return
+			}
+		}
+	}
+
+	full := filepath.Join(HLSDir, stream.PlaybackID, filepath.FromSlash(rel))
+	if info, err := os.Stat(full); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	switch {
+	case contentType == hls.PlaylistContentType || contentType == hls.DASHContentType:
+		w.Header().Set("Cache-Control", playlistCacheControl)
+		if uriQuery != "" {
+			// Tokens differ per viewer: nothing may be shared between them.
+			w.Header().Set("Cache-Control", "private, no-cache")
+			s.serveManifestWithQuery(w, r, full, contentType, uriQuery)
+			return
+		}
+	case uriQuery != "":
+		w.Header().Set("Cache-Control", "private, max-age=60")
+	default:
+		w.Header().Set("Cache-Control", segmentCacheControl)
+	}
+	http.ServeFile(w, r, full)
+}
+
+// serveManifestWithQuery serves a playlist or MPD with uriQuery appended
+// to the URIs it references.
+func (s *Server) serveManifestWithQuery(w http.ResponseWriter, r *http.Request, full, contentType, uriQuery string) {
+	data, err := os.ReadFile(full)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if contentType == hls.DASHContentType {
+		data = hls.ManifestWithQuery(data, uriQuery)
+	} else {
+		data = hls.PlaylistWithQuery(data, uriQuery)
+	}
+	w.Write(data)
+}
+
+// serveKey releases a content key of an encrypted stream to a viewer with
+// a playback session.
+func (s *Server) serveKey(w http.ResponseWriter, stream *models.Stream, name, token, ip string) {
+	id, ok := strings.CutSuffix(name, ".key")
+	if !ok {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	if s.KeyAccess == nil {
+		http.Error(w, "key delivery is disabled", http.StatusForbidden)
+		return
+	}
+	if err := s.KeyAccess(stream, token, ip); err != nil {
+		http.Error(w, "key not released: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	key, err := lookupKey(stream.ID, id)
+	if err != nil {
+		http.Error(w, "key not found", http.StatusNotFound)
+		return
+	}
+	// Keys are per viewer session: never let nginx or the browser keep them.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(key.Key)
+}
+
+// isPlayable reports whether a stream's output may be served: it is being
+// ingested, or briefly reconnecting.
+func (s *Server) isPlayable(stream *models.Stream) bool {
+	if s.channels.ByStreamID(stream.ID) != nil {
+		return true
+	}
+	switch s.states.Status(stream.ID) {
+	case StatusStartingSoon, StatusConnecting, StatusLive, StatusReconnecting:
+		return true
+	}
+	return false
+}
+
+func (s *Server) checkAccess(stream *models.Stream, token, ip string) error {
+	if s.Access == nil {
+		return nil
+	}
+	if err := s.Access(stream, token, ip); err != nil {
+		return fmt.Errorf("playback not allowed: %w", err)
+	}
+	return nil
+}
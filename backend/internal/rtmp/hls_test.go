@@ -0,0 +1,220 @@
+package rtmp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/hls"
+	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/playback"
+)
+
+// hlsServer returns a server whose streams come from streams instead of the
+// database. Each stream gets an output in HLSDir, and those with
+// IngestStatus live are live.
+func hlsServer(t *testing.T, streams ...*models.Stream) *Server {
+	t.Helper()
+	dir := HLSDir
+	t.Cleanup(func() { HLSDir = dir })
+	HLSDir = t.TempDir()
+
+	lookup := lookupStreamByPlaybackID
+	t.Cleanup(func() { lookupStreamByPlaybackID = lookup })
+	lookupStreamByPlaybackID = func(id string) (*models.Stream, error) {
+		for _, stream := range streams {
+			if stream.PlaybackID == id {
+				return stream, nil
+			}
+		}
+		return nil, errors.New("unknown playback ID")
+	}
+
+	s := NewRtmpServer("0")
+	for _, stream := range streams {
+		files := map[string]string{
+			"master.m3u8":         "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000000\nsource/index.m3u8\n",
+			"source/index.m3u8":   "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.000,\nseg0.ts\n",
+			"source/seg0.ts":      "segment",
+			"source/index.m3u8~":  "partial playlist",
+			"source/seg1.ts.part": "partial segment",
+		}
+		for name, content := range files {
+			path := filepath.Join(HLSDir, stream.PlaybackID, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if stream.IngestStatus == StatusLive {
+			s.states.Transition(stream.ID, StatusConnecting)
+			s.states.Transition(stream.ID, StatusLive)
+		}
+	}
+	return s
+}
+
+func serveHLS(s *Server, playbackID, file, query string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/hls/"+playbackID+"/stream?"+query, nil)
+	r.RemoteAddr = "198.51.100.1:4000"
+	w := httptest.NewRecorder()
+	s.ServeHLS(w, r, playbackID, file)
+	return w
+}
+
+func TestServeHLS(t *testing.T) {
+	defer func(secret []byte) { playback.Secret = secret }(playback.Secret)
+	playback.Secret = []byte("test secret")
+
+	live := &models.Stream{ID: 1, PlaybackID: "pb-live", IngestStatus: StatusLive}
+	offline := &models.Stream{ID: 2, PlaybackID: "pb-offline"}
+	signed := &models.Stream{ID: 3, PlaybackID: "pb-signed", IngestStatus: StatusLive, PlaybackPolicy: playback.PolicySigned}
+	s := hlsServer(t, live, offline, signed)
+	s.Access = playback.Check
+	if err := os.WriteFile(filepath.Join(HLSDir, "leak.ts"), []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := playback.Sign(playback.Secret, playback.Claims{StreamID: 3, Expires: time.Now().Add(time.Hour)})
+	otherStream := playback.Sign(playback.Secret, playback.Claims{StreamID: 1, Expires: time.Now().Add(time.Hour)})
+	expired := playback.Sign(playback.Secret, playback.Claims{StreamID: 3, Expires: time.Now().Add(-time.Minute)})
+
+	for _, tc := range []struct {
+		name        string
+		playbackID  string
+		file        string
+		query       string
+		code        int
+		contentType string
+		cache       string
+	}{
+		{"master playlist", "pb-live", "master.m3u8", "", http.StatusOK, hls.PlaylistContentType, playlistCacheControl},
+		{"media playlist", "pb-live", "source/index.m3u8", "", http.StatusOK, hls.PlaylistContentType, playlistCacheControl},
+		{"segment", "pb-live", "source/seg0.ts", "", http.StatusOK, "video/mp2t", segmentCacheControl},
+		{"missing segment", "pb-live", "source/seg9.ts", "", http.StatusNotFound, "", ""},
+
+		{"temporary playlist", "pb-live", "source/index.m3u8~", "", http.StatusNotFound, "", ""},
+		{"partial segment", "pb-live", "source/seg1.ts.part", "", http.StatusNotFound, "", ""},
+		{"no extension", "pb-live", "source/seg0", "", http.StatusNotFound, "", ""},
+
+		{"another stream", "pb-live", "../pb-signed/source/seg0.ts", "", http.StatusNotFound, "", ""},
+		{"parent of the stream directory", "pb-live", "../leak.ts", "", http.StatusNotFound, "", ""},
+		{"parent of HLSDir", "pb-live", "../../../etc/passwd.ts", "", http.StatusNotFound, "", ""},
+		{"cleaned into the stream", "pb-live", "source/../source/./seg0.ts", "", http.StatusOK, "video/mp2t", segmentCacheControl},
+
+		{"unknown stream", "pb-unknown", "master.m3u8", "", http.StatusNotFound, "", ""},
+		{"offline stream", "pb-offline", "master.m3u8", "", http.StatusNotFound, "", ""},
+
+		{"signed without token", "pb-signed", "master.m3u8", "", http.StatusForbidden, "", ""},
+		{"signed segment without token", "pb-signed", "source/seg0.ts", "", http.StatusForbidden, "", ""},
+		{"signed with garbage token", "pb-signed", "master.m3u8", "token=garbage", http.StatusForbidden, "", ""},
+		{"signed with token of another stream", "pb-signed", "master.m3u8", "token=" + otherStream, http.StatusForbidden, "", ""},
+		{"signed with expired token", "pb-signed", "master.m3u8", "token=" + expired, http.StatusForbidden, "", ""},
+		{"signed playlist", "pb-signed", "source/index.m3u8", "token=" + valid, http.StatusOK, hls.PlaylistContentType, "private, no-cache"},
+		{"signed segment", "pb-signed", "source/seg0.ts", "token=" + valid, http.StatusOK, "video/mp2t", "private, max-age=60"},
+
+		{"key without key delivery", "pb-live", "keys/k1.key", "", http.StatusForbidden, "", ""},
+		{"key of a signed stream without token", "pb-signed", "keys/k1.key", "", http.StatusForbidden, "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serveHLS(s, tc.playbackID, tc.file, tc.query)
+			if w.Code != tc.code {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.code, w.Body)
+			}
+			if tc.code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tc.contentType {
+				t.Errorf("Content-Type %q, want %q", got, tc.contentType)
+			}
+			if got := w.Header().Get("Cache-Control"); got != tc.cache {
+				t.Errorf("Cache-Control %q, want %q", got, tc.cache)
+			}
+		})
+	}
+
+	// Players resolve segment URIs without the playlist's query, so the
+	// token is written into the playlist of a signed stream.
+	body := serveHLS(s, "pb-signed", "source/index.m3u8", "token="+valid).Body.String()
+	if !strings.Contains(body, "seg0.ts?token="+valid) {
+		t.Errorf("signed playlist does not pass the token on:\n%s", body)
+	}
+	if body := serveHLS(s, "pb-live", "source/index.m3u8", "").Body.String(); strings.Contains(body, "token=") {
+		t.Errorf("public playlist rewritten:\n%s", body)
+	}
+}
+
+func TestServeHLSKeyAccess(t *testing.T) {
+	live := &models.Stream{ID: 1, PlaybackID: "pb-live", IngestStatus: StatusLive, Encrypted: true}
+	s := hlsServer(t, live)
+	s.KeyAccess = func(stream *models.Stream, token, ip string) error {
+		if ip != "198.51.100.1" {
+			t.Errorf("key access checked for %q", ip)
+		}
+		if token != "session" {
+			return playback.ErrMissingToken
+		}
+		return nil
+	}
+
+	if w := serveHLS(s, "pb-live", "keys/k1.key", ""); w.Code != http.StatusForbidden {
+		t.Errorf("key without session: status %d", w.Code)
+	}
+	if w := serveHLS(s, "pb-live", "keys/k1", "token=session"); w.Code != http.StatusNotFound {
+		t.Errorf("key name without .key: status %d", w.Code)
+	}
+	if w := serveHLS(s, "pb-live", "source/../keys/k1.key", ""); w.Code != http.StatusForbidden {
+		t.Errorf("key path with dot segments: status %d, want it routed to key delivery", w.Code)
+	}
+}
+
+func TestPlaybackURLsAreServed(t *testing.T) {
+	defer func(secret []byte) { playback.Secret = secret }(playback.Secret)
+	playback.Secret = []byte("test secret")
+
+	standard := &models.Stream{ID: 1, PlaybackID: "pb-standard", IngestStatus: StatusLive, PlaybackPolicy: playback.PolicySigned}
+	lowLatency := &models.Stream{ID: 2, PlaybackID: "pb-ll", IngestStatus: StatusLive, PlaybackPolicy: playback.PolicySigned, LowLatency: true}
+	s := hlsServer(t, standard, lowLatency)
+	s.Access = playback.Check
+	llPlaylist := filepath.Join(HLSDir, "pb-ll", LowLatencyRendition, "index.m3u8")
+	if err := os.MkdirAll(filepath.Dir(llPlaylist), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(llPlaylist, []byte("#EXTM3U\n#EXT-X-TARGETDURATION:1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stream := range []*models.Stream{standard, lowLatency} {
+		token := playback.Sign(playback.Secret, playback.Claims{StreamID: stream.ID, Expires: time.Now().Add(time.Hour)})
+		hlsURL, flvURL := PlaybackURLs(stream, token)
+		if want := "/live/" + stream.PlaybackID + ".flv?token="; !strings.HasPrefix(flvURL, want) {
+			t.Errorf("%s: FLV URL %q, want prefix %q", stream.PlaybackID, flvURL, want)
+		}
+
+		// Route the URL the way the API does: /hls/:playback_id/*file.
+		u, err := url.Parse(hlsURL)
+		if err != nil {
+			t.Fatalf("%s: HLS URL %q: %v", stream.PlaybackID, hlsURL, err)
+		}
+		file, ok := strings.CutPrefix(u.Path, "/hls/"+stream.PlaybackID+"/")
+		if !ok {
+			t.Fatalf("%s: HLS URL %q is not under the stream", stream.PlaybackID, hlsURL)
+		}
+		w := serveHLS(s, stream.PlaybackID, file, u.RawQuery)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: GET %s: status %d: %s", stream.PlaybackID, hlsURL, w.Code, w.Body)
+		}
+	}
+
+	if hlsURL, _ := PlaybackURLs(standard, ""); hlsURL != "/hls/pb-standard/master.m3u8" {
+		t.Errorf("URL without token %q", hlsURL)
+	}
+}
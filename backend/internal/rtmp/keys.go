@@ -0,0 +1,192 @@
+package rtmp
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"streamcast-backend/internal/hls"
+	"streamcast-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// DefaultKeyRotation is how many segments share a content key when a
+// stream does not set KeyRotation.
+var DefaultKeyRotation = 10
+
+// KeyDir holds the key files ffmpeg encrypts with. It must not be served:
+// keys are only handed out through ServeHLS.
+var KeyDir = "/var/lib/streamcast/keys"
+
+// keyRing creates and stores the content keys of one encrypted publish.
+type keyRing struct {
+	stream   *models.Stream
+	rotation int
+
+	lock    sync.Mutex
+	index   int // seq / rotation of current
+	current *hls.Key
+	id      uint // models.HLSKey ID of current
+}
+
+func newKeyRing(stream *models.Stream) *keyRing {
+	rotation := stream.KeyRotation
+	if rotation <= 0 {
+		rotation = DefaultKeyRotation
+	}
+	return &keyRing{stream: stream, rotation: rotation}
+}
+
+// KeyFor is the hls.KeySource of the native segmenter: segments are
+// grouped into runs of rotation segments sharing one key.
+func (k *keyRing) KeyFor(seq int) (*hls.Key, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.current != nil && seq/k.rotation == k.index {
+		return k.current, nil
+	}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	k.index = seq / k.rotation
+	return k.current, nil
+}
+
+// rotate creates a new key and stores it so the key endpoint can find it.
+func (k *keyRing) rotate() error {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	record := models.HLSKey{StreamID: k.stream.ID, Key: key}
+	if err := models.DB.Create(&record).Error; err != nil {
+		return fmt.Errorf("failed to store content key: %w", err)
+	}
+	k.current = &hls.Key{URI: keyURI(k.stream.PlaybackID, record.ID), Bytes: key}
+	k.id = record.ID
+	return nil
+}
+
+func keyURI(playbackID string, id uint) string {
+	return fmt.Sprintf("/hls/%s/keys/%d.key", playbackID, id)
+}
+
+// ffmpegKeyInfo is the -hls_key_info_file of a stream. With
+// -hls_flags periodic_rekey ffmpeg re-reads it for every segment, so
+// replacing it switches keys from the next segment on.
+func ffmpegKeyInfo(playbackID string) string {
+	return filepath.Join(KeyDir, playbackID, "keyinfo.txt")
+}
+
+// rotateFFmpegKey writes a new key for ffmpeg: the key file first, then the
+// key info pointing at it. Key files of earlier keys are removed once
+// ffmpeg can no longer be reading them.
+func (k *keyRing) rotateFFmpegKey() error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	previous := k.id
+	if err := k.rotate(); err != nil {
+		return err
+	}
+	dir := filepath.Dir(ffmpegKeyInfo(k.stream.PlaybackID))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	keyFile := filepath.Join(dir, fmt.Sprintf("%d.key", k.id))
+	if err := os.WriteFile(keyFile, k.current.Bytes, 0600); err != nil {
+		return err
+	}
+	// Without an IV line ffmpeg uses the media sequence number, like
+	// players do when EXT-X-KEY has no IV.
+	info := k.current.URI + "\n" + keyFile + "\n"
+	tmp := ffmpegKeyInfo(k.stream.PlaybackID) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(info), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ffmpegKeyInfo(k.stream.PlaybackID)); err != nil {
+		return err
+	}
+	if previous != 0 {
+		stale := filepath.Join(dir, fmt.Sprintf("%d.key", previous))
+		time.AfterFunc(time.Minute, func() { os.Remove(stale) })
+	}
+	return nil
+}
+
+// runFFmpegKeyRotation switches ffmpeg to a new key every rotation
+// segments until the channel closes. It counts the segments listed by
+// playlist, the media playlist of one rendition, as ffmpeg cuts all of them
+// at the same keyframes. FFmpeg picks the new key up when it opens its next
+// segment, so the segment in progress when the count is reached still uses
+// the old key.
+func runFFmpegKeyRotation(ring *keyRing, playlist string, segmentDuration time.Duration, channel *Channel) {
+	ticker := time.NewTicker(segmentDuration / 2)
+	defer ticker.Stop()
+	var (
+		last    string // URI of the newest segment seen
+		counted int    // segments written since the last rotation
+	)
+	for {
+		select {
+		case <-ticker.C:
+		case <-channel.Done():
+			// ffmpeg is stopped before the channel closes.
+			os.RemoveAll(filepath.Dir(ffmpegKeyInfo(ring.stream.PlaybackID)))
+			return
+		}
+		segments, err := readMediaPlaylist(playlist)
+		if err != nil || len(segments) == 0 {
+			continue // not written yet
+		}
+		counted += newSegments(segments, last)
+		last = segments[len(segments)-1].URI
+		if counted < ring.rotation {
+			continue
+		}
+		if err := ring.rotateFFmpegKey(); err != nil {
+			log.Printf("Stream %d: key rotation failed, keeping the current key: %v", ring.stream.ID, err)
+			continue
+		}
+		counted = 0
+	}
+}
+
+// newSegments returns how many of segments come after the one named last.
+// A playlist without it was started over by a restarted ffmpeg, so all of
+// its segments are new.
+func newSegments(segments []playlistSegment, last string) int {
+	for i := len(segments) - 1; i >= 0; i-- {
+		if segments[i].URI == last {
+			return len(segments) - 1 - i
+		}
+	}
+	return len(segments)
+}
+
+// lookupKey returns a stored content key of a stream.
+func lookupKey(streamID uint, id string) (*models.HLSKey, error) {
+	var key models.HLSKey
+	if err := models.DB.Where("id = ? AND stream_id = ?", id, streamID).First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// deleteContentKeys deletes the stored content keys of a stream. Only
+// playable streams have their keys served, so they are useless once the
+// stream ends.
+func deleteContentKeys(streamID uint) {
+	if models.DB == nil {
+		return
+	}
+	result := models.DB.Where("stream_id = ?", streamID).Delete(&models.HLSKey{})
+	if result.Error != nil {
+		log.Printf("Stream %d: failed to delete content keys: %v", streamID, result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Stream %d: deleted %d content keys", streamID, result.RowsAffected)
+	}
+}
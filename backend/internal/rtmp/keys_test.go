@@ -0,0 +1,30 @@
+package rtmp
+
+import "testing"
+
+func TestNewSegments(t *testing.T) {
+	playlist := func(uris ...string) []playlistSegment {
+		var segments []playlistSegment
+		for _, uri := range uris {
+			segments = append(segments, playlistSegment{URI: uri})
+		}
+		return segments
+	}
+
+	for _, tc := range []struct {
+		name     string
+		segments []playlistSegment
+		last     string
+		want     int
+	}{
+		{"first look", playlist("seg_000.ts", "seg_001.ts"), "", 2},
+		{"nothing new", playlist("seg_000.ts", "seg_001.ts"), "seg_001.ts", 0},
+		{"two new", playlist("seg_001.ts", "seg_002.ts", "seg_003.ts"), "seg_001.ts", 2},
+		{"window slid", playlist("seg_004.ts", "seg_005.ts", "seg_006.ts"), "seg_004.ts", 2},
+		{"ffmpeg restarted", playlist("seg_000.ts"), "seg_006.ts", 1},
+	} {
+		if got := newSegments(tc.segments, tc.last); got != tc.want {
+			t.Errorf("%s: %d new segments, want %d", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Bitrates of the audio transcoded between WebRTC (Opus) and everything
+// else (AAC): OpusAACBitrate for WHIP publishers, WHEPOpusBitrate for WHEP
+// viewers.
+var (
+	OpusAACBitrate  = "128k"
+	WHEPOpusBitrate = "96k"
+)
+
+// opusTranscoder turns Opus (as sent by browsers) into AAC for HLS, FLV and
+// RTMP, which cannot carry Opus. Opus packets go to ffmpeg in Ogg pages;
+// AAC comes back as ADTS frames.
+type opusTranscoder struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	ogg *oggwriter.OggWriter
+	out *bufio.Reader
+
+	closeOnce sync.Once
+}
+
+func newOpusTranscoder() (*opusTranscoder, error) {
+	cmd := exec.Command(FFmpegBinary,
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-f", "ogg", "-i", "pipe:0",
+		// Fill gaps left by lost packets so the AAC timeline, which the
+		// caller derives from the frame count, stays in step with the video.
+		"-af", "aresample=async=1",
+		"-c:a", "aac", "-b:a", OpusAACBitrate, "-ar", "48000", "-ac", "2",
+		"-f", "adts", "-flush_packets", "1", "pipe:1",
+	)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+	ogg, err := oggwriter.NewWith(in, 48000, 2)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	return &opusTranscoder{cmd: cmd, in: in, ogg: ogg, out: bufio.NewReader(out)}, nil
+}
+
+// WriteOpus sends one Opus packet with its RTP timestamp (48kHz) to ffmpeg.
+func (t *opusTranscoder) WriteOpus(payload []byte, timestamp uint32) error {
+	return t.ogg.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: timestamp}, Payload: payload})
+}
+
+// ReadFrame returns the next AAC frame (without its ADTS header) and the
+// configuration it was encoded with.
+func (t *opusTranscoder) ReadFrame() (aacparser.MPEG4AudioConfig, []byte, error) {
+	header, err := t.out.Peek(7)
+	if err != nil {
+		return aacparser.MPEG4AudioConfig{}, nil, err
+	}
+	config, hdrlen, framelen, _, err := aacparser.ParseADTSHeader(header)
+	if err != nil {
+		return config, nil, err
+	}
+	frame := make([]byte, framelen)
+	if _, err := io.ReadFull(t.out, frame); err != nil {
+		return config, nil, err
+	}
+	return config, frame[hdrlen:], nil
+}
+
+// Close stops ffmpeg. Pending reads return io.EOF.
+func (t *opusTranscoder) Close() {
+	t.closeOnce.Do(func() {
+		t.in.Close()
+		t.cmd.Process.Kill()
+		t.cmd.Wait()
+	})
+}
+
+// aacTranscoder turns a channel's AAC into Opus for WebRTC, which cannot
+// carry AAC. AAC goes to ffmpeg as ADTS; Opus comes back in Ogg pages, one
+// 20ms packet per page so nothing waits for a page to fill.
+type aacTranscoder struct {
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *oggPacketReader
+
+	closeOnce sync.Once
+}
+
+func newAACTranscoder() (*aacTranscoder, error) {
+	cmd := exec.Command(FFmpegBinary,
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-f", "aac", "-i", "pipe:0",
+		"-c:a", "libopus", "-b:a", WHEPOpusBitrate, "-ar", "48000", "-ac", "2",
+		"-application", "lowdelay", "-frame_duration", "20",
+		"-f", "ogg", "-page_duration", "20000", "-flush_packets", "1", "pipe:1",
+	)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start ffmpeg: %w", err)
+	}
+	return &aacTranscoder{cmd: cmd, in: in, out: newOggPacketReader(out)}, nil
+}
+
+// WriteAAC sends one raw AAC frame to ffmpeg.
+func (t *aacTranscoder) WriteAAC(config aacparser.MPEG4AudioConfig, frame []byte) error {
+	adts := make([]byte, 7+len(frame))
+	aacparser.FillADTSHeader(adts, config, 1024, len(frame))
+	copy(adts[7:], frame)
+	_, err := t.in.Write(adts)
+	return err
+}
+
+// ReadOpus returns the next Opus packet, skipping the Ogg Opus headers.
+func (t *aacTranscoder) ReadOpus() ([]byte, error) {
+	for {
+		packet, err := t.out.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(packet, []byte("OpusHead")) || bytes.HasPrefix(packet, []byte("OpusTags")) {
+			continue
+		}
+		return packet, nil
+	}
+}
+
+// Close stops ffmpeg. Pending reads return io.EOF.
+func (t *aacTranscoder) Close() {
+	t.closeOnce.Do(func() {
+		t.in.Close()
+		t.cmd.Process.Kill()
+		t.cmd.Wait()
+	})
+}
+
+// oggPacketReader reads the packets of a single Ogg logical stream.
+type oggPacketReader struct {
+	r       *bufio.Reader
+	partial []byte   // packet continued on the next page
+	packets [][]byte // complete packets of the current page
+}
+
+func newOggPacketReader(r io.Reader) *oggPacketReader {
+	return &oggPacketReader{r: bufio.NewReader(r)}
+}
+
+func (o *oggPacketReader) ReadPacket() ([]byte, error) {
+	for len(o.packets) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	packet := o.packets[0]
+	o.packets = o.packets[1:]
+	return packet, nil
+}
+
+func (o *oggPacketReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		return err
+	}
+	if string(header[:4]) != "OggS" {
+		return errors.New("ogg: missing page capture pattern")
+	}
+	lacing := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, lacing); err != nil {
+		return err
+	}
+	size := 0
+	for _, n := range lacing {
+		size += int(n)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(o.r, body); err != nil {
+		return err
+	}
+	if header[5]&0x01 == 0 {
+		o.partial = nil // not a continuation: drop a packet cut short
+	}
+	for _, n := range lacing {
+		o.partial = append(o.partial, body[:n]...)
+		body = body[n:]
+		if n < 255 {
+			o.packets = append(o.packets, o.partial)
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+// opusDuration returns the playing time of an Opus packet from its TOC byte
+// (RFC 6716, section 3.1).
+func opusDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := packet[0] >> 3
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // hybrid: 10, 20ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT: 2.5, 5, 10, 20ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	switch packet[0] & 0x03 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return time.Duration(packet[1]&0x3f) * frame
+	}
+}
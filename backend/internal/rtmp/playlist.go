@@ -0,0 +1,77 @@
+package rtmp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"streamcast-backend/internal/hls"
+	"strings"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+// defaultPassthroughBandwidth is advertised for a stream-copied rendition
+// when the ingest bitrate is not known yet (bits per second).
+const defaultPassthroughBandwidth = 6000000
+
+// writeMasterPlaylist writes master.m3u8 for a single stream-copied
+// rendition. FFmpeg's own master playlist for copied streams lacks a usable
+// BANDWIDTH and CODECS, which some players require.
+func writeMasterPlaylist(hlsDir, rendition string, codecs []av.CodecData, bandwidth int) error {
+	if bandwidth <= 0 {
+		bandwidth = defaultPassthroughBandwidth
+	}
+
+	attrs := []string{fmt.Sprintf("BANDWIDTH=%d", bandwidth)}
+	codecStr, width, height := hlsCodecs(codecs)
+	if width > 0 && height > 0 {
+		attrs = append(attrs, fmt.Sprintf("RESOLUTION=%dx%d", width, height))
+	}
+	if codecStr != "" {
+		attrs = append(attrs, fmt.Sprintf("CODECS=\"%s\"", codecStr))
+	}
+
+	playlist := "#EXTM3U\n#EXT-X-VERSION:3\n" +
+		"#EXT-X-STREAM-INF:" + strings.Join(attrs, ",") + "\n" +
+		rendition + "/index.m3u8\n"
+	return writeFileAtomic(filepath.Join(hlsDir, "master.m3u8"), []byte(playlist))
+}
+
+// hlsCodecs returns the RFC 6381 CODECS value and video size for an
+// ingest's codecs, e.g. "avc1.64001f,mp4a.40.2".
+func hlsCodecs(codecs []av.CodecData) (codecStr string, width, height int) {
+	var parts []string
+	for _, codec := range codecs {
+		if name := hls.CodecString(codec); name != "" {
+			parts = append(parts, name)
+		}
+		if c, ok := codec.(h264parser.CodecData); ok {
+			width, height = c.Width(), c.Height()
+		}
+	}
+	return strings.Join(parts, ","), width, height
+}
+
+// canPassthrough reports whether an ingest can be repackaged into HLS
+// without re-encoding (H.264 video and/or AAC audio only).
+func canPassthrough(codecs []av.CodecData) bool {
+	if len(codecs) == 0 {
+		return false
+	}
+	for _, codec := range codecs {
+		if codec.Type() != av.H264 && codec.Type() != av.AAC {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic replaces path so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,277 @@
+package rtmp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"streamcast-backend/internal/models"
+	"strings"
+)
+
+// HLS packagers selectable per profile (models.TranscodeProfile.Packager).
+const (
+	PackagerFFmpeg = "ffmpeg"
+	// PackagerNative segments the channel queue in-process (see package
+	// hls), leaving ffmpeg only the archive recording.
+	PackagerNative = "native"
+)
+
+// FFmpegInput is the source ffmpeg reads a channel from.
+type FFmpegInput struct {
+	URL       string // e.g. "pipe:0"
+	Format    string // input format, e.g. "flv", probed if empty
+	VideoOnly bool   // the source carries no audio track
+}
+
+// BuildFFmpegArgs turns a transcoding profile into the ffmpeg command line
+// for one run: every rendition becomes an HLS variant under hlsDir (with a
+// master.m3u8), and the source is stream-copied to archivePath if set. With
+// keyInfo set, segments are AES-128 encrypted with the key it names (see
+// ffmpegKeyInfo). With a DVR the playlists cover its window (or the whole
+// broadcast) and ffmpeg deletes nothing; see runDVRPruner. Profiles using
+// the native packager only get the archive output. Renditions of a source
+// without audio are video only.
+func BuildFFmpegArgs(profile *models.TranscodeProfile, dvr DVR, input FFmpegInput, hlsDir, archivePath, keyInfo string) ([]string, error) {
+	if err := ValidateProfile(profile); err != nil {
+		return nil, err
+	}
+	audio := !input.VideoOnly
+	if profile.VideoCodec == "none" && !audio {
+		return nil, fmt.Errorf("profile %q is audio only and the source has no audio", profile.Name)
+	}
+
+	args := []string{"-y"}
+	if input.Format != "" {
+		args = append(args, "-f", input.Format)
+	}
+	args = append(args, "-i", input.URL)
+	if profile.Packager == PackagerNative {
+		if archivePath == "" {
+			return nil, fmt.Errorf("profile %q packages HLS natively and has no archive to record", profile.Name)
+		}
+		return append(args, archiveArgs(archivePath)...), nil
+	}
+
+	switch profile.VideoCodec {
+	case "none":
+		args = append(args, audioOnlyArgs(profile)...)
+	case "copy":
+		args = append(args, passthroughArgs(profile, audio)...)
+	default:
+		args = append(args, ladderArgs(profile, audio)...)
+	}
+
+	// HLS Output settings
+	flags := "delete_segments+append_list"
+	if dvr.Mode != "" {
+		flags = "append_list"
+	}
+	if keyInfo != "" {
+		flags += "+periodic_rekey"
+		args = append(args, "-hls_key_info_file", keyInfo)
+	}
+	if dvr.Mode == DVREvent {
+		args = append(args, "-hls_playlist_type", "event")
+	}
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(profile.SegmentDuration),
+		"-hls_list_size", strconv.Itoa(dvr.playlistSize(profile.SegmentDuration, profile.PlaylistSize)),
+		"-hls_flags", flags,
+		"-var_stream_map", varStreamMap(profile, audio),
+	)
+	// For stream copies the master playlist is written by us (see
+	// writeMasterPlaylist), since ffmpeg cannot fill in BANDWIDTH/CODECS.
+	if profile.VideoCodec != "copy" {
+		args = append(args, "-master_pl_name", "master.m3u8")
+	}
+	args = append(args,
+		"-hls_segment_filename", filepath.Join(hlsDir, "%v/seg_%03d.ts"),
+		filepath.Join(hlsDir, "%v/index.m3u8"),
+	)
+
+	// Archive & VOD: the source is stream-copied into a single MP4. Options
+	// given before an output file apply to that file only.
+	if archivePath != "" {
+		args = append(args, archiveArgs(archivePath)...)
+	}
+	return args, nil
+}
+
+// archiveArgs records the source as a fragmented MP4: the header is
+// written up front and every fragment is self-contained, so a recording cut
+// short by a crash or a kill still plays up to its last complete fragment.
+// Fragments start on video keyframes, and at least every 10s for audio-only
+// sources. The archive job remuxes the result into a regular MP4.
+func archiveArgs(archivePath string) []string {
+	return []string{
+		"-map", "0:v?", "-map", "0:a?",
+		"-c:v", "copy", "-c:a", "copy",
+		"-movflags", "+frag_keyframe+empty_moov+default_base_moof",
+		"-frag_duration", "10000000",
+		archivePath,
+	}
+}
+
+// ValidateProfile checks that a profile can be turned into ffmpeg arguments.
+func ValidateProfile(profile *models.TranscodeProfile) error {
+	if profile == nil {
+		return fmt.Errorf("no transcode profile")
+	}
+	if len(profile.Renditions) == 0 {
+		return fmt.Errorf("profile %q has no renditions", profile.Name)
+	}
+	if profile.SegmentDuration <= 0 || profile.PlaylistSize <= 0 {
+		return fmt.Errorf("profile %q needs a positive segment duration and playlist size", profile.Name)
+	}
+
+	switch profile.VideoCodec {
+	case "none":
+	case "copy":
+		if len(profile.Renditions) != 1 {
+			return fmt.Errorf("profile %q copies video and can only have one rendition", profile.Name)
+		}
+	case "":
+		return fmt.Errorf("profile %q has no video codec", profile.Name)
+	default:
+		for _, r := range profile.Renditions {
+			if r.Width <= 0 || r.Height <= 0 || r.VideoBitrate <= 0 {
+				return fmt.Errorf("profile %q rendition %q needs a size and video bitrate", profile.Name, r.Name)
+			}
+		}
+		if profile.FrameRate <= 0 || profile.GOPSize <= 0 {
+			return fmt.Errorf("profile %q needs a frame rate and GOP size", profile.Name)
+		}
+	}
+
+	if profile.AudioCodec == "" {
+		return fmt.Errorf("profile %q has no audio codec", profile.Name)
+	}
+
+	switch profile.Packager {
+	case "", PackagerFFmpeg:
+	case PackagerNative:
+		// The native packager only remuxes, it cannot encode.
+		if profile.VideoCodec != "copy" || profile.AudioCodec != "copy" {
+			return fmt.Errorf("profile %q: the native packager requires copy video and audio codecs", profile.Name)
+		}
+	default:
+		return fmt.Errorf("profile %q has an unknown packager %q", profile.Name, profile.Packager)
+	}
+	if profile.AudioCodec != "copy" {
+		for _, r := range profile.Renditions {
+			if r.AudioBitrate <= 0 {
+				return fmt.Errorf("profile %q rendition %q needs an audio bitrate", profile.Name, r.Name)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range profile.Renditions {
+		if r.Name == "" || strings.ContainsAny(r.Name, "/\\ ,:") {
+			return fmt.Errorf("profile %q has an invalid rendition name %q", profile.Name, r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("profile %q has duplicate rendition %q", profile.Name, r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// ladderArgs scales the source once per rendition and encodes each scaled
+// copy with its own bitrate.
+func ladderArgs(profile *models.TranscodeProfile, audio bool) []string {
+	n := len(profile.Renditions)
+
+	var filter strings.Builder
+	fmt.Fprintf(&filter, "[0:v]split=%d", n)
+	for i := range profile.Renditions {
+		fmt.Fprintf(&filter, "[v%d]", i)
+	}
+	for i, r := range profile.Renditions {
+		fmt.Fprintf(&filter, ";[v%d]scale=w=%d:h=%d[out%d]", i, r.Width, r.Height, i)
+	}
+
+	args := []string{"-filter_complex", filter.String()}
+	for i, r := range profile.Renditions {
+		idx := strconv.Itoa(i)
+		args = append(args, "-map", "[out"+idx+"]")
+		if audio {
+			args = append(args, "-map", "0:a")
+		}
+		args = append(args,
+			"-c:v:"+idx, profile.VideoCodec,
+			"-b:v:"+idx, kbps(r.VideoBitrate),
+			"-maxrate:v:"+idx, kbps(r.VideoBitrate),
+			"-bufsize:v:"+idx, kbps(2*r.VideoBitrate),
+		)
+		if audio {
+			args = append(args, audioCodecArgs(profile, i, r)...)
+		}
+	}
+
+	if profile.Preset != "" {
+		args = append(args, "-preset", profile.Preset)
+	}
+	if profile.Tune != "" {
+		args = append(args, "-tune", profile.Tune)
+	}
+	gop := strconv.Itoa(profile.GOPSize)
+	args = append(args,
+		"-g", gop, "-keyint_min", gop, "-sc_threshold", "0",
+		"-r", strconv.Itoa(profile.FrameRate),
+		"-ac", "2", "-ar", "44100",
+	)
+	return args
+}
+
+// passthroughArgs repackages the source without touching the video.
+func passthroughArgs(profile *models.TranscodeProfile, audio bool) []string {
+	args := []string{"-map", "0:v", "-map", "0:a?", "-c:v:0", "copy"}
+	if !audio {
+		return args
+	}
+	return append(args, audioCodecArgs(profile, 0, profile.Renditions[0])...)
+}
+
+func audioOnlyArgs(profile *models.TranscodeProfile) []string {
+	var args []string
+	for i, r := range profile.Renditions {
+		args = append(args, "-map", "0:a")
+		args = append(args, audioCodecArgs(profile, i, r)...)
+	}
+	if profile.AudioCodec != "copy" {
+		args = append(args, "-ac", "2", "-ar", "44100")
+	}
+	return args
+}
+
+func audioCodecArgs(profile *models.TranscodeProfile, i int, r models.Rendition) []string {
+	idx := strconv.Itoa(i)
+	if profile.AudioCodec == "copy" {
+		return []string{"-c:a:" + idx, "copy"}
+	}
+	return []string{"-c:a:" + idx, profile.AudioCodec, "-b:a:" + idx, kbps(r.AudioBitrate)}
+}
+
+// varStreamMap pairs each rendition's streams for ffmpeg's HLS muxer, e.g.
+// "v:0,a:0,name:1080p v:1,a:1,name:720p".
+func varStreamMap(profile *models.TranscodeProfile, audio bool) string {
+	entries := make([]string, len(profile.Renditions))
+	for i, r := range profile.Renditions {
+		switch {
+		case profile.VideoCodec == "none":
+			entries[i] = fmt.Sprintf("a:%d,name:%s", i, r.Name)
+		case !audio:
+			entries[i] = fmt.Sprintf("v:%d,name:%s", i, r.Name)
+		default:
+			entries[i] = fmt.Sprintf("v:%d,a:%d,name:%s", i, i, r.Name)
+		}
+	}
+	return strings.Join(entries, " ")
+}
+
+func kbps(v int) string {
+	return strconv.Itoa(v) + "k"
+}
@@ -0,0 +1,187 @@
+package rtmp
+
+import (
+	"strings"
+	"testing"
+
+	"streamcast-backend/internal/models"
+)
+
+func builtinProfile(t *testing.T, name string) *models.TranscodeProfile {
+	t.Helper()
+	for _, profile := range models.BuiltinTranscodeProfiles() {
+		if profile.Name == name {
+			return &profile
+		}
+	}
+	t.Fatalf("no built-in profile %q", name)
+	return nil
+}
+
+// argValue returns the value following flag in args.
+func argValue(args []string, flag string) (string, bool) {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1], true
+		}
+	}
+	return "", false
+}
+
+func TestBuiltinProfilesAreValid(t *testing.T) {
+	for _, profile := range models.BuiltinTranscodeProfiles() {
+		if err := ValidateProfile(&profile); err != nil {
+			t.Errorf("built-in profile %s: %v", profile.Name, err)
+		}
+	}
+}
+
+func TestBuildFFmpegArgsLadder(t *testing.T) {
+	args, err := BuildFFmpegArgs(builtinProfile(t, "football-hd"), DVR{}, FFmpegInput{URL: "rtmp://localhost:1935/live/key"}, "/hls/pb", "/archive/a.mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, _ := argValue(args, "-filter_complex")
+	if !strings.HasPrefix(filter, "[0:v]split=4[v0][v1][v2][v3]") || !strings.Contains(filter, "[v3]scale=w=426:h=240[out3]") {
+		t.Errorf("unexpected filter graph %q", filter)
+	}
+	if v, _ := argValue(args, "-b:v:1"); v != "2000k" {
+		t.Errorf("720p bitrate = %q, want 2000k", v)
+	}
+	if v, _ := argValue(args, "-b:a:3"); v != "64k" {
+		t.Errorf("240p audio bitrate = %q, want 64k", v)
+	}
+	if v, _ := argValue(args, "-var_stream_map"); v != "v:0,a:0,name:1080p v:1,a:1,name:720p v:2,a:2,name:480p v:3,a:3,name:240p" {
+		t.Errorf("unexpected var_stream_map %q", v)
+	}
+	if v, _ := argValue(args, "-hls_time"); v != "2" {
+		t.Errorf("hls_time = %q, want 2", v)
+	}
+	if v, _ := argValue(args, "-preset"); v != "ultrafast" {
+		t.Errorf("preset = %q, want ultrafast", v)
+	}
+	if args[len(args)-1] != "/archive/a.mp4" {
+		t.Errorf("archive must be the last output, got %q", args[len(args)-1])
+	}
+	if v, _ := argValue(args, "-movflags"); !strings.Contains(v, "frag_keyframe") || !strings.Contains(v, "empty_moov") {
+		t.Errorf("archive movflags = %q, want a fragmented MP4 that survives a kill", v)
+	}
+	args, _ = BuildFFmpegArgs(builtinProfile(t, "football-hd"), DVR{}, FFmpegInput{URL: "pipe:0", Format: "flv"}, "/hls/pb", "", "")
+	if strings.Join(args[:5], " ") != "-y -f flv -i pipe:0" {
+		t.Errorf("stdin input args %q", args[:5])
+	}
+}
+
+func TestBuildFFmpegArgsPassthrough(t *testing.T) {
+	profile := builtinProfile(t, "passthrough")
+	profile.Packager = PackagerFFmpeg
+	args, err := BuildFFmpegArgs(profile, DVR{}, FFmpegInput{URL: "in"}, "/hls/pb", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := argValue(args, "-filter_complex"); ok {
+		t.Error("passthrough must not scale")
+	}
+	if v, _ := argValue(args, "-c:v:0"); v != "copy" {
+		t.Errorf("video codec = %q, want copy", v)
+	}
+	if v, _ := argValue(args, "-var_stream_map"); v != "v:0,a:0,name:source" {
+		t.Errorf("unexpected var_stream_map %q", v)
+	}
+	if _, ok := argValue(args, "-master_pl_name"); ok {
+		t.Error("passthrough master playlist is written by writeMasterPlaylist, not ffmpeg")
+	}
+	if v, _ := argValue(args[2:], "-map"); v != "0:v" || !strings.Contains(strings.Join(args, " "), "-map 0:a?") {
+		t.Errorf("passthrough must tolerate sources without audio: %v", args)
+	}
+	if args[len(args)-1] != "/hls/pb/%v/index.m3u8" {
+		t.Errorf("without an archive the playlist is the last output, got %q", args[len(args)-1])
+	}
+}
+
+func TestBuildFFmpegArgsNativePackager(t *testing.T) {
+	profile := builtinProfile(t, "passthrough")
+	args, err := BuildFFmpegArgs(profile, DVR{}, FFmpegInput{URL: "in"}, "/hls/pb", "/archive/a.mp4", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"-y", "-i", "in"}, archiveArgs("/archive/a.mp4")...)
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("native packager leaves ffmpeg only the archive, got %v", args)
+	}
+
+	if _, err := BuildFFmpegArgs(profile, DVR{}, FFmpegInput{URL: "in"}, "/hls/pb", "", ""); err == nil {
+		t.Error("expected an error when there is nothing for ffmpeg to do")
+	}
+}
+
+func TestBuildFFmpegArgsAudioOnly(t *testing.T) {
+	args, err := BuildFFmpegArgs(builtinProfile(t, "audio-only"), DVR{}, FFmpegInput{URL: "in"}, "/hls/pb", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-c:v") {
+			t.Errorf("audio-only profile sets a video codec: %v", args)
+		}
+	}
+	if v, _ := argValue(args, "-var_stream_map"); v != "a:0,name:audio" {
+		t.Errorf("unexpected var_stream_map %q", v)
+	}
+}
+
+func TestBuildFFmpegArgsEncryption(t *testing.T) {
+	args, err := BuildFFmpegArgs(builtinProfile(t, "football-hd"), DVR{}, FFmpegInput{URL: "in"}, "/hls/pb", "", "/keys/pb/keyinfo.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := argValue(args, "-hls_key_info_file"); v != "/keys/pb/keyinfo.txt" {
+		t.Errorf("hls_key_info_file = %q", v)
+	}
+	if v, _ := argValue(args, "-hls_flags"); !strings.Contains(v, "periodic_rekey") {
+		t.Errorf("key rotation needs periodic_rekey, got hls_flags %q", v)
+	}
+}
+
+func TestValidateProfileRejectsBadInput(t *testing.T) {
+	cases := map[string]models.TranscodeProfile{
+		"no renditions": {Name: "x", VideoCodec: "libx264", AudioCodec: "aac", SegmentDuration: 2, PlaylistSize: 6, FrameRate: 30, GOPSize: 60},
+		"copy ladder": {Name: "x", VideoCodec: "copy", AudioCodec: "copy", SegmentDuration: 2, PlaylistSize: 6,
+			Renditions: []models.Rendition{{Name: "a"}, {Name: "b"}}},
+		"bad name": {Name: "x", VideoCodec: "none", AudioCodec: "aac", SegmentDuration: 2, PlaylistSize: 6,
+			Renditions: []models.Rendition{{Name: "../etc", AudioBitrate: 64}}},
+		"missing bitrate": {Name: "x", VideoCodec: "libx264", AudioCodec: "aac", SegmentDuration: 2, PlaylistSize: 6, FrameRate: 30, GOPSize: 60,
+			Renditions: []models.Rendition{{Name: "720p", Width: 1280, Height: 720, AudioBitrate: 128}}},
+		"native transcode": {Name: "x", VideoCodec: "none", AudioCodec: "aac", Packager: PackagerNative, SegmentDuration: 2, PlaylistSize: 6,
+			Renditions: []models.Rendition{{Name: "audio", AudioBitrate: 64}}},
+		"unknown packager": {Name: "x", VideoCodec: "copy", AudioCodec: "copy", Packager: "gstreamer", SegmentDuration: 2, PlaylistSize: 6,
+			Renditions: []models.Rendition{{Name: "source"}}},
+	}
+	for name, profile := range cases {
+		if err := ValidateProfile(&profile); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestBuildFFmpegArgsVideoOnlySource(t *testing.T) {
+	passthrough := builtinProfile(t, "passthrough")
+	passthrough.Packager = PackagerFFmpeg
+	for _, profile := range []*models.TranscodeProfile{passthrough, builtinProfile(t, "football-hd")} {
+		args, err := BuildFFmpegArgs(profile, DVR{}, FFmpegInput{URL: "in", VideoOnly: true}, "/hls/pb", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		joined := strings.Join(args, " ")
+		if strings.Contains(joined, "-map 0:a ") || strings.Contains(joined, "-c:a:") {
+			t.Errorf("%s maps audio of a video-only source: %q", profile.Name, joined)
+		}
+		if v, _ := argValue(args, "-var_stream_map"); strings.Contains(v, "a:") {
+			t.Errorf("%s var_stream_map %q references audio", profile.Name, v)
+		}
+	}
+	if _, err := BuildFFmpegArgs(builtinProfile(t, "audio-only"), DVR{}, FFmpegInput{URL: "in", VideoOnly: true}, "/hls/pb", "", ""); err == nil {
+		t.Error("audio-only profile accepted a source without audio")
+	}
+}
@@ -0,0 +1,331 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"streamcast-backend/internal/hls"
+	"streamcast-backend/internal/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/flv"
+	"github.com/nareix/joy4/format/rtmp"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// Stream source types (models.Stream.SourceType). An empty type is push.
+const (
+	SourcePush = "push"
+	SourcePull = "pull"
+)
+
+// Pull ingest: sources are reconnected with backoff as long as the pull
+// runs, like restream targets. Scheduled pulls are started and stopped
+// within PullScheduleInterval of their times.
+var (
+	PullBackoffMin       = 2 * time.Second
+	PullBackoffMax       = 30 * time.Second
+	PullStableAfter      = time.Minute
+	PullDialTimeout      = 10 * time.Second
+	PullScheduleInterval = 10 * time.Second
+)
+
+// pullClient fetches HTTP-FLV and HLS sources. It has no overall timeout:
+// an HTTP-FLV response lasts as long as the stream.
+var pullClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: PullDialTimeout}).DialContext,
+		TLSHandshakeTimeout:   PullDialTimeout,
+		ResponseHeaderTimeout: PullDialTimeout,
+	},
+}
+
+// Pull source protocols, told apart by URL.
+const (
+	pullRTMP = "rtmp"
+	pullFLV  = "http-flv"
+	pullHLS  = "hls"
+)
+
+func pullProtocol(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid source URL %q", rawURL)
+	}
+	switch u.Scheme {
+	case "rtmp":
+		return pullRTMP, nil
+	case "http", "https":
+		if strings.HasSuffix(u.Path, ".m3u8") {
+			return pullHLS, nil
+		}
+		return pullFLV, nil
+	}
+	return "", fmt.Errorf("source URL must be rtmp://, or http(s):// for HTTP-FLV and HLS (.m3u8), got %q", rawURL)
+}
+
+// ValidateSource checks a stream's source settings.
+func ValidateSource(stream *models.Stream) error {
+	switch stream.SourceType {
+	case "", SourcePush:
+		return nil
+	case SourcePull:
+	default:
+		return fmt.Errorf("unknown source type %q", stream.SourceType)
+	}
+	if _, err := pullProtocol(stream.SourceURL); err != nil {
+		return err
+	}
+	if stream.PullStartAt != nil && stream.PullStopAt != nil && !stream.PullStopAt.After(*stream.PullStartAt) {
+		return errors.New("pull_stop_at must be after pull_start_at")
+	}
+	return nil
+}
+
+// openPullSource connects to a pull source and returns it as a demuxer
+// whose timestamps start at zero.
+func openPullSource(rawURL string) (av.DemuxCloser, error) {
+	protocol, err := pullProtocol(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch protocol {
+	case pullRTMP:
+		conn, err := rtmp.DialTimeout(rawURL, PullDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return &rebasedSource{Demuxer: conn, Closer: conn}, nil
+	case pullHLS:
+		r := hls.NewPlaylistReader(pullClient, rawURL)
+		return &rebasedSource{Demuxer: ts.NewDemuxer(r), Closer: r}, nil
+	default:
+		resp, err := pullClient.Get(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+		}
+		return &rebasedSource{Demuxer: flv.NewDemuxer(resp.Body), Closer: resp.Body}, nil
+	}
+}
+
+// rebasedSource rebases a remote source's timestamps, which continue the
+// origin's clock (for MPEG-TS, an arbitrary 33-bit clock), to start at zero.
+type rebasedSource struct {
+	av.Demuxer
+	io.Closer
+
+	started bool
+	base    time.Duration
+}
+
+func (p *rebasedSource) ReadPacket() (av.Packet, error) {
+	pkt, err := p.Demuxer.ReadPacket()
+	if err != nil {
+		return pkt, err
+	}
+	if !p.started {
+		p.started, p.base = true, pkt.Time
+	}
+	pkt.Time -= p.base
+	if pkt.Time < 0 {
+		// Another track started slightly before the first packet.
+		pkt.Time = 0
+	}
+	return pkt, nil
+}
+
+// puller runs one stream's pull ingest until stopped.
+type puller struct {
+	stream models.Stream
+
+	lock     sync.Mutex
+	source   io.Closer // open source, if any
+	stop     chan struct{}
+	stopOnce sync.Once
+	finished chan struct{}
+}
+
+// StartPull starts pulling a stream from its source URL. Starting a pull is
+// an explicit operator action, so it lifts the cooldown of a recent stop.
+func (s *Server) StartPull(stream *models.Stream) error {
+	if stream.SourceType != SourcePull {
+		return errors.New("stream is not a pull source")
+	}
+	if err := ValidateSource(stream); err != nil {
+		return err
+	}
+	s.unblockKey(stream.StreamKey)
+	return s.startPull(stream)
+}
+
+func (s *Server) startPull(stream *models.Stream) error {
+	s.pullLock.Lock()
+	defer s.pullLock.Unlock()
+
+	if _, running := s.pulls[stream.ID]; running {
+		return errors.New("stream is already being pulled")
+	}
+	// A channel on its starting soon slate waits for this pull.
+	if s.channels.InputBusy(stream.StreamKey, InputPrimary) {
+		return errors.New("stream is already live")
+	}
+	p := &puller{
+		stream:   *stream,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+	s.pulls[stream.ID] = p
+	go s.runPull(p)
+	return nil
+}
+
+// isPulling reports whether a pull is running for a stream.
+func (s *Server) isPulling(streamID uint) bool {
+	s.pullLock.Lock()
+	defer s.pullLock.Unlock()
+	_, running := s.pulls[streamID]
+	return running
+}
+
+// stopPull stops a stream's pull, closing its source so the channel ends.
+// It reports whether a pull was running.
+func (s *Server) stopPull(streamID uint) bool {
+	s.pullLock.Lock()
+	p, running := s.pulls[streamID]
+	delete(s.pulls, streamID)
+	s.pullLock.Unlock()
+	if !running {
+		return false
+	}
+	p.stopOnce.Do(func() {
+		close(p.stop)
+		p.lock.Lock()
+		if p.source != nil {
+			p.source.Close()
+		}
+		p.lock.Unlock()
+	})
+	return true
+}
+
+// runPull feeds the stream's channel from its source, reconnecting with
+// backoff whenever the source fails or ends, until the pull is stopped.
+func (s *Server) runPull(p *puller) {
+	defer close(p.finished)
+	stream := &p.stream
+	log.Printf("Pulling stream %d from %s", stream.ID, stream.SourceURL)
+
+	backoff := PullBackoffMin
+	for {
+		started := time.Now()
+		src, err := openPullSource(stream.SourceURL)
+		if err == nil {
+			if !p.setSource(src) {
+				src.Close()
+				return
+			}
+			s.runSource(stream, InputPrimary, src, src)
+			p.setSource(nil)
+			src.Close()
+			err = errors.New("source ended")
+		}
+		if p.isStopping() {
+			log.Printf("Stopped pulling stream %d", stream.ID)
+			return
+		}
+		if time.Since(started) >= PullStableAfter {
+			backoff = PullBackoffMin
+		}
+
+		log.Printf("[PULL %d] %v, reconnecting in %s", stream.ID, err, backoff)
+		select {
+		case <-p.stop:
+			log.Printf("Stopped pulling stream %d", stream.ID)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > PullBackoffMax {
+			backoff = PullBackoffMax
+		}
+	}
+}
+
+// setSource records the open source so a stop can close it. It reports
+// false if the pull was stopped in the meantime.
+func (p *puller) setSource(src io.Closer) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if src != nil && p.isStopping() {
+		return false
+	}
+	p.source = src
+	return true
+}
+
+func (p *puller) isStopping() bool {
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// runPullScheduler starts and stops scheduled pulls.
+func (s *Server) runPullScheduler() {
+	ticker := time.NewTicker(PullScheduleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.schedulePulls(now)
+	}
+}
+
+// schedulePulls starts every pull whose start time has passed, once per
+// scheduled start (a pull the operator stopped stays stopped), and stops
+// those whose stop time has passed.
+func (s *Server) schedulePulls(now time.Time) {
+	if models.DB == nil {
+		return
+	}
+	var streams []models.Stream
+	if err := models.DB.Where("source_type = ? AND pull_start_at IS NOT NULL", SourcePull).Find(&streams).Error; err != nil {
+		log.Printf("Pull scheduler: failed to load streams: %v", err)
+		return
+	}
+
+	for i := range streams {
+		stream := &streams[i]
+		if stream.PullStopAt != nil && !now.Before(*stream.PullStopAt) {
+			if s.isPulling(stream.ID) {
+				log.Printf("Stream %d reached its scheduled stop", stream.ID)
+				go s.StopStream(stream, 0)
+			}
+			continue
+		}
+		if now.Before(*stream.PullStartAt) || s.scheduledStarts[stream.ID].Equal(*stream.PullStartAt) {
+			continue
+		}
+		if _, blocked := s.blockedUntil(stream.StreamKey); blocked {
+			continue
+		}
+		s.scheduledStarts[stream.ID] = *stream.PullStartAt
+		if err := s.startPull(stream); err != nil {
+			log.Printf("Stream %d: scheduled pull not started: %v", stream.ID, err)
+			continue
+		}
+		log.Printf("Stream %d reached its scheduled start", stream.ID)
+	}
+}
@@ -0,0 +1,182 @@
+package rtmp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+// startOrigin serves channel to RTMP players, standing in for a remote
+// source. It returns the origin's rtmp:// URL.
+func startOrigin(t *testing.T, channel *Channel) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := &rtmp.Server{Addr: addr, HandlePlay: func(conn *rtmp.Conn) {
+		defer conn.Close()
+		avutil.CopyFile(flushingConn{conn}, channel.Queue.Latest())
+	}}
+	go srv.ListenAndServe()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return "rtmp://" + addr + "/live/origin"
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("origin server did not start")
+	return ""
+}
+
+// flushingConn sends every packet right away; the test stream is too thin
+// to fill joy4's write buffer.
+type flushingConn struct{ *rtmp.Conn }
+
+func (c flushingConn) WritePacket(pkt av.Packet) error {
+	if err := c.Conn.WritePacket(pkt); err != nil {
+		return err
+	}
+	return c.Conn.WriteTrailer()
+}
+
+// checkPullSource reads from a pull source and checks it carries the
+// channel's codecs with timestamps rebased to zero.
+func checkPullSource(t *testing.T, rawURL string) {
+	t.Helper()
+	src, err := openPullSource(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	streams, err := src.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 || streams[0].Type() != av.H264 || streams[1].Type() != av.AAC {
+		t.Fatalf("source codecs = %v", streams)
+	}
+	var last time.Duration
+	for i := 0; i < 30; i++ {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 && pkt.Time != 0 {
+			t.Errorf("first packet at %s, want 0", pkt.Time)
+		}
+		last = pkt.Time
+	}
+	if last > 5*time.Second {
+		t.Errorf("timestamps were not rebased: %s after 30 packets", last)
+	}
+}
+
+func TestOpenPullSourceRTMP(t *testing.T) {
+	channel, stop := liveChannel(t)
+	defer stop()
+	// Start the origin's clock well past zero, as a long-running source's.
+	time.Sleep(100 * time.Millisecond)
+
+	checkPullSource(t, startOrigin(t, channel))
+}
+
+func TestOpenPullSourceHTTPFLV(t *testing.T) {
+	channel, stop := liveChannel(t)
+	defer stop()
+
+	s := NewRtmpServer("0")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.HandleFLV(w, r, channel)
+	}))
+	defer origin.Close()
+
+	checkPullSource(t, origin.URL+"/live/origin.flv")
+}
+
+func TestStopStreamStopsPull(t *testing.T) {
+	saved := PullBackoffMin
+	PullBackoffMin = time.Hour
+	defer func() { PullBackoffMin = saved }()
+
+	// Nothing listens on the source, so the pull waits to reconnect.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := NewRtmpServer("0")
+	stream := &models.Stream{ID: 9, StreamKey: "key", PlaybackID: "pb", SourceType: SourcePull, SourceURL: "rtmp://" + addr + "/live/x"}
+	if err := s.StartPull(stream); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.StartPull(stream); err == nil {
+		t.Error("a second pull of the same stream must be refused")
+	}
+	p := s.pulls[stream.ID]
+
+	if !s.StopStream(stream, 0) {
+		t.Error("StopStream should report the stopped pull")
+	}
+	select {
+	case <-p.finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pull did not stop")
+	}
+	if s.isPulling(stream.ID) {
+		t.Error("stream is still pulling after StopStream")
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	start := time.Date(2026, 5, 1, 18, 0, 0, 0, time.UTC)
+	stop := start.Add(2 * time.Hour)
+	for _, stream := range []models.Stream{
+		{},
+		{SourceType: SourcePush},
+		{SourceType: SourcePull, SourceURL: "rtmp://origin/live/feed"},
+		{SourceType: SourcePull, SourceURL: "https://origin/live/feed.flv"},
+		{SourceType: SourcePull, SourceURL: "https://origin/live/index.m3u8?x=1", PullStartAt: &start, PullStopAt: &stop},
+	} {
+		if err := ValidateSource(&stream); err != nil {
+			t.Errorf("%+v rejected: %v", stream, err)
+		}
+	}
+
+	for name, stream := range map[string]models.Stream{
+		"unknown type":  {SourceType: "ndi"},
+		"no url":        {SourceType: SourcePull},
+		"bad scheme":    {SourceType: SourcePull, SourceURL: "ftp://origin/feed"},
+		"stop <= start": {SourceType: SourcePull, SourceURL: "rtmp://origin/live/feed", PullStartAt: &stop, PullStopAt: &start},
+		"no host":       {SourceType: SourcePull, SourceURL: "rtmp:///live/feed"},
+	} {
+		if err := ValidateSource(&stream); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	for rawURL, want := range map[string]string{
+		"rtmp://origin/live/feed":      pullRTMP,
+		"http://origin/live/feed.flv":  pullFLV,
+		"http://origin/hls/index.m3u8": pullHLS,
+	} {
+		if got, _ := pullProtocol(rawURL); got != want {
+			t.Errorf("pullProtocol(%s) = %s, want %s", rawURL, got, want)
+		}
+	}
+}
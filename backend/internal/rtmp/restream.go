@@ -0,0 +1,334 @@
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"streamcast-backend/internal/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/av/avutil"
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+// Reconnect policy of restream targets, as for the transcoder: the first
+// retry waits RestreamBackoffMin, doubling up to RestreamBackoffMax. A
+// connection that stayed up for RestreamStableAfter resets the backoff.
+var (
+	RestreamBackoffMin  = time.Second
+	RestreamBackoffMax  = 30 * time.Second
+	RestreamStableAfter = time.Minute
+	RestreamDialTimeout = 10 * time.Second
+)
+
+// Restream states, reported per target.
+const (
+	RestreamConnecting   = "connecting"
+	RestreamLive         = "live"
+	RestreamReconnecting = "reconnecting"
+	RestreamStopped      = "stopped"
+)
+
+// RestreamStatus is a snapshot of a restreamer, served by the admin API.
+type RestreamStatus struct {
+	TargetID    uint       `json:"target_id"`
+	Name        string     `json:"name"`
+	URL         string     `json:"url"` // without the stream key
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	Packets     int64      `json:"packets"` // sent over the current connection
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Restreamer relays a channel to one external RTMP ingest, reconnecting
+// with backoff whenever the destination drops the connection.
+type Restreamer struct {
+	target models.RestreamTarget
+
+	lock        sync.Mutex
+	conn        *rtmp.Conn
+	state       string
+	attempts    int
+	connectedAt time.Time
+	packets     int64
+	lastError   string
+	lastErrorAt time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	finished chan struct{}
+}
+
+func NewRestreamer(target models.RestreamTarget) *Restreamer {
+	return &Restreamer{
+		target:   target,
+		state:    RestreamConnecting,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// RestreamURL is the RTMP URL published to: the target URL with the stream
+// key as the stream name.
+func RestreamURL(target models.RestreamTarget) string {
+	if target.StreamKey == "" {
+		return target.URL
+	}
+	return strings.TrimSuffix(target.URL, "/") + "/" + target.StreamKey
+}
+
+// ValidateRestreamTarget checks that a target can be published to.
+func ValidateRestreamTarget(target *models.RestreamTarget) error {
+	u, err := url.Parse(target.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("restream target %q has an invalid URL", target.Name)
+	}
+	if u.Scheme != "rtmp" {
+		// joy4's client speaks plain RTMP only.
+		return fmt.Errorf("restream target %q must use an rtmp:// URL", target.Name)
+	}
+	if strings.Contains(target.StreamKey, "/") {
+		return fmt.Errorf("restream target %q has an invalid stream key", target.Name)
+	}
+	return nil
+}
+
+// Run relays channel until it closes or Stop is called. Every connection
+// starts on the latest keyframe.
+func (r *Restreamer) Run(channel *Channel) {
+	defer close(r.finished)
+	defer r.setState(RestreamStopped)
+
+	select {
+	case <-channel.Keyframe():
+	case <-channel.Done():
+		return
+	case <-r.stop:
+		return
+	}
+
+	backoff := RestreamBackoffMin
+	for {
+		started := time.Now()
+		err := r.runOnce(channel)
+		if err == nil || r.isStopping() {
+			// The channel ended (or we were told to stop).
+			return
+		}
+		r.recordError(err)
+		if time.Since(started) >= RestreamStableAfter {
+			backoff = RestreamBackoffMin
+		}
+
+		log.Printf("[RESTREAM %d %s] %v, reconnecting in %s", r.target.StreamID, r.target.Name, err, backoff)
+		r.setState(RestreamReconnecting)
+		select {
+		case <-r.stop:
+			return
+		case <-channel.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > RestreamBackoffMax {
+			backoff = RestreamBackoffMax
+		}
+	}
+}
+
+// runOnce publishes to the target until the channel ends (nil) or the
+// connection fails.
+func (r *Restreamer) runOnce(channel *Channel) error {
+	r.lock.Lock()
+	r.attempts++
+	r.packets = 0
+	r.lock.Unlock()
+
+	conn, err := rtmp.DialTimeout(RestreamURL(r.target), RestreamDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.lock.Lock()
+	r.conn = conn
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		r.conn = nil
+		r.lock.Unlock()
+	}()
+	if r.isStopping() {
+		// Stop raced with the dial; it could not see this connection yet.
+		return errors.New("stopped")
+	}
+
+	return avutil.CopyFile(&restreamMuxer{conn: conn, r: r}, channel.Queue.DelayedGopCount(1))
+}
+
+// restreamMuxer publishes packets as they come and tracks a connection's
+// progress for Status.
+type restreamMuxer struct {
+	conn *rtmp.Conn
+	r    *Restreamer
+}
+
+func (m *restreamMuxer) WriteHeader(streams []av.CodecData) error {
+	// Publishing starts with the header; once it is accepted we are live.
+	if err := m.conn.WriteHeader(streams); err != nil {
+		return err
+	}
+	m.r.lock.Lock()
+	m.r.state = RestreamLive
+	m.r.connectedAt = time.Now()
+	m.r.lock.Unlock()
+	return nil
+}
+
+func (m *restreamMuxer) WritePacket(pkt av.Packet) error {
+	if err := m.conn.WritePacket(pkt); err != nil {
+		return err
+	}
+	// joy4 buffers up to 64KB of output and its WriteTrailer does nothing
+	// but flush. Flushing every packet keeps the relay live (and surfaces a
+	// dropped connection right away).
+	if err := m.conn.WriteTrailer(); err != nil {
+		return err
+	}
+	m.r.lock.Lock()
+	m.r.packets++
+	m.r.lock.Unlock()
+	return nil
+}
+
+func (m *restreamMuxer) WriteTrailer() error {
+	return m.conn.WriteTrailer()
+}
+
+// Stop disconnects from the target and waits for Run to return.
+func (r *Restreamer) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.lock.Lock()
+		if r.conn != nil {
+			r.conn.Close()
+		}
+		r.lock.Unlock()
+	})
+	<-r.finished
+}
+
+func (r *Restreamer) isStopping() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Restreamer) setState(state string) {
+	r.lock.Lock()
+	r.state = state
+	r.lock.Unlock()
+}
+
+func (r *Restreamer) recordError(err error) {
+	r.lock.Lock()
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now()
+	r.lock.Unlock()
+}
+
+// Status returns a snapshot of the restreamer for the admin API.
+func (r *Restreamer) Status() RestreamStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status := RestreamStatus{
+		TargetID:  r.target.ID,
+		Name:      r.target.Name,
+		URL:       r.target.URL,
+		State:     r.state,
+		Attempts:  r.attempts,
+		Packets:   r.packets,
+		LastError: r.lastError,
+	}
+	if r.state == RestreamLive {
+		connectedAt := r.connectedAt
+		status.ConnectedAt = &connectedAt
+	}
+	if !r.lastErrorAt.IsZero() {
+		lastErrorAt := r.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
+
+// startRestreams relays a new channel to its stream's enabled targets.
+func (s *Server) startRestreams(stream *models.Stream, channel *Channel) {
+	if models.DB == nil {
+		return
+	}
+	var targets []models.RestreamTarget
+	if err := models.DB.Where("stream_id = ? AND enabled = ?", stream.ID, true).Find(&targets).Error; err != nil {
+		log.Printf("Stream %d: failed to load restream targets: %v", stream.ID, err)
+		return
+	}
+	for _, target := range targets {
+		startRestream(channel, target)
+	}
+}
+
+func startRestream(channel *Channel, target models.RestreamTarget) {
+	r := NewRestreamer(target)
+	channel.AddRestreamer(target.ID, r)
+	go r.Run(channel)
+}
+
+// ApplyRestreamTarget brings the relay of a live stream in line with a
+// created or updated target: a running relay is restarted with the new
+// settings, or stopped if the target was disabled.
+func (s *Server) ApplyRestreamTarget(target models.RestreamTarget) {
+	channel := s.channels.ByStreamID(target.StreamID)
+	if channel == nil {
+		return
+	}
+	if old := channel.RemoveRestreamer(target.ID); old != nil {
+		old.Stop()
+	}
+	if target.Enabled {
+		startRestream(channel, target)
+	}
+}
+
+// RemoveRestreamTarget stops the relay to a deleted target.
+func (s *Server) RemoveRestreamTarget(target models.RestreamTarget) {
+	channel := s.channels.ByStreamID(target.StreamID)
+	if channel == nil {
+		return
+	}
+	if old := channel.RemoveRestreamer(target.ID); old != nil {
+		old.Stop()
+	}
+}
+
+// RestreamStatus reports the relays of a live stream.
+func (s *Server) RestreamStatus(streamID uint) ([]RestreamStatus, bool) {
+	channel := s.channels.ByStreamID(streamID)
+	if channel == nil {
+		return nil, false
+	}
+	restreamers := channel.Restreamers()
+	statuses := make([]RestreamStatus, 0, len(restreamers))
+	for _, r := range restreamers {
+		statuses = append(statuses, r.Status())
+	}
+	return statuses, true
+}
@@ -0,0 +1,275 @@
+package rtmp
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/rtmp"
+)
+
+func testCodecs(t *testing.T) []av.CodecData {
+	t.Helper()
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c0f162d96")
+	video, err := h264parser.NewCodecDataFromSPSAndPPS(sps, []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := aacparser.NewCodecDataFromMPEG4AudioConfig(aacparser.MPEG4AudioConfig{
+		ObjectType:      aacparser.AOT_AAC_LC,
+		SampleRate:      44100,
+		SampleRateIndex: 4,
+		ChannelConfig:   2,
+		ChannelLayout:   av.CH_STEREO,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []av.CodecData{video, audio}
+}
+
+// destination is a local joy4 RTMP server standing in for a partner ingest.
+type destination struct {
+	url string
+
+	lock       sync.Mutex
+	publishes  []string // stream paths, one per accepted publish
+	codecs     []av.CodecData
+	packets    int
+	firstVideo *av.Packet
+	dropAfter  int // close the first publish after this many packets
+}
+
+func startDestination(t *testing.T) *destination {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	d := &destination{url: "rtmp://" + addr + "/live"}
+	srv := &rtmp.Server{Addr: addr, HandlePublish: d.handlePublish}
+	go srv.ListenAndServe()
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return d
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("destination server did not start")
+	return nil
+}
+
+func (d *destination) handlePublish(conn *rtmp.Conn) {
+	defer conn.Close()
+	streams, err := conn.Streams()
+	if err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	d.publishes = append(d.publishes, conn.URL.Path)
+	d.codecs = streams
+	dropAfter := 0
+	if len(d.publishes) == 1 {
+		dropAfter = d.dropAfter
+	}
+	d.lock.Unlock()
+
+	for n := 0; ; n++ {
+		if dropAfter > 0 && n == dropAfter {
+			return
+		}
+		pkt, err := conn.ReadPacket()
+		if err != nil {
+			return
+		}
+		d.lock.Lock()
+		d.packets++
+		if pkt.Idx == 0 && d.firstVideo == nil {
+			d.firstVideo = &pkt
+		}
+		d.lock.Unlock()
+	}
+}
+
+func (d *destination) snapshot() (publishes []string, packets int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string(nil), d.publishes...), d.packets
+}
+
+// liveChannel opens a channel and feeds it 30fps video with a keyframe
+// every 10 frames until the returned stop function is called.
+func liveChannel(t *testing.T) (*Channel, func()) {
+	t.Helper()
+	registry := NewRegistry()
+	channel, _, err := registry.Attach(&models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}, InputPrimary, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.Queue.WriteHeader(testCodecs(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(time.Second / 30)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			pts := time.Duration(i) * time.Second / 30
+			channel.Queue.WritePacket(av.Packet{Idx: 0, Time: pts, IsKeyFrame: i%10 == 0, Data: []byte{0, 0, 0, 4, 0x65, 1, 2, 3}})
+			channel.Queue.WritePacket(av.Packet{Idx: 1, Time: pts, Data: make([]byte, 64)})
+			if i == 0 {
+				channel.markKeyframe()
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return channel, func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+			registry.Close(channel)
+		})
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRestreamerRelaysChannel(t *testing.T) {
+	dest := startDestination(t)
+	channel, stop := liveChannel(t)
+	defer stop()
+
+	r := NewRestreamer(models.RestreamTarget{ID: 3, Name: "partner", URL: dest.url + "/", StreamKey: "secret"})
+	go r.Run(channel)
+
+	waitFor(t, "packets at the destination", func() bool {
+		_, packets := dest.snapshot()
+		return packets >= 20
+	})
+	publishes, _ := dest.snapshot()
+	if len(publishes) != 1 || publishes[0] != "/live/secret" {
+		t.Errorf("publishes = %v, want one to /live/secret", publishes)
+	}
+	dest.lock.Lock()
+	if len(dest.codecs) != 2 || dest.codecs[0].Type() != av.H264 || dest.codecs[1].Type() != av.AAC {
+		t.Errorf("destination got codecs %v", dest.codecs)
+	}
+	if dest.firstVideo == nil || !dest.firstVideo.IsKeyFrame {
+		t.Error("the relay must start on a keyframe")
+	}
+	dest.lock.Unlock()
+
+	status := r.Status()
+	if status.State != RestreamLive || status.Attempts != 1 || status.Packets == 0 || status.ConnectedAt == nil {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// The relay ends with the channel.
+	stop()
+	select {
+	case <-r.finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("restreamer did not stop with its channel")
+	}
+	if state := r.Status().State; state != RestreamStopped {
+		t.Errorf("state after the channel closed = %s", state)
+	}
+}
+
+func TestRestreamerReconnects(t *testing.T) {
+	saved := RestreamBackoffMin
+	RestreamBackoffMin = 10 * time.Millisecond
+	defer func() { RestreamBackoffMin = saved }()
+
+	dest := startDestination(t)
+	dest.lock.Lock()
+	dest.dropAfter = 5
+	dest.lock.Unlock()
+	channel, stop := liveChannel(t)
+	defer stop()
+
+	r := NewRestreamer(models.RestreamTarget{ID: 3, Name: "partner", URL: dest.url, StreamKey: "secret"})
+	go r.Run(channel)
+	defer r.Stop()
+
+	waitFor(t, "a second publish", func() bool {
+		publishes, _ := dest.snapshot()
+		return len(publishes) >= 2
+	})
+	waitFor(t, "the relay to be live again", func() bool {
+		return r.Status().State == RestreamLive
+	})
+	status := r.Status()
+	if status.Attempts < 2 || status.LastError == "" || status.LastErrorAt == nil {
+		t.Errorf("a reconnect should be counted and its cause kept: %+v", status)
+	}
+}
+
+func TestRestreamerStop(t *testing.T) {
+	dest := startDestination(t)
+	channel, stop := liveChannel(t)
+	defer stop()
+
+	r := NewRestreamer(models.RestreamTarget{ID: 3, URL: dest.url, StreamKey: "secret"})
+	go r.Run(channel)
+	waitFor(t, "the relay to be live", func() bool {
+		return r.Status().State == RestreamLive
+	})
+
+	r.Stop()
+	if state := r.Status().State; state != RestreamStopped {
+		t.Errorf("state after Stop = %s", state)
+	}
+}
+
+func TestValidateRestreamTarget(t *testing.T) {
+	valid := models.RestreamTarget{Name: "yt", URL: "rtmp://a.rtmp.youtube.com/live2", StreamKey: "abcd-1234"}
+	if err := ValidateRestreamTarget(&valid); err != nil {
+		t.Errorf("valid target rejected: %v", err)
+	}
+	if got := RestreamURL(valid); got != "rtmp://a.rtmp.youtube.com/live2/abcd-1234" {
+		t.Errorf("RestreamURL = %q", got)
+	}
+
+	for name, target := range map[string]models.RestreamTarget{
+		"no host":      {URL: "rtmp:///live"},
+		"not rtmp":     {URL: "https://example.com/live"},
+		"garbage":      {URL: "::"},
+		"key has path": {URL: "rtmp://example.com/live", StreamKey: "../other"},
+	} {
+		if err := ValidateRestreamTarget(&target); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -1,27 +1,98 @@
 package rtmp
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
+	"strconv"
+	"streamcast-backend/internal/hls"
 	"streamcast-backend/internal/models"
+	"streamcast-backend/internal/playback"
+	"strings"
 	"sync"
 	"time"
 
+	srt "github.com/datarhei/gosrt"
 	"github.com/google/uuid"
+	"github.com/nareix/joy4/av"
 	"github.com/nareix/joy4/av/avutil"
-	"github.com/nareix/joy4/av/pubsub"
-	"github.com/nareix/joy4/format/flv"
 	"github.com/nareix/joy4/format/rtmp"
 )
 
+// Output locations for HLS and MP4 archives (served by nginx).
+var (
+	HLSDir     = "/var/www/hls"
+	ArchiveDir = "/var/www/archive"
+)
+
+// FFmpegStopTimeout bounds how long ffmpeg gets to finalize its outputs
+// after being interrupted before it is killed.
+var FFmpegStopTimeout = 10 * time.Second
+
+// DefaultStopCooldown is how long a stream key is refused after an operator
+// stops the stream. Override it with STREAM_STOP_COOLDOWN (e.g. "5m").
+var DefaultStopCooldown = stopCooldownFromEnv()
+
+// PassthroughProfile is used instead of re-encoding when CPU usage is at or
+// above PassthroughCPUThreshold percent (PASSTHROUGH_CPU_THRESHOLD).
+var (
+	PassthroughProfile      = "passthrough"
+	PassthroughCPUThreshold = floatFromEnv("PASSTHROUGH_CPU_THRESHOLD", 85)
+)
+
+// LL-HLS output of streams with LowLatency set: the source is remuxed (not
+// transcoded) into HLSDir/<playback_id>/<LowLatencyRendition>.
+var (
+	LowLatencyRendition       = "ll"
+	LowLatencySegmentDuration = 2 * time.Second
+	LowLatencyPartDuration    = 500 * time.Millisecond
+	LowLatencyPlaylistSize    = 6
+)
+
+// CMAF output of streams with DASH set: the source is remuxed into
+// HLSDir/<playback_id>/<CMAFRendition> as manifest.mpd and master.m3u8
+// sharing the same fMP4 segments.
+var (
+	CMAFRendition       = "cmaf"
+	CMAFSegmentDuration = 2 * time.Second
+	CMAFPlaylistSize    = 6
+)
+
 type Server struct {
-	server *rtmp.Server
-	queue  *pubsub.Queue
-	lock   sync.Mutex
+	// CPUUsage reports host CPU usage in percent. When set, new publishes
+	// fall back to passthrough on a busy host.
+	CPUUsage func() float64
+	// Access, when set, authorizes every HLS/DASH request after the stream
+	// has been found live.
+	Access PlaybackAccess
+	// KeyAccess authorizes requests for the content keys of encrypted
+	// streams. Without it keys are never released.
+	KeyAccess PlaybackAccess
+
+	server   *rtmp.Server
+	channels *Registry
+	states   *stateTracker
+
+	blockLock sync.Mutex
+	blocked   map[string]time.Time // stream key -> refuse publishes until
+
+	pullLock        sync.Mutex
+	pulls           map[uint]*puller   // by stream ID
+	scheduledStarts map[uint]time.Time // stream ID -> PullStartAt last started, scheduler only
+
+	srtLock     sync.Mutex
+	srtListener srt.Listener
+
+	whipLock sync.Mutex
+	whips    map[string]*whipSession // by session ID
+
+	whepLock  sync.Mutex
+	wheps     map[string]*whepSession // by session ID
+	whepFeeds map[uint]*whepFeed      // by stream ID
 }
 
 func NewRtmpServer(port string) *Server {
@@ -30,198 +101,498 @@ func NewRtmpServer(port string) *Server {
 	}
 
 	srv := &Server{
-		server: s,
-		queue:  pubsub.NewQueue(),
+		server:   s,
+		channels: NewRegistry(),
+		states:   newStateTracker(),
+		blocked:  make(map[string]time.Time),
+
+		pulls:           make(map[uint]*puller),
+		scheduledStarts: make(map[uint]time.Time),
+		whips:           make(map[string]*whipSession),
+		wheps:           make(map[string]*whepSession),
+		whepFeeds:       make(map[uint]*whepFeed),
 	}
 
-	s.HandlePublish = func(conn *rtmp.Conn) {
-		log.Println("RTMP Publish connected from", conn.NetConn().RemoteAddr())
-		log.Println("Stream Key/Path:", conn.URL.Path)
+	s.HandlePublish = srv.handlePublish
 
-		// 1. Prepare Directory Structure (HLS Scaffolding)
-		// FORCE 'test' key to match frontend hardcoding
-		// irrespective of what OBS sends.
-		streamKey := "test"
+	s.HandlePlay = func(conn *rtmp.Conn) {
+		// Players use the playback ID, never the stream key.
+		name := StreamKeyFromPath(conn.URL.Path)
+		channel := srv.channels.ByPlaybackID(name)
+		if channel == nil {
+			log.Printf("RTMP Play rejected, no live channel for %s", conn.URL.Path)
+			conn.Close()
+			return
+		}
+		if err := srv.checkPlayer(conn, name); err != nil {
+			log.Printf("RTMP Play rejected for %s: %v", conn.URL.Path, err)
+			conn.Close()
+			return
+		}
+		srv.viewerJoined(channel)
+		defer srv.viewerLeft(channel)
 
-		hlsDir := filepath.Join("/var/www/hls", streamKey)
+		avutil.CopyFile(conn, channel.Queue.Latest())
+	}
 
-		// CLEANUP: Remove old HLS data to prevent "ghost" streams
-		if err := os.RemoveAll(hlsDir); err != nil {
-			log.Printf("Warning: Failed to clean HLS dir %s: %v", hlsDir, err)
-		}
+	return srv
+}
 
-		if err := os.MkdirAll(hlsDir, 0755); err != nil {
-			log.Printf("CRITICAL: Failed to create HLS directory %s: %v", hlsDir, err)
-			return
+// checkPlayer applies Server.Access to an RTMP player. Tokens are passed in
+// the play path's query: rtmp://host/live/<playback_id>?token=...
+func (s *Server) checkPlayer(conn *rtmp.Conn, playbackID string) error {
+	stream, err := lookupStreamByPlaybackID(playbackID)
+	if err != nil {
+		return err
+	}
+	ip := playback.HostIP(conn.NetConn().RemoteAddr().String())
+	return s.checkAccess(stream, conn.URL.Query().Get("token"), ip)
+}
+
+func (s *Server) handlePublish(conn *rtmp.Conn) {
+	log.Println("RTMP Publish connected from", conn.NetConn().RemoteAddr())
+
+	// 1. Resolve the publishing stream from the key in the RTMP path
+	// (OBS sends rtmp://host:1935/live/<stream_key>).
+	streamKey := StreamKeyFromPath(conn.URL.Path)
+	stream, role, err := lookupPublisher(streamKey)
+	if err != nil {
+		log.Printf("Rejected RTMP publish from %s: %v", conn.NetConn().RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if err := s.admitPublisher(stream); err != nil {
+		log.Printf("Rejected RTMP publish for stream %d: %v", stream.ID, err)
+		conn.Close()
+		return
+	}
+
+	s.runSource(stream, role, conn, conn)
+}
+
+// admitPublisher refuses pushes to streams pulled from a source URL and to
+// stream keys an operator recently stopped.
+func (s *Server) admitPublisher(stream *models.Stream) error {
+	if stream.SourceType == SourcePull {
+		return errors.New("it is pulled from its source URL")
+	}
+	if until, blocked := s.blockedUntil(stream.StreamKey); blocked {
+		return fmt.Errorf("stopped by operator, cooldown until %s", until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// runSource feeds a stream's channel from src as its role input (primary
+// or backup) until src ends. The first input to arrive opens the channel
+// and starts the live pipeline (transcoder, LL-HLS, CMAF, restreams,
+// viewers); the last to leave shuts it down. Closing publisher, which may
+// be src itself, ends the input early.
+func (s *Server) runSource(stream *models.Stream, role string, src av.Demuxer, publisher io.Closer) {
+	playbackID := stream.PlaybackID
+
+	channel, created, err := s.channels.Attach(stream, role, publisher)
+	if err != nil {
+		log.Printf("Rejected ingest for stream %d: %v", stream.ID, err)
+		publisher.Close()
+		return
+	}
+	if created {
+		log.Printf("Ingest accepted for stream %d (%s)", stream.ID, playbackID)
+		s.states.Transition(stream.ID, StatusConnecting)
+		if !s.startPipeline(stream, channel) {
+			for _, p := range channel.Publishers() {
+				p.Close()
+			}
 		}
+	} else {
+		log.Printf("[FAILOVER %d] %s input connected", stream.ID, role)
+	}
+
+	// 4. Ingest: copy the source's packets into the channel queue
+	if err := ingest(channel, role, src); err != nil {
+		log.Printf("Source %s (%s) ingest error: %v", playbackID, role, err)
+	}
+	s.leave(stream, channel, role)
+}
 
-		// 2. Simplified FFmpeg Command (Single Bitrate for Stability)
-		// We pipe stderr to a buffer to log it if it fails instantly, or stream it.
-		// For production, streaming stderr to logs is better.
-		ffmpegBinary := "ffmpeg"
-		rtmpUrl := "rtmp://localhost:1935" + conn.URL.Path
-
-		// Prepare FFmpeg
-		time.Sleep(3 * time.Second) // Wait for stream to stabilize
-
-		// Multi-Bitrate ABR Command
-		ffmpegBinary = "ffmpeg"
-		rtmpUrl = "rtmp://localhost:1935" + conn.URL.Path
-
-		args := []string{
-			"-y",
-			"-i", rtmpUrl,
-
-			// HLS Configuration (4 Qualities: 1080p, 720p, 480p, 240p)
-			"-filter_complex", "[0:v]split=4[v1][v2][v3][v4];[v1]scale=w=1920:h=1080[v1080];[v2]scale=w=1280:h=720[v720];[v3]scale=w=854:h=480[v480];[v4]scale=w=426:h=240[v240]",
-
-			// Stream 0: 1080p (Full HD)
-			"-map", "[v1080]", "-map", "0:a",
-			"-c:v:0", "libx264", "-b:v:0", "3500k", "-maxrate:v:0", "3500k", "-bufsize:v:0", "7000k",
-			"-preset", "ultrafast", "-tune", "zerolatency", "-g", "60", "-keyint_min", "60", "-sc_threshold", "0", "-r", "30",
-			"-c:a:0", "aac", "-b:a:0", "192k", "-ac", "2", "-ar", "44100",
-
-			// Stream 1: 720p (HD)
-			"-map", "[v720]", "-map", "0:a",
-			"-c:v:1", "libx264", "-b:v:1", "2000k", "-maxrate:v:1", "2000k", "-bufsize:v:1", "4000k",
-			"-preset", "ultrafast", "-tune", "zerolatency", "-g", "60", "-keyint_min", "60", "-sc_threshold", "0", "-r", "30",
-			"-c:a:1", "aac", "-b:a:1", "128k", "-ac", "2", "-ar", "44100",
-
-			// Stream 2: 480p (SD)
-			"-map", "[v480]", "-map", "0:a",
-			"-c:v:2", "libx264", "-b:v:2", "1000k", "-maxrate:v:2", "1000k", "-bufsize:v:2", "2000k",
-			"-preset", "ultrafast", "-tune", "zerolatency", "-g", "60", "-keyint_min", "60", "-sc_threshold", "0", "-r", "30",
-			"-c:a:2", "aac", "-b:a:2", "96k", "-ac", "2", "-ar", "44100",
-
-			// Stream 3: 240p (Low Bandwidth)
-			"-map", "[v240]", "-map", "0:a",
-			"-c:v:3", "libx264", "-b:v:3", "400k", "-maxrate:v:3", "400k", "-bufsize:v:3", "800k",
-			"-preset", "ultrafast", "-tune", "zerolatency", "-g", "60", "-keyint_min", "60", "-sc_threshold", "0", "-r", "30",
-			"-c:a:3", "aac", "-b:a:3", "64k", "-ac", "2", "-ar", "44100",
-
-			// HLS Output settings
-			"-f", "hls",
-			"-hls_time", "2",
-			"-hls_list_size", "6",
-			"-hls_flags", "delete_segments+append_list",
-			"-var_stream_map", "v:0,a:0,name:1080p v:1,a:1,name:720p v:2,a:2,name:480p v:3,a:3,name:240p",
-			"-master_pl_name", "master.m3u8",
-			"-hls_segment_filename", filepath.Join(hlsDir, "%v/seg_%03d.ts"),
-			filepath.Join(hlsDir, "%v/index.m3u8"),
+// leave detaches a finished input from its channel. When the last
+// publisher leaves, the channel carries on with the offline slate; when
+// nothing is left, the channel is shut down.
+func (s *Server) leave(stream *models.Stream, channel *Channel, role string) {
+	var slate *slateSource
+	if SlateEnabled && role != InputSlate {
+		slate = newSlateSource(stream, channel.Codecs())
+	}
+	slated, last := s.channels.DetachToSlate(channel, role, slate)
+	switch {
+	case slated:
+		log.Printf("[SLATE %d] %s input disconnected, showing the offline slate", stream.ID, role)
+		s.states.Interrupted(stream.ID)
+		go s.runSlate(stream, channel, slate, ReconnectGrace)
+		return
+	case !last && role == InputSlate:
+		if channel.ActiveInput() != "" {
+			log.Printf("[SLATE %d] Publisher resumed, slate stopped", stream.ID)
+			s.states.Transition(stream.ID, StatusLive)
 		}
+		return
+	case !last:
+		log.Printf("[FAILOVER %d] %s input disconnected, the stream continues on the other input", stream.ID, role)
+		return
+	}
 
-		// 4. Archive & VOD Setup
-		archiveDir := "/var/www/archive"
-		archiveFilename := fmt.Sprintf("archive_%s_%d.mp4", streamKey, time.Now().Unix())
-		archivePath := filepath.Join(archiveDir, archiveFilename)
-
-		// Add MP4 recording output mapping [v1080_archive] to file
-		// Note: We are re-encoding for the archive to ensure single file compatibility.
-		// Alternatively, we could map [0:v] directly but we want 1080p specifically if available (or source).
-		// Let's use [v1080_archive] and [0:a].
-		args = append(args,
-			"-map", "0:v", "-map", "0:a",
-			"-c:v:4", "copy", "-c:a:4", "copy",
-			archivePath,
-		)
-
-		cmd := exec.Command(ffmpegBinary, args...)
-
-		// 3. Deep Logging: Pipe Stderr to Go logs
-		stderrPipe, err := cmd.StderrPipe()
-		if err != nil {
-			log.Println("Failed to open stderr pipe for FFmpeg:", err)
-		} else {
-			// Spawn a goroutine to read stderr
-			go func() {
-				// We can use a scanner or just copy to os.Stderr
-				// Log prefixing for clarity
-				buf := make([]byte, 1024)
-				for {
-					n, err := stderrPipe.Read(buf)
-					if n > 0 {
-						log.Printf("[FFMPEG %s] %s", streamKey, string(buf[:n]))
-					}
-					if err != nil {
-						break
+	// Cleanup when the last source drops. FFmpeg is stopped before the queue
+	// closes so the supervisor does not mistake the end of input for a crash.
+	log.Printf("Source %s disconnected, stopping FFmpeg...", stream.PlaybackID)
+	channel.StopTranscoder(FFmpegStopTimeout)
+	s.channels.Close(channel)
+	saveViewerCount(stream.ID, 0)
+	switch {
+	case channel.StopRequested():
+		s.states.Transition(stream.ID, StatusEnded)
+	case s.states.Status(stream.ID) == StatusStartingSoon:
+		// Nobody published before the starting soon slate ran out.
+		s.states.Transition(stream.ID, StatusOffline)
+	case role == InputSlate:
+		// Already reconnecting; ReconnectGrace ends the stream.
+	default:
+		s.states.Interrupted(stream.ID)
+	}
+}
+
+// runSlate feeds a channel from a slate until a publisher takes over or
+// limit runs out.
+func (s *Server) runSlate(stream *models.Stream, channel *Channel, slate *slateSource, limit time.Duration) {
+	expire := time.AfterFunc(limit, func() { slate.Close() })
+	defer expire.Stop()
+	if err := ingest(channel, InputSlate, slate); err != nil {
+		log.Printf("[SLATE %d] Slate failed: %v", stream.ID, err)
+	}
+	s.leave(stream, channel, InputSlate)
+}
+
+// ShowStartingSoon opens a stream nobody publishes to yet on its "starting
+// soon" slate, so viewers can tune in early. The first publisher takes over
+// on its first keyframe, like after a reconnect; the slate ends after
+// StartingSoonLimit, or when the stream is stopped.
+func (s *Server) ShowStartingSoon(stream *models.Stream) error {
+	if !SlateEnabled {
+		return errors.New("slates are disabled")
+	}
+	if until, blocked := s.blockedUntil(stream.StreamKey); blocked {
+		return fmt.Errorf("stopped by operator, cooldown until %s", until.Format(time.RFC3339))
+	}
+	if s.channels.ByStreamID(stream.ID) != nil {
+		return errors.New("stream is already live")
+	}
+
+	slate := newStartingSoonSlate(stream)
+	channel, created, err := s.channels.Attach(stream, InputSlate, slate)
+	if err != nil {
+		return err
+	}
+	if !created {
+		// A publisher got in first.
+		s.leave(stream, channel, InputSlate)
+		return errors.New("stream is already live")
+	}
+	log.Printf("[SLATE %d] Showing the starting soon slate", stream.ID)
+	s.states.Transition(stream.ID, StatusStartingSoon)
+	if !s.startPipeline(stream, channel) {
+		slate.Close()
+	}
+	go s.runSlate(stream, channel, slate, StartingSoonLimit)
+	return nil
+}
+
+// startPipeline prepares a new channel's HLS directory and starts the
+// workers reading the channel. It reports false if the stream cannot be
+// served.
+func (s *Server) startPipeline(stream *models.Stream, channel *Channel) bool {
+	playbackID := stream.PlaybackID
+
+	// 2. Prepare Directory Structure (HLS Scaffolding)
+	// HLS output is keyed by the public PlaybackID, never the secret stream key.
+	hlsDir := filepath.Join(HLSDir, playbackID)
+
+	// CLEANUP: Remove old HLS data to prevent "ghost" streams
+	if err := os.RemoveAll(hlsDir); err != nil {
+		log.Printf("Warning: Failed to clean HLS dir %s: %v", hlsDir, err)
+	}
+
+	if err := os.MkdirAll(hlsDir, 0755); err != nil {
+		log.Printf("CRITICAL: Failed to create HLS directory %s: %v", hlsDir, err)
+		return false
+	}
+
+	// 3. Transcoder: ffmpeg is fed the channel on its stdin, starting on the
+	// first keyframe, and is restarted with backoff if it dies mid-stream.
+	transcoder := NewTranscoder(playbackID, s.transcoderHooks(stream, channel, hlsDir))
+	channel.SetTranscoder(transcoder)
+	go transcoder.Run(channel.Keyframe())
+	if stream.LowLatency {
+		go runLowLatency(stream, channel, hlsDir)
+	}
+	if stream.DASH {
+		go runCMAF(stream, channel, hlsDir)
+	}
+	if StreamDVR(stream).Mode == DVRSliding {
+		go runDVRPruner(stream, channel, hlsDir)
+	}
+	s.startRestreams(stream, channel)
+	return true
+}
+
+// transcoderHooks wires a channel's ffmpeg supervisor to the stream state
+// and archive registration.
+func (s *Server) transcoderHooks(stream *models.Stream, channel *Channel, hlsDir string) TranscoderHooks {
+	playbackID := stream.PlaybackID
+
+	// The profile is chosen once per publish so restarts keep the same
+	// renditions (and HLS directory layout).
+	var profile *models.TranscodeProfile
+	segmenting := false
+
+	dvr := StreamDVR(stream)
+
+	// Encrypted streams get fresh content keys every publish.
+	var keys *keyRing
+	rotating := false
+	if stream.Encrypted {
+		keys = newKeyRing(stream)
+	}
+
+	return TranscoderHooks{
+		Build: func(run *TranscodeRun) error {
+			if profile == nil {
+				profile = s.selectProfile(stream, channel)
+			}
+			// The native segmenter follows the channel queue, not ffmpeg,
+			// so it survives ffmpeg restarts and is only started once.
+			if profile.Packager == PackagerNative && !segmenting {
+				segmenting = true
+				rendition := profile.Renditions[0].Name
+				segmenter := hls.NewSegmenter(
+					filepath.Join(hlsDir, rendition),
+					time.Duration(profile.SegmentDuration)*time.Second,
+					dvr.playlistSize(profile.SegmentDuration, profile.PlaylistSize),
+				)
+				if dvr.Mode == DVREvent {
+					segmenter.PlaylistType = "EVENT"
+				}
+				if keys != nil {
+					segmenter.Keys = keys.KeyFor
+				}
+				channel.AddSegmenter(rendition, segmenter)
+				go runSegmenter(stream, channel, segmenter)
+			}
+
+			// Every run records to its own file so a restart never
+			// overwrites a finished archive.
+			run.Archive = filepath.Join(ArchiveDir, fmt.Sprintf("archive_%s_%d.mp4", playbackID, time.Now().Unix()))
+			var keyInfo string
+			if keys != nil && profile.Packager != PackagerNative {
+				if !rotating {
+					// Never fall back to clear segments: without a key the
+					// run fails and is retried.
+					if err := keys.rotateFFmpegKey(); err != nil {
+						return fmt.Errorf("create content key: %w", err)
 					}
+					rotating = true
+					playlist := filepath.Join(hlsDir, profile.Renditions[0].Name, "index.m3u8")
+					go runFFmpegKeyRotation(keys, playlist, time.Duration(profile.SegmentDuration)*time.Second, channel)
+				}
+				keyInfo = ffmpegKeyInfo(playbackID)
+			}
+			input := FFmpegInput{URL: "pipe:0", Format: "flv", VideoOnly: !hasAudio(channel.Codecs())}
+			args, err := BuildFFmpegArgs(profile, dvr, input, hlsDir, run.Archive, keyInfo)
+			if err != nil {
+				return err
+			}
+			run.Args = args
+
+			if profile.VideoCodec == "copy" {
+				rendition := profile.Renditions[0].Name
+				if err := writeMasterPlaylist(hlsDir, rendition, channel.Codecs(), channel.IngestBitrate()); err != nil {
+					log.Printf("Stream %d: failed to write master playlist: %v", stream.ID, err)
+				}
+			}
+			return nil
+		},
+		Feed: func(run *TranscodeRun, stdin io.Writer) error {
+			return feedFFmpeg(channel, stdin)
+		},
+		OnStart: func(run *TranscodeRun) {
+			if run.Number > 1 && channel.ActiveInput() != InputSlate {
+				s.states.Transition(stream.ID, StatusConnecting)
+			}
+		},
+		OnProgress: func(run *TranscodeRun) {
+			// The stream only counts as live once the first rendition's
+			// playlist exists, i.e. a segment has been written, and not
+			// while it is showing a slate: the publisher taking over from
+			// the slate makes it live.
+			playlist := filepath.Join(hlsDir, profile.Renditions[0].Name, "index.m3u8")
+			go func() {
+				if waitForFile(playlist, channel.Done()) && channel.ActiveInput() != InputSlate {
+					s.states.Transition(stream.ID, StatusLive)
 				}
 			}()
-		}
+		},
+		OnExit: func(run *TranscodeRun, err error, interrupted bool) {
+			if !interrupted {
+				// FFmpeg dying while the publisher is still connected means
+				// viewers get nothing, even though RTMP keeps flowing.
+				log.Printf("FFmpeg for %s died while publisher is still connected", playbackID)
+				s.states.Interrupted(stream.ID)
+			}
+
+			// Every run's recording is kept, however ffmpeg exited: the
+			// archive is a fragmented MP4 that plays up to the crash, and
+			// the archive job repairs it into a regular one.
+			if run.Archive != "" {
+				registerArchive(stream, run.Archive, run.StartedAt)
+			}
+		},
+	}
+}
 
-		// 4. Process Management & Zombie Prevention
-		startTime := time.Now()
-		if err := cmd.Start(); err != nil {
-			log.Printf("CRITICAL: Failed to start FFmpeg for key %s: %v", streamKey, err)
-		} else {
-			log.Printf("FFmpeg started for stream %s (PID: %d)", streamKey, cmd.Process.Pid)
+// runLowLatency publishes the source as LL-HLS next to the profile's
+// regular HLS output, once the ingest has a keyframe to start on.
+func runLowLatency(stream *models.Stream, channel *Channel, hlsDir string) {
+	if !waitForKeyframe(channel) {
+		return
+	}
 
-			// Master creation is handled by ffmpeg now (-master_pl_name)
+	segmenter := hls.NewSegmenter(filepath.Join(hlsDir, LowLatencyRendition), LowLatencySegmentDuration, LowLatencyPlaylistSize)
+	segmenter.PartTarget = LowLatencyPartDuration
+	channel.AddSegmenter(LowLatencyRendition, segmenter)
+	runSegmenter(stream, channel, segmenter)
+}
 
-			// Wait Routine (Cleanup & Archiving)
-			go func() {
-				err := cmd.Wait() // Blocking wait ensures zombie process is reaped
-				if err != nil {
-					log.Printf("FFmpeg process for %s exited with error: %v", streamKey, err)
-				} else {
-					log.Printf("FFmpeg process for %s exited clean.", streamKey)
-
-					// Register Archive in DB
-					duration := time.Since(startTime).String() // Approx duration
-					fileInfo, err := os.Stat(archivePath)
-					var fileSize int64 = 0
-					if err == nil {
-						fileSize = fileInfo.Size()
-						log.Printf("Archive created: %s (%d bytes)", archivePath, fileSize)
-
-						// Create Archive Entry
-						archiveEntry := models.Archive{ // Assumes we added Archive to models
-							Title:     fmt.Sprintf("Live Stream %s", time.Now().Format("2006-01-02 15:04")),
-							FilePath:  "/archive/" + archiveFilename, // Web path
-							Duration:  duration,
-							FileSize:  fileSize,
-							CreatedAt: time.Now(),
-						}
-
-						if models.DB != nil {
-							if result := models.DB.Create(&archiveEntry); result.Error != nil {
-								log.Printf("Failed to save archive to DB: %v", result.Error)
-							} else {
-								log.Printf("Archive saved to DB with ID: %d", archiveEntry.ID)
-							}
-						}
-					}
-				}
+// runCMAF publishes the source as CMAF segments described by both a DASH
+// manifest and fMP4 HLS playlists.
+func runCMAF(stream *models.Stream, channel *Channel, hlsDir string) {
+	if !waitForKeyframe(channel) {
+		return
+	}
+	segmenter := hls.NewCMAFSegmenter(filepath.Join(hlsDir, CMAFRendition), CMAFSegmentDuration, CMAFPlaylistSize)
+	runSegmenter(stream, channel, segmenter)
+}
 
-				// Optional: Cleanup HLS files on stop?
-				// os.RemoveAll(hlsDir) // Maybe keep for VOD?
-			}()
+func waitForKeyframe(channel *Channel) bool {
+	select {
+	case <-channel.Keyframe():
+		return true
+	case <-channel.Done():
+		return false
+	}
+}
+
+// runSegmenter packages the channel queue in-process, starting at the last
+// keyframe, until the channel closes.
+func runSegmenter(stream *models.Stream, channel *Channel, segmenter av.Muxer) {
+	if err := avutil.CopyFile(segmenter, channel.Queue.DelayedGopCount(1)); err != nil {
+		log.Printf("Stream %d: HLS segmenter stopped: %v", stream.ID, err)
+	}
+}
+
+// ingest copies packets from a source into the channel as its role input
+// until the source ends. Only the active input's packets reach the queue.
+func ingest(channel *Channel, role string, src av.Demuxer) error {
+	streams, err := src.Streams()
+	if err != nil {
+		return err
+	}
+	in, err := channel.openInput(role, streams)
+	if err != nil {
+		return err
+	}
+
+	for {
+		pkt, err := src.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := channel.writeInput(in, pkt); err != nil {
+			return err
 		}
+	}
+}
 
-		// 5. Standard RTMP Handlers
-		streams, _ := conn.Streams()
-		srv.queue.WriteHeader(streams)
-		avutil.CopyFile(srv.queue, conn)
+// feedFFmpeg writes a channel to ffmpeg's stdin as FLV, starting on the
+// last keyframe so the first segment is decodable, until the channel
+// closes or ffmpeg stops reading.
+func feedFFmpeg(channel *Channel, stdin io.Writer) error {
+	return avutil.CopyFile(newFlushingMuxer(stdin, nil), channel.Queue.DelayedGopCount(1))
+}
 
-		// Cleanup when RTMP connection drops
-		log.Printf("RTMP Source %s disconnected, killing FFmpeg...", streamKey)
-		if cmd.Process != nil {
-			_ = cmd.Process.Kill()
+// hasAudio reports whether an ingest carries an audio track.
+func hasAudio(codecs []av.CodecData) bool {
+	for _, codec := range codecs {
+		if codec.Type().IsAudio() {
+			return true
 		}
+	}
+	return false
+}
 
-		srv.queue.Close()
-		srv.queue = pubsub.NewQueue()
+// selectProfile picks the transcoding profile for a publish: the stream's
+// own profile, or passthrough when the host is already over
+// PassthroughCPUThreshold and the ingest can be repackaged as is.
+func (s *Server) selectProfile(stream *models.Stream, channel *Channel) *models.TranscodeProfile {
+	profile := resolveProfile(stream)
+	if profile.VideoCodec == "copy" || profile.VideoCodec == "none" || s.CPUUsage == nil {
+		return profile
 	}
 
-	s.HandlePlay = func(conn *rtmp.Conn) {
-		cursor := srv.queue.Latest()
-		avutil.CopyFile(conn, cursor)
+	load := s.CPUUsage()
+	if load < PassthroughCPUThreshold {
+		return profile
+	}
+	if !canPassthrough(channel.Codecs()) {
+		log.Printf("Stream %d: CPU at %.0f%% but ingest codecs cannot be passed through", stream.ID, load)
+		return profile
 	}
 
-	return srv
+	passthrough, ok := models.FindTranscodeProfile(PassthroughProfile)
+	if !ok || ValidateProfile(passthrough) != nil || passthrough.VideoCodec != "copy" {
+		return profile
+	}
+	log.Printf("Stream %d: CPU at %.0f%%, using %s instead of %s", stream.ID, load, passthrough.Name, profile.Name)
+	return passthrough
+}
+
+// resolveProfile loads a stream's transcoding profile, falling back to the
+// built-in default if it is missing or invalid.
+func resolveProfile(stream *models.Stream) *models.TranscodeProfile {
+	if profile, ok := models.FindTranscodeProfile(stream.TranscodeProfile); ok {
+		err := ValidateProfile(profile)
+		if err == nil {
+			return profile
+		}
+		log.Printf("Stream %d: %v, using %s", stream.ID, err, models.DefaultTranscodeProfile)
+	} else {
+		log.Printf("Stream %d: unknown transcode profile %q, using %s", stream.ID, stream.TranscodeProfile, models.DefaultTranscodeProfile)
+	}
+
+	for _, profile := range models.BuiltinTranscodeProfiles() {
+		if profile.Name == models.DefaultTranscodeProfile {
+			return &profile
+		}
+	}
+	return nil
 }
 
 func (s *Server) Start() {
+	// Nothing can be publishing to a server that is only now starting up.
+	resetIngestStates()
+	// Nor recording: whatever is in ArchiveDir is as complete as it gets.
+	recoverArchives()
+
 	// Start RTMP Listener
 	go func() {
 		log.Println("RTMP Server listening on", s.server.Addr)
@@ -229,6 +600,21 @@ func (s *Server) Start() {
 			log.Println("RTMP Server Error:", err)
 		}
 	}()
+	go s.runPullScheduler()
+
+	if SRTAddr != "" {
+		go func() {
+			ln, err := s.ListenSRT(SRTAddr)
+			if err != nil {
+				log.Println("SRT Server Error:", err)
+				return
+			}
+			log.Println("SRT Server listening on", SRTAddr)
+			if err := s.ServeSRT(ln); err != nil {
+				log.Println("SRT Server Error:", err)
+			}
+		}()
+	}
 
 	// Start HTTP-FLV Handler
 	// We will attach this to the default http mux since we are running in the same process,
@@ -238,21 +624,163 @@ func (s *Server) Start() {
 	// Actually, main.go uses Gin. We can provide a Gin handler.
 }
 
-func (s *Server) HandleFLV(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "video/x-flv")
-	w.Header().Set("Transfer-Encoding", "chunked")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(200)
+// StopStream ends a stream on behalf of an operator: the publisher is
+// disconnected (or the pull stopped), ffmpeg finalizes the archive, and the
+// stream key is refused for cooldown. It reports whether a live publisher
+// or pull was stopped.
+func (s *Server) StopStream(stream *models.Stream, cooldown time.Duration) bool {
+	s.blockKey(stream.StreamKey, cooldown)
+	pulled := s.stopPull(stream.ID)
+
+	channel := s.channels.ByStreamID(stream.ID)
+	if channel == nil {
+		s.states.Transition(stream.ID, StatusEnded)
+		return pulled
+	}
 
-	flvWriter := flv.NewMuxer(w)
-	cursor := s.queue.Latest()
+	log.Printf("Stopping stream %d (%s) on operator request", stream.ID, channel.PlaybackID)
+	channel.RequestStop()
+	for _, publisher := range channel.Publishers() {
+		publisher.Close()
+	}
 
-	avutil.CopyFile(flvWriter, cursor)
+	// runSource notices the closed connection, stops ffmpeg and tears
+	// the channel down.
+	select {
+	case <-channel.Done():
+	case <-time.After(2 * FFmpegStopTimeout):
+		channel.StopTranscoder(FFmpegStopTimeout)
+		s.channels.Close(channel)
+	}
+	s.states.Transition(stream.ID, StatusEnded)
+	return true
+}
+
+func (s *Server) blockKey(key string, cooldown time.Duration) {
+	if cooldown <= 0 {
+		return
+	}
+	s.blockLock.Lock()
+	s.blocked[key] = time.Now().Add(cooldown)
+	s.blockLock.Unlock()
+}
+
+func (s *Server) unblockKey(key string) {
+	s.blockLock.Lock()
+	delete(s.blocked, key)
+	s.blockLock.Unlock()
+}
+
+func (s *Server) blockedUntil(key string) (time.Time, bool) {
+	s.blockLock.Lock()
+	defer s.blockLock.Unlock()
+
+	until, ok := s.blocked[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	if time.Now().After(until) {
+		delete(s.blocked, key)
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func stopCooldownFromEnv() time.Duration {
+	if v := os.Getenv("STREAM_STOP_COOLDOWN"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+		log.Printf("Invalid STREAM_STOP_COOLDOWN %q, using default", v)
+	}
+	return time.Minute
+}
+
+func floatFromEnv(name string, fallback float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+		log.Printf("Invalid %s %q, using default", name, v)
+	}
+	return fallback
+}
+
+// IngestStatus returns the current ingest state of a stream.
+func (s *Server) IngestStatus(streamID uint) string {
+	return s.states.Status(streamID)
+}
+
+// TranscoderStatus reports on the ffmpeg supervisor of a live stream.
+func (s *Server) TranscoderStatus(streamID uint) (TranscoderStatus, bool) {
+	channel := s.channels.ByStreamID(streamID)
+	if channel == nil || channel.Transcoder() == nil {
+		return TranscoderStatus{}, false
+	}
+	return channel.Transcoder().Status(), true
+}
+
+// Channels exposes the live channel registry.
+func (s *Server) Channels() *Registry {
+	return s.channels
 }
 
 func (s *Server) Stop() {
+	s.srtLock.Lock()
+	if s.srtListener != nil {
+		s.srtListener.Close()
+	}
+	s.srtLock.Unlock()
 }
 
 func GenerateStreamKey() (string, error) {
 	return "live_" + uuid.New().String(), nil
 }
+
+// StreamKeyFromPath extracts the stream key from an RTMP URL path such as
+// "/live/live_<uuid>". The last path segment is the key, whatever the app
+// name; a query string (as some encoders append to the key) is dropped.
+func StreamKeyFromPath(p string) string {
+	p, _, _ = strings.Cut(p, "?")
+	key := path.Base(strings.TrimSuffix(p, "/"))
+	if key == "." || key == "/" {
+		return ""
+	}
+	return key
+}
+
+// lookupStreamByPlaybackID finds the models.Stream behind a public playback
+// ID. It is a variable so tests can serve streams without a database.
+var lookupStreamByPlaybackID = func(id string) (*models.Stream, error) {
+	if id == "" {
+		return nil, fmt.Errorf("missing playback ID")
+	}
+	if models.DB == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	var stream models.Stream
+	if err := models.DB.Where("playback_id = ?", id).First(&stream).Error; err != nil {
+		return nil, fmt.Errorf("unknown playback ID")
+	}
+	return &stream, nil
+}
+
+// lookupStreamByKey finds the models.Stream a publisher is allowed to push to.
+func lookupStreamByKey(key string) (*models.Stream, error) {
+	if key == "" {
+		return nil, fmt.Errorf("missing stream key")
+	}
+	if models.DB == nil {
+		return nil, fmt.Errorf("database not connected")
+	}
+
+	var stream models.Stream
+	if err := models.DB.Where("stream_key = ?", key).First(&stream).Error; err != nil {
+		return nil, fmt.Errorf("unknown stream key")
+	}
+	if stream.PlaybackID == "" {
+		return nil, fmt.Errorf("stream %d has no playback ID", stream.ID)
+	}
+	return &stream, nil
+}
@@ -0,0 +1,102 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+)
+
+func TestStopStreamDisconnectsPublisher(t *testing.T) {
+	defer func(hls, archive string) { HLSDir, ArchiveDir = hls, archive }(HLSDir, ArchiveDir)
+	HLSDir, ArchiveDir = t.TempDir(), t.TempDir()
+	fakeFFmpeg(t, "exec cat > /dev/null")
+
+	s := NewRtmpServer("0")
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}
+
+	// publish feeds the stream like a publisher connecting on its key would.
+	publish := func() (closed *atomic.Bool, ingested chan struct{}) {
+		t.Helper()
+		if err := s.admitPublisher(stream); err != nil {
+			t.Fatalf("publisher refused: %v", err)
+		}
+		publisher, stop := liveChannel(t)
+		t.Cleanup(stop)
+		closed, ingested = new(atomic.Bool), make(chan struct{})
+		go func() {
+			s.runSource(stream, InputPrimary, publisher.Queue.Latest(), closerFunc(func() {
+				closed.Store(true)
+				stop()
+			}))
+			close(ingested)
+		}()
+		waitFor(t, "the publisher to feed the stream", func() bool {
+			channel := s.channels.ByStreamID(stream.ID)
+			return channel != nil && channel.ActiveInput() == InputPrimary
+		})
+		return closed, ingested
+	}
+
+	closed, ingested := publish()
+	channel := s.channels.ByStreamID(stream.ID)
+	if !s.StopStream(stream, time.Hour) {
+		t.Error("StopStream found nothing to stop")
+	}
+	if !closed.Load() {
+		t.Error("publisher still connected after StopStream")
+	}
+	select {
+	case <-channel.Done():
+	default:
+		t.Error("StopStream returned before the channel shut down")
+	}
+	<-ingested
+	if status := s.states.Status(stream.ID); status != StatusEnded {
+		t.Errorf("status %q after the stop, want %q", status, StatusEnded)
+	}
+
+	// The key is refused until the cooldown runs out.
+	if err := s.admitPublisher(stream); err == nil {
+		t.Fatal("republish accepted during the cooldown")
+	}
+	s.blockLock.Lock()
+	s.blocked[stream.StreamKey] = time.Now().Add(-time.Second)
+	s.blockLock.Unlock()
+	closed, ingested = publish()
+
+	if !s.StopStream(stream, 0) {
+		t.Error("StopStream found nothing to stop after the republish")
+	}
+	<-ingested
+	if !closed.Load() {
+		t.Error("republished publisher still connected after StopStream")
+	}
+	if err := s.admitPublisher(stream); err != nil {
+		t.Errorf("stop without cooldown refuses the key: %v", err)
+	}
+}
+
+func TestStreamKeyFromPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/live/live_abc", "live_abc"},
+		{"live/live_abc", "live_abc"},
+		{"/live/live_abc/", "live_abc"},
+		{"live_abc", "live_abc"},
+		{"/live_abc", "live_abc"},
+		{"/app/nested/live_abc", "live_abc"},
+		{"/live/live_abc?token=xyz", "live_abc"},
+		{"/live/live_abc/?token=xyz&x=1", "live_abc"},
+		{"", ""},
+		{"/", ""},
+		{"//", ""},
+		{"?token=xyz", ""},
+	} {
+		if got := StreamKeyFromPath(tc.path); got != tc.want {
+			t.Errorf("StreamKeyFromPath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
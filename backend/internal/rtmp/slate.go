@@ -0,0 +1,260 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"streamcast-backend/internal/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/flv"
+)
+
+// Offline slate. When the last publisher of a stream drops, its channel is
+// held open for ReconnectGrace on a generated slate input: the stream's
+// offline banner (or a black frame) over silence, encoded to match the
+// channel's tracks. HLS playlists keep advancing, so viewers see the banner
+// instead of a stalled player, and a publisher reconnecting takes over on
+// its first keyframe exactly like a failover.
+//
+// Before a publish, an operator can open the stream on a "starting soon"
+// slate instead (ShowStartingSoon): the stream's banner with its pre-match
+// details, until the publisher arrives or StartingSoonLimit runs out.
+var (
+	SlateEnabled      = true
+	SlateFrameRate    = 30
+	SlateVideoBitrate = "500k"
+	StartingSoonLimit = 2 * time.Hour
+)
+
+// UploadsDir is where banners uploaded through the API are stored.
+var UploadsDir = "uploads"
+
+// slateWidth and slateHeight size the slate of channels without H.264
+// video, slateSampleRate sets its audio when a channel has no tracks yet.
+const (
+	slateWidth, slateHeight = 1280, 720
+	slateSampleRate         = 48000
+)
+
+// slateSource is a slate input. ffmpeg only starts once the channel reads
+// its tracks, so an unused slate costs nothing.
+type slateSource struct {
+	image   string // file or URL of the banner, "" for a black frame
+	caption string // text shown over the banner, "" for none
+	codecs  []av.CodecData
+
+	lock        sync.Mutex
+	cmd         *exec.Cmd
+	demuxer     av.Demuxer
+	captionFile string
+	closed      bool
+}
+
+func newSlateSource(stream *models.Stream, codecs []av.CodecData) *slateSource {
+	return &slateSource{image: slateImage(stream.OfflineBannerURL), codecs: codecs}
+}
+
+// newStartingSoonSlate returns the slate of a stream nobody publishes to
+// yet: its banner (or offline banner) captioned with its pre-match details,
+// with the tracks publishers usually send.
+func newStartingSoonSlate(stream *models.Stream) *slateSource {
+	image := slateImage(stream.BannerURL)
+	if image == "" {
+		image = slateImage(stream.OfflineBannerURL)
+	}
+	caption := "Starting soon"
+	if details := strings.TrimSpace(stream.PreMatchDetails); details != "" {
+		caption += "\n\n" + details
+	}
+	return &slateSource{image: image, caption: caption}
+}
+
+func (s *slateSource) Streams() ([]av.CodecData, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, io.EOF
+	}
+	if s.demuxer == nil {
+		// drawtext reads the caption from a file: no escaping to get wrong.
+		if s.caption != "" && s.captionFile == "" {
+			file, err := writeSlateCaption(s.caption)
+			if err != nil {
+				s.lock.Unlock()
+				return nil, err
+			}
+			s.captionFile = file
+		}
+		cmd := exec.Command(FFmpegBinary, slateArgs(s.image, s.captionFile, s.codecs)...)
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			s.lock.Unlock()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			s.lock.Unlock()
+			return nil, fmt.Errorf("start ffmpeg: %w", err)
+		}
+		s.cmd, s.demuxer = cmd, flv.NewDemuxer(out)
+	}
+	demuxer := s.demuxer
+	s.lock.Unlock()
+	return demuxer.Streams()
+}
+
+func (s *slateSource) ReadPacket() (av.Packet, error) {
+	s.lock.Lock()
+	demuxer, closed := s.demuxer, s.closed
+	s.lock.Unlock()
+	if closed || demuxer == nil {
+		return av.Packet{}, io.EOF
+	}
+	pkt, err := demuxer.ReadPacket()
+	if err != nil && s.isClosed() {
+		return pkt, io.EOF
+	}
+	return pkt, err
+}
+
+// Close stops ffmpeg, ending the slate input.
+func (s *slateSource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+		s.cmd.Wait()
+	}
+	if s.captionFile != "" {
+		os.Remove(s.captionFile)
+	}
+	return nil
+}
+
+func (s *slateSource) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+func writeSlateCaption(caption string) (string, error) {
+	f, err := os.CreateTemp("", "slate-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("write slate caption: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(caption); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("write slate caption: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// slateArgs builds the ffmpeg command line of a slate matching a channel's
+// tracks: same picture size, sample rate and channel count, so switching
+// to and from it needs no more than in-band parameter sets. A channel
+// without tracks yet gets H.264 and AAC, what publishers usually send.
+// Keyframes every two seconds let a reconnecting publisher's first
+// keyframe, not the slate's, decide when the switch back happens. The
+// text of captionFile, if set, is drawn over the lower part of the picture.
+func slateArgs(image, captionFile string, codecs []av.CodecData) []string {
+	var video h264parser.CodecData
+	var audio aacparser.CodecData
+	hasVideo, hasAudio := false, false
+	for _, codec := range codecs {
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			video, hasVideo = codec, true
+		case aacparser.CodecData:
+			audio, hasAudio = codec, true
+		}
+	}
+	if len(codecs) == 0 {
+		hasVideo, hasAudio = true, true
+	} else if !hasVideo && !hasAudio {
+		hasVideo = true
+	}
+
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	width, height := slateWidth, slateHeight
+	if video.Width() > 0 && video.Height() > 0 {
+		width, height = video.Width()&^1, video.Height()&^1
+	}
+	if hasVideo && image != "" {
+		args = append(args, "-re", "-loop", "1", "-framerate", fmt.Sprint(SlateFrameRate), "-i", image)
+	} else if hasVideo {
+		args = append(args, "-re", "-f", "lavfi", "-i", fmt.Sprintf("color=c=black:s=%dx%d:r=%d", width, height, SlateFrameRate))
+	}
+	if hasAudio {
+		layout := "stereo"
+		if audio.ChannelLayout().Count() == 1 {
+			layout = "mono"
+		}
+		sampleRate := audio.SampleRate()
+		if sampleRate <= 0 {
+			sampleRate = slateSampleRate
+		}
+		args = append(args, "-re", "-f", "lavfi", "-i", fmt.Sprintf("anullsrc=r=%d:cl=%s", sampleRate, layout))
+	}
+
+	if hasVideo && hasAudio {
+		args = append(args, "-map", "0:v", "-map", "1:a")
+	}
+	if hasVideo {
+		gop := fmt.Sprint(2 * SlateFrameRate)
+		filter := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:-1:-1:color=black,setsar=1", width, height, width, height)
+		if captionFile != "" {
+			filter += fmt.Sprintf(",drawtext=textfile='%s':expansion=none:fontcolor=white:fontsize=%d:line_spacing=%d"+
+				":box=1:boxcolor=black@0.6:boxborderw=%d:x=(w-text_w)/2:y=h-text_h-h/8",
+				captionFile, height/18, height/80, height/40)
+		}
+		args = append(args,
+			"-vf", filter+",format=yuv420p",
+			"-c:v", "libx264", "-preset", "veryfast", "-tune", "stillimage",
+			"-r", fmt.Sprint(SlateFrameRate), "-g", gop, "-keyint_min", gop,
+			"-sc_threshold", "0", "-b:v", SlateVideoBitrate,
+		)
+	}
+	if hasAudio {
+		args = append(args, "-c:a", "aac", "-b:a", "64k")
+	}
+	return append(args, "-f", "flv", "pipe:1")
+}
+
+// slateImage returns where ffmpeg reads an offline banner from: the stored
+// file for banners uploaded here, the URL itself for other web images, or
+// "" when there is no usable banner.
+func slateImage(bannerURL string) string {
+	if bannerURL == "" {
+		return ""
+	}
+	u, err := url.Parse(bannerURL)
+	if err != nil {
+		return ""
+	}
+	for _, prefix := range []string{"/uploads/", "/api/uploads/"} {
+		if name, ok := strings.CutPrefix(u.Path, prefix); ok {
+			local := filepath.Join(UploadsDir, path.Base(name))
+			if _, err := os.Stat(local); err == nil {
+				return local
+			}
+		}
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return bannerURL
+	}
+	return ""
+}
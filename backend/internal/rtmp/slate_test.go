@@ -0,0 +1,243 @@
+package rtmp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/flv"
+)
+
+func TestSlateArgs(t *testing.T) {
+	codecs := testCodecs(t)
+	video := codecs[0].(h264parser.CodecData)
+
+	args := strings.Join(slateArgs("uploads/banner.png", "", codecs), " ")
+	for _, want := range []string{
+		"-loop 1 -framerate 30 -i uploads/banner.png",
+		"-f lavfi -i anullsrc=r=44100:cl=stereo",
+		"-map 0:v -map 1:a",
+		fmt.Sprintf("scale=%d:%d:", video.Width(), video.Height()),
+		"-c:v libx264",
+		"-c:a aac",
+		"-f flv pipe:1",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("args %q lack %q", args, want)
+		}
+	}
+
+	args = strings.Join(slateArgs("", "", codecs[:1]), " ")
+	if !strings.Contains(args, fmt.Sprintf("color=c=black:s=%dx%d", video.Width(), video.Height())) {
+		t.Errorf("args %q lack a black frame the size of the channel", args)
+	}
+	if strings.Contains(args, "anullsrc") || strings.Contains(args, "-map") {
+		t.Errorf("video-only slate has audio: %q", args)
+	}
+	if strings.Contains(args, "drawtext") {
+		t.Errorf("slate without caption draws text: %q", args)
+	}
+
+	// Before the first publish there are no tracks to match.
+	args = strings.Join(slateArgs("", "/tmp/caption.txt", nil), " ")
+	for _, want := range []string{
+		fmt.Sprintf("color=c=black:s=%dx%d", slateWidth, slateHeight),
+		fmt.Sprintf("anullsrc=r=%d:cl=stereo", slateSampleRate),
+		"drawtext=textfile='/tmp/caption.txt':expansion=none:",
+		"-c:v libx264",
+		"-c:a aac",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("starting soon args %q lack %q", args, want)
+		}
+	}
+}
+
+func TestSlateImage(t *testing.T) {
+	defer func(dir string) { UploadsDir = dir }(UploadsDir)
+	UploadsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(UploadsDir, "banner.png"), []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ url, want string }{
+		{"", ""},
+		{"http://localhost:8080/uploads/banner.png", filepath.Join(UploadsDir, "banner.png")},
+		{"/api/uploads/banner.png", filepath.Join(UploadsDir, "banner.png")},
+		{"/uploads/../../etc/passwd", ""},
+		{"https://cdn.example.com/offline.jpg", "https://cdn.example.com/offline.jpg"},
+		{"/uploads/missing.png", ""},
+		{"file:///etc/passwd", ""},
+	} {
+		if got := slateImage(tc.url); got != tc.want {
+			t.Errorf("slateImage(%q) = %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestSlateHoldsChannel(t *testing.T) {
+	registry := NewRegistry()
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}
+	ch, _, _ := registry.Attach(stream, InputPrimary, nil)
+	defer registry.Close(ch)
+
+	video := testCodecs(t)[:1]
+	primary, err := ch.openInput(InputPrimary, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.writeInput(primary, failoverPacket(0, true, 'P'))
+
+	slate := newSlateSource(stream, video)
+	if slated, last := registry.DetachToSlate(ch, InputPrimary, slate); !slated || last {
+		t.Fatalf("slated %v, last %v, want the slate to hold the channel", slated, last)
+	}
+	if registry.ByKey("key") != ch || registry.InputBusy("key", InputPrimary) {
+		t.Fatal("channel closed or busy while on the slate")
+	}
+	onSlate, err := ch.openInput(InputSlate, video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch.writeInput(onSlate, failoverPacket(0, true, 'S'))
+	if got := ch.ActiveInput(); got != InputSlate {
+		t.Fatalf("active input %q, want slate", got)
+	}
+
+	// The publisher comes back and takes over on its first keyframe.
+	if again, created, err := registry.Attach(stream, InputPrimary, nil); err != nil || created || again != ch {
+		t.Fatalf("reconnect: created %v, err %v", created, err)
+	}
+	primary, _ = ch.openInput(InputPrimary, video)
+	ch.writeInput(primary, failoverPacket(0, false, 'P'))
+	if got := ch.ActiveInput(); got != InputSlate {
+		t.Errorf("switched to %q on a non-keyframe", got)
+	}
+	ch.writeInput(primary, failoverPacket(20*time.Millisecond, true, 'P'))
+	if got := ch.ActiveInput(); got != InputPrimary {
+		t.Fatalf("active input %q, want primary", got)
+	}
+	events := ch.FailoverEvents()
+	if reason := events[len(events)-1].Reason; reason != "publish resumed" {
+		t.Errorf("switched back because %q", reason)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !slate.isClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !slate.isClosed() {
+		t.Error("slate still running after the publisher took over")
+	}
+	if registry.Detach(ch, InputSlate) {
+		t.Error("channel shut down when the slate left")
+	}
+
+	// An operator stop skips the slate.
+	ch.RequestStop()
+	if slated, last := registry.DetachToSlate(ch, InputPrimary, newSlateSource(stream, video)); slated || !last {
+		t.Errorf("slated %v, last %v after a stop, want the channel shut down", slated, last)
+	}
+}
+
+// slateFFmpeg makes ffmpeg print an FLV of a few seconds of video for
+// slates, then idle, and swallow its input as a transcoder.
+func slateFFmpeg(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "slate.flv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	muxer := flv.NewMuxer(f)
+	if err := muxer.WriteHeader(testCodecs(t)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 90; i++ {
+		pts := time.Duration(i) * time.Second / 30
+		muxer.WritePacket(av.Packet{Idx: 0, Time: pts, IsKeyFrame: i%30 == 0, Data: []byte{0, 0, 0, 4, 0x65, 1, 2, 3}})
+	}
+	muxer.WriteTrailer()
+	f.Close()
+	fakeFFmpeg(t, `case "$*" in
+*pipe:1) cat `+path+`; exec sleep 60 ;;
+*) exec cat > /dev/null ;;
+esac`)
+}
+
+func TestShowStartingSoon(t *testing.T) {
+	defer func(hls, archive string) { HLSDir, ArchiveDir = hls, archive }(HLSDir, ArchiveDir)
+	HLSDir, ArchiveDir = t.TempDir(), t.TempDir()
+	slateFFmpeg(t)
+
+	s := NewRtmpServer("0")
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb", PreMatchDetails: "Kick-off 20:00"}
+	if err := s.ShowStartingSoon(stream); err != nil {
+		t.Fatal(err)
+	}
+	channel := s.channels.ByStreamID(stream.ID)
+	waitFor(t, "the slate to feed the channel", func() bool { return channel.ActiveInput() == InputSlate })
+	if status := s.states.Status(stream.ID); status != StatusStartingSoon {
+		t.Fatalf("status %q, want %q", status, StatusStartingSoon)
+	}
+	if !s.isPlayable(stream) {
+		t.Error("starting soon stream is not playable")
+	}
+	if err := s.ShowStartingSoon(stream); err == nil {
+		t.Error("second starting soon slate accepted")
+	}
+
+	// The publisher arrives and takes over on its first keyframe.
+	publisher, stop := liveChannel(t)
+	defer stop()
+	ingested := make(chan struct{})
+	go func() {
+		s.runSource(stream, InputPrimary, publisher.Queue.Latest(), closerFunc(stop))
+		close(ingested)
+	}()
+	waitFor(t, "the publisher to take over", func() bool {
+		return channel.ActiveInput() == InputPrimary && s.states.Status(stream.ID) == StatusLive
+	})
+	if events := channel.FailoverEvents(); events[len(events)-1].Reason != "publish resumed" {
+		t.Errorf("switched to the publisher because %q", events[len(events)-1].Reason)
+	}
+
+	if !s.StopStream(stream, 0) {
+		t.Error("StopStream found nothing to stop")
+	}
+	<-ingested
+	if status := s.states.Status(stream.ID); status != StatusEnded {
+		t.Errorf("status %q after the stop, want %q", status, StatusEnded)
+	}
+}
+
+func TestStartingSoonLimit(t *testing.T) {
+	defer func(hls, archive string, limit time.Duration) {
+		HLSDir, ArchiveDir, StartingSoonLimit = hls, archive, limit
+	}(HLSDir, ArchiveDir, StartingSoonLimit)
+	HLSDir, ArchiveDir = t.TempDir(), t.TempDir()
+	StartingSoonLimit = 500 * time.Millisecond
+	slateFFmpeg(t)
+
+	s := NewRtmpServer("0")
+	stream := &models.Stream{ID: 1, StreamKey: "key", PlaybackID: "pb"}
+	if err := s.ShowStartingSoon(stream); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the slate to run out", func() bool {
+		return s.channels.ByStreamID(stream.ID) == nil && s.states.Status(stream.ID) == StatusOffline
+	})
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
@@ -0,0 +1,228 @@
+package rtmp
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+	"github.com/nareix/joy4/format/ts"
+)
+
+// SRT ingest: encoders send MPEG-TS to SRTAddr (SRT_ADDR, empty to disable)
+// with the stream key as streamid. SRTLatency is the receive buffer that
+// absorbs retransmissions on lossy uplinks; encoders asking for more get
+// more. A peer silent for SRTPeerIdleTimeout is disconnected.
+var (
+	SRTAddr            = srtAddrFromEnv()
+	SRTLatency         = time.Second
+	SRTPeerIdleTimeout = 5 * time.Second
+)
+
+// SRTStreamKey extracts the stream key from an SRT streamid: the key itself,
+// a path ending in it as with RTMP ("live/<key>"), or SRT access control
+// syntax ("#!::r=live/<key>,m=publish"). publish is false when the caller
+// asks for anything but publishing.
+func SRTStreamKey(streamID string) (key string, publish bool) {
+	body, ok := strings.CutPrefix(streamID, "#!::")
+	if !ok {
+		return StreamKeyFromPath(streamID), true
+	}
+	publish = true
+	for _, pair := range strings.Split(body, ",") {
+		name, value, _ := strings.Cut(pair, "=")
+		switch name {
+		case "r":
+			key = StreamKeyFromPath(value)
+		case "m":
+			publish = value == "publish"
+		}
+	}
+	return key, publish
+}
+
+// ListenSRT opens the SRT ingest listener on addr. Serve it with ServeSRT.
+func (s *Server) ListenSRT(addr string) (srt.Listener, error) {
+	config := srt.DefaultConfig()
+	config.ReceiverLatency = SRTLatency
+	config.PeerIdleTimeout = SRTPeerIdleTimeout
+	ln, err := srt.Listen("srt", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	s.srtLock.Lock()
+	s.srtListener = ln
+	s.srtLock.Unlock()
+	return ln, nil
+}
+
+// ServeSRT accepts publishers on ln until it is closed.
+func (s *Server) ServeSRT(ln srt.Listener) error {
+	for {
+		req, err := ln.Accept2()
+		if err != nil {
+			if err == srt.ErrListenerClosed {
+				return nil
+			}
+			return err
+		}
+		go s.handleSRTRequest(req)
+	}
+}
+
+// handleSRTRequest admits an SRT publisher like handlePublish does an RTMP
+// one. Rejections are decided before the handshake completes, so the
+// encoder is told why.
+func (s *Server) handleSRTRequest(req srt.ConnRequest) {
+	remote := req.RemoteAddr()
+	streamKey, publish := SRTStreamKey(req.StreamId())
+	if !publish {
+		log.Printf("Rejected SRT connection from %s: only publishing is supported", remote)
+		req.Reject(srt.REJX_BAD_MODE)
+		return
+	}
+	stream, role, err := lookupPublisher(streamKey)
+	if err != nil {
+		log.Printf("Rejected SRT publish from %s: %v", remote, err)
+		req.Reject(srt.REJX_UNAUTHORIZED)
+		return
+	}
+	if err := s.admitPublisher(stream); err != nil {
+		log.Printf("Rejected SRT publish for stream %d: %v", stream.ID, err)
+		req.Reject(srt.REJX_FORBIDDEN)
+		return
+	}
+	if s.channels.InputBusy(stream.StreamKey, role) {
+		log.Printf("Rejected SRT publish for stream %d: %s input already being published", stream.ID, role)
+		req.Reject(srt.REJX_CONFLICT)
+		return
+	}
+
+	conn, err := req.Accept()
+	if err != nil {
+		log.Printf("SRT handshake with %s failed: %v", remote, err)
+		return
+	}
+	defer conn.Close()
+	log.Println("SRT Publish connected from", remote)
+
+	src := &rebasedSource{Demuxer: ts.NewDemuxer(newPESFilter(conn)), Closer: conn}
+	s.runSource(stream, role, src, src)
+}
+
+func srtAddrFromEnv() string {
+	if v, ok := os.LookupEnv("SRT_ADDR"); ok {
+		return v
+	}
+	return ":9000"
+}
+
+// pesFilter passes an MPEG-TS stream on one PES packet at a time per PID,
+// dropping those that lost TS packets; tables (PAT, PMT) pass as they are.
+// joy4's demuxer gives up on the first truncated PES, which on a lossy SRT
+// uplink (where late packets are dropped) would turn every loss into a
+// reconnect.
+type pesFilter struct {
+	r       io.Reader
+	packet  [188]byte
+	pending map[uint16]*pesBuffer
+	out     []byte // complete units ready to be read
+}
+
+type pesBuffer struct {
+	data    []byte
+	cc      byte // continuity counter of the last packet
+	started bool // a PES start has been seen
+	broken  bool // the current PES lost packets
+	table   bool // the PID carries PSI rather than PES
+}
+
+func newPESFilter(r io.Reader) *pesFilter {
+	return &pesFilter{r: r, pending: make(map[uint16]*pesBuffer)}
+}
+
+func (f *pesFilter) Read(p []byte) (int, error) {
+	for len(f.out) == 0 {
+		if err := f.readPacket(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+func (f *pesFilter) readPacket() error {
+	pkt := f.packet[:]
+	if _, err := io.ReadFull(f.r, pkt); err != nil {
+		return err
+	}
+	for pkt[0] != 0x47 {
+		// Lost sync: slide until the next sync byte.
+		copy(pkt, pkt[1:])
+		if _, err := io.ReadFull(f.r, pkt[187:]); err != nil {
+			return err
+		}
+	}
+
+	pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+	if pid == 0x1fff {
+		return nil // null packet
+	}
+	unitStart := pkt[1]&0x40 != 0
+	hasPayload := pkt[3]&0x10 != 0
+	cc := pkt[3] & 0x0f
+
+	b := f.pending[pid]
+	if b == nil {
+		b = &pesBuffer{}
+		f.pending[pid] = b
+	}
+	if unitStart && !b.started {
+		b.table = !isPESStart(pkt)
+	}
+	if b.table {
+		f.out = append(f.out, pkt...)
+		return nil
+	}
+	if !b.started && !unitStart {
+		return nil // joined mid-PES
+	}
+	if hasPayload && b.started {
+		discontinuity := pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x80 != 0
+		switch {
+		case cc == b.cc && !discontinuity:
+			return nil // duplicate
+		case cc != (b.cc+1)&0x0f && !discontinuity:
+			b.broken = true
+		}
+	}
+	if hasPayload {
+		b.cc = cc
+	}
+
+	if unitStart {
+		if b.started && !b.broken {
+			f.out = append(f.out, b.data...)
+		}
+		b.data = b.data[:0]
+		b.started, b.broken = true, false
+	}
+	b.data = append(b.data, pkt...)
+	return nil
+}
+
+// isPESStart reports whether a unit start packet begins a PES packet
+// (payload starting with 00 00 01) rather than a PSI section.
+func isPESStart(pkt []byte) bool {
+	payload := pkt[4:]
+	if pkt[3]&0x20 != 0 {
+		if int(pkt[4])+1 >= len(payload) {
+			return false
+		}
+		payload = payload[pkt[4]+1:]
+	}
+	return len(payload) >= 3 && payload[0] == 0 && payload[1] == 0 && payload[2] == 1
+}
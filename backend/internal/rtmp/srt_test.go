@@ -0,0 +1,145 @@
+package rtmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	srt "github.com/datarhei/gosrt"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/format/ts"
+)
+
+func TestSRTStreamKey(t *testing.T) {
+	for streamID, want := range map[string]struct {
+		key     string
+		publish bool
+	}{
+		"live_abc":                        {"live_abc", true},
+		"live/live_abc":                   {"live_abc", true},
+		"#!::r=live/live_abc,m=publish":   {"live_abc", true},
+		"#!::m=publish,r=live_abc,u=crew": {"live_abc", true},
+		"#!::r=live_abc":                  {"live_abc", true},
+		"#!::r=live/live_abc,m=request":   {"live_abc", false},
+		"":                                {"", true},
+	} {
+		key, publish := SRTStreamKey(streamID)
+		if key != want.key || publish != want.publish {
+			t.Errorf("SRTStreamKey(%q) = %q, %v, want %q, %v", streamID, key, publish, want.key, want.publish)
+		}
+	}
+}
+
+// muxTS returns 3s of synthetic media as MPEG-TS, with AAC frames large
+// enough to span several TS packets.
+func muxTS(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	muxer := ts.NewMuxer(&buf)
+	if err := muxer.WriteHeader(testCodecs(t)); err != nil {
+		t.Fatal(err)
+	}
+	aacFrame := time.Duration(1024) * time.Second / 44100
+	nextAudio := time.Duration(0)
+	for i := 0; i < 90; i++ {
+		now := time.Duration(i) * time.Second / 30
+		for ; nextAudio <= now; nextAudio += aacFrame {
+			if err := muxer.WritePacket(av.Packet{Idx: 1, Time: nextAudio, Data: make([]byte, 400)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := muxer.WritePacket(av.Packet{Idx: 0, Time: now, IsKeyFrame: i%30 == 0, Data: []byte{0, 0, 0, 4, 0x65, 1, 2, 3}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := muxer.WriteTrailer(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// countAudio demuxes r to the end and counts its AAC frames.
+func countAudio(r io.Reader) (int, error) {
+	demuxer := ts.NewDemuxer(r)
+	streams, err := demuxer.Streams()
+	if err != nil {
+		return 0, err
+	}
+	frames := 0
+	for {
+		pkt, err := demuxer.ReadPacket()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		if streams[pkt.Idx].Type() == av.AAC {
+			frames++
+		}
+	}
+}
+
+func TestPESFilterDropsTruncatedUnits(t *testing.T) {
+	stream := muxTS(t)
+	intact, err := countAudio(newPESFilter(bytes.NewReader(stream)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intact < 100 {
+		t.Fatalf("only %d audio frames made it through an intact stream", intact)
+	}
+
+	// Lose one packet from the middle of an AAC frame (PID 0x101), as a
+	// dropped SRT packet would.
+	var lossy []byte
+	dropped := false
+	for off := 0; off+188 <= len(stream); off += 188 {
+		pkt := stream[off : off+188]
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if !dropped && off > len(stream)/2 && pid == 0x101 && pkt[1]&0x40 == 0 {
+			dropped = true
+			continue
+		}
+		lossy = append(lossy, pkt...)
+	}
+	if !dropped {
+		t.Fatal("no continuation packet to drop")
+	}
+
+	if _, err := countAudio(bytes.NewReader(lossy)); err == nil {
+		t.Log("joy4 now survives truncated PES packets; pesFilter may no longer be needed")
+	}
+	frames, err := countAudio(newPESFilter(bytes.NewReader(lossy)))
+	if err != nil {
+		t.Fatalf("filtered lossy stream: %v", err)
+	}
+	if frames != intact-1 {
+		t.Errorf("got %d audio frames, want %d (all but the damaged one)", frames, intact-1)
+	}
+}
+
+func TestSRTRejectsPublishers(t *testing.T) {
+	s := NewRtmpServer("0")
+	ln, err := s.ListenSRT("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ServeSRT(ln)
+	defer s.Stop()
+
+	for _, streamID := range []string{
+		"live/unknown_key",              // no such stream
+		"#!::r=live/live_abc,m=request", // playback is not offered over SRT
+	} {
+		config := srt.DefaultConfig()
+		config.StreamId = streamID
+		config.ConnectionTimeout = 2 * time.Second
+		conn, err := srt.Dial("srt", ln.Addr().String(), config)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: connection was accepted", streamID)
+		}
+	}
+}
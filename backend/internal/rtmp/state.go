@@ -0,0 +1,215 @@
+package rtmp
+
+import (
+	"log"
+	"os"
+	"streamcast-backend/internal/models"
+	"sync"
+	"time"
+)
+
+// Ingest states stored in models.Stream.IngestStatus.
+//
+//	offline -> connecting -> live -> reconnecting -> ended
+//	                 ^                    |
+//	                 +--------------------+  (publisher came back in time)
+//
+// A stream waiting for its publisher on the "starting soon" slate is
+// starting_soon, and goes live when the publisher takes over.
+const (
+	StatusOffline      = "offline"
+	StatusStartingSoon = "starting_soon"
+	StatusConnecting   = "connecting"
+	StatusLive         = "live"
+	StatusReconnecting = "reconnecting"
+	StatusEnded        = "ended"
+)
+
+// ReconnectGrace is how long a stream stays "reconnecting" after the
+// publisher or transcoder drops before it is marked "ended".
+var ReconnectGrace = 30 * time.Second
+
+var allowedTransitions = map[string][]string{
+	StatusOffline:      {StatusConnecting, StatusStartingSoon},
+	StatusStartingSoon: {StatusConnecting, StatusLive, StatusOffline, StatusEnded},
+	StatusConnecting:   {StatusLive, StatusReconnecting, StatusEnded},
+	StatusLive:         {StatusReconnecting, StatusEnded},
+	StatusReconnecting: {StatusConnecting, StatusLive, StatusEnded},
+	StatusEnded:        {StatusConnecting, StatusStartingSoon},
+}
+
+// CanTransition reports whether the state machine allows moving from one
+// ingest status to another. Unknown (legacy) statuses behave like offline.
+func CanTransition(from, to string) bool {
+	if _, known := allowedTransitions[from]; !known {
+		from = StatusOffline
+	}
+	for _, next := range allowedTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+type trackedState struct {
+	status   string
+	since    time.Time
+	endTimer *time.Timer
+	saveLock sync.Mutex // serializes the DB writes of this stream
+}
+
+// stateTracker owns the ingest state of every stream and mirrors it into the
+// streams table so the frontend's live badges follow the real ingest.
+type stateTracker struct {
+	lock   sync.Mutex
+	states map[uint]*trackedState
+	save   func(streamID uint, status string)
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{states: make(map[uint]*trackedState), save: saveIngestStatus}
+}
+
+// Status returns the current ingest status of a stream.
+func (t *stateTracker) Status(streamID uint) string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if st, ok := t.states[streamID]; ok {
+		return st.status
+	}
+	return StatusOffline
+}
+
+// Transition moves a stream to a new status if the state machine allows it
+// and saves the result. It reports whether the status actually changed.
+func (t *stateTracker) Transition(streamID uint, to string) bool {
+	return t.transition(streamID, "", to)
+}
+
+// transition is Transition, but only from the status from if it is set.
+func (t *stateTracker) transition(streamID uint, from, to string) bool {
+	t.lock.Lock()
+	st, ok := t.states[streamID]
+	if !ok {
+		st = &trackedState{status: StatusOffline}
+		t.states[streamID] = st
+	}
+	if st.status == to || (from != "" && st.status != from) {
+		t.lock.Unlock()
+		return false
+	}
+	if !CanTransition(st.status, to) {
+		log.Printf("Stream %d: ignoring ingest transition %s -> %s", streamID, st.status, to)
+		t.lock.Unlock()
+		return false
+	}
+	if st.endTimer != nil {
+		st.endTimer.Stop()
+		st.endTimer = nil
+	}
+	from = st.status
+	st.status = to
+	st.since = time.Now()
+	t.lock.Unlock()
+
+	log.Printf("Stream %d: ingest %s -> %s", streamID, from, to)
+	t.saveStatus(streamID, st)
+	return true
+}
+
+// saveStatus writes a stream's status to the DB. Writes of a stream are
+// serialized and each one saves the status current when it runs, so however
+// concurrent transitions interleave, the last write matches memory.
+func (t *stateTracker) saveStatus(streamID uint, st *trackedState) {
+	st.saveLock.Lock()
+	defer st.saveLock.Unlock()
+	t.lock.Lock()
+	status := st.status
+	t.lock.Unlock()
+	t.save(streamID, status)
+}
+
+// Interrupted marks a stream as reconnecting and ends it if nothing
+// recovers it within ReconnectGrace.
+func (t *stateTracker) Interrupted(streamID uint) {
+	if !t.Transition(streamID, StatusReconnecting) {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	st := t.states[streamID]
+	if st.status != StatusReconnecting {
+		return // recovered in the meantime
+	}
+	if st.endTimer != nil {
+		st.endTimer.Stop()
+	}
+	// A recovery racing with the timer stops it too late to matter, so the
+	// timer only ends a stream that is still reconnecting.
+	st.endTimer = time.AfterFunc(ReconnectGrace, func() {
+		t.transition(streamID, StatusReconnecting, StatusEnded)
+	})
+}
+
+func saveIngestStatus(streamID uint, status string) {
+	if models.DB == nil {
+		return
+	}
+	err := models.DB.Model(&models.Stream{}).Where("id = ?", streamID).Updates(map[string]interface{}{
+		"ingest_status": status,
+		"is_live":       status == StatusLive,
+	}).Error
+	if err != nil {
+		log.Printf("Stream %d: failed to save ingest status %s: %v", streamID, status, err)
+	}
+	if status == StatusEnded {
+		deleteContentKeys(streamID)
+	}
+}
+
+func saveViewerCount(streamID uint, count int) {
+	if models.DB == nil {
+		return
+	}
+	err := models.DB.Model(&models.Stream{}).Where("id = ?", streamID).Update("viewer_count", count).Error
+	if err != nil {
+		log.Printf("Stream %d: failed to save viewer count: %v", streamID, err)
+	}
+}
+
+// resetIngestStates clears live flags and content keys left behind by a
+// previous process, since no publisher can be connected to a server that
+// just started.
+func resetIngestStates() {
+	if models.DB == nil {
+		return
+	}
+	err := models.DB.Model(&models.Stream{}).
+		Where("is_live = ? OR ingest_status IN ?", true, []string{StatusStartingSoon, StatusConnecting, StatusLive, StatusReconnecting}).
+		Updates(map[string]interface{}{"ingest_status": StatusOffline, "is_live": false, "viewer_count": 0}).Error
+	if err != nil {
+		log.Printf("Failed to reset stale ingest states: %v", err)
+	}
+	if err := models.DB.Where("1 = 1").Delete(&models.HLSKey{}).Error; err != nil {
+		log.Printf("Failed to delete stale content keys: %v", err)
+	}
+}
+
+// waitForFile polls until path exists or done is closed. It is used to
+// detect that ffmpeg is actually producing HLS output.
+func waitForFile(path string, done <-chan struct{}) bool {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
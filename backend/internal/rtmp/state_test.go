@@ -0,0 +1,124 @@
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCanTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		want     bool
+	}{
+		{StatusOffline, StatusConnecting, true},
+		{StatusOffline, StatusLive, false},
+		{StatusConnecting, StatusLive, true},
+		{StatusLive, StatusReconnecting, true},
+		{StatusLive, StatusConnecting, false},
+		{StatusReconnecting, StatusLive, true},
+		{StatusReconnecting, StatusEnded, true},
+		{StatusEnded, StatusConnecting, true},
+		{StatusEnded, StatusLive, false},
+		{StatusOffline, StatusStartingSoon, true},
+		{StatusStartingSoon, StatusLive, true},
+		{StatusStartingSoon, StatusOffline, true},
+		{StatusStartingSoon, StatusReconnecting, false},
+		{StatusLive, StatusStartingSoon, false},
+		{"", StatusConnecting, true}, // legacy rows behave like offline
+		{"publishing", StatusLive, false},
+	} {
+		if got := CanTransition(tc.from, tc.to); got != tc.want {
+			t.Errorf("CanTransition(%q, %q) = %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+}
+
+// recordingTracker is a stateTracker whose saves are recorded instead of
+// written to the DB.
+func recordingTracker() (*stateTracker, func() []string) {
+	var (
+		lock  sync.Mutex
+		saved []string
+	)
+	tracker := newStateTracker()
+	tracker.save = func(streamID uint, status string) {
+		lock.Lock()
+		saved = append(saved, status)
+		lock.Unlock()
+	}
+	return tracker, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), saved...)
+	}
+}
+
+func TestInterruptedEndsAfterGrace(t *testing.T) {
+	defer func(grace time.Duration) { ReconnectGrace = grace }(ReconnectGrace)
+	ReconnectGrace = 50 * time.Millisecond
+
+	tracker, saved := recordingTracker()
+	tracker.Transition(1, StatusConnecting)
+	tracker.Transition(1, StatusLive)
+	tracker.Interrupted(1)
+	if got := tracker.Status(1); got != StatusReconnecting {
+		t.Fatalf("status %q, want reconnecting", got)
+	}
+	tracker.Interrupted(1) // already reconnecting: the grace is not extended
+	time.Sleep(4 * ReconnectGrace)
+	if got := tracker.Status(1); got != StatusEnded {
+		t.Errorf("status %q after the grace, want ended", got)
+	}
+	if got := fmt.Sprint(saved()); got != "[connecting live reconnecting ended]" {
+		t.Errorf("saved %s", got)
+	}
+}
+
+func TestInterruptedRecoversWithinGrace(t *testing.T) {
+	defer func(grace time.Duration) { ReconnectGrace = grace }(ReconnectGrace)
+	ReconnectGrace = 50 * time.Millisecond
+
+	tracker, _ := recordingTracker()
+	tracker.Transition(1, StatusConnecting)
+	tracker.Transition(1, StatusLive)
+	tracker.Interrupted(1)
+	tracker.Transition(1, StatusLive)
+	time.Sleep(4 * ReconnectGrace)
+	if got := tracker.Status(1); got != StatusLive {
+		t.Errorf("status %q, want the recovered stream still live", got)
+	}
+
+	// The timer only ends streams that are still reconnecting.
+	if tracker.transition(1, StatusReconnecting, StatusEnded) {
+		t.Error("live stream ended by a stale grace timer")
+	}
+}
+
+func TestTransitionSavesLatestStatus(t *testing.T) {
+	tracker, saved := recordingTracker()
+	slow := tracker.save
+	tracker.save = func(streamID uint, status string) {
+		if status == StatusConnecting {
+			time.Sleep(20 * time.Millisecond) // a slow write racing a later one
+		}
+		slow(streamID, status)
+	}
+
+	for i := 0; i < 20; i++ {
+		var wg sync.WaitGroup
+		for _, to := range []string{StatusConnecting, StatusLive, StatusReconnecting} {
+			wg.Add(1)
+			go func(to string) {
+				defer wg.Done()
+				tracker.Transition(1, to)
+			}(to)
+		}
+		wg.Wait()
+		if writes := saved(); len(writes) > 0 && writes[len(writes)-1] != tracker.Status(1) {
+			t.Fatalf("last write %q, status %q", writes[len(writes)-1], tracker.Status(1))
+		}
+		tracker.Transition(1, StatusEnded)
+	}
+}
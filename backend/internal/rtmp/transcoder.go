@@ -0,0 +1,424 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FFmpegBinary is the ffmpeg executable used for transcoding.
+var FFmpegBinary = "ffmpeg"
+
+// Restart policy: the first restart waits TranscoderBackoffMin, doubling up
+// to TranscoderBackoffMax. A run that stayed up for TranscoderStableAfter
+// resets the backoff.
+var (
+	TranscoderBackoffMin  = time.Second
+	TranscoderBackoffMax  = 30 * time.Second
+	TranscoderStableAfter = time.Minute
+)
+
+// stderrHistory is how many ffmpeg stderr lines are kept per transcoder.
+const stderrHistory = 200
+
+// maxStderrLine bounds a single stderr line; longer ones are dropped and the
+// rest of the output is discarded, never left unread.
+const maxStderrLine = 1 << 20
+
+// StderrLine is one line of ffmpeg's stderr output.
+type StderrLine struct {
+	Time time.Time `json:"time"`
+	Run  int       `json:"run"`
+	Text string    `json:"text"`
+}
+
+// TranscoderStatus is a snapshot of a transcoder, served by the admin API.
+type TranscoderStatus struct {
+	Running    bool              `json:"running"`
+	PID        int               `json:"pid,omitempty"`
+	Runs       int               `json:"runs"`
+	Restarts   int               `json:"restarts"`
+	StartedAt  *time.Time        `json:"started_at,omitempty"`
+	LastExit   string            `json:"last_exit,omitempty"`
+	LastExitAt *time.Time        `json:"last_exit_at,omitempty"`
+	BuildError string            `json:"build_error,omitempty"` // why the last run could not be started
+	Progress   map[string]string `json:"progress,omitempty"`
+	Stderr     []StderrLine      `json:"stderr"`
+}
+
+// TranscodeRun is a single ffmpeg invocation of a transcoder.
+type TranscodeRun struct {
+	Number    int
+	Args      []string
+	Archive   string // MP4 recording written by this run, if any
+	StartedAt time.Time
+}
+
+// TranscoderHooks connect a Transcoder to the stream it works for.
+type TranscoderHooks struct {
+	// Build fills in the ffmpeg arguments (and archive path) for a run. If
+	// it fails, or leaves no arguments, ffmpeg is not started and the run
+	// is retried after the backoff.
+	Build func(run *TranscodeRun) error
+	// Feed, if set, writes ffmpeg's input to its stdin, starting with each
+	// run. It must return once a write fails; stdin is then closed, which
+	// ffmpeg takes as the end of its input.
+	Feed func(run *TranscodeRun, stdin io.Writer) error
+	// OnStart is called once ffmpeg has been started.
+	OnStart func(run *TranscodeRun)
+	// OnProgress is called on the first progress report of a run, i.e. once
+	// ffmpeg is actually encoding.
+	OnProgress func(run *TranscodeRun)
+	// OnExit is called after every run, with the build or start error if
+	// ffmpeg never ran. interrupted is true when the exit was requested
+	// through Stop.
+	OnExit func(run *TranscodeRun, err error, interrupted bool)
+}
+
+// Transcoder supervises the ffmpeg process of a channel: it starts ffmpeg
+// when the channel is ready, restarts it with exponential backoff when it
+// dies, and keeps a bounded copy of its stderr.
+type Transcoder struct {
+	name  string
+	hooks TranscoderHooks
+
+	lock       sync.Mutex
+	cmd        *exec.Cmd
+	exited     chan struct{}
+	runs       int
+	startedAt  time.Time
+	lastExit   string
+	lastExitAt time.Time
+	buildError string
+	progress   map[string]string
+	stderr     []StderrLine
+	stopping   bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	finished chan struct{}
+}
+
+func NewTranscoder(name string, hooks TranscoderHooks) *Transcoder {
+	return &Transcoder{
+		name:     name,
+		hooks:    hooks,
+		stop:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Run supervises ffmpeg until Stop is called. The first run starts once
+// ready is closed (e.g. on the first keyframe of the ingest).
+func (t *Transcoder) Run(ready <-chan struct{}) {
+	defer close(t.finished)
+
+	select {
+	case <-ready:
+	case <-t.stop:
+		return
+	}
+
+	backoff := TranscoderBackoffMin
+	for {
+		run := t.runOnce()
+
+		if t.isStopping() {
+			return
+		}
+		if time.Since(run.StartedAt) >= TranscoderStableAfter {
+			backoff = TranscoderBackoffMin
+		}
+
+		log.Printf("[FFMPEG %s] restarting in %s", t.name, backoff)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > TranscoderBackoffMax {
+			backoff = TranscoderBackoffMax
+		}
+	}
+}
+
+func (t *Transcoder) runOnce() *TranscodeRun {
+	t.lock.Lock()
+	run := &TranscodeRun{Number: t.runs + 1, StartedAt: time.Now()}
+	t.lock.Unlock()
+
+	if err := t.build(run); err != nil {
+		log.Printf("[FFMPEG %s] not starting ffmpeg: %v", t.name, err)
+		t.lock.Lock()
+		t.buildError = err.Error()
+		t.lock.Unlock()
+		if t.hooks.OnExit != nil {
+			t.hooks.OnExit(run, err, t.isStopping())
+		}
+		return run
+	}
+
+	t.lock.Lock()
+	t.runs++
+	t.buildError = ""
+	t.progress = nil
+	t.lock.Unlock()
+
+	cmd := exec.Command(FFmpegBinary, run.Args...)
+	var (
+		stdin      io.WriteCloser
+		stderrPipe io.ReadCloser
+		err        error
+	)
+	if t.hooks.Feed != nil {
+		stdin, err = cmd.StdinPipe()
+	}
+	if err == nil {
+		stderrPipe, err = cmd.StderrPipe()
+	}
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("CRITICAL: Failed to start FFmpeg for stream %s: %v", t.name, err)
+		t.recordExit(err)
+		if t.hooks.OnExit != nil {
+			t.hooks.OnExit(run, err, t.isStopping())
+		}
+		return run
+	}
+
+	exited := make(chan struct{})
+	t.lock.Lock()
+	t.cmd = cmd
+	t.exited = exited
+	t.startedAt = run.StartedAt
+	if t.stopping {
+		// Stop raced with the start; it could not see this process yet.
+		_ = cmd.Process.Signal(os.Interrupt)
+	}
+	t.lock.Unlock()
+
+	log.Printf("FFmpeg started for stream %s (PID: %d, run %d)", t.name, cmd.Process.Pid, run.Number)
+	if stdin != nil {
+		go func() {
+			err := t.hooks.Feed(run, stdin)
+			stdin.Close()
+			select {
+			case <-exited: // writes fail once ffmpeg is gone
+			default:
+				if err != nil {
+					log.Printf("[FFMPEG %s] input feed stopped: %v", t.name, err)
+				}
+			}
+		}()
+	}
+	if t.hooks.OnStart != nil {
+		t.hooks.OnStart(run)
+	}
+
+	// Stderr must be fully read before Wait closes the pipe.
+	t.readStderr(run, stderrPipe)
+	err = cmd.Wait() // Blocking wait ensures zombie process is reaped
+
+	t.lock.Lock()
+	t.cmd = nil
+	t.lock.Unlock()
+	close(exited)
+
+	interrupted := t.isStopping()
+	if err != nil && !interrupted {
+		log.Printf("FFmpeg process for %s exited with error: %v", t.name, err)
+	} else {
+		log.Printf("FFmpeg process for %s exited clean.", t.name)
+	}
+	t.recordExit(err)
+	if t.hooks.OnExit != nil {
+		t.hooks.OnExit(run, err, interrupted)
+	}
+	return run
+}
+
+// build fills in a run through the Build hook.
+func (t *Transcoder) build(run *TranscodeRun) error {
+	if t.hooks.Build != nil {
+		if err := t.hooks.Build(run); err != nil {
+			return fmt.Errorf("build ffmpeg arguments: %w", err)
+		}
+	}
+	if len(run.Args) == 0 {
+		return errors.New("build ffmpeg arguments: no arguments")
+	}
+	return nil
+}
+
+// readStderr keeps ffmpeg's stderr (split on \r as well, since progress
+// lines are carriage-return terminated) and logs everything that is not a
+// progress report.
+func (t *Transcoder) readStderr(run *TranscodeRun, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxStderrLine)
+	scanner.Split(scanLinesCR)
+	defer func() {
+		// After a scan error ffmpeg must still be able to write, or it
+		// blocks and never exits.
+		if err := scanner.Err(); err != nil {
+			log.Printf("[FFMPEG %s] discarding the rest of stderr: %v", t.name, err)
+			io.Copy(io.Discard, r)
+		}
+	}()
+	reportedProgress := false
+
+	for scanner.Scan() {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if progress := parseProgress(text); progress != nil {
+			t.lock.Lock()
+			t.progress = progress
+			t.lock.Unlock()
+			if !reportedProgress {
+				reportedProgress = true
+				if t.hooks.OnProgress != nil {
+					t.hooks.OnProgress(run)
+				}
+			}
+			continue
+		}
+
+		log.Printf("[FFMPEG %s] %s", t.name, text)
+		t.lock.Lock()
+		t.stderr = append(t.stderr, StderrLine{Time: time.Now(), Run: run.Number, Text: text})
+		if len(t.stderr) > stderrHistory {
+			t.stderr = t.stderr[len(t.stderr)-stderrHistory:]
+		}
+		t.lock.Unlock()
+	}
+}
+
+func (t *Transcoder) recordExit(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastExitAt = time.Now()
+	if err != nil {
+		t.lastExit = err.Error()
+	} else {
+		t.lastExit = "exit status 0"
+	}
+}
+
+func (t *Transcoder) isStopping() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stopping
+}
+
+// Stop ends supervision: ffmpeg is interrupted (SIGINT, so the MP4 archive
+// gets its index written) and killed if it has not exited within timeout.
+func (t *Transcoder) Stop(timeout time.Duration) {
+	t.stopOnce.Do(func() {
+		t.lock.Lock()
+		t.stopping = true
+		cmd, exited := t.cmd, t.exited
+		t.lock.Unlock()
+		close(t.stop)
+
+		if cmd != nil && cmd.Process != nil {
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				// Interrupts are not supported everywhere (e.g. Windows).
+				_ = cmd.Process.Kill()
+			}
+			select {
+			case <-exited:
+			case <-time.After(timeout):
+				log.Printf("FFmpeg for %s did not stop within %s, killing it", t.name, timeout)
+				_ = cmd.Process.Kill()
+			}
+		}
+	})
+	<-t.finished
+}
+
+// Status returns a snapshot of the transcoder for the admin API.
+func (t *Transcoder) Status() TranscoderStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	status := TranscoderStatus{
+		Running:    t.cmd != nil,
+		Runs:       t.runs,
+		LastExit:   t.lastExit,
+		BuildError: t.buildError,
+		Stderr:     append([]StderrLine(nil), t.stderr...),
+	}
+	if t.runs > 1 {
+		status.Restarts = t.runs - 1
+	}
+	if t.cmd != nil && t.cmd.Process != nil {
+		status.PID = t.cmd.Process.Pid
+		startedAt := t.startedAt
+		status.StartedAt = &startedAt
+	}
+	if !t.lastExitAt.IsZero() {
+		lastExitAt := t.lastExitAt
+		status.LastExitAt = &lastExitAt
+	}
+	if t.progress != nil {
+		status.Progress = make(map[string]string, len(t.progress))
+		for k, v := range t.progress {
+			status.Progress[k] = v
+		}
+	}
+	return status
+}
+
+// parseProgress parses an ffmpeg progress line such as
+// "frame=  120 fps= 30 q=28.0 size=  1024kB time=00:00:04.00 bitrate=2097.2kbits/s speed=1.0x"
+// into its key/value pairs. It returns nil for any other line.
+func parseProgress(line string) map[string]string {
+	if !strings.HasPrefix(line, "frame=") && !strings.HasPrefix(line, "size=") {
+		return nil
+	}
+
+	// Values may be padded ("fps= 30"), so glue "key=" and its value back
+	// together before splitting into pairs.
+	fields := strings.Fields(line)
+	progress := make(map[string]string)
+	for i := 0; i < len(fields); i++ {
+		key, value, ok := strings.Cut(fields[i], "=")
+		if !ok {
+			continue
+		}
+		if value == "" && i+1 < len(fields) && !strings.Contains(fields[i+1], "=") {
+			i++
+			value = fields[i]
+		}
+		progress[key] = value
+	}
+	return progress
+}
+
+// scanLinesCR is bufio.ScanLines that also treats a lone '\r' as a line end.
+func scanLinesCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,282 @@
+package rtmp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/format/flv"
+)
+
+// fakeFFmpeg points FFmpegBinary at a shell script for the test.
+func fakeFFmpeg(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	binary := FFmpegBinary
+	t.Cleanup(func() { FFmpegBinary = binary })
+	FFmpegBinary = path
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+func staticArgs(run *TranscodeRun) error {
+	run.Args = []string{"-i", "in"}
+	return nil
+}
+
+func TestParseProgress(t *testing.T) {
+	progress := parseProgress("frame=  120 fps= 30 q=28.0 size=    1024kB time=00:00:04.00 bitrate=2097.2kbits/s speed=1.0x")
+	for key, want := range map[string]string{"frame": "120", "fps": "30", "q": "28.0", "size": "1024kB", "time": "00:00:04.00", "speed": "1.0x"} {
+		if progress[key] != want {
+			t.Errorf("%s = %q, want %q", key, progress[key], want)
+		}
+	}
+	if progress := parseProgress("size=N/A time=00:00:01.00 bitrate=N/A speed=1x"); progress["time"] != "00:00:01.00" {
+		t.Errorf("audio-only progress: got %v", progress)
+	}
+	if parseProgress("Input #0, flv, from 'rtmp://localhost/live/key':") != nil {
+		t.Error("ordinary line parsed as progress")
+	}
+}
+
+func TestScanLinesCR(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("one\rtwo\r\nthree\n\nfour"))
+	scanner.Split(scanLinesCR)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if got := strings.Join(lines, "|"); got != "one|two||three||four" {
+		t.Errorf("lines %q", got)
+	}
+}
+
+// exitTimes runs a transcoder until it has exited n times and returns when
+// each run ended.
+func exitTimes(t *testing.T, n int) []time.Time {
+	t.Helper()
+	exits := make(chan time.Time, n)
+	transcoder := NewTranscoder("test", TranscoderHooks{
+		Build: staticArgs,
+		OnExit: func(run *TranscodeRun, err error, interrupted bool) {
+			select {
+			case exits <- time.Now():
+			default:
+			}
+		},
+	})
+	go transcoder.Run(closedChan())
+	defer transcoder.Stop(time.Second)
+
+	var times []time.Time
+	for len(times) < n {
+		select {
+		case at := <-exits:
+			times = append(times, at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of %d runs exited", len(times), n)
+		}
+	}
+	return times
+}
+
+func TestTranscoderBackoff(t *testing.T) {
+	defer func(min, max, stable time.Duration) {
+		TranscoderBackoffMin, TranscoderBackoffMax, TranscoderStableAfter = min, max, stable
+	}(TranscoderBackoffMin, TranscoderBackoffMax, TranscoderStableAfter)
+	fakeFFmpeg(t, "echo 'Connection refused' >&2; exit 1")
+	TranscoderBackoffMin, TranscoderBackoffMax = 20*time.Millisecond, 80*time.Millisecond
+
+	// Failing runs back off 20, 40, 80, then stay at the 80ms cap.
+	TranscoderStableAfter = time.Hour
+	times := exitTimes(t, 5)
+	for i, min := range []time.Duration{20, 40, 80, 80} {
+		if gap := times[i+1].Sub(times[i]); gap < min*time.Millisecond {
+			t.Errorf("restart %d after %s, want at least %dms", i+1, gap, min)
+		}
+	}
+	if gap := times[4].Sub(times[3]); gap > 150*time.Millisecond {
+		t.Errorf("backoff not capped: restart after %s", gap)
+	}
+
+	// Runs that stayed up long enough reset the backoff every time.
+	TranscoderStableAfter = 0
+	times = exitTimes(t, 5)
+	if total := times[4].Sub(times[0]); total > 150*time.Millisecond {
+		t.Errorf("4 restarts took %s, want the backoff reset to 20ms each time", total)
+	}
+}
+
+func TestTranscoderStderr(t *testing.T) {
+	fakeFFmpeg(t, `
+i=0
+while [ $i -lt 250 ]; do echo "line $i" >&2; i=$((i+1)); done
+printf 'frame=  1 fps=0.0 time=00:00:00.04 speed=1x\rframe= 30 fps= 30 time=00:00:01.00 speed=1x\r' >&2
+head -c 2000000 /dev/zero | tr '\0' x >&2
+echo >&2
+echo "after the long line" >&2
+exit 0`)
+
+	var progressed int
+	transcoder := NewTranscoder("test", TranscoderHooks{
+		Build:      staticArgs,
+		OnProgress: func(run *TranscodeRun) { progressed++ },
+	})
+	done := make(chan struct{})
+	go func() {
+		transcoder.runOnce()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ffmpeg writing an over-long stderr line was never reaped")
+	}
+
+	status := transcoder.Status()
+	if len(status.Stderr) != stderrHistory {
+		t.Fatalf("kept %d stderr lines, want %d", len(status.Stderr), stderrHistory)
+	}
+	if first, last := status.Stderr[0].Text, status.Stderr[len(status.Stderr)-1].Text; first != "line 50" || last != "line 249" {
+		t.Errorf("kept lines %q to %q, want the last 200", first, last)
+	}
+	if progressed != 1 || status.Progress["frame"] != "30" {
+		t.Errorf("OnProgress called %d times, progress %v", progressed, status.Progress)
+	}
+	if status.Runs != 1 || status.LastExit != "exit status 0" {
+		t.Errorf("runs %d, last exit %q", status.Runs, status.LastExit)
+	}
+}
+
+func TestTranscoderBuildFailure(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "started")
+	fakeFFmpeg(t, "touch "+marker)
+
+	var exitErr error
+	for _, build := range []func(*TranscodeRun) error{
+		func(run *TranscodeRun) error { return errors.New("no content key") },
+		func(run *TranscodeRun) error { return nil }, // no arguments
+	} {
+		transcoder := NewTranscoder("test", TranscoderHooks{
+			Build:  build,
+			OnExit: func(run *TranscodeRun, err error, interrupted bool) { exitErr = err },
+		})
+		transcoder.runOnce()
+		if _, err := os.Stat(marker); err == nil {
+			t.Fatal("ffmpeg started without arguments")
+		}
+		status := transcoder.Status()
+		if exitErr == nil || status.BuildError != exitErr.Error() {
+			t.Errorf("build error %q, OnExit got %v", status.BuildError, exitErr)
+		}
+		if status.Runs != 0 || status.Restarts != 0 {
+			t.Errorf("failed build counted as run %d, restart %d", status.Runs, status.Restarts)
+		}
+	}
+}
+
+func TestTranscoderStop(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		script string
+	}{
+		{"interrupt", "trap 'exit 0' INT\nwhile :; do sleep 0.05; done"},
+		{"kill", "trap '' INT\nwhile :; do sleep 0.05; done"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeFFmpeg(t, tc.script)
+			var (
+				lock        sync.Mutex
+				interrupted bool
+			)
+			started := make(chan struct{}, 1)
+			transcoder := NewTranscoder("test", TranscoderHooks{
+				Build:   staticArgs,
+				OnStart: func(run *TranscodeRun) { started <- struct{}{} },
+				OnExit: func(run *TranscodeRun, err error, stopped bool) {
+					lock.Lock()
+					interrupted = stopped
+					lock.Unlock()
+				},
+			})
+			go transcoder.Run(closedChan())
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("ffmpeg never started")
+			}
+			time.Sleep(50 * time.Millisecond) // let the shell install its trap
+
+			stopped := make(chan struct{})
+			go func() {
+				transcoder.Stop(200 * time.Millisecond)
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Stop did not return")
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			if !interrupted {
+				t.Error("exit not reported as interrupted")
+			}
+			if status := transcoder.Status(); status.Running || status.Runs != 1 {
+				t.Errorf("after Stop: running %v, runs %d", status.Running, status.Runs)
+			}
+		})
+	}
+}
+
+func TestTranscoderFeedsChannel(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "in.flv")
+	fakeFFmpeg(t, "exec cat > "+out)
+	channel, stop := liveChannel(t)
+	defer stop()
+
+	transcoder := NewTranscoder("test", TranscoderHooks{
+		Build: staticArgs,
+		Feed: func(run *TranscodeRun, stdin io.Writer) error {
+			return feedFFmpeg(channel, stdin)
+		},
+	})
+	go transcoder.Run(channel.Keyframe())
+	waitFor(t, "ffmpeg input", func() bool {
+		info, err := os.Stat(out)
+		return err == nil && info.Size() > 4096
+	})
+	stop() // the channel ends, and with it ffmpeg's input
+	waitFor(t, "ffmpeg to exit on the end of its input", func() bool {
+		return transcoder.Status().LastExit == "exit status 0"
+	})
+	transcoder.Stop(time.Second)
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	demuxer := flv.NewDemuxer(f)
+	streams, err := demuxer.Streams()
+	if err != nil || len(streams) != 2 {
+		t.Fatalf("ffmpeg got %d streams, err %v", len(streams), err)
+	}
+	pkt, err := demuxer.ReadPacket()
+	if err != nil || !pkt.IsKeyFrame || pkt.Idx != 0 {
+		t.Errorf("ffmpeg input starts with %+v, %v, want a keyframe", pkt, err)
+	}
+}
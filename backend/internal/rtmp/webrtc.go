@@ -0,0 +1,144 @@
+package rtmp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebRTC transport settings shared by WHIP ingest and WHEP playback. Behind
+// NAT, WEBRTC_PUBLIC_IP makes ICE candidates carry the public address;
+// WEBRTC_UDP_PORT multiplexes every peer over one UDP port, which is easier
+// to open in a firewall than the default ephemeral ports.
+var (
+	WebRTCPublicIPs = listFromEnv("WEBRTC_PUBLIC_IP")
+	WebRTCUDPPort   = intFromEnv("WEBRTC_UDP_PORT", 0)
+)
+
+// WebRTCGatherTimeout bounds ICE candidate gathering while answering an
+// offer. WHIP and WHEP answers carry every candidate (no trickle ICE).
+var WebRTCGatherTimeout = 5 * time.Second
+
+// H.264 profiles negotiated with browsers, all in packetization mode 1,
+// which every browser supports.
+var webrtcH264Profiles = []string{"42e01f", "42001f", "4d001f", "640c1f", "64001f"}
+
+var (
+	webrtcOnce sync.Once
+	webrtcAPI  *webrtc.API
+	webrtcErr  error
+)
+
+// sharedWebRTCAPI returns the WebRTC API, set up on first use so a server
+// without WebRTC peers never binds WEBRTC_UDP_PORT.
+func sharedWebRTCAPI() (*webrtc.API, error) {
+	webrtcOnce.Do(func() {
+		webrtcAPI, webrtcErr = newWebRTCAPI()
+	})
+	return webrtcAPI, webrtcErr
+}
+
+func newWebRTCAPI() (*webrtc.API, error) {
+	media := &webrtc.MediaEngine{}
+	feedback := []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}, {Type: "goog-remb"}}
+	for i, profile := range webrtcH264Profiles {
+		codec := webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH264,
+				ClockRate:    90000,
+				SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + profile,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: webrtc.PayloadType(102 + 2*i),
+		}
+		if err := media.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+	opus := webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: "minptime=10;useinbandfec=1",
+		},
+		PayloadType: 111,
+	}
+	if err := media.RegisterCodec(opus, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, err
+	}
+
+	interceptors := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(media, interceptors); err != nil {
+		return nil, err
+	}
+
+	settings := webrtc.SettingEngine{}
+	if len(WebRTCPublicIPs) > 0 {
+		settings.SetNAT1To1IPs(WebRTCPublicIPs, webrtc.ICECandidateTypeHost)
+	}
+	if WebRTCUDPPort > 0 {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: WebRTCUDPPort})
+		if err != nil {
+			return nil, fmt.Errorf("WebRTC UDP port %d: %w", WebRTCUDPPort, err)
+		}
+		log.Println("WebRTC listening on UDP", conn.LocalAddr())
+		settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(media),
+		webrtc.WithInterceptorRegistry(interceptors),
+		webrtc.WithSettingEngine(settings),
+	), nil
+}
+
+// answerOffer applies a remote offer to pc and returns the complete local
+// answer, candidates included.
+func answerOffer(pc *webrtc.PeerConnection, offer string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", fmt.Errorf("invalid offer: %w", err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(WebRTCGatherTimeout):
+		log.Printf("WebRTC: ICE gathering timed out, answering with the candidates found so far")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+func listFromEnv(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func intFromEnv(name string, fallback int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+		log.Printf("Invalid %s %q, using default", name, v)
+	}
+	return fallback
+}
@@ -0,0 +1,426 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"streamcast-backend/internal/models"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// WHEP playback: every WebRTC viewer of a channel shares one feed, which
+// reads the channel's live packets and sends them to all of its viewers'
+// tracks, with AAC transcoded to Opus once per channel. Viewers joining
+// between keyframes see video from the next one. A viewer not connected
+// within WHEPConnectTimeout is dropped.
+var WHEPConnectTimeout = 10 * time.Second
+
+// WHEP playback errors.
+var (
+	ErrStreamOffline  = errors.New("stream is not live")
+	ErrPlaybackDenied = errors.New("playback not allowed")
+	ErrNoH264         = errors.New("WebRTC playback needs H.264 video")
+)
+
+// PlayWHEP answers a WHEP offer from a viewer of the stream with playbackID.
+// token and ip are checked like an HLS request's; encrypted streams also
+// need their key policy to pass, since WebRTC skips the HLS keys. It
+// returns the session ID the viewer ends the session with.
+func (s *Server) PlayWHEP(playbackID, token, ip, offer string) (id, answer string, err error) {
+	stream, err := lookupStreamByPlaybackID(playbackID)
+	if err != nil {
+		return "", "", ErrStreamOffline
+	}
+	channel := s.channels.ByStreamID(stream.ID)
+	if channel == nil {
+		return "", "", ErrStreamOffline
+	}
+	if err := s.checkWHEPAccess(stream, token, ip); err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrPlaybackDenied, err)
+	}
+	return s.openWHEP(channel, offer)
+}
+
+func (s *Server) checkWHEPAccess(stream *models.Stream, token, ip string) error {
+	if err := s.checkAccess(stream, token, ip); err != nil {
+		return err
+	}
+	if !stream.Encrypted {
+		return nil
+	}
+	if s.KeyAccess == nil {
+		return errors.New("key delivery is disabled")
+	}
+	return s.KeyAccess(stream, token, ip)
+}
+
+// openWHEP adds a viewer to channel's feed.
+func (s *Server) openWHEP(channel *Channel, offer string) (string, string, error) {
+	feed, err := s.joinWHEPFeed(channel)
+	if err != nil {
+		return "", "", err
+	}
+	session, answer, err := newWHEPSession(channel.PlaybackID, feed, offer)
+	if err != nil {
+		s.leaveWHEPFeed(feed)
+		return "", "", err
+	}
+
+	s.whepLock.Lock()
+	s.wheps[session.ID] = session
+	s.whepLock.Unlock()
+	s.viewerJoined(channel)
+	go func() {
+		session.wait()
+		session.Close()
+		s.whepLock.Lock()
+		delete(s.wheps, session.ID)
+		s.whepLock.Unlock()
+		s.viewerLeft(channel)
+		s.leaveWHEPFeed(feed)
+	}()
+	return session.ID, answer, nil
+}
+
+// StopWHEP ends a WHEP session at the viewer's request. It reports whether
+// the session existed.
+func (s *Server) StopWHEP(playbackID, id string) bool {
+	s.whepLock.Lock()
+	session, ok := s.wheps[id]
+	s.whepLock.Unlock()
+	if !ok || session.playbackID != playbackID {
+		return false
+	}
+	session.Close()
+	return true
+}
+
+// joinWHEPFeed returns channel's feed, starting it for the first viewer.
+func (s *Server) joinWHEPFeed(channel *Channel) (*whepFeed, error) {
+	s.whepLock.Lock()
+	defer s.whepLock.Unlock()
+	feed := s.whepFeeds[channel.StreamID]
+	if feed == nil || feed.channel != channel || feed.isClosed() {
+		var err error
+		if feed, err = newWHEPFeed(channel); err != nil {
+			return nil, err
+		}
+		s.whepFeeds[channel.StreamID] = feed
+		go feed.run()
+	}
+	feed.viewers++
+	return feed, nil
+}
+
+// leaveWHEPFeed stops a feed once its last viewer is gone.
+func (s *Server) leaveWHEPFeed(feed *whepFeed) {
+	s.whepLock.Lock()
+	defer s.whepLock.Unlock()
+	feed.viewers--
+	if feed.viewers > 0 {
+		return
+	}
+	if s.whepFeeds[feed.channel.StreamID] == feed {
+		delete(s.whepFeeds, feed.channel.StreamID)
+	}
+	feed.Close()
+}
+
+// whepFeed sends a channel's packets to the tracks its WebRTC viewers are
+// bound to.
+type whepFeed struct {
+	channel *Channel
+	video   *webrtc.TrackLocalStaticSample // nil without video
+	audio   *webrtc.TrackLocalStaticSample // nil without audio
+	opus    *aacTranscoder
+	viewers int // guarded by Server.whepLock
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWHEPFeed(channel *Channel) (*whepFeed, error) {
+	codecs := channel.Codecs()
+	if codecs == nil {
+		return nil, ErrStreamOffline
+	}
+	feed := &whepFeed{channel: channel, stop: make(chan struct{})}
+	for _, codec := range codecs {
+		var err error
+		switch codec := codec.(type) {
+		case h264parser.CodecData:
+			feed.video, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeH264,
+				ClockRate:   90000,
+				SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + whepH264Profile(codec),
+			}, "video", channel.PlaybackID)
+		case aacparser.CodecData:
+			feed.audio, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   48000,
+				Channels:    2,
+				SDPFmtpLine: "minptime=10;useinbandfec=1",
+			}, "audio", channel.PlaybackID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if feed.video == nil {
+		return nil, ErrNoH264
+	}
+	if feed.audio != nil {
+		var err error
+		if feed.opus, err = newAACTranscoder(); err != nil {
+			return nil, fmt.Errorf("audio transcoder: %w", err)
+		}
+	}
+	return feed, nil
+}
+
+// whepH264Profile picks the negotiated profile matching the source's: the
+// browser only needs to know which decoder to prepare.
+func whepH264Profile(codec h264parser.CodecData) string {
+	switch codec.RecordInfo.AVCProfileIndication {
+	case 66:
+		return "42e01f"
+	case 77:
+		return "4d001f"
+	default:
+		return "64001f"
+	}
+}
+
+// run reads the channel from its live edge until the channel ends or the
+// feed is closed.
+func (f *whepFeed) run() {
+	defer f.Close()
+	if f.opus != nil {
+		go f.sendOpus()
+	}
+
+	cursor := f.channel.Queue.Latest()
+	streams, err := cursor.Streams()
+	if err != nil {
+		return
+	}
+	var (
+		video   = newSampleWriter(f.video)
+		started bool // a keyframe has been sent
+	)
+	for {
+		pkt, err := cursor.ReadPacket()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("WHEP feed %s: %v", f.channel.PlaybackID, err)
+			}
+			return
+		}
+		if f.isClosed() {
+			return
+		}
+		switch codec := streams[pkt.Idx].(type) {
+		case h264parser.CodecData:
+			if !started && !pkt.IsKeyFrame {
+				continue
+			}
+			started = true
+			data := avccToAnnexB(pkt.Data)
+			if pkt.IsKeyFrame {
+				// RTMP carries SPS/PPS out of band; browsers need them in-band.
+				data = append(annexB(codec.SPS(), codec.PPS()), data...)
+			}
+			video.Write(data, pkt.Time)
+		case aacparser.CodecData:
+			if f.opus == nil {
+				continue
+			}
+			if err := f.opus.WriteAAC(codec.Config, pkt.Data); err != nil {
+				log.Printf("WHEP feed %s: audio transcoder: %v", f.channel.PlaybackID, err)
+				return
+			}
+		}
+	}
+}
+
+// sendOpus passes the transcoder's Opus packets to the audio track.
+func (f *whepFeed) sendOpus() {
+	for {
+		packet, err := f.opus.ReadOpus()
+		if err != nil {
+			return
+		}
+		f.audio.WriteSample(media.Sample{Data: packet, Duration: opusDuration(packet)})
+	}
+}
+
+// Close stops the feed. Its sessions end with it.
+func (f *whepFeed) Close() {
+	f.closeOnce.Do(func() {
+		close(f.stop)
+		if f.opus != nil {
+			f.opus.Close()
+		}
+	})
+}
+
+func (f *whepFeed) isClosed() bool {
+	select {
+	case <-f.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sampleWriter writes samples to a track one behind, so each sample's
+// duration (the RTP timestamp step to the next) is known exactly.
+type sampleWriter struct {
+	track   *webrtc.TrackLocalStaticSample
+	pending []byte
+	at      time.Duration
+}
+
+func newSampleWriter(track *webrtc.TrackLocalStaticSample) *sampleWriter {
+	return &sampleWriter{track: track}
+}
+
+func (w *sampleWriter) Write(data []byte, at time.Duration) {
+	if w.pending != nil {
+		duration := at - w.at
+		if duration < 0 {
+			duration = 0
+		}
+		w.track.WriteSample(media.Sample{Data: w.pending, Duration: duration})
+	}
+	w.pending, w.at = data, at
+}
+
+// avccToAnnexB converts length-prefixed NAL units to start-code-prefixed.
+func avccToAnnexB(b []byte) []byte {
+	var out []byte
+	for len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		if n > len(b)-4 {
+			break
+		}
+		out = append(out, annexB(b[4:4+n])...)
+		b = b[4+n:]
+	}
+	return out
+}
+
+func annexB(nalus ...[]byte) []byte {
+	var out []byte
+	for _, nalu := range nalus {
+		out = append(out, 0, 0, 0, 1)
+		out = append(out, nalu...)
+	}
+	return out
+}
+
+// whepSession is one WebRTC viewer.
+type whepSession struct {
+	ID         string
+	playbackID string
+
+	pc        *webrtc.PeerConnection
+	feed      *whepFeed
+	connected chan struct{}
+	connOnce  sync.Once
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWHEPSession(playbackID string, feed *whepFeed, offer string) (*whepSession, string, error) {
+	api, err := sharedWebRTCAPI()
+	if err != nil {
+		return nil, "", err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	w := &whepSession{
+		ID:         uuid.New().String(),
+		playbackID: playbackID,
+		pc:         pc,
+		feed:       feed,
+		connected:  make(chan struct{}),
+		closed:     make(chan struct{}),
+	}
+	for _, track := range []*webrtc.TrackLocalStaticSample{feed.video, feed.audio} {
+		if track == nil {
+			continue
+		}
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			pc.Close()
+			return nil, "", err
+		}
+		// Read RTCP so the interceptors (NACK responder, reports) run.
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			w.connOnce.Do(func() { close(w.connected) })
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			w.Close()
+		}
+	})
+
+	answer, err := answerOffer(pc, offer)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	return w, answer, nil
+}
+
+// wait returns once the session should end: the viewer left or never
+// connected, or the channel or its feed ended.
+func (w *whepSession) wait() {
+	timeout := time.NewTimer(WHEPConnectTimeout)
+	defer timeout.Stop()
+	select {
+	case <-w.connected:
+	case <-w.closed:
+		return
+	case <-w.feed.stop:
+		return
+	case <-timeout.C:
+		log.Printf("WHEP session %s: viewer did not connect within %s", w.ID, WHEPConnectTimeout)
+		return
+	}
+	select {
+	case <-w.closed:
+	case <-w.feed.stop:
+	case <-w.feed.channel.Done():
+	}
+}
+
+// Close hangs up on the viewer.
+func (w *whepSession) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.pc.Close()
+	})
+	return nil
+}
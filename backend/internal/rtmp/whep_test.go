@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"streamcast-backend/internal/models"
+
+	"github.com/nareix/joy4/av"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+func TestOpusDuration(t *testing.T) {
+	for _, tc := range []struct {
+		packet []byte
+		want   time.Duration
+	}{
+		{[]byte{0xfc}, 20 * time.Millisecond},         // CELT FB 20ms, one frame
+		{[]byte{0xf8 | 1}, 40 * time.Millisecond},     // CELT FB 20ms, two frames
+		{[]byte{0xe0}, 2500 * time.Microsecond},       // CELT FB 2.5ms
+		{[]byte{0x08}, 20 * time.Millisecond},         // SILK NB 20ms
+		{[]byte{0x18 | 3, 3}, 180 * time.Millisecond}, // SILK NB 60ms, three frames
+		{[]byte{0x78}, 20 * time.Millisecond},         // hybrid FB 20ms
+		{nil, 0},
+	} {
+		if got := opusDuration(tc.packet); got != tc.want {
+			t.Errorf("opusDuration(%x) = %s, want %s", tc.packet, got, tc.want)
+		}
+	}
+}
+
+func TestOggPacketReader(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := oggwriter.NewWith(&buf, 48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{{0xfc, 1, 2}, bytes.Repeat([]byte{0xfc}, 600), {0xfc}}
+	for i, p := range packets {
+		if err := w.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: uint32(i * 960)}, Payload: p}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := newOggPacketReader(&buf)
+	for _, header := range []string{"OpusHead", "OpusTags"} {
+		p, err := r.ReadPacket()
+		if err != nil || !bytes.HasPrefix(p, []byte(header)) {
+			t.Fatalf("got %q, %v, want the %s header", p, err, header)
+		}
+	}
+	for i, want := range packets {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("packet %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("got %v at the end, want io.EOF", err)
+	}
+}
+
+func TestAVCCToAnnexB(t *testing.T) {
+	got := avccToAnnexB([]byte{0, 0, 0, 2, 0x65, 1, 0, 0, 0, 1, 0x06})
+	want := []byte{0, 0, 0, 1, 0x65, 1, 0, 0, 0, 1, 0x06}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestPlayWHEPOfflineStream(t *testing.T) {
+	s := NewRtmpServer("0")
+	if _, _, err := s.PlayWHEP("nope", "", "127.0.0.1", "v=0"); !errors.Is(err, ErrStreamOffline) {
+		t.Errorf("got %v, want ErrStreamOffline", err)
+	}
+}
+
+// TestWHEPFeedVideo plays a live channel to a local WebRTC viewer. Audio
+// needs ffmpeg and is left out.
+func TestWHEPFeedVideo(t *testing.T) {
+	s := NewRtmpServer("0")
+	stream := &models.Stream{StreamKey: "live_abc", PlaybackID: "pb_abc"}
+	stream.ID = 7
+	channel, _, err := s.channels.Attach(stream, InputPrimary, io.NopCloser(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.channels.Close(channel)
+	codecs := testCodecs(t)[:1]
+	channel.Queue.WriteHeader(codecs)
+	channel.setCodecs(codecs)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second / 30)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			channel.Queue.WritePacket(av.Packet{
+				Time:       time.Duration(i) * time.Second / 30,
+				IsKeyFrame: i%30 == 0,
+				Data:       []byte{0, 0, 0, 4, 0x65, 1, 2, 3},
+			})
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	viewer, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer viewer.Close()
+	if _, err := viewer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *rtp.Packet, 1)
+	viewer.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case received <- pkt:
+			default:
+			}
+		}
+	})
+	offer, err := viewer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(viewer)
+	if err := viewer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	id, answer, err := s.openWHEP(channel, viewer.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := viewer.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkt := <-received:
+		if len(pkt.Payload) == 0 {
+			t.Error("empty RTP payload")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no video reached the viewer")
+	}
+	if channel.Viewers() != 1 {
+		t.Errorf("channel has %d viewers, want 1", channel.Viewers())
+	}
+
+	if !s.StopWHEP("pb_abc", id) {
+		t.Fatal("StopWHEP did not find the session")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for channel.Viewers() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if channel.Viewers() != 0 {
+		t.Error("viewer not counted out after the session ended")
+	}
+}
@@ -0,0 +1,418 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nareix/joy4/av"
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+)
+
+// WHIP ingest: browsers publish H.264 and Opus over WebRTC; the Opus is
+// transcoded to AAC so the channel looks like any RTMP publish. A keyframe
+// is requested every WHIPKeyframeInterval since browsers only send them on
+// demand, and HLS needs one per segment. A session whose tracks are not all
+// known within WHIPStartTimeout is dropped.
+var (
+	WHIPKeyframeInterval = 2 * time.Second
+	WHIPStartTimeout     = 10 * time.Second
+)
+
+// WHIP publish errors.
+var (
+	ErrUnknownStreamKey = errors.New("unknown stream key")
+	ErrPublishRefused   = errors.New("publish refused")
+	ErrStreamBusy       = errors.New("stream is already being published")
+	ErrNoMedia          = errors.New("offer has no audio or video to receive")
+)
+
+// whipMaxLate is how many RTP packets the jitter buffers hold for a missing
+// packet to be retransmitted before giving up on the frame.
+const whipMaxLate = 512
+
+// PublishWHIP answers a WHIP offer for the stream with streamKey and starts
+// feeding the stream from the resulting session. It returns the session ID
+// the publisher ends the session with.
+func (s *Server) PublishWHIP(streamKey, offer string) (id, answer string, err error) {
+	stream, role, err := lookupPublisher(streamKey)
+	if err != nil {
+		return "", "", ErrUnknownStreamKey
+	}
+	if err := s.admitPublisher(stream); err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrPublishRefused, err)
+	}
+	if s.channels.InputBusy(stream.StreamKey, role) {
+		return "", "", ErrStreamBusy
+	}
+
+	session, answer, err := newWHIPSession(streamKey, offer)
+	if err != nil {
+		return "", "", err
+	}
+	s.whipLock.Lock()
+	s.whips[session.ID] = session
+	s.whipLock.Unlock()
+
+	log.Printf("WHIP Publish session %s for stream %d (%s)", session.ID, stream.ID, role)
+	go func() {
+		s.runSource(stream, role, session, session)
+		session.Close()
+		s.whipLock.Lock()
+		delete(s.whips, session.ID)
+		s.whipLock.Unlock()
+	}()
+	return session.ID, answer, nil
+}
+
+// StopWHIP ends a WHIP session at the publisher's request. It reports
+// whether the session existed.
+func (s *Server) StopWHIP(streamKey, id string) bool {
+	s.whipLock.Lock()
+	session, ok := s.whips[id]
+	s.whipLock.Unlock()
+	if !ok || session.streamKey != streamKey {
+		return false
+	}
+	session.Close()
+	return true
+}
+
+// whipSession is a WHIP publisher as seen by the channel pipeline: a
+// demuxer fed from the peer connection's tracks. Video comes first when
+// both are sent.
+type whipSession struct {
+	ID        string
+	streamKey string
+
+	pc      *webrtc.PeerConnection
+	opus    *opusTranscoder
+	started time.Time
+
+	lock     sync.Mutex
+	codecs   []av.CodecData // by packet index, nil until known
+	videoIdx int            // -1 without video
+	audioIdx int            // -1 without audio
+
+	ready     chan struct{} // closed once every codec is known
+	packets   chan av.Packet
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWHIPSession(streamKey, offer string) (*whipSession, string, error) {
+	api, err := sharedWebRTCAPI()
+	if err != nil {
+		return nil, "", err
+	}
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+	w := &whipSession{
+		ID:        uuid.New().String(),
+		streamKey: streamKey,
+		pc:        pc,
+		started:   time.Now(),
+		videoIdx:  -1,
+		audioIdx:  -1,
+		ready:     make(chan struct{}),
+		packets:   make(chan av.Packet, 1024),
+		closed:    make(chan struct{}),
+	}
+	pc.OnTrack(w.handleTrack)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			w.Close()
+		}
+	})
+
+	answer, err := answerOffer(pc, offer)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+	for _, t := range pc.GetTransceivers() {
+		if t.Direction() != webrtc.RTPTransceiverDirectionRecvonly && t.Direction() != webrtc.RTPTransceiverDirectionSendrecv {
+			continue
+		}
+		switch t.Kind() {
+		case webrtc.RTPCodecTypeVideo:
+			if w.videoIdx < 0 {
+				w.videoIdx = len(w.codecs)
+				w.codecs = append(w.codecs, nil)
+			}
+		case webrtc.RTPCodecTypeAudio:
+			if w.audioIdx < 0 {
+				w.audioIdx = -2 // placed after video below
+			}
+		}
+	}
+	if w.audioIdx == -2 {
+		w.audioIdx = len(w.codecs)
+		w.codecs = append(w.codecs, nil)
+		if w.opus, err = newOpusTranscoder(); err != nil {
+			pc.Close()
+			return nil, "", fmt.Errorf("audio transcoder: %w", err)
+		}
+		go w.readAAC()
+	}
+	if len(w.codecs) == 0 {
+		pc.Close()
+		return nil, "", ErrNoMedia
+	}
+	go w.closeIfNotReady()
+	return w, answer, nil
+}
+
+func (w *whipSession) closeIfNotReady() {
+	select {
+	case <-w.ready:
+	case <-w.closed:
+	case <-time.After(WHIPStartTimeout):
+		log.Printf("WHIP session %s: no media within %s", w.ID, WHIPStartTimeout)
+		w.Close()
+	}
+}
+
+func (w *whipSession) handleTrack(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+	mime := track.Codec().MimeType
+	switch {
+	case strings.EqualFold(mime, webrtc.MimeTypeH264) && w.videoIdx >= 0:
+		go w.requestKeyframes(track)
+		w.readVideo(track)
+	case strings.EqualFold(mime, webrtc.MimeTypeOpus) && w.audioIdx >= 0:
+		w.readOpus(track)
+	default:
+		log.Printf("WHIP session %s: unsupported %s track", w.ID, mime)
+		w.Close()
+	}
+}
+
+// requestKeyframes sends a PLI for track every WHIPKeyframeInterval.
+func (w *whipSession) requestKeyframes(track *webrtc.TrackRemote) {
+	ticker := time.NewTicker(WHIPKeyframeInterval)
+	defer ticker.Stop()
+	for {
+		pli := []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}}
+		if err := w.pc.WriteRTCP(pli); err != nil {
+			return
+		}
+		select {
+		case <-w.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (w *whipSession) readVideo(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(whipMaxLate, &codecs.H264Packet{IsAVC: true}, 90000)
+	clock := &rtpClock{rate: 90000}
+	var codec av.CodecData
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(pkt)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			at := clock.Time(sample.PacketTimestamp, time.Since(w.started))
+			frame := parseAVCC(sample.Data)
+			if codec == nil && frame.SPS != nil && frame.PPS != nil {
+				if codec, err = h264parser.NewCodecDataFromSPSAndPPS(frame.SPS, frame.PPS); err != nil {
+					log.Printf("WHIP session %s: bad SPS/PPS: %v", w.ID, err)
+					codec = nil
+					continue
+				}
+				w.setCodec(w.videoIdx, codec)
+			}
+			if codec == nil || len(frame.Data) == 0 {
+				continue // nothing decodable before the first SPS/PPS
+			}
+			w.emit(av.Packet{Idx: int8(w.videoIdx), Time: at, IsKeyFrame: frame.Keyframe, Data: frame.Data})
+		}
+	}
+}
+
+// readOpus passes the Opus track, reordered, to the AAC transcoder.
+func (w *whipSession) readOpus(track *webrtc.TrackRemote) {
+	builder := samplebuilder.New(whipMaxLate, &codecs.OpusPacket{}, 48000)
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return
+		}
+		builder.Push(pkt)
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			if err := w.opus.WriteOpus(sample.Data, sample.PacketTimestamp); err != nil {
+				log.Printf("WHIP session %s: audio transcoder: %v", w.ID, err)
+				w.Close()
+				return
+			}
+		}
+	}
+}
+
+// readAAC emits the transcoder's AAC frames. Their times count samples from
+// the first frame, which is placed at the time it came out.
+func (w *whipSession) readAAC() {
+	var (
+		base    time.Duration
+		samples int64
+		rate    int
+	)
+	for {
+		config, frame, err := w.opus.ReadFrame()
+		if err != nil {
+			if err != io.EOF && !w.isClosed() {
+				log.Printf("WHIP session %s: audio transcoder: %v", w.ID, err)
+			}
+			w.Close()
+			return
+		}
+		if rate == 0 {
+			codec, err := aacparser.NewCodecDataFromMPEG4AudioConfig(config)
+			if err != nil {
+				log.Printf("WHIP session %s: %v", w.ID, err)
+				w.Close()
+				return
+			}
+			base, rate = time.Since(w.started), config.SampleRate
+			w.setCodec(w.audioIdx, codec)
+		}
+		at := base + time.Duration(samples)*time.Second/time.Duration(rate)
+		samples += 1024
+		w.emit(av.Packet{Idx: int8(w.audioIdx), Time: at, Data: frame})
+	}
+}
+
+func (w *whipSession) setCodec(idx int, codec av.CodecData) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.codecs[idx] != nil {
+		return
+	}
+	w.codecs[idx] = codec
+	for _, c := range w.codecs {
+		if c == nil {
+			return
+		}
+	}
+	close(w.ready)
+}
+
+func (w *whipSession) emit(pkt av.Packet) {
+	select {
+	case w.packets <- pkt:
+	case <-w.closed:
+	}
+}
+
+// Streams waits until every track's codec is known.
+func (w *whipSession) Streams() ([]av.CodecData, error) {
+	select {
+	case <-w.ready:
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return append([]av.CodecData(nil), w.codecs...), nil
+	case <-w.closed:
+		return nil, io.EOF
+	}
+}
+
+func (w *whipSession) ReadPacket() (av.Packet, error) {
+	select {
+	case pkt := <-w.packets:
+		return pkt, nil
+	case <-w.closed:
+		return av.Packet{}, io.EOF
+	}
+}
+
+// Close hangs up on the publisher.
+func (w *whipSession) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		w.pc.Close()
+		if w.opus != nil {
+			w.opus.Close()
+		}
+	})
+	return nil
+}
+
+func (w *whipSession) isClosed() bool {
+	select {
+	case <-w.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// rtpClock turns a track's RTP timestamps into stream time: the first one
+// maps to the time since the session started, so tracks starting at
+// different times stay in sync, and later ones follow the RTP clock.
+type rtpClock struct {
+	rate    uint32
+	started bool
+	base    time.Duration
+	last    uint32
+	elapsed int64 // RTP ticks since the first timestamp, unwrapped
+}
+
+func (c *rtpClock) Time(timestamp uint32, sinceStart time.Duration) time.Duration {
+	if !c.started {
+		c.started, c.base, c.last = true, sinceStart, timestamp
+	}
+	c.elapsed += int64(int32(timestamp - c.last))
+	c.last = timestamp
+	return c.base + time.Duration(c.elapsed)*time.Second/time.Duration(c.rate)
+}
+
+// avccFrame is an H.264 access unit as joy4 carries it.
+type avccFrame struct {
+	Data     []byte // length-prefixed NAL units, access unit delimiters removed
+	SPS, PPS []byte
+	Keyframe bool
+}
+
+// parseAVCC picks the parameter sets and IDR flag out of a length-prefixed
+// access unit. SPS and PPS stay in the data so resolution changes reach the
+// transcoder.
+func parseAVCC(b []byte) avccFrame {
+	var frame avccFrame
+	for len(b) >= 4 {
+		n := int(binary.BigEndian.Uint32(b))
+		if n == 0 || n > len(b)-4 {
+			break
+		}
+		nalu := b[4 : 4+n]
+		b = b[4+n:]
+		switch nalu[0] & 0x1f {
+		case 7:
+			frame.SPS = nalu
+		case 8:
+			frame.PPS = nalu
+		case 5:
+			frame.Keyframe = true
+		case 9:
+			continue // access unit delimiter
+		}
+		frame.Data = binary.BigEndian.AppendUint32(frame.Data, uint32(n))
+		frame.Data = append(frame.Data, nalu...)
+	}
+	return frame
+}
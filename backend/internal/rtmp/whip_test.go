@@ -0,0 +1,145 @@
+package rtmp
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nareix/joy4/av"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+func TestParseAVCC(t *testing.T) {
+	nalus := [][]byte{
+		{0x09, 0xf0},             // AUD
+		{0x67, 0x64, 0x00, 0x1e}, // SPS
+		{0x68, 0xeb},             // PPS
+		{0x65, 0x88, 0x84},       // IDR slice
+	}
+	var au []byte
+	for _, nalu := range nalus {
+		au = append(au, 0, 0, 0, byte(len(nalu)))
+		au = append(au, nalu...)
+	}
+
+	frame := parseAVCC(au)
+	if !frame.Keyframe {
+		t.Error("IDR access unit not flagged as keyframe")
+	}
+	if hex.EncodeToString(frame.SPS) != "6764001e" || hex.EncodeToString(frame.PPS) != "68eb" {
+		t.Errorf("SPS %x, PPS %x", frame.SPS, frame.PPS)
+	}
+	if want := au[6:]; hex.EncodeToString(frame.Data) != hex.EncodeToString(want) {
+		t.Errorf("data %x, want %x (AUD removed)", frame.Data, want)
+	}
+
+	if frame := parseAVCC([]byte{0, 0, 0, 2, 0x41, 0x9a}); frame.Keyframe || frame.SPS != nil {
+		t.Errorf("P slice parsed as %+v", frame)
+	}
+}
+
+func TestRTPClock(t *testing.T) {
+	clock := &rtpClock{rate: 90000}
+	start := uint32(0xffffffff - 1500) // wraps after the first frame
+	if got := clock.Time(start, time.Second); got != time.Second {
+		t.Errorf("first timestamp at %s, want the session offset 1s", got)
+	}
+	if got := clock.Time(start+3000, 0); got != time.Second+time.Second/30 {
+		t.Errorf("after wrap at %s", got)
+	}
+	if got := clock.Time(start+1500, 0); got != time.Second+time.Second/60 {
+		t.Errorf("reordered timestamp at %s", got)
+	}
+}
+
+func TestPublishWHIPRejectsUnknownKey(t *testing.T) {
+	s := NewRtmpServer("0")
+	if _, _, err := s.PublishWHIP("live_unknown", "v=0"); !errors.Is(err, ErrUnknownStreamKey) {
+		t.Errorf("got %v, want ErrUnknownStreamKey", err)
+	}
+}
+
+// TestWHIPSessionVideo publishes H.264 from a local peer and reads it back
+// through the session's demuxer. Audio needs ffmpeg and is left out.
+func TestWHIPSessionVideo(t *testing.T) {
+	publisher, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "whip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := publisher.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := publisher.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(publisher)
+	if err := publisher.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	session, answer, err := newWHIPSession("live_abc", publisher.LocalDescription().SDP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := publisher.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+
+	sps, _ := hex.DecodeString("6764001eacd940a02ff9610000030001000003003c0f162d96")
+	keyframe := append([]byte{0, 0, 0, 1}, sps...)
+	keyframe = append(keyframe, 0, 0, 0, 1, 0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0)
+	keyframe = append(keyframe, 0, 0, 0, 1, 0x65, 0x88, 0x84, 0x00)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(time.Second / 30)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			data := []byte{0, 0, 0, 1, 0x41, 0x9a, 0x00}
+			if i%30 == 0 {
+				data = keyframe
+			}
+			track.WriteSample(media.Sample{Data: data, Duration: time.Second / 30})
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	streams, err := session.Streams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || streams[0].Type() != av.H264 {
+		t.Fatalf("got streams %v, want H.264 video only", streams)
+	}
+	pkt, err := session.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pkt.IsKeyFrame || pkt.Idx != 0 {
+		t.Errorf("first packet %+v, want the keyframe", pkt)
+	}
+	var last time.Duration
+	for i := 0; i < 5; i++ {
+		if pkt, err = session.ReadPacket(); err != nil {
+			t.Fatal(err)
+		}
+		if pkt.Time < last {
+			t.Errorf("packet time went back from %s to %s", last, pkt.Time)
+		}
+		last = pkt.Time
+	}
+}
@@ -0,0 +1,127 @@
+import React, { useState, useEffect } from 'react';
+import { Plus, Trash2, Radio } from 'lucide-react';
+
+interface RestreamTarget {
+    id: number;
+    name: string;
+    url: string;
+    stream_key: string;
+    enabled: boolean;
+}
+
+interface RestreamStatus {
+    target_id: number;
+    state: string;
+    attempts: number;
+    last_error?: string;
+}
+
+interface RestreamTargetsProps {
+    streamId: number;
+}
+
+const stateColors: { [state: string]: string } = {
+    live: 'bg-green-500/20 text-green-500',
+    connecting: 'bg-yellow-500/20 text-yellow-500',
+    reconnecting: 'bg-orange-500/20 text-orange-500',
+};
+
+const RestreamTargets: React.FC<RestreamTargetsProps> = ({ streamId }) => {
+    const [targets, setTargets] = useState<RestreamTarget[]>([]);
+    const [status, setStatus] = useState<RestreamStatus[]>([]);
+    const [draft, setDraft] = useState({ name: '', url: '', stream_key: '' });
+
+    const fetchTargets = async () => {
+        try {
+            const res = await fetch(`/api/streams/${streamId}/restreams`);
+            const data = await res.json();
+            if (data.data) setTargets(data.data);
+            setStatus(data.status || []);
+        } catch (err) { console.error(err); }
+    };
+
+    useEffect(() => {
+        fetchTargets();
+        const interval = setInterval(fetchTargets, 5000);
+        return () => clearInterval(interval);
+    }, [streamId]);
+
+    const addTarget = async () => {
+        if (!draft.url) return;
+        try {
+            const res = await fetch(`/api/streams/${streamId}/restreams`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ ...draft, enabled: true }),
+            });
+            const data = await res.json();
+            if (data.error) return alert(data.error);
+            setDraft({ name: '', url: '', stream_key: '' });
+            fetchTargets();
+        } catch (err) { console.error(err); }
+    };
+
+    const toggleTarget = async (target: RestreamTarget) => {
+        try {
+            await fetch(`/api/streams/${streamId}/restreams/${target.id}`, {
+                method: 'PUT',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ ...target, enabled: !target.enabled }),
+            });
+            fetchTargets();
+        } catch (err) { console.error(err); }
+    };
+
+    const deleteTarget = async (id: number) => {
+        if (!window.confirm("Remove this restream destination?")) return;
+        try {
+            await fetch(`/api/streams/${streamId}/restreams/${id}`, { method: 'DELETE' });
+            fetchTargets();
+        } catch (err) { console.error(err); }
+    };
+
+    return (
+        <div className="space-y-3">
+            <label className="text-xs text-gray-400 flex items-center gap-2"><Radio size={14} /> Restream Destinations</label>
+            {targets.map(target => {
+                const live = status.find(s => s.target_id === target.id);
+                return (
+                    <div key={target.id} className="flex items-center justify-between bg-midnight-black border border-gray-700 rounded p-2">
+                        <div className="min-w-0">
+                            <div className="text-white text-sm font-medium">{target.name || target.url}</div>
+                            <div className="text-gray-500 text-xs font-mono truncate">{target.url}</div>
+                            {live?.last_error && <div className="text-red-400 text-xs truncate">{live.last_error}</div>}
+                        </div>
+                        <div className="flex items-center gap-2">
+                            {live && (
+                                <span className={`px-2 py-1 rounded text-xs font-bold ${stateColors[live.state] || 'bg-gray-700 text-gray-400'}`}>
+                                    {live.state.toUpperCase()}{live.attempts > 1 ? ` (${live.attempts})` : ''}
+                                </span>
+                            )}
+                            <button type="button" onClick={() => toggleTarget(target)}
+                                className={`px-2 py-1 rounded text-xs font-bold ${target.enabled ? 'bg-emerald-900/40 text-emerald-400' : 'bg-gray-700 text-gray-400'}`}>
+                                {target.enabled ? 'ENABLED' : 'DISABLED'}
+                            </button>
+                            <button type="button" onClick={() => deleteTarget(target.id)} className="text-gray-400 hover:text-red-500 p-1">
+                                <Trash2 size={16} />
+                            </button>
+                        </div>
+                    </div>
+                );
+            })}
+            <div className="grid grid-cols-3 gap-2">
+                <input className="input-field bg-midnight-black p-2 rounded border border-gray-700 text-white text-sm" placeholder="Name"
+                    value={draft.name} onChange={e => setDraft({ ...draft, name: e.target.value })} />
+                <input className="input-field bg-midnight-black p-2 rounded border border-gray-700 text-white text-sm" placeholder="rtmp://host/app"
+                    value={draft.url} onChange={e => setDraft({ ...draft, url: e.target.value })} />
+                <input className="input-field bg-midnight-black p-2 rounded border border-gray-700 text-white text-sm" placeholder="Stream key"
+                    value={draft.stream_key} onChange={e => setDraft({ ...draft, stream_key: e.target.value })} />
+            </div>
+            <button type="button" onClick={addTarget} className="btn-primary px-4 py-2 flex items-center gap-2 text-sm">
+                <Plus size={16} /> Add Destination
+            </button>
+        </div>
+    );
+};
+
+export default RestreamTargets;
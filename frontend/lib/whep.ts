@@ -0,0 +1,78 @@
+// WHEP (WebRTC) playback of a live stream, for sub-second latency. The
+// server answers with every ICE candidate, so the offer is sent once
+// gathering is complete.
+
+export interface WhepSession {
+  stream: MediaStream;
+  // Resolves once media flows, rejects if the connection fails first.
+  connected: Promise<void>;
+  // Called when an established connection drops.
+  onFailed?: () => void;
+  close: () => void;
+}
+
+function waitForIceGathering(pc: RTCPeerConnection, timeoutMs = 2000): Promise<void> {
+  if (pc.iceGatheringState === 'complete') return Promise.resolve();
+  return new Promise((resolve) => {
+    const check = () => {
+      if (pc.iceGatheringState === 'complete') {
+        pc.removeEventListener('icegatheringstatechange', check);
+        resolve();
+      }
+    };
+    pc.addEventListener('icegatheringstatechange', check);
+    setTimeout(resolve, timeoutMs);
+  });
+}
+
+export async function playWhep(playbackId: string, token?: string, timeoutMs = 5000): Promise<WhepSession> {
+  const pc = new RTCPeerConnection();
+  pc.addTransceiver('video', { direction: 'recvonly' });
+  pc.addTransceiver('audio', { direction: 'recvonly' });
+  const stream = new MediaStream();
+  pc.ontrack = (e) => stream.addTrack(e.track);
+
+  let sessionUrl: string | null = null;
+  const session: WhepSession = {
+    stream,
+    connected: Promise.resolve(),
+    close: () => {
+      if (sessionUrl) fetch(sessionUrl, { method: 'DELETE' }).catch(() => {});
+      sessionUrl = null;
+      pc.close();
+    },
+  };
+
+  try {
+    await pc.setLocalDescription(await pc.createOffer());
+    await waitForIceGathering(pc);
+    const headers: Record<string, string> = { 'Content-Type': 'application/sdp' };
+    if (token) headers['Authorization'] = `Bearer ${token}`;
+    const res = await fetch(`/api/whep/${encodeURIComponent(playbackId)}`, {
+      method: 'POST',
+      headers,
+      body: pc.localDescription!.sdp,
+    });
+    if (res.status !== 201) throw new Error(`WHEP answered ${res.status}`);
+    sessionUrl = res.headers.get('Location');
+    await pc.setRemoteDescription({ type: 'answer', sdp: await res.text() });
+  } catch (err) {
+    session.close();
+    throw err;
+  }
+
+  session.connected = new Promise((resolve, reject) => {
+    const timer = setTimeout(() => reject(new Error('WHEP connection timed out')), timeoutMs);
+    pc.onconnectionstatechange = () => {
+      if (pc.connectionState === 'connected') {
+        clearTimeout(timer);
+        resolve();
+      } else if (pc.connectionState === 'failed') {
+        clearTimeout(timer);
+        reject(new Error('WHEP connection failed'));
+        session.onFailed?.();
+      }
+    };
+  });
+  return session;
+}
@@ -1,7 +1,8 @@
 import React, { useState, useEffect } from 'react';
-import { Plus, Trash2, Edit2, Copy, Eye, EyeOff, Save, X } from 'lucide-react';
+import { Plus, Trash2, Edit2, Copy, Eye, EyeOff, Save, X, Download, LifeBuoy, Scissors, Clock } from 'lucide-react';
 import AdminLayout from '../../components/AdminLayout';
 import ImageUpload from '../../components/ImageUpload';
+import RestreamTargets from '../../components/RestreamTargets';
 
 interface Stream {
     id: number;
@@ -9,14 +10,34 @@ interface Stream {
     description: string;
     sport_category: string;
     is_live: boolean;
+    ingest_status: string;
     stream_key: string;
     banner_url: string;
     thumbnail_url: string;
     offline_banner_url: string;
     pre_match_details: string;
     post_match_details: string;
+    low_latency: boolean;
+    dash: boolean;
+    playback_policy: string;
+    encrypted: boolean;
+    key_rotation: number;
+    dvr_window: number;
+    dvr_mode: string;
+    source_type: string;
+    source_url: string;
+    pull_start_at: string | null;
+    pull_stop_at: string | null;
 }
 
+// datetime-local inputs work in local time without a zone; the API uses RFC 3339.
+const toLocalInput = (iso: string | null) => {
+    if (!iso) return '';
+    const d = new Date(iso);
+    return new Date(d.getTime() - d.getTimezoneOffset() * 60000).toISOString().slice(0, 16);
+};
+const fromLocalInput = (value: string) => value ? new Date(value).toISOString() : null;
+
 const Streams = () => {
     const [streams, setStreams] = useState<Stream[]>([]);
     const [showKey, setShowKey] = useState<{ [key: number]: boolean }>({});
@@ -72,6 +93,40 @@ const Streams = () => {
         } catch (err) { console.error(err); }
     };
 
+    const startPull = async (id: number) => {
+        try {
+            const res = await fetch(`/api/streams/${id}/pull`, { method: 'POST' });
+            const data = await res.json();
+            alert(data.error || "Pull started");
+        } catch (err) { console.error(err); }
+    };
+
+    // Opens the stream on its "starting soon" slate (banner + pre-match
+    // details) until the publisher arrives.
+    const showStartingSoon = async (id: number) => {
+        try {
+            const res = await fetch(`/api/streams/${id}/starting-soon`, { method: 'POST' });
+            const data = await res.json();
+            alert(data.error || "Starting soon slate shown");
+            fetchStreams();
+        } catch (err) { console.error(err); }
+    };
+
+    // Cuts the last 30 seconds of a live stream; the clip is processed in the background.
+    const clipLive = async (stream: Stream) => {
+        const title = prompt("Clip title", `${stream.title} highlight`);
+        if (title === null) return;
+        try {
+            const res = await fetch(`/api/streams/${stream.id}/clips`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ title, start: -30 }),
+            });
+            const data = await res.json();
+            alert(data.error || "Clip is being processed");
+        } catch (err) { console.error(err); }
+    };
+
     const copyToClipboard = (text: string) => {
         navigator.clipboard.writeText(text);
         alert("Copied to clipboard!");
@@ -114,6 +169,15 @@ const Streams = () => {
                                     <Copy size={16} />
                                 </button>
                             </div>
+                            <div className="bg-black/50 border border-gray-700 rounded-lg px-4 py-2 flex items-center justify-between min-w-[250px]">
+                                <div>
+                                    <span className="text-xs text-gray-500 block uppercase">SRT (streamid = stream key)</span>
+                                    <code className="text-emerald-400 font-mono">srt://72.62.91.240:9000</code>
+                                </div>
+                                <button onClick={() => copyToClipboard("srt://72.62.91.240:9000")} className="text-gray-400 hover:text-white p-2">
+                                    <Copy size={16} />
+                                </button>
+                            </div>
                         </div>
                     </div>
                 </div>
@@ -139,14 +203,95 @@ const Streams = () => {
                                             value={editingStream.sport_category} onChange={e => setEditingStream({ ...editingStream, sport_category: e.target.value })} />
                                     </div>
                                     <div>
-                                        <label className="text-xs text-gray-400">Is Live?</label>
+                                        <label className="text-xs text-gray-400">Low Latency (LL-HLS)</label>
                                         <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
-                                            value={editingStream.is_live ? "true" : "false"}
-                                            onChange={e => setEditingStream({ ...editingStream, is_live: e.target.value === 'true' })}>
-                                            <option value="false">OFFLINE</option>
-                                            <option value="true">LIVE ON AIR</option>
+                                            value={editingStream.low_latency ? "true" : "false"}
+                                            onChange={e => setEditingStream({ ...editingStream, low_latency: e.target.value === 'true' })}>
+                                            <option value="false">OFF</option>
+                                            <option value="true">ON (next publish)</option>
                                         </select>
                                     </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">MPEG-DASH (CMAF)</label>
+                                        <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.dash ? "true" : "false"}
+                                            onChange={e => setEditingStream({ ...editingStream, dash: e.target.value === 'true' })}>
+                                            <option value="false">OFF</option>
+                                            <option value="true">ON (next publish)</option>
+                                        </select>
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">Playback Access</label>
+                                        <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.playback_policy || "public"}
+                                            onChange={e => setEditingStream({ ...editingStream, playback_policy: e.target.value })}>
+                                            <option value="public">Public</option>
+                                            <option value="signed">Signed tokens only</option>
+                                        </select>
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">AES-128 Encryption</label>
+                                        <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.encrypted ? "true" : "false"}
+                                            onChange={e => setEditingStream({ ...editingStream, encrypted: e.target.value === 'true' })}>
+                                            <option value="false">OFF</option>
+                                            <option value="true">ON (next publish)</option>
+                                        </select>
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">Key Rotation (segments, 0 = default)</label>
+                                        <input type="number" min={0} className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.key_rotation || 0}
+                                            onChange={e => setEditingStream({ ...editingStream, key_rotation: parseInt(e.target.value) || 0 })} />
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">DVR / Timeshift</label>
+                                        <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.dvr_mode || "sliding"}
+                                            onChange={e => setEditingStream({ ...editingStream, dvr_mode: e.target.value })}>
+                                            <option value="sliding">Sliding window</option>
+                                            <option value="event">Whole broadcast, no limit (EVENT)</option>
+                                        </select>
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">DVR Window (minutes, 0 = live only)</label>
+                                        <input type="number" min={0} max={360} className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            disabled={editingStream.dvr_mode === 'event'}
+                                            value={Math.round((editingStream.dvr_window || 0) / 60)}
+                                            onChange={e => setEditingStream({ ...editingStream, dvr_window: (parseInt(e.target.value) || 0) * 60 })} />
+                                    </div>
+                                    <div>
+                                        <label className="text-xs text-gray-400">Source</label>
+                                        <select className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                            value={editingStream.source_type || "push"}
+                                            onChange={e => setEditingStream({ ...editingStream, source_type: e.target.value })}>
+                                            <option value="push">Push (encoder publishes via RTMP)</option>
+                                            <option value="pull">Pull from URL</option>
+                                        </select>
+                                    </div>
+                                    {editingStream.source_type === 'pull' && (
+                                        <>
+                                            <div className="col-span-2">
+                                                <label className="text-xs text-gray-400">Source URL (rtmp://, HTTP-FLV or .m3u8)</label>
+                                                <input className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                                    placeholder="rtmp://origin.example.com/live/feed"
+                                                    value={editingStream.source_url || ''}
+                                                    onChange={e => setEditingStream({ ...editingStream, source_url: e.target.value })} />
+                                            </div>
+                                            <div>
+                                                <label className="text-xs text-gray-400">Scheduled Start (empty = on demand)</label>
+                                                <input type="datetime-local" className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                                    value={toLocalInput(editingStream.pull_start_at)}
+                                                    onChange={e => setEditingStream({ ...editingStream, pull_start_at: fromLocalInput(e.target.value) })} />
+                                            </div>
+                                            <div>
+                                                <label className="text-xs text-gray-400">Scheduled Stop (optional)</label>
+                                                <input type="datetime-local" className="input-field w-full bg-midnight-black p-2 rounded border border-gray-700 text-white"
+                                                    value={toLocalInput(editingStream.pull_stop_at)}
+                                                    onChange={e => setEditingStream({ ...editingStream, pull_stop_at: fromLocalInput(e.target.value) })} />
+                                            </div>
+                                        </>
+                                    )}
                                 </div>
                                 <div className="grid grid-cols-2 gap-4">
                                     <div>
@@ -185,6 +330,9 @@ const Streams = () => {
                                     <Save size={20} /> Save Changes
                                 </button>
                             </form>
+                            <div className="mt-6 pt-6 border-t border-gray-800">
+                                <RestreamTargets streamId={editingStream.id} />
+                            </div>
                         </div>
                     </div>
                 )}
@@ -219,9 +367,23 @@ const Streams = () => {
                                             <button onClick={() => copyToClipboard(stream.stream_key)} className="text-gray-400 hover:text-white p-1 hover:bg-white/10 rounded transition-colors" title="Copy Key">
                                                 <Copy size={16} />
                                             </button>
+                                            {stream.source_type !== 'pull' && (
+                                                <button onClick={() => copyToClipboard(`${stream.stream_key}_backup`)} className="text-gray-400 hover:text-white p-1 hover:bg-white/10 rounded transition-colors" title="Copy Backup Key (second encoder, takes over when the primary drops)">
+                                                    <LifeBuoy size={16} />
+                                                </button>
+                                            )}
                                         </div>
                                     </td>
                                     <td className="p-5 text-right">
+                                        {stream.source_type === 'pull' && !stream.is_live && (
+                                            <button onClick={() => startPull(stream.id)} className="p-2 text-emerald-400 hover:bg-emerald-900/20 rounded mr-2" title="Start Pull"><Download size={16} /></button>
+                                        )}
+                                        {!stream.is_live && stream.ingest_status !== 'starting_soon' && (
+                                            <button onClick={() => showStartingSoon(stream.id)} className="p-2 text-sky-400 hover:bg-sky-900/20 rounded mr-2" title="Show the starting soon slate until the publisher arrives"><Clock size={16} /></button>
+                                        )}
+                                        {stream.is_live && (
+                                            <button onClick={() => clipLive(stream)} className="p-2 text-amber-400 hover:bg-amber-900/20 rounded mr-2" title="Clip the last 30 seconds"><Scissors size={16} /></button>
+                                        )}
                                         <button onClick={() => setEditingStream(stream)} className="p-2 text-blue-400 hover:bg-blue-900/20 rounded mr-2"><Edit2 size={16} /></button>
                                         <button onClick={() => deleteStream(stream.id)} className="p-2 text-red-400 hover:bg-red-900/20 rounded"><Trash2 size={16} /></button>
                                     </td>
@@ -0,0 +1,161 @@
+import React, { useEffect, useRef, useState } from 'react';
+import Head from 'next/head';
+import { Key, Radio, Square, Video } from 'lucide-react';
+
+// Browser publishing over WHIP: the camera and microphone are sent to
+// /api/whip/<stream_key> and go out like any OBS publish.
+type Status = 'idle' | 'connecting' | 'live' | 'error';
+
+// Answers carry every ICE candidate and trickle is not supported, so the
+// offer is only sent once gathering is complete.
+function waitForIceGathering(pc: RTCPeerConnection, timeoutMs = 3000): Promise<void> {
+    if (pc.iceGatheringState === 'complete') return Promise.resolve();
+    return new Promise((resolve) => {
+        const done = () => {
+            pc.removeEventListener('icegatheringstatechange', check);
+            resolve();
+        };
+        const check = () => {
+            if (pc.iceGatheringState === 'complete') done();
+        };
+        pc.addEventListener('icegatheringstatechange', check);
+        setTimeout(done, timeoutMs);
+    });
+}
+
+export default function GoLivePage() {
+    const [streamKey, setStreamKey] = useState('');
+    const [status, setStatus] = useState<Status>('idle');
+    const [error, setError] = useState('');
+    const videoRef = useRef<HTMLVideoElement>(null);
+    const mediaRef = useRef<MediaStream | null>(null);
+    const pcRef = useRef<RTCPeerConnection | null>(null);
+    const sessionUrlRef = useRef<string | null>(null);
+
+    useEffect(() => {
+        navigator.mediaDevices
+            .getUserMedia({ video: { width: 1280, height: 720, frameRate: 30 }, audio: true })
+            .then((media) => {
+                mediaRef.current = media;
+                if (videoRef.current) videoRef.current.srcObject = media;
+            })
+            .catch(() => setError('Camera or microphone access was denied.'));
+
+        return () => {
+            stop();
+            mediaRef.current?.getTracks().forEach((t) => t.stop());
+        };
+        // eslint-disable-next-line react-hooks/exhaustive-deps
+    }, []);
+
+    const start = async () => {
+        const media = mediaRef.current;
+        if (!media || !streamKey) return;
+        setError('');
+        setStatus('connecting');
+
+        const pc = new RTCPeerConnection();
+        pcRef.current = pc;
+        pc.onconnectionstatechange = () => {
+            if (pc.connectionState === 'connected') setStatus('live');
+            if (pc.connectionState === 'failed') {
+                setError('Connection to the server was lost.');
+                setStatus('error');
+            }
+        };
+        media.getTracks().forEach((track) => {
+            const sender = pc.addTransceiver(track, { direction: 'sendonly' }).sender;
+            if (track.kind === 'video') {
+                // Drop frame rate rather than resolution when bandwidth is short.
+                const params = sender.getParameters();
+                params.degradationPreference = 'maintain-resolution';
+                sender.setParameters(params).catch(() => {});
+            }
+        });
+
+        try {
+            await pc.setLocalDescription(await pc.createOffer());
+            await waitForIceGathering(pc);
+            const res = await fetch(`/api/whip/${encodeURIComponent(streamKey)}`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/sdp' },
+                body: pc.localDescription!.sdp,
+            });
+            if (res.status !== 201) {
+                const body = await res.json().catch(() => ({}));
+                throw new Error(body.error || `Server answered ${res.status}`);
+            }
+            sessionUrlRef.current = res.headers.get('Location');
+            await pc.setRemoteDescription({ type: 'answer', sdp: await res.text() });
+        } catch (err: any) {
+            pc.close();
+            pcRef.current = null;
+            setError(err.message || 'Failed to go live.');
+            setStatus('error');
+        }
+    };
+
+    const stop = () => {
+        if (sessionUrlRef.current) {
+            fetch(sessionUrlRef.current, { method: 'DELETE' }).catch(() => {});
+            sessionUrlRef.current = null;
+        }
+        pcRef.current?.close();
+        pcRef.current = null;
+        setStatus('idle');
+    };
+
+    const busy = status === 'connecting' || status === 'live';
+
+    return (
+        <div className="min-h-screen bg-midnight-black text-white p-6">
+            <Head>
+                <title>Go Live | StreamCast</title>
+            </Head>
+            <div className="max-w-3xl mx-auto space-y-6">
+                <h1 className="text-2xl font-bold flex items-center gap-2">
+                    <Video className="text-emerald-400" /> Go Live from the Browser
+                </h1>
+
+                <div className="relative aspect-video bg-black rounded-xl overflow-hidden border border-white/10">
+                    <video ref={videoRef} autoPlay muted playsInline className="w-full h-full object-cover" />
+                    {status === 'live' && (
+                        <span className="absolute top-3 left-3 bg-red-600 text-xs font-bold px-2 py-1 rounded flex items-center gap-1">
+                            <Radio size={12} /> LIVE
+                        </span>
+                    )}
+                </div>
+
+                <div className="flex gap-3">
+                    <div className="relative flex-1">
+                        <Key className="absolute left-3 top-1/2 -translate-y-1/2 text-gray-500" size={18} />
+                        <input
+                            type="password"
+                            value={streamKey}
+                            onChange={(e) => setStreamKey(e.target.value.trim())}
+                            disabled={busy}
+                            className="w-full bg-white/5 border border-white/10 rounded-xl px-10 py-3 text-white focus:outline-none focus:border-emerald-500"
+                            placeholder="Stream key"
+                        />
+                    </div>
+                    {busy ? (
+                        <button onClick={stop} className="px-6 rounded-xl bg-red-600 hover:bg-red-500 font-bold flex items-center gap-2">
+                            <Square size={16} /> Stop
+                        </button>
+                    ) : (
+                        <button
+                            onClick={start}
+                            disabled={!streamKey || !mediaRef.current}
+                            className="px-6 rounded-xl bg-emerald-600 hover:bg-emerald-500 disabled:opacity-50 font-bold flex items-center gap-2"
+                        >
+                            <Radio size={16} /> Start
+                        </button>
+                    )}
+                </div>
+
+                {status === 'connecting' && <p className="text-gray-400 text-sm">Connecting…</p>}
+                {error && <p className="text-red-500 text-sm">{error}</p>}
+            </div>
+        </div>
+    );
+}
@@ -122,9 +122,13 @@ export default function HomePage() {
                   {archives.map((arch) => (
                     <a key={arch.id} href={arch.file_path} target="_blank" rel="noopener noreferrer" className="glass-panel group rounded-xl overflow-hidden hover:border-emerald-energy transition-all block">
                       <div className="h-32 bg-gray-900 relative">
-                        <div className="absolute inset-0 flex items-center justify-center">
-                          <MdLiveTv className="text-4xl text-gray-700 group-hover:text-emerald-energy transition-colors" />
-                        </div>
+                        {arch.thumbnail ? (
+                          <img src={arch.thumbnail} alt={arch.title} className="absolute inset-0 w-full h-full object-cover" />
+                        ) : (
+                          <div className="absolute inset-0 flex items-center justify-center">
+                            <MdLiveTv className="text-4xl text-gray-700 group-hover:text-emerald-energy transition-colors" />
+                          </div>
+                        )}
                         <span className="absolute bottom-2 right-2 bg-black/60 text-white text-xs px-2 py-1 rounded">
                           {arch.duration}
                         </span>
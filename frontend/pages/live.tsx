@@ -5,6 +5,7 @@ import Layout from '../components/Layout';
 import { MdLiveTv, MdPeople, MdTimer, MdShare, MdOutlineSportsEsports, MdSettings, MdCheck, MdVolumeUp, MdVolumeOff } from 'react-icons/md';
 import { BiJoystick, BiFullscreen, BiExitFullscreen } from 'react-icons/bi';
 import AdSpace from '../components/AdSpace';
+import { playWhep, WhepSession } from '../lib/whep';
 
 interface StreamDetails {
   title: string;
@@ -17,6 +18,11 @@ interface StreamDetails {
   pre_match_details?: string;
   post_match_details?: string;
   stream_key?: string;
+  playback_id?: string;
+  low_latency?: boolean;
+  id?: number;
+  playback_policy?: string;
+  encrypted?: boolean;
 }
 
 const LivePage = () => {
@@ -32,6 +38,9 @@ const LivePage = () => {
   const videoRef = useRef<HTMLVideoElement>(null);
   const containerRef = useRef<HTMLDivElement>(null);
   const hlsRef = useRef<any>(null);
+  const whepRef = useRef<WhepSession | null>(null);
+  // Set once WebRTC playback failed: HLS is used until the next page load
+  const [whepFailed, setWhepFailed] = useState(false);
   const [qualities, setQualities] = useState<any[]>([]);
   const [currentQuality, setCurrentQuality] = useState(-1); // -1 = Auto
   const [showQualityMenu, setShowQualityMenu] = useState(false);
@@ -62,19 +71,27 @@ const LivePage = () => {
         const realViewerCount = dataStats.system ? dataStats.system.viewer_count : 0;
 
         if (dataStreams.data && dataStreams.data.length > 0) {
-          const liveStream = dataStreams.data.find((s: any) => s.is_live);
+          // A reconnecting stream keeps playing: the server fills the gap
+          // with its offline slate until the publisher is back. Before the
+          // publish, a stream on its starting soon slate plays too.
+          const liveStream = dataStreams.data.find((s: any) => s.is_live || s.ingest_status === 'reconnecting' || s.ingest_status === 'starting_soon');
           if (liveStream) {
             setStream({
               title: liveStream.title,
               description: liveStream.description,
-              is_live: liveStream.is_live,
+              is_live: true,
               viewer_count: realViewerCount, // Use Real Count
               banner_url: liveStream.banner_url,
               thumbnail_url: liveStream.thumbnail_url,
               offline_banner_url: liveStream.offline_banner_url,
               pre_match_details: liveStream.pre_match_details,
               post_match_details: liveStream.post_match_details,
-              stream_key: liveStream.stream_key
+              stream_key: liveStream.stream_key,
+              playback_id: liveStream.playback_id,
+              low_latency: liveStream.low_latency,
+              id: liveStream.id,
+              playback_policy: liveStream.playback_policy,
+              encrypted: liveStream.encrypted
             });
           } else {
             const s = dataStreams.data[0];
@@ -117,9 +134,10 @@ const LivePage = () => {
     return () => clearInterval(hbInterval);
   }, [stream.is_live]);
 
-  // HLS.js Setup
+  // Player Setup: WebRTC with HLS.js fallback
   useEffect(() => {
     let hls: any = null;
+    let cancelled = false;
 
     const initPlayer = async () => {
       if (!stream.is_live && !hlsRef.current) return;
@@ -127,6 +145,57 @@ const LivePage = () => {
       // @ts-ignore
       const Hls = (await import('hls.js')).default;
 
+      // Signed streams need a playback token, and so do the decryption keys
+      // of encrypted ones. The API only issues them to this page (by its
+      // origin), bound to the viewer's address
+      let token = '';
+      if ((stream.playback_policy === 'signed' || stream.encrypted) && stream.id) {
+        try {
+          const res = await fetch(`/api/streams/${stream.id}/playback-token`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ bind_ip: true })
+          });
+          const body = await res.json();
+          if (!res.ok) throw new Error(body.error);
+          token = body.data.token;
+        } catch (err) {
+          console.error("Failed to get playback token", err);
+        }
+      }
+      const query = token ? `?token=${encodeURIComponent(token)}` : '';
+
+      // WebRTC (WHEP) first for sub-second latency, HLS if it cannot be
+      // negotiated or drops later
+      if (!whepFailed && stream.playback_id && videoRef.current && typeof RTCPeerConnection !== 'undefined') {
+        try {
+          const session = await playWhep(stream.playback_id, token);
+          whepRef.current = session;
+          session.onFailed = () => {
+            session.close();
+            setWhepFailed(true);
+          };
+          await session.connected;
+          if (cancelled) return;
+          if (hlsRef.current) {
+            hlsRef.current.destroy();
+            hlsRef.current = null;
+          }
+          videoRef.current.srcObject = session.stream;
+          setQualities([]);
+          videoRef.current.play().catch(() => console.log("Autoplay blocked"));
+          setIsPlaying(true);
+          return;
+        } catch (err) {
+          console.log("WebRTC playback unavailable, falling back to HLS", err);
+          whepRef.current?.close();
+          whepRef.current = null;
+          if (cancelled) return;
+          if (videoRef.current) videoRef.current.srcObject = null;
+        }
+      }
+
+      if (videoRef.current) videoRef.current.srcObject = null;
       if (Hls.isSupported() && videoRef.current) {
         if (hlsRef.current) {
           hlsRef.current.destroy();
@@ -135,9 +204,13 @@ const LivePage = () => {
         hls = new Hls({
           capLevelToPlayerSize: true,
           autoStartLoad: true,
+          lowLatencyMode: !!stream.low_latency,
         });
 
-        const streamUrl = `/hls/test/master.m3u8`;
+        // LL-HLS is a single source rendition next to the regular ladder
+        const streamUrl = stream.low_latency
+          ? `/hls/${stream.playback_id}/ll/index.m3u8${query}`
+          : `/hls/${stream.playback_id}/master.m3u8${query}`;
 
         hls.loadSource(streamUrl);
         hls.attachMedia(videoRef.current);
@@ -169,7 +242,7 @@ const LivePage = () => {
 
         hlsRef.current = hls;
       } else if (videoRef.current && videoRef.current.canPlayType('application/vnd.apple.mpegurl')) {
-        videoRef.current.src = '/hls/test/master.m3u8';
+        videoRef.current.src = `/hls/${stream.playback_id}/master.m3u8${query}`;
         videoRef.current.addEventListener('loadedmetadata', () => {
           videoRef.current?.play();
           setIsPlaying(true);
@@ -187,9 +260,12 @@ const LivePage = () => {
     }
 
     return () => {
+      cancelled = true;
       if (hls) hls.destroy();
+      whepRef.current?.close();
+      whepRef.current = null;
     };
-  }, [stream.is_live]);
+  }, [stream.is_live, stream.playback_id, stream.low_latency, stream.playback_policy, stream.encrypted, whepFailed]);
 
   // Sync fullscreen state listener
   useEffect(() => {